@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	controlKeyframe = "keyframe"
+	controlSnapshot = "snapshot"
+	controlBitrate  = "bitrate"
+	controlStop     = "stop"
+	// controlError is not a command: the backend reports why it dropped
+	// the stream, as relayframe.Receiver does.
+	controlError = "error"
+
+	minControlKbps         = 100
+	maxControlKbps         = 50000
+	defaultStopSeconds     = 60
+	maxStopSeconds         = 24 * 60 * 60
+	maxControlMessageBytes = 64 << 10
+)
+
+// controlMessage is one command from the backend, sent as a line of JSON on
+// the relay response body (or as a text message over a WebSocket).
+type controlMessage struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Kbps    *int   `json:"kbps,omitempty"`
+	Seconds *int   `json:"seconds,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// controlAck answers a control message. Over a WebSocket it goes back on the
+// same connection; otherwise it is POSTed to the events endpoint.
+type controlAck struct {
+	Type    string    `json:"type"`
+	ID      string    `json:"id,omitempty"`
+	Command string    `json:"command"`
+	Status  string    `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// relayControls carries what the backend asked for across relay sessions:
+// a bitrate cap, a pause, and whether the running session must restart to
+// apply them. It also holds the running session's ring, so commands that
+// need a frame read it instead of opening the camera again.
+type relayControls struct {
+	logger  *log.Logger
+	restart chan struct{}
+
+	mu          sync.Mutex
+	bitrateKbps int
+	pausedUntil time.Time
+	ring        *tsRing
+}
+
+func newRelayControls(logger *log.Logger) *relayControls {
+	return &relayControls{logger: logger, restart: make(chan struct{}, 1)}
+}
+
+// bitrate returns the backend's bitrate cap in kbit/s, or 0 for none.
+func (c *relayControls) bitrate() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bitrateKbps
+}
+
+// setSource records the running session's ring, or nil once it ends.
+func (c *relayControls) setSource(ring *tsRing) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ring = ring
+}
+
+// source returns the running session's ring, or nil between sessions.
+func (c *relayControls) source() *tsRing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ring
+}
+
+// pausedFor returns how long the backend asked the relay to stay stopped.
+func (c *relayControls) pausedFor() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Until(c.pausedUntil)
+}
+
+// serveLines dispatches newline-delimited control messages from r until it
+// ends. Blank lines are keepalives.
+func (c *relayControls) serveLines(ctx context.Context, cfg runtimeConfig, r io.Reader, ack func(controlAck) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 4096), maxControlMessageBytes)
+	for scanner.Scan() {
+		c.dispatch(ctx, cfg, scanner.Bytes(), ack)
+	}
+	return scanner.Err()
+}
+
+// dispatch runs one control message and acknowledges it. A message that is
+// not JSON cannot be acknowledged and is only logged.
+func (c *relayControls) dispatch(ctx context.Context, cfg runtimeConfig, line []byte, ack func(controlAck) error) {
+	line = bytes.TrimSpace(line)
+	if len(line) == 0 {
+		return
+	}
+	var msg controlMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		c.logger.Printf("WARN: ignoring malformed control message: %v", err)
+		return
+	}
+	if msg.Type == controlError {
+		c.logger.Printf("WARN: relay backend rejected the stream: %s", msg.Error)
+		return
+	}
+
+	c.logger.Printf("Control message %q (id %s)", msg.Type, msg.ID)
+	restart, err := c.handle(ctx, cfg, msg)
+	reply := controlAck{Type: "control", ID: msg.ID, Command: msg.Type, Status: "ok", At: time.Now()}
+	if err != nil {
+		c.logger.Printf("WARN: control message %q failed: %v", msg.Type, err)
+		reply.Status = "error"
+		reply.Error = err.Error()
+	}
+	if err := ack(reply); err != nil && ctx.Err() == nil {
+		c.logger.Printf("WARN: control acknowledgement failed: %v", err)
+	}
+	if restart {
+		select {
+		case c.restart <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// handle applies msg. It reports whether the running session has to end,
+// which happens only after the acknowledgement is sent.
+func (c *relayControls) handle(ctx context.Context, cfg runtimeConfig, msg controlMessage) (bool, error) {
+	switch msg.Type {
+	case controlKeyframe:
+		// ffmpeg cannot be asked for a keyframe while it runs; a transcode
+		// already forces one every few seconds.
+		if !privacyActive(cfg.raw.Camera.Privacy) && c.bitrate() == 0 {
+			return false, errors.New("video is copied from the camera, whose keyframe interval applies")
+		}
+		return false, nil
+
+	case controlSnapshot:
+		// A running session has the current picture; the stored interval
+		// snapshot can be up to an interval old.
+		if ring := c.source(); ring != nil && !ring.ended() {
+			return false, grabRingSnapshot(ctx, cfg, ring, "control")
+		}
+		if cfg.raw.Snapshot.Enabled {
+			return false, uploadSnapshot(ctx, cfg, "control")
+		}
+		return false, grabSnapshot(ctx, cfg, "control")
+
+	case controlBitrate:
+		if msg.Kbps == nil {
+			return false, errors.New("kbps is required")
+		}
+		kbps := *msg.Kbps
+		if kbps != 0 && (kbps < minControlKbps || kbps > maxControlKbps) {
+			return false, fmt.Errorf("kbps must be 0 (camera bitrate) or between %d and %d", minControlKbps, maxControlKbps)
+		}
+		c.mu.Lock()
+		changed := c.bitrateKbps != kbps
+		c.bitrateKbps = kbps
+		c.mu.Unlock()
+		if changed {
+			c.logger.Printf("Backend set the relay bitrate to %s; restarting FFmpeg", describeKbps(kbps))
+		}
+		return changed, nil
+
+	case controlStop:
+		seconds := defaultStopSeconds
+		if msg.Seconds != nil {
+			seconds = *msg.Seconds
+		}
+		if seconds < 0 || seconds > maxStopSeconds {
+			return false, fmt.Errorf("seconds must be between 0 and %d", maxStopSeconds)
+		}
+		c.mu.Lock()
+		c.pausedUntil = time.Now().Add(time.Duration(seconds) * time.Second)
+		c.mu.Unlock()
+		return true, nil
+
+	default:
+		return false, fmt.Errorf("unknown control message type %q", msg.Type)
+	}
+}
+
+func describeKbps(kbps int) string {
+	if kbps == 0 {
+		return "the camera's own"
+	}
+	return fmt.Sprintf("%d kbit/s", kbps)
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHealthPath       = "/api/health"
+	defaultProbeSeconds     = 15
+	defaultFailureThreshold = 3
+	defaultFailbackSeconds  = 120
+	healthProbeTimeout      = 5 * time.Second
+)
+
+// failoverConfig tunes how the agent moves between the backends listed in
+// backends: after FailureThreshold consecutive failed requests it moves to
+// the next healthy one, and it returns to an earlier one once HealthPath has
+// answered there for FailbackSeconds. Every backend is probed every
+// ProbeSeconds.
+type failoverConfig struct {
+	HealthPath       string `json:"healthPath,omitempty"`
+	ProbeSeconds     int    `json:"probeSeconds,omitempty"`
+	FailureThreshold int    `json:"failureThreshold,omitempty"`
+	FailbackSeconds  int    `json:"failbackSeconds,omitempty"`
+}
+
+// failoverEvent reports a change of the active backend. It goes to the new one.
+type failoverEvent struct {
+	Type   string    `json:"type"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// backendHealth is one backend's entry in relay-stats.json.
+type backendHealth struct {
+	URL          string     `json:"url"`
+	Active       bool       `json:"active"`
+	Healthy      bool       `json:"healthy"`
+	HealthySince *time.Time `json:"healthySince,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+func applyFailoverDefaults(f *failoverConfig) {
+	if strings.TrimSpace(f.HealthPath) == "" {
+		f.HealthPath = defaultHealthPath
+	}
+	if f.ProbeSeconds <= 0 {
+		f.ProbeSeconds = defaultProbeSeconds
+	}
+	if f.FailureThreshold <= 0 {
+		f.FailureThreshold = defaultFailureThreshold
+	}
+	if f.FailbackSeconds <= 0 {
+		f.FailbackSeconds = defaultFailbackSeconds
+	}
+}
+
+// validateBackends checks the backend list; the first entry is the primary.
+func validateBackends(backends []string) error {
+	seen := map[string]bool{}
+	for i, b := range backends {
+		u, err := url.Parse(strings.TrimSpace(b))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("backends[%d] must be an http or https URL", i)
+		}
+		key := strings.TrimRight(u.String(), "/")
+		if seen[key] {
+			return fmt.Errorf("backends[%d] is listed twice", i)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// withBackend returns cfg with every backend endpoint resolved against base.
+// Absolute endpoints are left alone.
+func (cfg runtimeConfig) withBackend(base string) (runtimeConfig, error) {
+	raw := cfg.raw
+	for _, e := range []struct {
+		dst      *string
+		endpoint string
+	}{
+		{&cfg.relay, raw.RelayEndpoint},
+		{&cfg.snapshotURL, raw.Snapshot.Endpoint},
+		{&cfg.armURL, raw.Schedule.ArmEndpoint},
+		{&cfg.eventsURL, raw.Schedule.EventsEndpoint},
+		{&cfg.viewersURL, raw.OnDemand.ViewersEndpoint},
+	} {
+		resolved, err := resolveRelayURL(base, e.endpoint)
+		if err != nil {
+			return cfg, err
+		}
+		*e.dst = resolved
+	}
+	cfg.backendURL = base
+	return cfg, nil
+}
+
+// report tells the backend selector how a request to rawURL went. ok is
+// false for network errors and 5xx answers; a cancelled request is not
+// reported. It does nothing without a selector, as in the snapshot command.
+func (cfg runtimeConfig) report(ctx context.Context, rawURL string, ok bool) {
+	if cfg.backends == nil || ctx.Err() != nil {
+		return
+	}
+	cfg.backends.report(rawURL, ok)
+}
+
+// backendSelector tracks which of the configured backends the agent talks to.
+// It is signalled on every change of the active backend.
+type backendSelector struct {
+	logger  *log.Logger
+	client  *http.Client
+	changed chan struct{}
+
+	mu       sync.Mutex
+	cfg      runtimeConfig
+	backends []*backendState
+	active   int
+	failures int
+}
+
+type backendState struct {
+	url          string
+	healthy      bool
+	healthySince time.Time
+	lastError    string
+}
+
+func newBackendSelector(logger *log.Logger) *backendSelector {
+	return &backendSelector{logger: logger, client: &http.Client{Timeout: healthProbeTimeout}, changed: make(chan struct{}, 1)}
+}
+
+// configure applies a freshly loaded config. The health of each backend is
+// kept while the list is unchanged; a new list starts at its primary.
+func (s *backendSelector) configure(cfg runtimeConfig) {
+	urls := cfg.raw.Backends
+	if len(urls) == 0 {
+		urls = []string{cfg.raw.BackendURL}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	same := len(urls) == len(s.backends)
+	for i := 0; same && i < len(urls); i++ {
+		same = strings.TrimRight(urls[i], "/") == s.backends[i].url
+	}
+	if same {
+		return
+	}
+	now := time.Now()
+	s.backends = s.backends[:0]
+	for _, u := range urls {
+		s.backends = append(s.backends, &backendState{url: strings.TrimRight(u, "/"), healthy: true, healthySince: now})
+	}
+	s.active, s.failures = 0, 0
+}
+
+// activeURL returns the base URL of the backend requests should go to.
+func (s *backendSelector) activeURL() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backends[s.active].url
+}
+
+// report records the outcome of a request. Only requests to the active
+// backend count, so mirrors on other backends do not affect it.
+func (s *backendSelector) report(rawURL string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.backends) < 2 || !sameOrigin(rawURL, s.backends[s.active].url) {
+		return
+	}
+	if ok {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures >= s.cfg.raw.Failover.FailureThreshold {
+		s.failoverLocked("requests keep failing")
+	}
+}
+
+// sameOrigin reports whether two URLs name the same scheme and host, so a
+// request is only counted against the backend it was actually sent to.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(hostWithPort(ua), hostWithPort(ub))
+}
+
+// hostWithPort returns u's host with the scheme's default port made explicit.
+func hostWithPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "http", "ws":
+			port = "80"
+		case "https", "wss":
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// health returns each backend's state for relay-stats.json.
+func (s *backendSelector) health() []backendHealth {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]backendHealth, 0, len(s.backends))
+	for i, b := range s.backends {
+		h := backendHealth{URL: b.url, Active: i == s.active, Healthy: b.healthy, LastError: b.lastError}
+		if b.healthy {
+			since := b.healthySince
+			h.HealthySince = &since
+		}
+		out = append(out, h)
+	}
+	return out
+}
+
+// run probes every backend's health path until ctx ends. The probe interval
+// is read from the latest config each round.
+func (s *backendSelector) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		s.probeAll(ctx)
+		s.mu.Lock()
+		interval := time.Duration(s.cfg.raw.Failover.ProbeSeconds) * time.Second
+		s.mu.Unlock()
+		waitWithContext(ctx, interval)
+	}
+}
+
+func (s *backendSelector) probeAll(ctx context.Context) {
+	s.mu.Lock()
+	if len(s.backends) < 2 {
+		s.mu.Unlock()
+		return
+	}
+	cfg := s.cfg
+	urls := make([]string, len(s.backends))
+	for i, b := range s.backends {
+		urls[i] = b.url
+	}
+	s.mu.Unlock()
+
+	results := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			results[i] = s.probe(ctx, cfg, u)
+		}(i, u)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.backends) != len(urls) || s.backends[0].url != urls[0] {
+		// The list was reconfigured while probing.
+		return
+	}
+	now := time.Now()
+	for i, err := range results {
+		b := s.backends[i]
+		if err == nil {
+			if !b.healthy {
+				b.healthy, b.healthySince = true, now
+				s.logger.Printf("Backend %s is healthy again", b.url)
+			}
+			b.lastError = ""
+			continue
+		}
+		if b.healthy {
+			s.logger.Printf("WARN: backend %s failed its health check: %v", b.url, err)
+		}
+		b.healthy = false
+		b.lastError = err.Error()
+		if i == s.active {
+			// An unhealthy active backend counts like a failed request, so a
+			// paused or idle agent still moves on.
+			s.failures++
+		}
+	}
+
+	if s.failures >= cfg.raw.Failover.FailureThreshold {
+		s.failoverLocked("health checks keep failing")
+	}
+	stable := time.Duration(cfg.raw.Failover.FailbackSeconds) * time.Second
+	for i := 0; i < s.active; i++ {
+		if b := s.backends[i]; b.healthy && now.Sub(b.healthySince) >= stable {
+			s.switchLocked(i, fmt.Sprintf("failback after %s healthy", stable))
+			break
+		}
+	}
+}
+
+func (s *backendSelector) probe(ctx context.Context, cfg runtimeConfig, base string) error {
+	target, err := resolveRelayURL(base, cfg.raw.Failover.HealthPath)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("health check answered " + resp.Status)
+	}
+	return nil
+}
+
+// failoverLocked moves to the next healthy backend after the active one,
+// wrapping around, and stays put when none is healthy. The failing
+// backend's stability window starts over, so one that passes health checks
+// but fails requests is not failed back to straight away.
+func (s *backendSelector) failoverLocked(reason string) {
+	s.failures = 0
+	s.backends[s.active].healthySince = time.Now()
+	for k := 1; k < len(s.backends); k++ {
+		i := (s.active + k) % len(s.backends)
+		if s.backends[i].healthy {
+			s.switchLocked(i, reason)
+			return
+		}
+	}
+	s.logger.Printf("WARN: backend %s is failing (%s) but no other backend is healthy", s.backends[s.active].url, reason)
+}
+
+func (s *backendSelector) switchLocked(i int, reason string) {
+	from, to := s.backends[s.active].url, s.backends[i].url
+	s.active, s.failures = i, 0
+	s.logger.Printf("Active backend: %s (was %s; %s)", to, from, reason)
+
+	if cfg, err := s.cfg.withBackend(to); err == nil && cfg.eventsURL != "" {
+		ev := failoverEvent{Type: "failover", From: from, To: to, Reason: reason, At: time.Now()}
+		go func() {
+			if err := postEvent(context.Background(), cfg, ev); err != nil {
+				s.logger.Printf("WARN: event upload failed: %v", err)
+			}
+		}()
+	}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"net/url"
 	"os"
 	"os/exec"
@@ -28,25 +27,62 @@ const (
 	scheduledTaskName    = "DifaeCameraBridge"
 	defaultRelayEndpoint = "/api/bridge/relay"
 	defaultFfmpegPath    = "ffmpeg"
+	defaultSnapshotPath  = "/api/bridge/snapshot"
+	snapshotFileName     = "snapshot.jpg"
+	stillFileName        = "still.jpg"
 	defaultRtspPort      = 554
+
+	streamMain = "main"
+	streamSub  = "sub"
+
+	audioOff  = "off"
+	audioCopy = "copy"
+	audioAAC  = "aac"
 )
 
 type agentConfig struct {
-	BridgeID      string       `json:"bridgeId"`
-	BackendURL    string       `json:"backendUrl"`
-	RelayEndpoint string       `json:"relayEndpoint"`
-	APIKey        string       `json:"apiKey"`
-	Camera        cameraConfig `json:"camera"`
-	Ffmpeg        ffmpegConfig `json:"ffmpeg"`
+	BridgeID       string             `json:"bridgeId"`
+	BackendURL     string             `json:"backendUrl"`
+	Backends       []string           `json:"backends,omitempty"`
+	Failover       failoverConfig     `json:"failover"`
+	RelayEndpoint  string             `json:"relayEndpoint"`
+	RelayTransport string             `json:"relayTransport"`
+	APIKey         string             `json:"apiKey"`
+	Camera         cameraConfig       `json:"camera"`
+	Ffmpeg         ffmpegConfig       `json:"ffmpeg"`
+	Snapshot       snapshotConfig     `json:"snapshot"`
+	Schedule       scheduleConfig     `json:"schedule"`
+	OnDemand       onDemandConfig     `json:"onDemand"`
+	Relay          relayConfig        `json:"relay"`
+	Mirrors        []mirrorConfig     `json:"mirrors,omitempty"`
+	Outputs        []outputConfig     `json:"outputs,omitempty"`
+	RTSPServer     rtspServerConfig   `json:"rtspServer"`
+	StreamSwitch   streamSwitchConfig `json:"streamSwitch"`
 }
 
 type cameraConfig struct {
-	Host       string `json:"host"`
-	Username   string `json:"username"`
-	Password   string `json:"password"`
-	RtspPort   int    `json:"rtspPort"`
-	StreamPath string `json:"streamPath"`
-	RtspURL    string `json:"rtspUrl"`
+	Host       string      `json:"host"`
+	Username   string      `json:"username"`
+	Password   string      `json:"password"`
+	RtspPort   int         `json:"rtspPort"`
+	StreamPath string      `json:"streamPath"`
+	RtspURL    string      `json:"rtspUrl"`
+	Audio      audioConfig `json:"audio"`
+
+	// SubStreamPath/SubRtspURL describe the camera's low-bitrate sub stream;
+	// Stream selects which of the two is relayed ("main" or "sub"), unless
+	// streamSwitch chooses automatically.
+	SubStreamPath string `json:"subStreamPath,omitempty"`
+	SubRtspURL    string `json:"subRtspUrl,omitempty"`
+	Stream        string `json:"stream,omitempty"`
+
+	Privacy privacyConfig `json:"privacy"`
+}
+
+type audioConfig struct {
+	Mode        string `json:"mode"`
+	BitrateKbps int    `json:"bitrateKbps"`
+	SampleRate  int    `json:"sampleRate"`
 }
 
 type ffmpegConfig struct {
@@ -55,10 +91,32 @@ type ffmpegConfig struct {
 	ExtraArgs     []string `json:"extraArguments"`
 }
 
+type snapshotConfig struct {
+	Enabled         bool   `json:"enabled"`
+	Endpoint        string `json:"endpoint"`
+	IntervalSeconds int    `json:"intervalSeconds"`
+	Width           int    `json:"width"`
+	Quality         int    `json:"quality"`
+}
+
 type runtimeConfig struct {
-	raw     agentConfig
-	relay   string
-	rtspURL string
+	raw          agentConfig
+	relay        string
+	rtspURL      string
+	snapshotURL  string
+	snapshotPath string
+	schedule     *schedulePlan
+	armURL       string
+	eventsURL    string
+	viewersURL   string
+	mirrors      []relayTarget
+	statsPath    string
+	backendURL   string
+	backends     *backendSelector
+	switcher     *streamSwitcher
+	// switched marks a session that follows a main/sub stream switch; its
+	// stream starts with a discontinuity.
+	switched bool
 }
 
 func main() {
@@ -81,27 +139,190 @@ func main() {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
+	if len(os.Args) > 1 && (os.Args[1] == "arm" || os.Args[1] == "disarm" || os.Args[1] == "auto") {
+		if err := runArmCommand(filepath.Join(exeDir, armStateFileName), os.Args[1]); err != nil {
+			logger.Printf("ERROR: %s failed: %v", os.Args[1], err)
+			os.Exit(1)
+		}
+		logger.Printf("Arm mode set with %q; a running agent applies it within seconds", os.Args[1])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "stats" {
+		if err := runStatsCommand(filepath.Join(exeDir, relayStatsFileName), os.Stdout); err != nil {
+			logger.Printf("ERROR: stats failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "probe" {
+		var rawURL string
+		if len(os.Args) > 2 {
+			rawURL = os.Args[2]
+		}
+		if err := runProbeCommand(ctx, filepath.Join(exeDir, configFileName), rawURL, os.Stdout); err != nil {
+			logger.Printf("ERROR: probe failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		if err := runSnapshotCommand(ctx, filepath.Join(exeDir, configFileName)); err != nil {
+			logger.Printf("ERROR: snapshot failed: %v", err)
+			os.Exit(1)
+		}
+		logger.Printf("Snapshot uploaded")
+		return
+	}
+
 	if err := ensureAutoStart(ctx, logger, exePath, exeDir); err != nil {
 		logger.Printf("WARN: auto-start registration failed: %v", err)
 	}
 
 	configPath := filepath.Join(exeDir, configFileName)
 	backoff := 5 * time.Second
+	gate := newStreamGate(filepath.Join(exeDir, armStateFileName), logger)
+	gateRunning := false
+	viewers := newViewerWatcher(gate, logger)
+	viewersRunning := false
+	controls := newRelayControls(logger)
+	backends := newBackendSelector(logger)
+	backendsRunning := false
+	rtspServer := newRTSPServer(controls, logger)
+	rtspRunning := false
+	switcher := newStreamSwitcher(logger)
+	// lastOnSub is the stream of the previous session, so only a real
+	// main/sub switch is marked as a discontinuity.
+	lastOnSub, ran := false, false
 
 	for ctx.Err() == nil {
 		cfg, err := loadConfig(configPath)
+		if err == nil {
+			cfg.backends = backends
+			backends.configure(cfg)
+			cfg, err = cfg.withBackend(backends.activeURL())
+		}
 		if err != nil {
 			logger.Printf("ERROR: %v", err)
 			backoff = nextBackoff(backoff)
 			waitWithContext(ctx, backoff)
 			continue
 		}
+		if !backendsRunning {
+			go backends.run(ctx)
+			backendsRunning = true
+		}
+
+		// Drop stale signals; the decision is read fresh below.
+		select {
+		case <-gate.changed:
+		default:
+		}
+		select {
+		case <-viewers.changed:
+		default:
+		}
+		select {
+		case <-controls.restart:
+		default:
+		}
+		select {
+		case <-backends.changed:
+		default:
+		}
+		select {
+		case <-switcher.changed:
+		default:
+		}
+		gate.configure(cfg)
+		if !gateRunning {
+			go gate.run(ctx)
+			gateRunning = true
+		}
+		viewers.configure(cfg)
+		if cfg.raw.OnDemand.Enabled && !viewersRunning {
+			logger.Printf("On-demand relaying enabled (%ds idle timeout)", cfg.raw.OnDemand.IdleTimeoutSeconds)
+			go viewers.run(ctx)
+			viewersRunning = true
+		}
+		rtspServer.configure(cfg)
+		if rtsp := cfg.raw.RTSPServer; rtsp.Enabled && !rtspRunning {
+			logger.Printf("Local RTSP server enabled (rtsp://%s%s, up to %d clients)", rtsp.Listen, rtsp.Path, rtsp.MaxClients)
+			go rtspServer.run(ctx, rtsp.Listen)
+			rtspRunning = true
+		}
+		if !gate.isStreaming() || (cfg.raw.OnDemand.Enabled && !viewers.isWanted()) {
+			select {
+			case <-ctx.Done():
+			case <-gate.changed:
+			case <-viewers.changed:
+			case <-backends.changed:
+			}
+			continue
+		}
+
+		if pause := controls.pausedFor(); pause > 0 {
+			logger.Printf("Relay stopped by the backend; resuming in %s", pause.Round(time.Second))
+			waitWithContext(ctx, pause)
+			continue
+		}
+
+		switcher.configure(cfg.raw.StreamSwitch)
+		onSub := switcher.sub()
+		if onSub {
+			cfg.rtspURL = cfg.raw.Camera.SubRtspURL
+			cfg.raw.Camera.Stream = streamSub
+		}
+		cfg.switcher = switcher
+		cfg.switched = ran && onSub != lastOnSub
+		lastOnSub, ran = onSub, true
 
 		logger.Printf("Bridge ID: %s", cfg.raw.BridgeID)
-		logger.Printf("Backend relay: %s", cfg.relay)
-		logger.Printf("RTSP source: %s", maskPassword(cfg.rtspURL))
+		if len(cfg.raw.Backends) > 1 {
+			logger.Printf("Active backend: %s (%d configured)", cfg.backendURL, len(cfg.raw.Backends))
+		}
+		logger.Printf("Backend relay: %s (%s)", cfg.relay, cfg.raw.RelayTransport)
+		for _, m := range cfg.mirrors {
+			logger.Printf("Mirror relay %s: %s (%s)", m.name, m.relay, m.transport)
+		}
+		for _, out := range cfg.raw.Outputs {
+			logger.Printf("Push output %s: %s (audio %s)", out.Name, maskPassword(out.URL), out.Audio)
+		}
+		logger.Printf("RTSP source: %s (%s stream)", maskPassword(cfg.rtspURL), cfg.raw.Camera.Stream)
+		logger.Printf("Audio mode: %s", cfg.raw.Camera.Audio.Mode)
+		if privacy := cfg.raw.Camera.Privacy; privacyActive(privacy) {
+			logger.Printf("Privacy: %d mask(s), %d overlay(s); video is transcoded with libx264", len(privacy.Masks), len(privacy.Overlays))
+		}
+		if kbps := controls.bitrate(); kbps > 0 {
+			logger.Printf("Bitrate: capped at %d kbit/s by the backend; video is transcoded with libx264", kbps)
+		}
 
-		if err := runSession(ctx, cfg, logger); err != nil {
+		sessionCtx, stopSession := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-gate.changed:
+				stopSession()
+			case <-viewers.changed:
+				stopSession()
+			case <-controls.restart:
+				stopSession()
+			case <-backends.changed:
+				stopSession()
+			case <-switcher.changed:
+				stopSession()
+			case <-sessionCtx.Done():
+			}
+		}()
+		err = runSession(sessionCtx, cfg, controls, logger)
+		stopped := sessionCtx.Err() != nil && ctx.Err() == nil
+		stopSession()
+		if stopped {
+			backoff = 5 * time.Second
+			continue
+		}
+		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				break
 			}
@@ -130,6 +351,28 @@ func loadConfig(path string) (runtimeConfig, error) {
 
 	applyDefaults(&cfg)
 	applyEnvOverrides(&cfg)
+	// The RTSP path defaults to the bridge ID, which the environment may set.
+	applyRTSPServerDefaults(&cfg)
+
+	switch cfg.Camera.Audio.Mode {
+	case audioOff, audioCopy, audioAAC:
+	default:
+		return runtimeConfig{}, fmt.Errorf("camera.audio.mode must be %q, %q or %q", audioOff, audioCopy, audioAAC)
+	}
+
+	if err := validatePrivacy(cfg.Camera.Privacy); err != nil {
+		return runtimeConfig{}, err
+	}
+
+	if err := validateBackends(cfg.Backends); err != nil {
+		return runtimeConfig{}, err
+	}
+	if len(cfg.Backends) > 0 {
+		cfg.BackendURL = cfg.Backends[0]
+	}
+	if !strings.HasPrefix(cfg.Failover.HealthPath, "/") {
+		return runtimeConfig{}, errors.New("failover.healthPath must start with /")
+	}
 
 	relay, err := resolveRelayURL(cfg.BackendURL, cfg.RelayEndpoint)
 	if err != nil {
@@ -139,13 +382,105 @@ func loadConfig(path string) (runtimeConfig, error) {
 	rtsp := buildRtspURL(cfg.Camera)
 	cfg.Camera.RtspURL = rtsp
 
-	return runtimeConfig{raw: cfg, relay: relay, rtspURL: rtsp}, nil
+	sub := buildSubRtspURL(cfg.Camera)
+	cfg.Camera.SubRtspURL = sub
+
+	switch cfg.Camera.Stream {
+	case streamMain:
+	case streamSub:
+		if cfg.StreamSwitch.Enabled {
+			return runtimeConfig{}, errors.New("camera.stream must be \"main\" when streamSwitch is enabled; the sub stream is chosen automatically")
+		}
+		if sub == "" {
+			return runtimeConfig{}, errors.New("camera.stream is \"sub\" but neither camera.subStreamPath nor camera.subRtspUrl is set")
+		}
+		rtsp = sub
+	default:
+		return runtimeConfig{}, fmt.Errorf("camera.stream must be %q or %q", streamMain, streamSub)
+	}
+
+	if sw := cfg.StreamSwitch; sw.Enabled {
+		if sub == "" {
+			return runtimeConfig{}, errors.New("streamSwitch is enabled but neither camera.subStreamPath nor camera.subRtspUrl is set")
+		}
+		if sw.DowngradeAfterSeconds < 5 || sw.RecoverAfterSeconds < 5 || sw.MaxBacklogSeconds < 1 {
+			return runtimeConfig{}, errors.New("streamSwitch.downgradeAfterSeconds and recoverAfterSeconds must be at least 5, maxBacklogSeconds at least 1")
+		}
+	}
+
+	snapshotURL, err := resolveRelayURL(cfg.BackendURL, cfg.Snapshot.Endpoint)
+	if err != nil {
+		return runtimeConfig{}, err
+	}
+
+	armURL, err := resolveRelayURL(cfg.BackendURL, cfg.Schedule.ArmEndpoint)
+	if err != nil {
+		return runtimeConfig{}, err
+	}
+	eventsURL, err := resolveRelayURL(cfg.BackendURL, cfg.Schedule.EventsEndpoint)
+	if err != nil {
+		return runtimeConfig{}, err
+	}
+
+	viewersURL, err := resolveRelayURL(cfg.BackendURL, cfg.OnDemand.ViewersEndpoint)
+	if err != nil {
+		return runtimeConfig{}, err
+	}
+	if cfg.OnDemand.Enabled && cfg.OnDemand.IdleTimeoutSeconds < 5 {
+		return runtimeConfig{}, errors.New("onDemand.idleTimeoutSeconds must be at least 5")
+	}
+
+	switch cfg.RelayTransport {
+	case transportPost, transportWebSocket:
+	default:
+		return runtimeConfig{}, fmt.Errorf("relayTransport must be %q or %q", transportPost, transportWebSocket)
+	}
+
+	if cfg.Relay.BufferMB < 1 || cfg.Relay.BufferMB > 1024 {
+		return runtimeConfig{}, errors.New("relay.bufferMB must be between 1 and 1024")
+	}
+
+	mirrors, err := resolveMirrors(cfg)
+	if err != nil {
+		return runtimeConfig{}, err
+	}
+	if err := validateOutputs(cfg.Outputs); err != nil {
+		return runtimeConfig{}, err
+	}
+	if err := validateRTSPServer(cfg.RTSPServer); err != nil {
+		return runtimeConfig{}, err
+	}
+
+	var plan *schedulePlan
+	if cfg.Schedule.Enabled {
+		if plan, err = compileSchedule(cfg.Schedule); err != nil {
+			return runtimeConfig{}, err
+		}
+	}
+
+	return runtimeConfig{
+		raw:          cfg,
+		relay:        relay,
+		rtspURL:      rtsp,
+		snapshotURL:  snapshotURL,
+		snapshotPath: filepath.Join(filepath.Dir(path), snapshotFileName),
+		schedule:     plan,
+		armURL:       armURL,
+		eventsURL:    eventsURL,
+		viewersURL:   viewersURL,
+		mirrors:      mirrors,
+		statsPath:    filepath.Join(filepath.Dir(path), relayStatsFileName),
+		backendURL:   cfg.BackendURL,
+	}, nil
 }
 
 func applyDefaults(cfg *agentConfig) {
 	if strings.TrimSpace(cfg.RelayEndpoint) == "" {
 		cfg.RelayEndpoint = defaultRelayEndpoint
 	}
+	if strings.TrimSpace(cfg.RelayTransport) == "" {
+		cfg.RelayTransport = transportPost
+	}
 
 	if strings.TrimSpace(cfg.Ffmpeg.Path) == "" {
 		cfg.Ffmpeg.Path = defaultFfmpegPath
@@ -162,6 +497,65 @@ func applyDefaults(cfg *agentConfig) {
 	if cfg.Ffmpeg.ExtraArgs == nil {
 		cfg.Ffmpeg.ExtraArgs = []string{}
 	}
+
+	if strings.TrimSpace(cfg.Camera.Stream) == "" {
+		cfg.Camera.Stream = streamMain
+	}
+	if cfg.StreamSwitch.DowngradeAfterSeconds == 0 {
+		cfg.StreamSwitch.DowngradeAfterSeconds = 20
+	}
+	if cfg.StreamSwitch.RecoverAfterSeconds == 0 {
+		cfg.StreamSwitch.RecoverAfterSeconds = 120
+	}
+	if cfg.StreamSwitch.MaxBacklogSeconds == 0 {
+		cfg.StreamSwitch.MaxBacklogSeconds = 6
+	}
+	applyPrivacyDefaults(&cfg.Camera.Privacy)
+
+	if strings.TrimSpace(cfg.Snapshot.Endpoint) == "" {
+		cfg.Snapshot.Endpoint = defaultSnapshotPath
+	}
+	if cfg.Snapshot.IntervalSeconds <= 0 {
+		cfg.Snapshot.IntervalSeconds = 60
+	}
+	if cfg.Snapshot.Quality == 0 {
+		cfg.Snapshot.Quality = 5
+	}
+
+	if strings.TrimSpace(cfg.Schedule.ArmEndpoint) == "" {
+		cfg.Schedule.ArmEndpoint = defaultArmPath
+	}
+	if strings.TrimSpace(cfg.Schedule.EventsEndpoint) == "" {
+		cfg.Schedule.EventsEndpoint = defaultEventsPath
+	}
+	if cfg.Schedule.PollSeconds <= 0 {
+		cfg.Schedule.PollSeconds = defaultArmPollSeconds
+	}
+
+	if strings.TrimSpace(cfg.OnDemand.ViewersEndpoint) == "" {
+		cfg.OnDemand.ViewersEndpoint = defaultViewersPath
+	}
+	if cfg.OnDemand.IdleTimeoutSeconds == 0 {
+		cfg.OnDemand.IdleTimeoutSeconds = 60
+	}
+	if cfg.OnDemand.IdleSnapshotSeconds == 0 {
+		cfg.OnDemand.IdleSnapshotSeconds = 300
+	}
+
+	if cfg.Relay.BufferMB == 0 {
+		cfg.Relay.BufferMB = defaultRelayBufferMB
+	}
+	applyFailoverDefaults(&cfg.Failover)
+	applyOutputDefaults(cfg.Outputs)
+
+	// The relay has always passed the camera's audio through untouched.
+	if strings.TrimSpace(cfg.Camera.Audio.Mode) == "" {
+		cfg.Camera.Audio.Mode = audioCopy
+	}
+
+	if cfg.Camera.Audio.BitrateKbps == 0 {
+		cfg.Camera.Audio.BitrateKbps = 64
+	}
 }
 
 func applyEnvOverrides(cfg *agentConfig) {
@@ -171,9 +565,18 @@ func applyEnvOverrides(cfg *agentConfig) {
 	if v := strings.TrimSpace(os.Getenv("BACKEND_URL")); v != "" {
 		cfg.BackendURL = v
 	}
+	if v := strings.TrimSpace(os.Getenv("BACKEND_URLS")); v != "" {
+		cfg.Backends = strings.Split(v, ",")
+		for i := range cfg.Backends {
+			cfg.Backends[i] = strings.TrimSpace(cfg.Backends[i])
+		}
+	}
 	if v := strings.TrimSpace(os.Getenv("RELAY_ENDPOINT")); v != "" {
 		cfg.RelayEndpoint = v
 	}
+	if v := strings.TrimSpace(os.Getenv("RELAY_TRANSPORT")); v != "" {
+		cfg.RelayTransport = v
+	}
 	if v := strings.TrimSpace(os.Getenv("BRIDGE_API_KEY")); v != "" {
 		cfg.APIKey = v
 	}
@@ -206,6 +609,15 @@ func applyEnvOverrides(cfg *agentConfig) {
 	if v := strings.TrimSpace(os.Getenv("RTSP_TRANSPORT")); v != "" {
 		cfg.Ffmpeg.RtspTransport = v
 	}
+	if v := strings.TrimSpace(os.Getenv("RTSP_SUB_PATH")); v != "" {
+		camera.SubStreamPath = v
+	}
+	if v := strings.TrimSpace(os.Getenv("RTSP_STREAM")); v != "" {
+		camera.Stream = v
+	}
+	if v := strings.TrimSpace(os.Getenv("AUDIO_MODE")); v != "" {
+		camera.Audio.Mode = v
+	}
 }
 
 func resolveRelayURL(base, endpoint string) (string, error) {
@@ -236,7 +648,22 @@ func buildRtspURL(camera cameraConfig) string {
 		return camera.RtspURL
 	}
 
-	path := camera.StreamPath
+	return cameraURL(camera, camera.StreamPath)
+}
+
+// buildSubRtspURL returns the sub stream URL, or "" when none is configured.
+func buildSubRtspURL(camera cameraConfig) string {
+	if strings.TrimSpace(camera.SubRtspURL) != "" {
+		return camera.SubRtspURL
+	}
+	if strings.TrimSpace(camera.SubStreamPath) == "" {
+		return ""
+	}
+
+	return cameraURL(camera, camera.SubStreamPath)
+}
+
+func cameraURL(camera cameraConfig, path string) string {
 	if !strings.HasPrefix(path, "/") {
 		path = "/" + path
 	}
@@ -254,12 +681,26 @@ func buildRtspURL(camera cameraConfig) string {
 	return u.String()
 }
 
-func runSession(ctx context.Context, cfg runtimeConfig, logger *log.Logger) error {
+func runSession(ctx context.Context, cfg runtimeConfig, controls *relayControls, logger *log.Logger) error {
+	if err := checkCamera(ctx, cfg.rtspURL, logger); err != nil {
+		return err
+	}
+
 	args := []string{"-nostdin", "-rtsp_transport", cfg.raw.Ffmpeg.RtspTransport}
 	if len(cfg.raw.Ffmpeg.ExtraArgs) > 0 {
 		args = append(args, cfg.raw.Ffmpeg.ExtraArgs...)
 	}
-	args = append(args, "-i", cfg.rtspURL, "-c", "copy", "-f", "mpegts", "pipe:1")
+	args = append(args, "-i", cfg.rtspURL)
+	privacy := cfg.raw.Camera.Privacy
+	args = append(args, streamArgs(cfg.raw.Camera.Audio, videoArgs(privacy, cfg.raw.BridgeID, controls.bitrate()))...)
+	if cfg.switched {
+		// Tell receivers the stream changed under them.
+		args = append(args, "-mpegts_flags", "+initial_discontinuity")
+	}
+	args = append(args, "-f", "mpegts", "pipe:1")
+	if cfg.raw.Snapshot.Enabled {
+		args = append(args, snapshotOutputArgs(cfg.raw.Snapshot, privacyFilters(privacy, cfg.raw.BridgeID), cfg.snapshotPath)...)
+	}
 
 	cmd := exec.CommandContext(ctx, cfg.raw.Ffmpeg.Path, args...)
 	stdout, err := cmd.StdoutPipe()
@@ -271,7 +712,7 @@ func runSession(ctx context.Context, cfg runtimeConfig, logger *log.Logger) erro
 		return fmt.Errorf("failed to capture ffmpeg stderr: %w", err)
 	}
 
-	logger.Printf("Launching FFmpeg: %s %s", cfg.raw.Ffmpeg.Path, strings.Join(args, " "))
+	logger.Printf("Launching FFmpeg: %s %s", cfg.raw.Ffmpeg.Path, strings.Join(maskArgs(args), " "))
 
 	if err := cmd.Start(); err != nil {
 		return fmt.Errorf("failed to start ffmpeg: %w", err)
@@ -284,50 +725,51 @@ func runSession(ctx context.Context, cfg runtimeConfig, logger *log.Logger) erro
 		streamFfmpegStderr(stderr, logger)
 	}()
 
-	requestCtx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	req, err := http.NewRequestWithContext(requestCtx, http.MethodPost, cfg.relay, io.NopCloser(stdout))
-	if err != nil {
-		cmd.Process.Kill()
-		wg.Wait()
-		return fmt.Errorf("failed to construct relay request: %w", err)
-	}
+	// ffmpeg writes into the ring, not the connection, so a dropped relay
+	// connection does not cost a new camera handshake.
+	ring := newTSRing(cfg.raw.Relay.BufferMB << 20)
+	controls.setSource(ring)
+	defer controls.setSource(nil)
+	filled := make(chan struct{})
+	go func() {
+		defer close(filled)
+		if err := ring.fill(stdout); err != nil && ctx.Err() == nil {
+			logger.Printf("WARN: reading ffmpeg output failed: %v", err)
+		}
+	}()
 
-	req.Header.Set("Content-Type", "application/octet-stream")
-	req.Header.Set("X-Bridge-Id", cfg.raw.BridgeID)
-	req.Header.Set("Accept-Encoding", "identity")
-	req.TransferEncoding = []string{"chunked"}
-	if strings.TrimSpace(cfg.raw.APIKey) != "" {
-		req.Header.Set("X-Api-Key", cfg.raw.APIKey)
+	if len(cfg.raw.Outputs) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runOutputs(ctx, cfg, ring, logger)
+		}()
 	}
 
-	client := &http.Client{Timeout: 0}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		cmd.Process.Kill()
-		wg.Wait()
-		return fmt.Errorf("failed to send relay request: %w", err)
+	snapshotCtx, stopSnapshots := context.WithCancel(ctx)
+	defer stopSnapshots()
+	if cfg.raw.Snapshot.Enabled {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			watchSnapshots(snapshotCtx, cfg, logger)
+		}()
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	relayErr := relayToTargets(ctx, cfg, ring, controls, logger, func() {
 		cmd.Process.Kill()
-		wg.Wait()
-		return fmt.Errorf("relay endpoint %s rejected the stream with %d: %s", cfg.relay, resp.StatusCode, strings.TrimSpace(string(body)))
-	}
-
-	logger.Printf("Relay accepted stream (status %d)", resp.StatusCode)
-
+	})
+	<-filled
 	waitErr := cmd.Wait()
+	stopSnapshots()
 	wg.Wait()
-	io.Copy(io.Discard, resp.Body)
 
 	if ctx.Err() != nil {
 		return context.Canceled
 	}
+	if relayErr != nil {
+		return relayErr
+	}
 
 	if waitErr != nil {
 		var exitErr *exec.ExitError
@@ -340,6 +782,25 @@ func runSession(ctx context.Context, cfg runtimeConfig, logger *log.Logger) erro
 	return nil
 }
 
+// streamArgs maps the camera's video, encoded with video (see videoArgs),
+// and, depending on the audio mode, drops, copies or transcodes its first
+// audio track to AAC.
+func streamArgs(audio audioConfig, video []string) []string {
+	switch audio.Mode {
+	case audioOff:
+		return append(append([]string{"-map", "0:v:0"}, video...), "-an")
+	case audioAAC:
+		args := append([]string{"-map", "0:v:0", "-map", "0:a:0?"}, video...)
+		args = append(args, "-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audio.BitrateKbps))
+		if audio.SampleRate > 0 {
+			args = append(args, "-ar", strconv.Itoa(audio.SampleRate))
+		}
+		return args
+	default:
+		return append(append([]string{"-map", "0:v:0", "-map", "0:a:0?"}, video...), "-c:a", "copy")
+	}
+}
+
 func streamFfmpegStderr(r io.Reader, logger *log.Logger) {
 	scanner := bufio.NewScanner(r)
 	buf := make([]byte, 0, 64*1024)
@@ -377,13 +838,23 @@ func nextBackoff(current time.Duration) time.Duration {
 	return next
 }
 
-func maskPassword(rtsp string) string {
-	if rtsp == "" {
-		return rtsp
+// secretQueryKeys are query options whose values are credentials, such as an
+// SRT passphrase or stream id, or a camera's access token.
+var secretQueryKeys = map[string]bool{
+	"passphrase": true, "streamid": true, "password": true, "pass": true, "pwd": true,
+	"token": true, "key": true, "auth": true, "secret": true, "signature": true,
+}
+
+// maskPassword hides the secrets of a camera or output URL for logs, events
+// and status: the password, secret query options, and the stream key that
+// ends an RTMP URL.
+func maskPassword(raw string) string {
+	if raw == "" {
+		return raw
 	}
-	u, err := url.Parse(rtsp)
+	u, err := url.Parse(raw)
 	if err != nil {
-		return rtsp
+		return "(invalid URL)"
 	}
 	if u.User != nil {
 		username := u.User.Username()
@@ -391,7 +862,44 @@ func maskPassword(rtsp string) string {
 			u.User = url.UserPassword(username, "****")
 		}
 	}
-	return u.String()
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, p := range params {
+			key, _, ok := strings.Cut(p, "=")
+			if ok && secretQueryKeys[strings.ToLower(key)] {
+				params[i] = key + "=****"
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	// url.UserPassword escapes the mask; it reads better as typed.
+	s := strings.Replace(u.String(), ":%2A%2A%2A%2A@", ":****@", 1)
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "rtmp" || scheme == "rtmps" {
+		if i := strings.LastIndex(u.Path, "/"); i > 0 && i < len(u.Path)-1 {
+			u.Path = u.Path[:i+1]
+			u.RawPath = ""
+			s = strings.Replace(u.String(), ":%2A%2A%2A%2A@", ":****@", 1)
+			if q := strings.IndexAny(s, "?#"); q >= 0 {
+				return s[:q] + "****" + s[q:]
+			}
+			return s + "****"
+		}
+	}
+	return s
+}
+
+// maskArgs returns a copy of an ffmpeg command line for logging, with every
+// URL argument masked like maskPassword.
+func maskArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		if strings.Contains(arg, "://") {
+			arg = maskPassword(arg)
+		}
+		out[i] = arg
+	}
+	return out
 }
 
 func ensureAutoStart(ctx context.Context, logger *log.Logger, exePath, exeDir string) error {
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	relayStatsFileName = "relay-stats.json"
+	primaryTargetName  = "primary"
+	statsWriteInterval = 5 * time.Second
+
+	endpointConnecting = "connecting"
+	endpointStreaming  = "streaming"
+	endpointBackoff    = "backoff"
+	endpointRejected   = "rejected"
+	endpointStopped    = "stopped"
+)
+
+// mirrorConfig is an additional relay endpoint that receives the same stream
+// as the primary backend. APIKey and RelayTransport default to the primary's.
+type mirrorConfig struct {
+	Name           string `json:"name,omitempty"`
+	BackendURL     string `json:"backendUrl"`
+	RelayEndpoint  string `json:"relayEndpoint,omitempty"`
+	APIKey         string `json:"apiKey,omitempty"`
+	RelayTransport string `json:"relayTransport,omitempty"`
+}
+
+// relayTarget is one resolved relay endpoint: the primary backend or a mirror.
+type relayTarget struct {
+	name      string
+	relay     string
+	eventsURL string
+	apiKey    string
+	transport string
+}
+
+// resolveMirrors validates the mirrors and resolves their endpoints. Relay
+// events from a mirror go to that mirror's backend.
+func resolveMirrors(cfg agentConfig) ([]relayTarget, error) {
+	seen := map[string]bool{primaryTargetName: true}
+	var targets []relayTarget
+	for i, m := range cfg.Mirrors {
+		name := strings.TrimSpace(m.Name)
+		if name == "" {
+			name = fmt.Sprintf("mirror-%d", i+1)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("mirrors[%d].name %q is used twice", i, name)
+		}
+		seen[name] = true
+
+		if strings.TrimSpace(m.BackendURL) == "" {
+			return nil, fmt.Errorf("mirrors[%d].backendUrl is required", i)
+		}
+		relay, err := resolveRelayURL(m.BackendURL, m.RelayEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("mirrors[%d]: %w", i, err)
+		}
+		events, err := resolveRelayURL(m.BackendURL, cfg.Schedule.EventsEndpoint)
+		if err != nil {
+			return nil, fmt.Errorf("mirrors[%d]: %w", i, err)
+		}
+
+		t := relayTarget{name: name, relay: relay, eventsURL: events, apiKey: m.APIKey, transport: m.RelayTransport}
+		if strings.TrimSpace(t.apiKey) == "" {
+			t.apiKey = cfg.APIKey
+		}
+		if strings.TrimSpace(t.transport) == "" {
+			t.transport = cfg.RelayTransport
+		}
+		if t.transport != transportPost && t.transport != transportWebSocket {
+			return nil, fmt.Errorf("mirrors[%d].relayTransport must be %q or %q", i, transportPost, transportWebSocket)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// relayTargets returns the primary endpoint followed by the mirrors.
+func (cfg runtimeConfig) relayTargets() []relayTarget {
+	primary := relayTarget{
+		name:      primaryTargetName,
+		relay:     cfg.relay,
+		eventsURL: cfg.eventsURL,
+		apiKey:    cfg.raw.APIKey,
+		transport: cfg.raw.RelayTransport,
+	}
+	return append([]relayTarget{primary}, cfg.mirrors...)
+}
+
+// withTarget returns cfg aimed at t, for the relay and its events.
+func (cfg runtimeConfig) withTarget(t relayTarget) runtimeConfig {
+	cfg.relay = t.relay
+	cfg.eventsURL = t.eventsURL
+	cfg.raw.APIKey = t.apiKey
+	cfg.raw.RelayTransport = t.transport
+	return cfg
+}
+
+// endpointStats is one endpoint's entry in relay-stats.json.
+type endpointStats struct {
+	Name           string     `json:"name"`
+	URL            string     `json:"url"`
+	Transport      string     `json:"transport"`
+	State          string     `json:"state"`
+	Framed         bool       `json:"framed"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	Connections    int        `json:"connections"`
+	Reconnects     int        `json:"reconnects"`
+	BytesSent      int64      `json:"bytesSent"`
+	LostBytes      int64      `json:"lostBytes"`
+	BufferedBytes  int64      `json:"bufferedBytes"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorAt    *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// relayStatsFile is the content of relay-stats.json.
+type relayStatsFile struct {
+	UpdatedAt     time.Time       `json:"updatedAt"`
+	ActiveBackend string          `json:"activeBackend"`
+	Backends      []backendHealth `json:"backends,omitempty"`
+	Endpoints     []endpointStats `json:"endpoints"`
+}
+
+// endpointMonitor tracks one endpoint's health for the life of a session.
+type endpointMonitor struct {
+	ring *tsRing
+	sent atomic.Int64
+
+	mu     sync.Mutex
+	stats  endpointStats
+	reader *ringReader // nil between connections
+	pos    int64
+}
+
+func newEndpointMonitor(t relayTarget, ring *tsRing) *endpointMonitor {
+	return &endpointMonitor{
+		ring:  ring,
+		stats: endpointStats{Name: t.name, URL: t.relay, Transport: t.transport, State: endpointConnecting},
+	}
+}
+
+// connecting records a connection attempt that will read from rr.
+func (m *endpointMonitor) connecting(rr *ringReader, transport string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reader = rr
+	m.stats.State = endpointConnecting
+	m.stats.Transport = transport
+}
+
+func (m *endpointMonitor) accepted(framed bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.stats.State = endpointStreaming
+	m.stats.Framed = framed
+	m.stats.ConnectedSince = &now
+	if m.stats.Connections > 0 {
+		m.stats.Reconnects++
+	}
+	m.stats.Connections++
+}
+
+// disconnected records the end of a connection, where it stopped reading
+// and the bytes it skipped.
+func (m *endpointMonitor) disconnected(state string, err error, pos, lost int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reader = nil
+	m.pos = pos
+	m.stats.State = state
+	m.stats.ConnectedSince = nil
+	m.stats.LostBytes += lost
+	if err != nil {
+		now := time.Now()
+		m.stats.LastError = err.Error()
+		m.stats.LastErrorAt = &now
+	}
+}
+
+// count wraps a relay body so the bytes handed to the connection are counted.
+func (m *endpointMonitor) count(body io.ReadCloser) io.ReadCloser {
+	return &countingReader{ReadCloser: body, n: &m.sent}
+}
+
+func (m *endpointMonitor) snapshot() endpointStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.stats
+	s.BytesSent = m.sent.Load()
+	switch {
+	case m.reader != nil:
+		pos, lost := m.reader.position()
+		s.LostBytes += lost
+		s.BufferedBytes = m.ring.buffered(pos)
+	case s.State == endpointBackoff:
+		s.BufferedBytes = m.ring.buffered(m.pos)
+	}
+	return s
+}
+
+type countingReader struct {
+	io.ReadCloser
+	n *atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// writeRelayStats saves the endpoints' stats for `WindowsCameraBridge.exe stats`.
+func writeRelayStats(cfg runtimeConfig, monitors []*endpointMonitor) error {
+	file := relayStatsFile{UpdatedAt: time.Now(), ActiveBackend: cfg.backendURL}
+	if cfg.backends != nil && len(cfg.raw.Backends) > 1 {
+		file.Backends = cfg.backends.health()
+	}
+	for _, m := range monitors {
+		file.Endpoints = append(file.Endpoints, m.snapshot())
+	}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := cfg.statsPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cfg.statsPath)
+}
+
+// runStatsCommand prints the stats a running agent last saved.
+func runStatsCommand(path string, out io.Writer) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%s not found; the agent has not relayed yet", relayStatsFileName)
+		}
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+// relayToTargets relays the ring to every target at once. Each target reads
+// the ring at its own position, so a slow or unreachable endpoint only loses
+// its own data once the ring overruns; it never holds back ffmpeg or the
+// other endpoints. Control messages are taken from the primary only. It
+// returns an error only when every endpoint rejected the stream; onRejected
+// then runs so ffmpeg can be stopped.
+func relayToTargets(ctx context.Context, cfg runtimeConfig, ring *tsRing, controls *relayControls, logger *log.Logger, onRejected func()) error {
+	targets := cfg.relayTargets()
+	monitors := make([]*endpointMonitor, len(targets))
+	for i, t := range targets {
+		monitors[i] = newEndpointMonitor(t, ring)
+	}
+
+	statsCtx, stopStats := context.WithCancel(ctx)
+	statsDone := make(chan struct{})
+	go func() {
+		defer close(statsDone)
+		ticker := time.NewTicker(statsWriteInterval)
+		defer ticker.Stop()
+		for {
+			if err := writeRelayStats(cfg, monitors); err != nil {
+				logger.Printf("WARN: could not save %s: %v", relayStatsFileName, err)
+			}
+			select {
+			case <-statsCtx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	if cfg.switcher != nil && cfg.raw.StreamSwitch.Enabled {
+		go cfg.switcher.watch(statsCtx, cfg, ring, monitors[0])
+	}
+
+	type result struct {
+		target relayTarget
+		err    error
+	}
+	results := make(chan result, len(targets))
+	for i, t := range targets {
+		targetCfg := cfg.withTarget(t)
+		targetControls := controls
+		targetLogger := logger
+		if len(targets) > 1 {
+			targetLogger = log.New(logger.Writer(), logger.Prefix()+"["+t.name+"] ", logger.Flags()|log.Lmsgprefix)
+		}
+		if i > 0 {
+			targetControls = nil
+		}
+		go func(t relayTarget, m *endpointMonitor) {
+			results <- result{target: t, err: relayStream(ctx, targetCfg, ring, targetControls, m, targetLogger)}
+		}(t, monitors[i])
+	}
+
+	var firstErr error
+	rejected := 0
+	for range targets {
+		r := <-results
+		if r.err == nil || ctx.Err() != nil {
+			continue
+		}
+		rejected++
+		if firstErr == nil {
+			firstErr = r.err
+		}
+		if len(targets) > 1 && rejected < len(targets) {
+			logger.Printf("WARN: [%s] relay stopped: %v; other endpoints continue", r.target.name, r.err)
+		}
+		if rejected == len(targets) {
+			onRejected()
+		}
+	}
+
+	stopStats()
+	<-statsDone
+	if err := writeRelayStats(cfg, monitors); err != nil {
+		logger.Printf("WARN: could not save %s: %v", relayStatsFileName, err)
+	}
+	if rejected == len(targets) {
+		return firstErr
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The restart back-off; variables so tests need not wait minutes.
+var (
+	minOutputBackoff = 2 * time.Second
+	maxOutputBackoff = time.Minute
+)
+
+const (
+	// An output that ran this long resets its back-off.
+	stableOutputRun = time.Minute
+	// outputIOTimeout is how long ffmpeg waits on a stalled server, in
+	// microseconds.
+	outputIOTimeout = "10000000"
+)
+
+// outputConfig pushes the relayed stream to a media server outside DIFAE:
+// RTMP or RTMPS (rtmp:// or rtmps:// URL with the stream key) or an SRT
+// listener in caller mode (srt:// URL). Audio is "aac" (the default for
+// RTMP), "copy" (the default for SRT) or "off". LatencyMs and Passphrase
+// apply to SRT only.
+type outputConfig struct {
+	Name       string `json:"name,omitempty"`
+	URL        string `json:"url"`
+	Audio      string `json:"audio,omitempty"`
+	LatencyMs  int    `json:"latencyMs,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// outputEvent reports an output connecting, dropping or failing to connect.
+type outputEvent struct {
+	Type  string    `json:"type"`
+	Name  string    `json:"name"`
+	URL   string    `json:"url"`
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+func applyOutputDefaults(outputs []outputConfig) {
+	for i := range outputs {
+		out := &outputs[i]
+		if strings.TrimSpace(out.Name) == "" {
+			out.Name = fmt.Sprintf("output-%d", i+1)
+		}
+		if strings.TrimSpace(out.Audio) == "" {
+			out.Audio = audioAAC
+			if strings.HasPrefix(out.URL, "srt:") {
+				out.Audio = audioCopy
+			}
+		}
+		if out.LatencyMs == 0 {
+			out.LatencyMs = 200
+		}
+	}
+}
+
+func validateOutputs(outputs []outputConfig) error {
+	seen := map[string]bool{}
+	for i, out := range outputs {
+		if seen[out.Name] {
+			return fmt.Errorf("outputs[%d].name %q is used twice", i, out.Name)
+		}
+		seen[out.Name] = true
+		u, err := url.Parse(out.URL)
+		if err != nil || u.Host == "" || (u.Scheme != "rtmp" && u.Scheme != "rtmps" && u.Scheme != "srt") {
+			return fmt.Errorf("outputs[%d].url must be an rtmp://, rtmps:// or srt:// URL", i)
+		}
+		switch out.Audio {
+		case audioOff, audioCopy, audioAAC:
+		default:
+			return fmt.Errorf("outputs[%d].audio must be %q, %q or %q", i, audioOff, audioCopy, audioAAC)
+		}
+		if out.LatencyMs < 20 || out.LatencyMs > 8000 {
+			return fmt.Errorf("outputs[%d].latencyMs must be between 20 and 8000", i)
+		}
+		if n := len(out.Passphrase); n != 0 && (n < 10 || n > 79) {
+			return fmt.Errorf("outputs[%d].passphrase must be 10 to 79 characters", i)
+		}
+	}
+	return nil
+}
+
+// runOutputs pushes the ring to every output until the ring ends or ctx is
+// cancelled. Each output is a second ffmpeg reading the ring from the newest
+// keyframe, so it costs no camera connection and, like a relay endpoint,
+// only loses its own data when it falls behind.
+func runOutputs(ctx context.Context, cfg runtimeConfig, ring *tsRing, logger *log.Logger) {
+	var wg sync.WaitGroup
+	for _, out := range cfg.raw.Outputs {
+		wg.Add(1)
+		go func(out outputConfig) {
+			defer wg.Done()
+			prefixed := log.New(logger.Writer(), logger.Prefix()+"[output "+out.Name+"] ", logger.Flags()|log.Lmsgprefix)
+			superviseOutput(ctx, cfg, out, ring, prefixed)
+		}(out)
+	}
+	wg.Wait()
+}
+
+func superviseOutput(ctx context.Context, cfg runtimeConfig, out outputConfig, ring *tsRing, logger *log.Logger) {
+	backoff := minOutputBackoff
+	reported := false
+	send := func(state string, err error) {
+		ev := outputEvent{Type: "output", Name: out.Name, URL: maskPassword(out.URL), State: state, At: time.Now()}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		go func() {
+			if err := postEvent(ctx, cfg, ev); err != nil && ctx.Err() == nil {
+				logger.Printf("WARN: event upload failed: %v", err)
+			}
+		}()
+	}
+
+	for {
+		started := time.Now()
+		connected := false
+		err := pushOutput(ctx, cfg, out, ring, logger, func() {
+			connected, reported = true, false
+			logger.Printf("Connected to %s", maskPassword(out.URL))
+			send("connected", nil)
+		})
+		if ctx.Err() != nil || ring.ended() {
+			return
+		}
+		if time.Since(started) >= stableOutputRun {
+			backoff = minOutputBackoff
+		}
+		if !reported {
+			state := "failed"
+			if connected {
+				state = "disconnected"
+			}
+			send(state, err)
+			reported = true
+		}
+		logger.Printf("WARN: output stopped: %v; restarting in %s", err, backoff)
+		waitWithContext(ctx, backoff)
+		if ctx.Err() != nil {
+			return
+		}
+		if backoff *= 2; backoff > maxOutputBackoff {
+			backoff = maxOutputBackoff
+		}
+	}
+}
+
+// pushOutput runs one ffmpeg process for out until it exits. ffmpeg reports
+// its progress on stdout; the first report with bytes written means the
+// server accepted the stream, and onConnected runs.
+func pushOutput(ctx context.Context, cfg runtimeConfig, out outputConfig, ring *tsRing, logger *log.Logger, onConnected func()) error {
+	args := outputArgs(cfg, out)
+	cmd := exec.CommandContext(ctx, cfg.raw.Ffmpeg.Path, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	logger.Printf("Pushing to %s", maskPassword(out.URL))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	// The reader is closed once ffmpeg exits, which unblocks the copy even
+	// while the ring is idle.
+	reader := ring.liveReader()
+	go func() {
+		_, _ = io.Copy(stdin, reader)
+		stdin.Close()
+	}()
+
+	var lastLine string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			// ffmpeg names the output URL in its errors.
+			if line := scrubOutputURL(strings.TrimSpace(scanner.Text()), out); line != "" {
+				logger.Printf("ffmpeg: %s", line)
+				lastLine = line
+			}
+		}
+	}()
+
+	connected := false
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "total_size" || connected {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+			connected = true
+			onConnected()
+		}
+	}
+	_, _ = io.Copy(io.Discard, stdout)
+	wg.Wait()
+
+	err = cmd.Wait()
+	reader.Close()
+	if lastLine != "" {
+		return fmt.Errorf("ffmpeg exited (%v): %s", err, lastLine)
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg exited: %w", err)
+	}
+	return fmt.Errorf("ffmpeg exited")
+}
+
+// outputArgs returns the ffmpeg arguments that push MPEG-TS from stdin to out.
+// Video is already masked or capped upstream and is always copied.
+func outputArgs(cfg runtimeConfig, out outputConfig) []string {
+	args := []string{"-hide_banner", "-nostats", "-loglevel", "warning", "-progress", "pipe:1", "-f", "mpegts", "-i", "pipe:0"}
+	audio := audioConfig{Mode: out.Audio, BitrateKbps: cfg.raw.Camera.Audio.BitrateKbps, SampleRate: cfg.raw.Camera.Audio.SampleRate}
+	args = append(args, streamArgs(audio, []string{"-c:v", "copy"})...)
+	args = append(args, "-rw_timeout", outputIOTimeout)
+	if strings.HasPrefix(out.URL, "srt:") {
+		return append(args, "-f", "mpegts", srtOutputURL(out))
+	}
+	return append(args, "-f", "flv", "-flvflags", "no_duration_filesize", out.URL)
+}
+
+// srtOutputURL returns out.URL with the caller-mode options ffmpeg needs.
+// Options already in the URL are kept; ffmpeg takes latency in microseconds.
+func srtOutputURL(out outputConfig) string {
+	u, err := url.Parse(out.URL)
+	if err != nil {
+		return out.URL
+	}
+	q := u.Query()
+	set := func(key, value string) {
+		if q.Get(key) == "" {
+			q.Set(key, value)
+		}
+	}
+	set("mode", "caller")
+	set("latency", strconv.Itoa(out.LatencyMs*1000))
+	set("pkt_size", "1316")
+	if out.Passphrase != "" {
+		set("passphrase", out.Passphrase)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+func scrubOutputURL(line string, out outputConfig) string {
+	redacted := maskPassword(out.URL)
+	for _, secret := range []string{srtOutputURL(out), out.URL} {
+		line = strings.ReplaceAll(line, secret, redacted)
+	}
+	return line
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The back-off test needs ffmpeg to fail on cue, so the test binary doubles
+// as ffmpeg there: the test points ffmpeg.path at a copy of it, and it runs
+// fakeOutputFFmpeg when started with this variable set. Everything else runs
+// the real ffmpeg against a real ffmpeg listener and is skipped without one.
+const fakeFFmpegEnv = "OUTPUTS_TEST_FAKE_FFMPEG"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeFFmpegEnv) == "1" {
+		fakeOutputFFmpeg(os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeOutputFFmpeg fails the way ffmpeg does when its output URL (the last
+// argument) refuses the connection, naming the full URL in its error.
+func fakeOutputFFmpeg(args []string) {
+	fmt.Fprintf(os.Stderr, "%s: Connection refused\n", args[len(args)-1])
+	os.Exit(1)
+}
+
+// installFakeFFmpeg copies the test binary to a temporary directory and
+// returns its path for ffmpeg.path.
+func installFakeFFmpeg(t *testing.T) string {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "ffmpeg")
+	if runtime.GOOS == "windows" {
+		path += ".exe"
+	}
+	if err := os.WriteFile(path, data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(fakeFFmpegEnv, "1")
+	return path
+}
+
+// fastOutputBackoff shortens the restart delays for the test.
+func fastOutputBackoff(t *testing.T, initial, limit time.Duration) {
+	oldMin, oldMax := minOutputBackoff, maxOutputBackoff
+	minOutputBackoff, maxOutputBackoff = initial, limit
+	t.Cleanup(func() { minOutputBackoff, maxOutputBackoff = oldMin, oldMax })
+}
+
+// requireFFmpeg skips the test unless ffmpeg is on PATH with the protocol
+// and libx264, which encodes the test source, and returns its path.
+func requireFFmpeg(t *testing.T, protocol string) string {
+	t.Helper()
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not on PATH")
+	}
+	for _, probe := range [][2]string{{"-protocols", protocol}, {"-encoders", "libx264"}} {
+		out, err := exec.Command(path, "-hide_banner", probe[0]).Output()
+		if err != nil || !listsName(string(out), probe[1]) {
+			t.Skipf("ffmpeg lacks %s", probe[1])
+		}
+	}
+	return path
+}
+
+// listsName reports whether name is a word of ffmpeg's -protocols or
+// -encoders listing.
+func listsName(list, name string) bool {
+	for _, line := range strings.Split(list, "\n") {
+		for _, f := range strings.Fields(line) {
+			if f == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// freeLoopbackAddr returns a loopback address nothing listens on.
+func freeLoopbackAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// ffmpegListener is a real ffmpeg server, "-listen 1" for RTMP or
+// mode=listener for SRT, that records the stream it receives to a file.
+type ffmpegListener struct {
+	cmd  *exec.Cmd
+	out  string
+	done chan struct{}
+	logs logBuffer
+}
+
+func startFFmpegListener(t *testing.T, ffmpeg string, input ...string) *ffmpegListener {
+	t.Helper()
+	l := &ffmpegListener{out: filepath.Join(t.TempDir(), "received.ts"), done: make(chan struct{})}
+	args := append([]string{"-hide_banner", "-loglevel", "error"}, input...)
+	args = append(args, "-c", "copy", "-f", "mpegts", "-y", l.out)
+	l.cmd = exec.Command(ffmpeg, args...)
+	l.cmd.Stderr = &l.logs
+	if err := l.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = l.cmd.Wait()
+		close(l.done)
+	}()
+	t.Cleanup(l.stop)
+	return l
+}
+
+// stop kills the listener, dropping the sender's connection.
+func (l *ffmpegListener) stop() {
+	_ = l.cmd.Process.Kill()
+	<-l.done
+}
+
+// waitRecorded waits until l has recorded some MPEG-TS.
+func (l *ffmpegListener) waitRecorded(t *testing.T) {
+	t.Helper()
+	waitUntil(t, "the listener to record the stream", func() bool {
+		data, _ := os.ReadFile(l.out)
+		return len(data) >= 16*tsPacketSize && data[0] == tsSyncByte
+	})
+}
+
+// feedRingFFmpeg fills a ring from a real ffmpeg encoding a test pattern to
+// H.264 in real time, with a keyframe every second, until the test ends.
+func feedRingFFmpeg(t *testing.T, ctx context.Context, ffmpeg string) *tsRing {
+	t.Helper()
+	cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-loglevel", "error", "-re",
+		"-f", "lavfi", "-i", "testsrc2=size=320x240:rate=25",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-g", "25", "-pix_fmt", "yuv420p",
+		"-f", "mpegts", "pipe:1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ring := newTSRing(4 << 20)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pkt := make([]byte, tsPacketSize)
+		for {
+			if _, err := io.ReadFull(stdout, pkt); err != nil {
+				return
+			}
+			ring.append(pkt)
+		}
+	}()
+	t.Cleanup(func() {
+		<-done
+		_ = cmd.Wait()
+	})
+	return ring
+}
+
+// withoutFirstFailure drops a leading "failed": a listener cannot be probed
+// without taking its one connection, so the first attempt may beat it.
+func withoutFirstFailure(states []string) []string {
+	if len(states) > 0 && states[0] == "failed" {
+		return states[1:]
+	}
+	return states
+}
+
+// feedRing keeps appending access units, a keyframe every few, to a ring
+// until the test ends.
+func feedRing(t *testing.T, ctx context.Context) *tsRing {
+	t.Helper()
+	ring := newTSRing(1 << 20)
+	go func() {
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for i := int64(0); ; i++ {
+			chunk := testStreamStart()
+			chunk = append(chunk, pesPackets(i*3600, i%5 == 0, annexB([]byte{0x65, 0x88, 0x84}))...)
+			for len(chunk) > 0 {
+				ring.append(chunk[:tsPacketSize])
+				chunk = chunk[tsPacketSize:]
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return ring
+}
+
+// outputEventSink is an events endpoint that collects the output events it
+// is sent.
+type outputEventSink struct {
+	mu     sync.Mutex
+	events []outputEvent
+}
+
+func (s *outputEventSink) start(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev outputEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err == nil && ev.Type == "output" {
+			s.mu.Lock()
+			s.events = append(s.events, ev)
+			s.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// all returns the events in the order they happened; they are posted
+// concurrently and may arrive out of order.
+func (s *outputEventSink) all() []outputEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := append([]outputEvent(nil), s.events...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+	return events
+}
+
+func (s *outputEventSink) states() []string {
+	var out []string
+	for _, ev := range s.all() {
+		out = append(out, ev.State)
+	}
+	return out
+}
+
+// logBuffer collects log output from several goroutines and notes when each
+// line was written.
+type logBuffer struct {
+	mu    sync.Mutex
+	b     bytes.Buffer
+	lines []logLine
+}
+
+type logLine struct {
+	at   time.Time
+	text string
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines = append(b.lines, logLine{time.Now(), string(p)})
+	return b.b.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+// times returns when each line containing s was written.
+func (b *logBuffer) times(s string) []time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var out []time.Time
+	for _, l := range b.lines {
+		if strings.Contains(l.text, s) {
+			out = append(out, l.at)
+		}
+	}
+	return out
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestOutputReconnectAfterDrop(t *testing.T) {
+	ffmpeg := requireFFmpeg(t, "rtmp")
+	fastOutputBackoff(t, 200*time.Millisecond, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr := freeLoopbackAddr(t)
+	rawURL := "rtmp://" + addr + "/live/s3cr3t-key"
+	first := startFFmpegListener(t, ffmpeg, "-listen", "1", "-i", rawURL)
+
+	var sink outputEventSink
+	var logs logBuffer
+	cfg := runtimeConfig{
+		raw: agentConfig{
+			Ffmpeg:  ffmpegConfig{Path: ffmpeg},
+			Outputs: []outputConfig{{Name: "youtube", URL: rawURL, Audio: audioOff}},
+		},
+		eventsURL: sink.start(t),
+	}
+	done := make(chan struct{})
+	go func() {
+		runOutputs(ctx, cfg, feedRingFFmpeg(t, ctx, ffmpeg), log.New(&logs, "", 0))
+		close(done)
+	}()
+
+	waitUntil(t, "the first connection", func() bool { return len(withoutFirstFailure(sink.states())) >= 1 })
+	first.waitRecorded(t)
+
+	// The server goes away mid-stream and comes back on the same address.
+	first.stop()
+	second := startFFmpegListener(t, ffmpeg, "-listen", "1", "-i", rawURL)
+	waitUntil(t, "three events", func() bool { return len(withoutFirstFailure(sink.states())) >= 3 })
+	if got, want := strings.Join(withoutFirstFailure(sink.states()), ","), "connected,disconnected,connected"; got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+	second.waitRecorded(t)
+
+	redacted := "rtmp://" + addr + "/live/****"
+	for _, ev := range sink.all() {
+		if ev.Name != "youtube" || ev.URL != redacted || strings.Contains(ev.Error, "s3cr3t") {
+			t.Errorf("event = %+v, want the output's name and redacted URL", ev)
+		}
+	}
+
+	cancel()
+	<-done
+	out := logs.String()
+	if strings.Contains(out, "s3cr3t") {
+		t.Errorf("log reveals the stream key:\n%s", out)
+	}
+	for _, want := range []string{
+		"[output youtube] Pushing to " + redacted,
+		"Connected to " + redacted,
+		"WARN: output stopped: ",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestOutputSRT(t *testing.T) {
+	ffmpeg := requireFFmpeg(t, "srt")
+	fastOutputBackoff(t, 200*time.Millisecond, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr := freeLoopbackAddr(t)
+	const passphrase = "hunter2222"
+	l := startFFmpegListener(t, ffmpeg, "-i", "srt://"+addr+"?mode=listener&passphrase="+passphrase)
+
+	var sink outputEventSink
+	var logs logBuffer
+	out := outputConfig{Name: "srt", URL: "srt://" + addr + "?streamid=abc123", Audio: audioOff, LatencyMs: 200, Passphrase: passphrase}
+	cfg := runtimeConfig{
+		raw:       agentConfig{Ffmpeg: ffmpegConfig{Path: ffmpeg}, Outputs: []outputConfig{out}},
+		eventsURL: sink.start(t),
+	}
+	go runOutputs(ctx, cfg, feedRingFFmpeg(t, ctx, ffmpeg), log.New(&logs, "", 0))
+
+	waitUntil(t, "the connected event", func() bool { return len(withoutFirstFailure(sink.states())) > 0 })
+	l.waitRecorded(t)
+	if got := withoutFirstFailure(sink.states()); len(got) != 1 || got[0] != "connected" {
+		t.Errorf("events = %v, want a single connected", got)
+	}
+	for _, secret := range []string{passphrase, "abc123"} {
+		if s := logs.String(); strings.Contains(s, secret) {
+			t.Errorf("log reveals %q:\n%s", secret, s)
+		}
+	}
+}
+
+func TestOutputBackoffWhileUnreachable(t *testing.T) {
+	ffmpeg := installFakeFFmpeg(t)
+	fastOutputBackoff(t, 50*time.Millisecond, 200*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var sink outputEventSink
+	var logs logBuffer
+	out := outputConfig{Name: "srt", URL: "srt://" + addr + "?streamid=abc123", Audio: audioOff, LatencyMs: 200, Passphrase: "hunter2222"}
+	cfg := runtimeConfig{
+		raw:       agentConfig{Ffmpeg: ffmpegConfig{Path: ffmpeg}, Outputs: []outputConfig{out}},
+		eventsURL: sink.start(t),
+	}
+	done := make(chan struct{})
+	go func() {
+		runOutputs(ctx, cfg, feedRing(t, ctx), log.New(&logs, "", 0))
+		close(done)
+	}()
+
+	// Each attempt logs "Pushing to"; the gaps between them are the back-off
+	// plus the time ffmpeg takes to fail.
+	waitUntil(t, "six attempts", func() bool { return len(logs.times("Pushing to ")) >= 6 })
+	attempts := logs.times("Pushing to ")
+	want := []time.Duration{50, 100, 200, 200, 200}
+	for i, w := range want {
+		gap := attempts[i+1].Sub(attempts[i])
+		if gap < w*time.Millisecond {
+			t.Errorf("attempt %d came %s after the previous, want at least %dms", i+2, gap, w)
+		}
+		if gap > w*time.Millisecond+time.Second {
+			t.Errorf("attempt %d came %s after the previous, want about %dms", i+2, gap, w)
+		}
+	}
+
+	waitUntil(t, "the failure event", func() bool { return len(sink.states()) > 0 })
+	events := sink.all()
+	if len(events) != 1 || events[0].State != "failed" {
+		t.Errorf("events = %+v, want a single failed", events)
+	}
+	redacted := "srt://" + addr + "?streamid=****"
+	if events[0].URL != redacted {
+		t.Errorf("event URL = %q, want %q", events[0].URL, redacted)
+	}
+
+	cancel()
+	<-done
+	for _, secret := range []string{"hunter2222", "abc123"} {
+		if s := logs.String(); strings.Contains(s, secret) {
+			t.Errorf("log reveals %q:\n%s", secret, s)
+		}
+		if strings.Contains(events[0].Error, secret) {
+			t.Errorf("event reveals %q: %s", secret, events[0].Error)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultViewersPath = "/api/bridge/viewers"
+	// viewerPollWait is how long the backend may hold a viewer request.
+	viewerPollWait = 15 * time.Second
+)
+
+// onDemandConfig relays only while the backend reports viewers, stopping
+// IdleTimeoutSeconds after the last one leaves. While idle a still is taken
+// from the camera every IdleSnapshotSeconds (negative disables).
+type onDemandConfig struct {
+	Enabled             bool   `json:"enabled"`
+	ViewersEndpoint     string `json:"viewersEndpoint,omitempty"`
+	IdleTimeoutSeconds  int    `json:"idleTimeoutSeconds,omitempty"`
+	IdleSnapshotSeconds int    `json:"idleSnapshotSeconds,omitempty"`
+}
+
+// viewerWatcher long-polls the backend for the bridge's viewer count and is
+// signalled when the relay should start or stop.
+type viewerWatcher struct {
+	gate    *streamGate
+	logger  *log.Logger
+	changed chan struct{}
+	client  *http.Client
+
+	mu       sync.Mutex
+	cfg      runtimeConfig
+	viewers  int
+	wanted   bool
+	lastSeen time.Time
+}
+
+func newViewerWatcher(gate *streamGate, logger *log.Logger) *viewerWatcher {
+	return &viewerWatcher{
+		gate:    gate,
+		logger:  logger,
+		changed: make(chan struct{}, 1),
+		client:  &http.Client{Timeout: viewerPollWait + 15*time.Second},
+	}
+}
+
+func (w *viewerWatcher) configure(cfg runtimeConfig) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.cfg = cfg
+}
+
+func (w *viewerWatcher) isWanted() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.wanted
+}
+
+func (w *viewerWatcher) config() runtimeConfig {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cfg
+}
+
+// run polls for viewers, applies the idle timeout and takes idle snapshots
+// until ctx ends.
+func (w *viewerWatcher) run(ctx context.Context) {
+	go w.poll(ctx)
+
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+
+	var lastIdle time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-check.C:
+			w.expire(now)
+
+			cfg := w.config()
+			interval := time.Duration(cfg.raw.OnDemand.IdleSnapshotSeconds) * time.Second
+			if interval > 0 && now.Sub(lastIdle) >= interval && !w.isWanted() && w.gate.isStreaming() {
+				lastIdle = now
+				if err := grabSnapshot(ctx, cfg, "idle"); err != nil && ctx.Err() == nil {
+					w.logger.Printf("WARN: idle snapshot failed: %v", err)
+				}
+			}
+		}
+	}
+}
+
+func (w *viewerWatcher) poll(ctx context.Context) {
+	var lastErr string
+	for ctx.Err() == nil {
+		w.mu.Lock()
+		cfg, known := w.cfg, w.viewers
+		w.mu.Unlock()
+
+		n, err := w.fetch(ctx, cfg, known)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Without the backend nobody can be watching; let the idle
+			// timeout run and log each distinct failure once.
+			if msg := err.Error(); msg != lastErr {
+				w.logger.Printf("WARN: viewer poll failed: %v", err)
+				lastErr = msg
+			}
+			w.update(0, time.Now())
+			waitWithContext(ctx, 5*time.Second)
+			continue
+		}
+		lastErr = ""
+		w.update(n, time.Now())
+	}
+}
+
+func (w *viewerWatcher) fetch(ctx context.Context, cfg runtimeConfig, known int) (int, error) {
+	endpoint := fmt.Sprintf("%s?known=%d&wait=%d", cfg.viewersURL, known, int(viewerPollWait.Seconds()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to construct viewer request: %w", err)
+	}
+	setBridgeHeaders(req, cfg)
+
+	resp, err := w.client.Do(req)
+	cfg.report(ctx, cfg.viewersURL, err == nil && resp.StatusCode < 500)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query viewers: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("viewers endpoint %s answered %d", cfg.viewersURL, resp.StatusCode)
+	}
+
+	var body struct {
+		Viewers int `json:"viewers"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil {
+		return 0, fmt.Errorf("invalid viewers response: %w", err)
+	}
+	return body.Viewers, nil
+}
+
+func (w *viewerWatcher) update(viewers int, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	previous := w.viewers
+	w.viewers = viewers
+	switch {
+	case viewers > 0:
+		w.lastSeen = now
+		if !w.wanted {
+			w.logger.Printf("%d viewer(s) connected; starting relay", viewers)
+			w.setLocked(true)
+		}
+	case previous > 0:
+		w.lastSeen = now
+		w.logger.Printf("No viewers left; stopping relay in %ds unless one returns", w.cfg.raw.OnDemand.IdleTimeoutSeconds)
+	}
+}
+
+func (w *viewerWatcher) expire(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	timeout := time.Duration(w.cfg.raw.OnDemand.IdleTimeoutSeconds) * time.Second
+	if w.wanted && w.viewers == 0 && now.Sub(w.lastSeen) >= timeout {
+		w.logger.Printf("Idle for %s; stopping relay until a viewer connects", timeout)
+		w.setLocked(false)
+	}
+}
+
+func (w *viewerWatcher) setLocked(wanted bool) {
+	w.wanted = wanted
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
+
+// grabSnapshot grabs one still straight from the camera, for when no relay
+// session is running, then uploads it like a regular snapshot.
+func grabSnapshot(ctx context.Context, cfg runtimeConfig, reason string) error {
+	cfg = stillConfig(cfg)
+	filters := privacyFilters(cfg.raw.Camera.Privacy, cfg.raw.BridgeID)
+	input := []string{"-rtsp_transport", cfg.raw.Ffmpeg.RtspTransport, "-i", cfg.rtspURL}
+	if err := captureStill(ctx, cfg, input, nil, filters); err != nil {
+		return err
+	}
+	return uploadSnapshot(ctx, cfg, reason)
+}
+
+// grabRingSnapshot grabs one still from a running session's ring, so a
+// snapshot request does not cost a second camera connection. The ring is
+// already masked, so no privacy filters are applied again.
+func grabRingSnapshot(ctx context.Context, cfg runtimeConfig, ring *tsRing, reason string) error {
+	cfg = stillConfig(cfg)
+	reader := ring.liveReader()
+	defer reader.Close()
+	if err := captureStill(ctx, cfg, []string{"-f", "mpegts", "-i", "pipe:0"}, reader, nil); err != nil {
+		return err
+	}
+	return uploadSnapshot(ctx, cfg, reason)
+}
+
+// stillConfig points cfg's snapshot path at the file for one-off stills, so
+// they neither race the session's interval snapshots nor get uploaded again
+// by watchSnapshots.
+func stillConfig(cfg runtimeConfig) runtimeConfig {
+	cfg.snapshotPath = filepath.Join(filepath.Dir(cfg.snapshotPath), stillFileName)
+	return cfg
+}
+
+// captureStill writes the first frame of input to the snapshot path. A
+// non-nil stdin feeds an input read from pipe:0; the caller closes it.
+func captureStill(ctx context.Context, cfg runtimeConfig, input []string, stdin io.Reader, filters []string) error {
+	captureCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	if cfg.raw.Snapshot.Width > 0 {
+		filters = append(filters, fmt.Sprintf("scale=%d:-2", cfg.raw.Snapshot.Width))
+	}
+	args := append([]string{"-loglevel", "error"}, input...)
+	if stdin == nil {
+		args = append([]string{"-nostdin"}, args...)
+	}
+	args = append(args, "-frames:v", "1")
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	args = append(args, "-q:v", strconv.Itoa(cfg.raw.Snapshot.Quality), "-f", "image2", "-update", "1", "-y", cfg.snapshotPath)
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(captureCtx, cfg.raw.Ffmpeg.Path, args...)
+	cmd.Stderr = &stderr
+	if stdin != nil {
+		// Copied by hand: exec would wait for a copy blocked on an idle ring.
+		pipe, err := cmd.StdinPipe()
+		if err != nil {
+			return err
+		}
+		go func() {
+			_, _ = io.Copy(pipe, stdin)
+			pipe.Close()
+		}()
+	}
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg snapshot failed: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	overlayTopLeft     = "top-left"
+	overlayTopRight    = "top-right"
+	overlayBottomLeft  = "bottom-left"
+	overlayBottomRight = "bottom-right"
+
+	// privacyKeyframeSeconds keeps transcoded relay output seekable.
+	privacyKeyframeSeconds = 2
+
+	// windowsFont is used for overlays when no fontFile is configured.
+	windowsFont = `C:\Windows\Fonts\arial.ttf`
+
+	// Polygon masks are blacked out on a maskGridW x maskGridH grid, covering
+	// every cell the polygon touches.
+	maskGridW = 128
+	maskGridH = 72
+)
+
+// privacyConfig lists regions blacked out and text burned into the relayed
+// video. Any mask or overlay switches video from copy to a libx264 transcode.
+type privacyConfig struct {
+	Masks      []maskConfig    `json:"masks,omitempty"`
+	Overlays   []overlayConfig `json:"overlays,omitempty"`
+	CameraName string          `json:"cameraName,omitempty"`
+	FontFile   string          `json:"fontFile,omitempty"`
+	Crf        int             `json:"crf,omitempty"`
+	Preset     string          `json:"preset,omitempty"`
+}
+
+// maskConfig is a rectangle or, when Points is set, a polygon, in
+// frame-relative coordinates (0-1 from the top-left corner).
+type maskConfig struct {
+	X      float64      `json:"x,omitempty"`
+	Y      float64      `json:"y,omitempty"`
+	Width  float64      `json:"width,omitempty"`
+	Height float64      `json:"height,omitempty"`
+	Points [][2]float64 `json:"points,omitempty"`
+}
+
+// overlayConfig is a burned-in text line; Text may contain {time}, {date},
+// {camera} and {bridge} placeholders.
+type overlayConfig struct {
+	Text       string `json:"text"`
+	Position   string `json:"position,omitempty"`
+	FontSize   int    `json:"fontSize,omitempty"`
+	Color      string `json:"color,omitempty"`
+	Background bool   `json:"background,omitempty"`
+}
+
+func applyPrivacyDefaults(p *privacyConfig) {
+	if p.Crf == 0 {
+		p.Crf = 23
+	}
+	if strings.TrimSpace(p.Preset) == "" {
+		p.Preset = "veryfast"
+	}
+	for i := range p.Overlays {
+		o := &p.Overlays[i]
+		if o.Position == "" {
+			o.Position = overlayTopLeft
+		}
+		if o.FontSize == 0 {
+			o.FontSize = 24
+		}
+		if o.Color == "" {
+			o.Color = "white"
+		}
+	}
+}
+
+func validatePrivacy(p privacyConfig) error {
+	inFrame := func(v float64) bool { return v >= 0 && v <= 1 }
+	for i, m := range p.Masks {
+		if len(m.Points) > 0 {
+			if len(m.Points) < 3 {
+				return fmt.Errorf("camera.privacy.masks[%d] polygon needs at least 3 points", i)
+			}
+			for _, pt := range m.Points {
+				if !inFrame(pt[0]) || !inFrame(pt[1]) {
+					return fmt.Errorf("camera.privacy.masks[%d] has a point outside the frame (0-1 coordinates)", i)
+				}
+			}
+			continue
+		}
+		if m.Width <= 0 || m.Height <= 0 || !inFrame(m.X) || !inFrame(m.Y) || m.X+m.Width > 1 || m.Y+m.Height > 1 {
+			return fmt.Errorf("camera.privacy.masks[%d] must lie within the frame (0-1 coordinates)", i)
+		}
+	}
+	for i, o := range p.Overlays {
+		if o.Text == "" {
+			return fmt.Errorf("camera.privacy.overlays[%d].text is required", i)
+		}
+		switch o.Position {
+		case overlayTopLeft, overlayTopRight, overlayBottomLeft, overlayBottomRight:
+		default:
+			return fmt.Errorf("camera.privacy.overlays[%d].position must be top-left, top-right, bottom-left or bottom-right", i)
+		}
+		if o.FontSize < 6 || o.FontSize > 200 {
+			return fmt.Errorf("camera.privacy.overlays[%d].fontSize must be between 6 and 200", i)
+		}
+	}
+	if p.Crf < 0 || p.Crf > 51 {
+		return errors.New("camera.privacy.crf must be between 0 and 51")
+	}
+	return nil
+}
+
+func privacyActive(p privacyConfig) bool {
+	return len(p.Masks) > 0 || len(p.Overlays) > 0
+}
+
+// videoArgs copies the camera's video, or filters and re-encodes it when
+// privacy masks or overlays are configured or the backend has capped the
+// bitrate (bitrateKbps > 0).
+func videoArgs(p privacyConfig, bridgeID string, bitrateKbps int) []string {
+	active := privacyActive(p)
+	if !active && bitrateKbps <= 0 {
+		return []string{"-c:v", "copy"}
+	}
+	var args []string
+	if active {
+		args = append(args, "-vf", strings.Join(privacyFilters(p, bridgeID), ","))
+	}
+	args = append(args, "-c:v", "libx264", "-preset", p.Preset, "-tune", "zerolatency")
+	if bitrateKbps > 0 {
+		args = append(args, "-b:v", fmt.Sprintf("%dk", bitrateKbps), "-maxrate", fmt.Sprintf("%dk", bitrateKbps), "-bufsize", fmt.Sprintf("%dk", 2*bitrateKbps))
+	} else {
+		args = append(args, "-crf", strconv.Itoa(p.Crf))
+	}
+	return append(args,
+		"-pix_fmt", "yuv420p",
+		"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", privacyKeyframeSeconds),
+	)
+}
+
+// privacyFilters renders masks as drawbox and overlays as drawtext filters,
+// escaped for a filter chain. Masks come first so overlays stay visible.
+func privacyFilters(p privacyConfig, bridgeID string) []string {
+	var filters []string
+	for _, m := range p.Masks {
+		for _, r := range maskRects(m) {
+			// Grown by a pixel each way so rounding never leaves a gap.
+			filters = append(filters, fmt.Sprintf("drawbox=x=iw*%s-1:y=ih*%s-1:w=iw*%s+2:h=ih*%s+2:color=black:t=fill",
+				fnum(r.x), fnum(r.y), fnum(r.w), fnum(r.h)))
+		}
+	}
+
+	font := p.FontFile
+	if font == "" && runtime.GOOS == "windows" {
+		font = windowsFont
+	}
+	for _, o := range p.Overlays {
+		margin := strconv.Itoa(max(4, o.FontSize/2))
+		x, y := margin, margin
+		if o.Position == overlayTopRight || o.Position == overlayBottomRight {
+			x = "w-tw-" + margin
+		}
+		if o.Position == overlayBottomLeft || o.Position == overlayBottomRight {
+			y = "h-th-" + margin
+		}
+
+		opts := []string{
+			"text=" + escapeFilterValue(expandOverlay(o.Text, p.CameraName, bridgeID)),
+			"fontsize=" + strconv.Itoa(o.FontSize),
+			"fontcolor=" + escapeFilterValue(o.Color),
+			"x=" + x,
+			"y=" + y,
+		}
+		if o.Background {
+			opts = append(opts, "box=1", "boxcolor=black@0.5", "boxborderw="+strconv.Itoa(max(2, o.FontSize/4)))
+		}
+		if font != "" {
+			opts = append(opts, "fontfile="+escapeFilterValue(strings.ReplaceAll(font, `\`, "/")))
+		}
+		filters = append(filters, "drawtext="+strings.Join(opts, ":"))
+	}
+	return filters
+}
+
+// expandOverlay replaces placeholders with drawtext expansions, escaping the
+// literal text for drawtext's own %{...} syntax.
+func expandOverlay(template, camera, bridgeID string) string {
+	literal := strings.NewReplacer(`\`, `\\`, `%`, `\%`)
+	var b strings.Builder
+	for template != "" {
+		start := strings.IndexByte(template, '{')
+		end := -1
+		if start >= 0 {
+			end = strings.IndexByte(template[start:], '}')
+		}
+		if start < 0 || end < 0 {
+			b.WriteString(literal.Replace(template))
+			break
+		}
+		b.WriteString(literal.Replace(template[:start]))
+		switch name := template[start : start+end+1]; name {
+		case "{time}":
+			b.WriteString(`%{localtime:%Y-%m-%d %H\:%M\:%S}`)
+		case "{date}":
+			b.WriteString(`%{localtime:%Y-%m-%d}`)
+		case "{camera}":
+			b.WriteString(literal.Replace(camera))
+		case "{bridge}":
+			b.WriteString(literal.Replace(bridgeID))
+		default:
+			b.WriteString(literal.Replace(name))
+		}
+		template = template[start+end+1:]
+	}
+	return b.String()
+}
+
+// escapeFilterValue escapes an option value for the filter's option parser
+// and then for the filter graph parser.
+func escapeFilterValue(v string) string {
+	option := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(v)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(option)
+}
+
+func fnum(v float64) string {
+	return strconv.FormatFloat(v, 'f', 5, 64)
+}
+
+type maskRect struct {
+	x, y, w, h float64
+}
+
+type maskPoint struct {
+	x, y float64
+}
+
+// maskRects covers a mask with rectangles: the rectangle itself, or the
+// grid cells a polygon touches merged into horizontal runs and then
+// vertically where runs line up.
+func maskRects(m maskConfig) []maskRect {
+	if len(m.Points) == 0 {
+		return []maskRect{{m.X, m.Y, m.Width, m.Height}}
+	}
+
+	poly := make([]maskPoint, len(m.Points))
+	for i, p := range m.Points {
+		poly[i] = maskPoint{p[0], p[1]}
+	}
+
+	cw, ch := 1.0/maskGridW, 1.0/maskGridH
+	hit := func(col, row int) bool {
+		return polygonTouchesCell(poly, float64(col)*cw, float64(row)*ch, cw, ch)
+	}
+
+	var rects, open []maskRect
+	for row := 0; row < maskGridH; row++ {
+		var next []maskRect
+		for col := 0; col < maskGridW; {
+			if !hit(col, row) {
+				col++
+				continue
+			}
+			start := col
+			for col < maskGridW && hit(col, row) {
+				col++
+			}
+			run := maskRect{float64(start) * cw, float64(row) * ch, float64(col-start) * cw, ch}
+			for i, o := range open {
+				if o.x == run.x && o.w == run.w {
+					run.y, run.h = o.y, o.h+ch
+					open = append(open[:i], open[i+1:]...)
+					break
+				}
+			}
+			next = append(next, run)
+		}
+		rects = append(rects, open...)
+		open = next
+	}
+	return append(rects, open...)
+}
+
+func polygonTouchesCell(poly []maskPoint, x, y, w, h float64) bool {
+	corners := [4]maskPoint{{x, y}, {x + w, y}, {x + w, y + h}, {x, y + h}}
+	for _, c := range corners {
+		if pointInPolygon(poly, c) {
+			return true
+		}
+	}
+	for i := range poly {
+		a, b := poly[i], poly[(i+1)%len(poly)]
+		if a.x >= x && a.x <= x+w && a.y >= y && a.y <= y+h {
+			return true
+		}
+		for j := range corners {
+			if segmentsCross(a, b, corners[j], corners[(j+1)%4]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func pointInPolygon(poly []maskPoint, p maskPoint) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			in = !in
+		}
+	}
+	return in
+}
+
+func segmentsCross(a, b, c, d maskPoint) bool {
+	cross := func(o, p, q maskPoint) float64 { return (p.x-o.x)*(q.y-o.y) - (p.y-o.y)*(q.x-o.x) }
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return ((d1 > 0) != (d2 > 0)) && ((d3 > 0) != (d4 > 0))
+}
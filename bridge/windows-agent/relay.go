@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/difae/windows-agent/relayframe"
+)
+
+const (
+	defaultRelayBufferMB = 32
+	maxRelayBackoff      = 30 * time.Second
+	framePackets         = 64
+)
+
+// relayConfig tunes the relay connection. BufferMB bounds how much of
+// ffmpeg's output is held while the connection reconnects. Framed asks the
+// backend for the framed relay protocol; it falls back to raw MPEG-TS when
+// the backend does not offer it.
+type relayConfig struct {
+	BufferMB int  `json:"bufferMB,omitempty"`
+	Framed   bool `json:"framed,omitempty"`
+}
+
+// relayEvent reports a relay reconnect and the video lost during the outage.
+type relayEvent struct {
+	Type           string    `json:"type"`
+	State          string    `json:"state"`
+	OutageSeconds  float64   `json:"outageSeconds"`
+	LostBytes      int64     `json:"lostBytes"`
+	TotalLostBytes int64     `json:"totalLostBytes"`
+	At             time.Time `json:"at"`
+}
+
+// relayRejectedError is a 4xx answer from the relay endpoint. It ends the
+// session instead of reconnecting, since retrying the same request will not help.
+type relayRejectedError struct {
+	status int
+	body   string
+	url    string
+}
+
+func (e *relayRejectedError) Error() string {
+	return fmt.Sprintf("relay endpoint %s rejected the stream with %d: %s", e.url, e.status, e.body)
+}
+
+var relayClient = &http.Client{Timeout: 0}
+
+// relayStream sends the ring to the relay endpoint, reconnecting with backoff
+// whenever the connection drops while ffmpeg keeps running. A reconnect
+// resumes at the next buffered keyframe; everything skipped is counted as
+// lost. It returns nil once ffmpeg's output has ended.
+func relayStream(ctx context.Context, cfg runtimeConfig, ring *tsRing, controls *relayControls, mon *endpointMonitor, logger *log.Logger) error {
+	var pos, totalLost int64
+	var downSince time.Time
+	resume := false
+	backoff := time.Second
+
+	// Sequence numbers continue across reconnects within one ffmpeg run, so
+	// frames lost in flight show up as a gap at the receiver.
+	session := relayframe.NewSession()
+	var sequence uint64
+	wasFramed := false
+	webSocket := cfg.raw.RelayTransport == transportWebSocket
+
+	for {
+		reader := ring.reader(pos, resume)
+		open := func(framed bool) io.ReadCloser {
+			if framed {
+				return mon.count(&frameReader{rr: reader, session: session, sequence: &sequence})
+			}
+			return mon.count(reader)
+		}
+		onAccepted := func(status int, framed bool) {
+			mon.accepted(framed)
+			if cfg.raw.Relay.Framed && framed != wasFramed {
+				if framed {
+					logger.Printf("Relay protocol: %s (session %s)", relayframe.Protocol, session)
+				} else {
+					logger.Printf("WARN: relay endpoint did not offer %s; sending raw MPEG-TS", relayframe.Protocol)
+				}
+				wasFramed = framed
+			}
+			if downSince.IsZero() {
+				logger.Printf("Relay accepted stream (status %d)", status)
+				return
+			}
+			_, lost := reader.position()
+			outage := time.Since(downSince)
+			logger.Printf("Relay reconnected after %s; resumed at a keyframe, %d bytes lost", outage.Round(time.Millisecond), lost)
+			ev := relayEvent{Type: "relay", State: "reconnected", OutageSeconds: outage.Seconds(), LostBytes: lost, TotalLostBytes: totalLost + lost, At: time.Now()}
+			go func() {
+				if err := postEvent(ctx, cfg, ev); err != nil && ctx.Err() == nil {
+					logger.Printf("WARN: event upload failed: %v", err)
+				}
+			}()
+		}
+
+		var accepted bool
+		var err error
+		if webSocket {
+			mon.connecting(reader, transportWebSocket)
+			accepted, err = sendWebSocket(ctx, cfg, open, onAccepted, controls)
+			var refused *wsHandshakeError
+			if errors.As(err, &refused) {
+				// Stay on POST until ffmpeg restarts; the path to the backend
+				// evidently does not carry WebSockets.
+				logger.Printf("WARN: %v; falling back to chunked POST", err)
+				webSocket = false
+			}
+		}
+		if !webSocket {
+			mon.connecting(reader, transportPost)
+			accepted, err = sendRelay(ctx, cfg, open, onAccepted, controls)
+		}
+
+		var rejected *relayRejectedError
+		var refused *wsHandshakeError
+		// A backend that answered, even with a refusal, is up.
+		cfg.report(ctx, cfg.relay, accepted || errors.As(err, &rejected) || errors.As(err, &refused))
+
+		var lost int64
+		pos, lost = reader.position()
+		totalLost += lost
+		if ctx.Err() != nil {
+			mon.disconnected(endpointStopped, nil, pos, lost)
+			return ctx.Err()
+		}
+		if errors.As(err, &rejected) {
+			mon.disconnected(endpointRejected, err, pos, lost)
+			return err
+		}
+		if ring.done(pos) {
+			mon.disconnected(endpointStopped, nil, pos, lost)
+			return nil
+		}
+		if ring.ended() {
+			// ffmpeg is gone; the session restarts rather than waiting to
+			// flush what is left.
+			logger.Printf("WARN: relay connection lost after ffmpeg exited; dropping %d buffered bytes", ring.buffered(pos))
+			mon.disconnected(endpointStopped, err, pos, lost)
+			return nil
+		}
+		mon.disconnected(endpointBackoff, err, pos, lost)
+
+		if accepted {
+			backoff = time.Second
+			downSince = time.Now()
+		} else if downSince.IsZero() {
+			downSince = time.Now()
+		}
+		logger.Printf("WARN: relay connection lost: %v; reconnecting in %s with %d bytes buffered", err, backoff, ring.buffered(pos))
+		waitWithContext(ctx, backoff)
+		backoff *= 2
+		if backoff > maxRelayBackoff {
+			backoff = maxRelayBackoff
+		}
+		resume = true
+	}
+}
+
+// negotiateFramed asks the relay endpoint whether it accepts the framed
+// protocol. Any failure means raw MPEG-TS; a connection problem will surface
+// again on the POST that follows.
+func negotiateFramed(ctx context.Context, cfg runtimeConfig) bool {
+	requestCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(requestCtx, http.MethodOptions, cfg.relay, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set(relayframe.ProtocolHeader, relayframe.Protocol)
+	setBridgeHeaders(req, cfg)
+
+	resp, err := relayClient.Do(req)
+	if err != nil {
+		return false
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	return resp.StatusCode >= 200 && resp.StatusCode < 300 &&
+		resp.Header.Get(relayframe.ProtocolHeader) == relayframe.Protocol
+}
+
+// frameReader wraps a ringReader in relay frames of up to framePackets
+// packets each, stamped with the time ffmpeg produced them.
+type frameReader struct {
+	rr       *ringReader
+	session  relayframe.Session
+	sequence *uint64
+
+	packets []byte
+	frame   []byte
+	out     []byte
+}
+
+func (fr *frameReader) Read(p []byte) (int, error) {
+	for len(fr.out) == 0 {
+		if fr.packets == nil {
+			fr.packets = make([]byte, framePackets*tsPacketSize)
+		}
+		c, err := fr.rr.readChunk(fr.packets)
+		if err != nil {
+			return 0, err
+		}
+		f := relayframe.Frame{
+			Session:  fr.session,
+			Sequence: *fr.sequence,
+			Offset:   c.offset,
+			Captured: c.captured,
+			Payload:  c.data,
+		}
+		if c.headers {
+			f.Flags |= relayframe.FlagHeaders
+		}
+		if c.jumped {
+			f.Flags |= relayframe.FlagResync
+		}
+		*fr.sequence++
+		fr.frame = f.AppendTo(fr.frame[:0])
+		fr.out = fr.frame
+	}
+	n := copy(p, fr.out)
+	fr.out = fr.out[n:]
+	return n, nil
+}
+
+func (fr *frameReader) Close() error {
+	return fr.rr.Close()
+}
+
+// sendRelay streams the relay over one chunked POST until either side ends
+// it, in frames if relay.framed is set and the endpoint offers them.
+// onAccepted runs once the endpoint answers with a 2xx status. The response
+// body then carries control messages, which are acknowledged through the
+// events endpoint; without controls it is discarded.
+func sendRelay(ctx context.Context, cfg runtimeConfig, open func(framed bool) io.ReadCloser, onAccepted func(status int, framed bool), controls *relayControls) (bool, error) {
+	requestCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	framed := cfg.raw.Relay.Framed && negotiateFramed(ctx, cfg)
+	body := open(framed)
+
+	req, err := http.NewRequestWithContext(requestCtx, http.MethodPost, cfg.relay, body)
+	if err != nil {
+		return false, fmt.Errorf("failed to construct relay request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if framed {
+		req.Header.Set("Content-Type", relayframe.ContentType)
+		req.Header.Set(relayframe.ProtocolHeader, relayframe.Protocol)
+	}
+	req.Header.Set("Accept-Encoding", "identity")
+	req.TransferEncoding = []string{"chunked"}
+	setBridgeHeaders(req, cfg)
+
+	resp, err := relayClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to send relay request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		rejected := &relayRejectedError{status: resp.StatusCode, body: strings.TrimSpace(string(data)), url: cfg.relay}
+		if resp.StatusCode >= 500 {
+			// Gateways answer 5xx while the backend restarts; keep buffering.
+			return false, errors.New(rejected.Error())
+		}
+		return false, rejected
+	}
+
+	onAccepted(resp.StatusCode, framed)
+	if controls == nil {
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			return true, err
+		}
+		return true, errors.New("relay endpoint closed the connection")
+	}
+	ack := func(a controlAck) error { return postEvent(ctx, cfg, a) }
+	if err := controls.serveLines(ctx, cfg, resp.Body, ack); err != nil {
+		return true, err
+	}
+	return true, errors.New("relay endpoint closed the connection")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/difae/windows-agent/relayframe"
+)
+
+// cutBody ends a request body after n bytes as if the connection dropped.
+type cutBody struct {
+	io.ReadCloser
+	n int
+}
+
+func (b *cutBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= n
+	return n, err
+}
+
+// relayBackend is the reference receiver behind an endpoint that drops the
+// first relay POST part way through.
+type relayBackend struct {
+	rc     relayframe.Receiver
+	mu     sync.Mutex
+	posts  int
+	chunks [][]byte // what the sink got, one entry per connection
+	gaps   []relayframe.Gap
+	events []relayEvent
+}
+
+func (b *relayBackend) start(t *testing.T) (relay, events string) {
+	t.Helper()
+	b.rc.Sink = func(string) io.Writer { return b }
+	b.rc.OnGap = func(_ string, gap relayframe.Gap) {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.gaps = append(b.gaps, gap)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/relay", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			b.mu.Lock()
+			b.posts++
+			b.chunks = append(b.chunks, nil)
+			if b.posts == 1 {
+				r.Body = &cutBody{ReadCloser: r.Body, n: 8192}
+			}
+			b.mu.Unlock()
+		}
+		b.rc.ServeHTTP(w, r)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		var ev relayEvent
+		if err := json.NewDecoder(r.Body).Decode(&ev); err == nil && ev.Type == "relay" {
+			b.mu.Lock()
+			b.events = append(b.events, ev)
+			b.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL + "/relay", srv.URL + "/events"
+}
+
+func (b *relayBackend) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	last := &b.chunks[len(b.chunks)-1]
+	*last = append(*last, p...)
+	return len(p), nil
+}
+
+func TestRelayFramedResyncAfterDrop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var backend relayBackend
+	relay, events := backend.start(t)
+	cfg := runtimeConfig{
+		raw: agentConfig{
+			BridgeID:       "bridge-1",
+			RelayTransport: transportPost,
+			Relay:          relayConfig{Framed: true},
+		},
+		relay:     relay,
+		eventsURL: events,
+	}
+	ring := feedRing(t, ctx)
+	mon := newEndpointMonitor(relayTarget{name: "primary", relay: relay, transport: transportPost}, ring)
+	var logs logBuffer
+	done := make(chan error, 1)
+	go func() { done <- relayStream(ctx, cfg, ring, nil, mon, log.New(&logs, "", 0)) }()
+
+	waitUntil(t, "the stream after the reconnect", func() bool {
+		backend.mu.Lock()
+		defer backend.mu.Unlock()
+		return len(backend.chunks) == 2 && len(backend.chunks[1]) >= 8*tsPacketSize && len(backend.events) > 0
+	})
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("relayStream = %v, want context.Canceled", err)
+	}
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if len(backend.gaps) != 1 {
+		t.Fatalf("gaps = %+v, want the one from the drop", backend.gaps)
+	}
+	gap := backend.gaps[0]
+	if gap.ToSequence <= gap.FromSequence && gap.LostBytes == 0 {
+		t.Errorf("gap = %+v, want lost frames or bytes", gap)
+	}
+	stats, _ := backend.rc.Stats("bridge-1")
+	if stats.Sessions != 1 || stats.Gaps != 1 || stats.LostBytes != gap.LostBytes {
+		t.Errorf("stats = %+v; one session and the gap expected", stats)
+	}
+
+	// The second connection starts where a decoder can: PAT, PMT, then the
+	// first packet of a keyframe.
+	resumed := backend.chunks[1]
+	for i := 0; i < len(resumed); i += tsPacketSize {
+		if resumed[i] != tsSyncByte {
+			t.Fatalf("resumed stream lost packet alignment at byte %d", i)
+		}
+	}
+	pid := func(pkt []byte) int { return int(pkt[1]&0x1f)<<8 | int(pkt[2]) }
+	keyframe := resumed[2*tsPacketSize:]
+	if pid(resumed) != 0 || pid(resumed[tsPacketSize:]) != testPMTPID || pid(keyframe) != testVideoPID || !randomAccess(keyframe) {
+		t.Errorf("resumed stream does not start with PAT, PMT and a keyframe")
+	}
+
+	ev := backend.events[0]
+	// The bridge counts the bytes it skipped to the keyframe; the receiver
+	// also misses whatever was in flight when the connection dropped.
+	if ev.State != "reconnected" || ev.LostBytes <= 0 || ev.LostBytes > gap.LostBytes {
+		t.Errorf("event = %+v, want lost bytes within the receiver's %d", ev, gap.LostBytes)
+	}
+	out := logs.String()
+	for _, want := range []string{"Relay protocol: " + relayframe.Protocol, "WARN: relay connection lost: ", "Relay reconnected after "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package relayframe implements the framed relay protocol: an optional body
+// format for the relay POST in which MPEG-TS is sent in frames that carry a
+// session id, a sequence number and a capture timestamp, so the receiver can
+// tell where a reconnected stream resumes and how much was lost.
+//
+// A bridge asks for the protocol by sending ProtocolHeader: Protocol on an
+// OPTIONS request to the relay endpoint. Only if the answer echoes the same
+// header does it send frames; any other backend keeps receiving raw MPEG-TS.
+package relayframe
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// Protocol is the value negotiated through ProtocolHeader.
+	Protocol = "difae-frames/1"
+	// ProtocolHeader carries the protocol on the probe, its answer and the POST.
+	ProtocolHeader = "X-Relay-Protocol"
+	// ContentType is sent on framed relay POSTs.
+	ContentType = "application/x-difae-relay-frames"
+
+	// PacketSize is the MPEG-TS packet size; payloads hold whole packets.
+	PacketSize = 188
+	// MaxPayload bounds a frame's payload.
+	MaxPayload = 1024 * PacketSize
+	// HeaderSize is the fixed size of a frame header.
+	HeaderSize = 52
+
+	version = 1
+)
+
+const (
+	// FlagResync marks the first frame after the sender skipped data, either
+	// to reach a keyframe after a reconnect or because its buffer overran.
+	FlagResync uint8 = 1 << iota
+	// FlagHeaders marks a payload of repeated PAT/PMT packets sent ahead of a
+	// resumed stream. It is not part of the stream at Offset.
+	FlagHeaders
+)
+
+var magic = [4]byte{'D', 'F', 'R', 'M'}
+
+// Session identifies one run of the bridge's encoder. Offsets and sequence
+// numbers are only comparable within a session.
+type Session [16]byte
+
+// NewSession returns a random session id.
+func NewSession() Session {
+	var s Session
+	if _, err := rand.Read(s[:]); err != nil {
+		panic(fmt.Sprintf("relayframe: failed to read random session id: %v", err))
+	}
+	return s
+}
+
+func (s Session) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+// Frame is one unit of the framed relay body.
+//
+// The header is HeaderSize bytes, big-endian: magic "DFRM", version, flags,
+// two reserved bytes, the 16-byte session, the sequence number (uint64), the
+// offset of the payload in the encoder's output (int64), the capture time in
+// Unix nanoseconds (int64) and the payload length (uint32).
+type Frame struct {
+	Session  Session
+	Sequence uint64
+	Offset   int64
+	Captured time.Time
+	Flags    uint8
+	Payload  []byte
+}
+
+// AppendTo appends the encoded frame to b.
+func (f *Frame) AppendTo(b []byte) []byte {
+	var h [HeaderSize]byte
+	copy(h[0:4], magic[:])
+	h[4] = version
+	h[5] = f.Flags
+	copy(h[8:24], f.Session[:])
+	binary.BigEndian.PutUint64(h[24:32], f.Sequence)
+	binary.BigEndian.PutUint64(h[32:40], uint64(f.Offset))
+	binary.BigEndian.PutUint64(h[40:48], uint64(f.Captured.UnixNano()))
+	binary.BigEndian.PutUint32(h[48:52], uint32(len(f.Payload)))
+	b = append(b, h[:]...)
+	return append(b, f.Payload...)
+}
+
+// ErrMalformed is wrapped by every decoding error other than a truncated
+// stream.
+var ErrMalformed = errors.New("malformed relay frame")
+
+// Reader decodes frames from a framed relay body.
+type Reader struct {
+	r      *bufio.Reader
+	header [HeaderSize]byte
+}
+
+// NewReader returns a Reader for r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next frame. It returns io.EOF at a clean end of the body
+// and io.ErrUnexpectedEOF if the body ends inside a frame. The payload is
+// freshly allocated for every frame.
+func (fr *Reader) Next() (Frame, error) {
+	if _, err := io.ReadFull(fr.r, fr.header[:]); err != nil {
+		return Frame{}, err
+	}
+	h := fr.header[:]
+	if [4]byte(h[0:4]) != magic {
+		return Frame{}, fmt.Errorf("%w: bad magic %q", ErrMalformed, h[0:4])
+	}
+	if h[4] != version {
+		return Frame{}, fmt.Errorf("%w: unsupported version %d", ErrMalformed, h[4])
+	}
+	size := binary.BigEndian.Uint32(h[48:52])
+	if size == 0 || size > MaxPayload || size%PacketSize != 0 {
+		return Frame{}, fmt.Errorf("%w: payload length %d is not a whole number of packets", ErrMalformed, size)
+	}
+
+	f := Frame{
+		Sequence: binary.BigEndian.Uint64(h[24:32]),
+		Offset:   int64(binary.BigEndian.Uint64(h[32:40])),
+		Captured: time.Unix(0, int64(binary.BigEndian.Uint64(h[40:48]))),
+		Flags:    h[5],
+		Payload:  make([]byte, size),
+	}
+	copy(f.Session[:], h[8:24])
+	if _, err := io.ReadFull(fr.r, f.Payload); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return Frame{}, err
+	}
+	for i := 0; i < len(f.Payload); i += PacketSize {
+		if f.Payload[i] != 0x47 {
+			return Frame{}, fmt.Errorf("%w: packet at payload byte %d has no sync byte", ErrMalformed, i)
+		}
+	}
+	return f, nil
+}
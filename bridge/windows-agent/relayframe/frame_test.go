@@ -0,0 +1,94 @@
+package relayframe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// packets returns n MPEG-TS packets whose payload bytes are all fill.
+func packets(n int, fill byte) []byte {
+	b := bytes.Repeat([]byte{fill}, n*PacketSize)
+	for i := 0; i < len(b); i += PacketSize {
+		b[i] = 0x47
+	}
+	return b
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	session := NewSession()
+	captured := time.Unix(1700000000, 123456789)
+	frames := []Frame{
+		{Session: session, Sequence: 0, Offset: 0, Captured: captured, Payload: packets(2, 1)},
+		{Session: session, Sequence: 1, Offset: 4096, Captured: captured, Flags: FlagHeaders | FlagResync, Payload: packets(1, 2)},
+		{Session: session, Sequence: 2, Offset: 4096, Captured: captured.Add(time.Second), Payload: packets(1024, 3)},
+	}
+	var body []byte
+	for i := range frames {
+		body = frames[i].AppendTo(body)
+	}
+
+	fr := NewReader(bytes.NewReader(body))
+	for i, want := range frames {
+		got, err := fr.Next()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if got.Session != want.Session || got.Sequence != want.Sequence || got.Offset != want.Offset ||
+			got.Flags != want.Flags || !got.Captured.Equal(want.Captured) || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("frame %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := fr.Next(); err != io.EOF {
+		t.Errorf("after the last frame: err = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	f := Frame{Session: NewSession(), Payload: packets(2, 1)}
+	body := f.AppendTo(nil)
+	for _, n := range []int{HeaderSize - 1, HeaderSize + PacketSize} {
+		_, err := NewReader(bytes.NewReader(body[:n])).Next()
+		if !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%d bytes: err = %v, want io.ErrUnexpectedEOF", n, err)
+		}
+	}
+}
+
+func TestReaderMalformed(t *testing.T) {
+	valid := func() []byte {
+		f := Frame{Session: NewSession(), Payload: packets(2, 1)}
+		return f.AppendTo(nil)
+	}
+	tests := []struct {
+		name   string
+		modify func(b []byte) []byte
+	}{
+		{"bad magic", func(b []byte) []byte { b[0] = 'X'; return b }},
+		{"unknown version", func(b []byte) []byte { b[4] = 2; return b }},
+		{"empty payload", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[48:52], 0)
+			return b[:HeaderSize]
+		}},
+		{"partial packet", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[48:52], PacketSize+1)
+			return append(b, 0)
+		}},
+		{"oversized payload", func(b []byte) []byte {
+			binary.BigEndian.PutUint32(b[48:52], MaxPayload+PacketSize)
+			return b
+		}},
+		{"lost sync", func(b []byte) []byte { b[HeaderSize+PacketSize] = 0; return b }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(bytes.NewReader(tt.modify(valid()))).Next()
+			if !errors.Is(err, ErrMalformed) {
+				t.Errorf("err = %v, want ErrMalformed", err)
+			}
+		})
+	}
+}
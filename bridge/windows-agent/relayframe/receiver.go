@@ -0,0 +1,195 @@
+package relayframe
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Gap describes data that never reached the receiver: frames lost in flight
+// when a connection dropped, bytes the sender skipped to resume at a
+// keyframe, or both.
+type Gap struct {
+	Session      Session
+	FromSequence uint64 // first sequence number expected
+	ToSequence   uint64 // sequence number received
+	LostBytes    int64  // encoder output between the expected and received offsets
+}
+
+// Stats summarises one bridge's framed stream.
+type Stats struct {
+	Session   Session
+	Sessions  int
+	Frames    int64
+	Bytes     int64
+	Gaps      int
+	LostBytes int64
+}
+
+// Tracker follows one bridge's frames across connections and reports gaps.
+// The zero value is ready to use.
+type Tracker struct {
+	stats   Stats
+	started bool
+	next    uint64
+	offset  int64
+}
+
+// Accept records f. It returns a Gap when sequence numbers or offsets were
+// skipped since the previous frame of the same session, and an error when f
+// cannot follow it at all. A new session id starts over without a gap, since
+// the encoder restarted.
+func (t *Tracker) Accept(f Frame) (*Gap, error) {
+	if !t.started || f.Session != t.stats.Session {
+		t.started = true
+		t.stats.Session = f.Session
+		t.stats.Sessions++
+		t.next = f.Sequence
+		t.offset = f.Offset
+	}
+	if f.Sequence < t.next {
+		return nil, fmt.Errorf("session %s: sequence %d repeats or goes back (expected %d)", f.Session, f.Sequence, t.next)
+	}
+	if f.Flags&FlagHeaders == 0 && f.Offset < t.offset {
+		return nil, fmt.Errorf("session %s: offset %d goes back (expected %d)", f.Session, f.Offset, t.offset)
+	}
+
+	var gap *Gap
+	lost := int64(0)
+	if f.Offset > t.offset {
+		lost = f.Offset - t.offset
+	}
+	if f.Sequence > t.next || lost > 0 {
+		gap = &Gap{Session: f.Session, FromSequence: t.next, ToSequence: f.Sequence, LostBytes: lost}
+		t.stats.Gaps++
+		t.stats.LostBytes += lost
+	}
+
+	t.next = f.Sequence + 1
+	if f.Flags&FlagHeaders == 0 {
+		t.offset = f.Offset + int64(len(f.Payload))
+	} else if f.Offset > t.offset {
+		t.offset = f.Offset
+	}
+	t.stats.Frames++
+	t.stats.Bytes += int64(len(f.Payload))
+	return gap, nil
+}
+
+// Stats returns what the tracker has seen so far.
+func (t *Tracker) Stats() Stats {
+	return t.stats
+}
+
+// Receiver is a reference relay endpoint that understands both the framed
+// protocol and raw MPEG-TS. Bridges are told apart by X-Bridge-Id.
+type Receiver struct {
+	// Sink, if set, returns where a bridge's MPEG-TS is written. Framed
+	// payloads, including repeated PAT/PMT, are written unwrapped, so both
+	// protocols produce the same stream.
+	Sink func(bridgeID string) io.Writer
+	// OnGap, if set, is called for every gap in a framed stream.
+	OnGap func(bridgeID string, gap Gap)
+
+	mu       sync.Mutex
+	trackers map[string]*Tracker
+}
+
+// Stats returns the framed-stream statistics for a bridge.
+func (rc *Receiver) Stats(bridgeID string) (Stats, bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	t, ok := rc.trackers[bridgeID]
+	if !ok {
+		return Stats{}, false
+	}
+	return t.Stats(), true
+}
+
+func (rc *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodOptions:
+		if r.Header.Get(ProtocolHeader) == Protocol {
+			w.Header().Set(ProtocolHeader, Protocol)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "OPTIONS, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	bridgeID := r.Header.Get("X-Bridge-Id")
+	sink := io.Discard
+	if rc.Sink != nil {
+		if s := rc.Sink(bridgeID); s != nil {
+			sink = s
+		}
+	}
+
+	// Answer straight away, as the production backend does, so the bridge
+	// knows the stream was accepted while it is still sending.
+	_ = http.NewResponseController(w).EnableFullDuplex()
+	w.WriteHeader(http.StatusOK)
+	_ = http.NewResponseController(w).Flush()
+
+	if r.Header.Get(ProtocolHeader) != Protocol {
+		_, _ = io.Copy(sink, r.Body)
+		return
+	}
+
+	fr := NewReader(r.Body)
+	for {
+		f, err := fr.Next()
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+				writeError(w, err)
+			}
+			return
+		}
+		gap, err := rc.accept(bridgeID, f)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if gap != nil && rc.OnGap != nil {
+			rc.OnGap(bridgeID, *gap)
+		}
+		if _, err := sink.Write(f.Payload); err != nil {
+			return
+		}
+	}
+}
+
+// ErrorMessage is written on the response body, as a line of JSON like the
+// backend's control messages, when the receiver rejects a framed stream. The
+// status is already 200 by then, so this is the only way to tell the bridge.
+type ErrorMessage struct {
+	Type  string `json:"type"` // always "error"
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	line, _ := json.Marshal(ErrorMessage{Type: "error", Error: err.Error()})
+	_, _ = w.Write(append(line, '\n'))
+	_ = http.NewResponseController(w).Flush()
+}
+
+func (rc *Receiver) accept(bridgeID string, f Frame) (*Gap, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.trackers == nil {
+		rc.trackers = make(map[string]*Tracker)
+	}
+	t, ok := rc.trackers[bridgeID]
+	if !ok {
+		t = &Tracker{}
+		rc.trackers[bridgeID] = t
+	}
+	return t.Accept(f)
+}
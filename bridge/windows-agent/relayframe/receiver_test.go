@@ -0,0 +1,302 @@
+package relayframe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	s1, s2 := NewSession(), NewSession()
+	frame := func(s Session, seq uint64, offset int64, flags uint8, n int) Frame {
+		return Frame{Session: s, Sequence: seq, Offset: offset, Flags: flags, Payload: packets(n, 1)}
+	}
+	const p = PacketSize
+	tests := []struct {
+		name    string
+		frames  []Frame
+		gaps    []Gap
+		wantErr string
+		stats   Stats
+	}{
+		{
+			name:   "in order",
+			frames: []Frame{frame(s1, 0, 0, 0, 2), frame(s1, 1, 2*p, 0, 1), frame(s1, 2, 3*p, 0, 1)},
+			stats:  Stats{Session: s1, Sessions: 1, Frames: 3, Bytes: 4 * p},
+		},
+		{
+			// Frame 1 was lost in flight.
+			name:   "sequence gap",
+			frames: []Frame{frame(s1, 0, 0, 0, 2), frame(s1, 2, 3*p, 0, 1)},
+			gaps:   []Gap{{Session: s1, FromSequence: 1, ToSequence: 2, LostBytes: p}},
+			stats:  Stats{Session: s1, Sessions: 1, Frames: 2, Bytes: 3 * p, Gaps: 1, LostBytes: p},
+		},
+		{
+			// The sender skipped to a keyframe: repeated PAT/PMT first, then
+			// the stream resumes further on without a lost sequence number.
+			name: "resync",
+			frames: []Frame{
+				frame(s1, 0, 0, 0, 2),
+				frame(s1, 1, 10*p, FlagHeaders|FlagResync, 2),
+				frame(s1, 2, 10*p, 0, 1),
+			},
+			gaps:  []Gap{{Session: s1, FromSequence: 1, ToSequence: 1, LostBytes: 8 * p}},
+			stats: Stats{Session: s1, Sessions: 1, Frames: 3, Bytes: 5 * p, Gaps: 1, LostBytes: 8 * p},
+		},
+		{
+			name:   "new session",
+			frames: []Frame{frame(s1, 0, 0, 0, 2), frame(s1, 1, 2*p, 0, 1), frame(s2, 0, 0, 0, 1)},
+			stats:  Stats{Session: s2, Sessions: 2, Frames: 3, Bytes: 4 * p},
+		},
+		{
+			name:    "duplicate",
+			frames:  []Frame{frame(s1, 0, 0, 0, 2), frame(s1, 1, 2*p, 0, 1), frame(s1, 1, 2*p, 0, 1)},
+			wantErr: "sequence 1 repeats or goes back (expected 2)",
+			stats:   Stats{Session: s1, Sessions: 1, Frames: 2, Bytes: 3 * p},
+		},
+		{
+			name:    "offset goes back",
+			frames:  []Frame{frame(s1, 0, 0, 0, 2), frame(s1, 1, p, 0, 1)},
+			wantErr: "offset 188 goes back (expected 376)",
+			stats:   Stats{Session: s1, Sessions: 1, Frames: 1, Bytes: 2 * p},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tr Tracker
+			var gaps []Gap
+			var err error
+			for _, f := range tt.frames {
+				var gap *Gap
+				if gap, err = tr.Accept(f); err != nil {
+					break
+				}
+				if gap != nil {
+					gaps = append(gaps, *gap)
+				}
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, tt.wantErr)
+			}
+			if len(gaps) != len(tt.gaps) {
+				t.Fatalf("gaps = %+v, want %+v", gaps, tt.gaps)
+			}
+			for i := range gaps {
+				if gaps[i] != tt.gaps[i] {
+					t.Errorf("gap %d = %+v, want %+v", i, gaps[i], tt.gaps[i])
+				}
+			}
+			if got := tr.Stats(); got != tt.stats {
+				t.Errorf("stats = %+v, want %+v", got, tt.stats)
+			}
+		})
+	}
+}
+
+// testReceiver serves a Receiver that records each bridge's stream and gaps.
+type testReceiver struct {
+	rc   Receiver
+	srv  *httptest.Server
+	mu   sync.Mutex
+	sink bytes.Buffer
+	gaps []Gap
+}
+
+func newTestReceiver(t *testing.T) *testReceiver {
+	tr := &testReceiver{}
+	tr.rc.Sink = func(bridgeID string) io.Writer {
+		if bridgeID != "bridge-1" {
+			t.Errorf("bridge id = %q", bridgeID)
+		}
+		return tr
+	}
+	tr.rc.OnGap = func(bridgeID string, gap Gap) {
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		tr.gaps = append(tr.gaps, gap)
+	}
+	tr.srv = httptest.NewServer(&tr.rc)
+	t.Cleanup(tr.srv.Close)
+	return tr
+}
+
+func (tr *testReceiver) Write(p []byte) (int, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return tr.sink.Write(p)
+}
+
+func (tr *testReceiver) received() ([]byte, []Gap) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	return append([]byte(nil), tr.sink.Bytes()...), append([]Gap(nil), tr.gaps...)
+}
+
+// post sends body as one relay POST and returns the response body.
+func (tr *testReceiver) post(t *testing.T, framed bool, body []byte) string {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, tr.srv.URL, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Bridge-Id", "bridge-1")
+	if framed {
+		req.Header.Set("Content-Type", ContentType)
+		req.Header.Set(ProtocolHeader, Protocol)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	return string(data)
+}
+
+func TestReceiverNegotiation(t *testing.T) {
+	tr := newTestReceiver(t)
+	for _, offer := range []string{Protocol, "", "difae-frames/2"} {
+		req, _ := http.NewRequest(http.MethodOptions, tr.srv.URL, nil)
+		if offer != "" {
+			req.Header.Set(ProtocolHeader, offer)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		want := ""
+		if offer == Protocol {
+			want = Protocol
+		}
+		if got := resp.Header.Get(ProtocolHeader); got != want {
+			t.Errorf("offer %q: answer = %q, want %q", offer, got, want)
+		}
+	}
+
+	resp, err := http.Get(tr.srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET status = %d, want 405", resp.StatusCode)
+	}
+}
+
+func TestReceiverRaw(t *testing.T) {
+	tr := newTestReceiver(t)
+	body := packets(3, 7)
+	if answer := tr.post(t, false, body); answer != "" {
+		t.Errorf("answer = %q", answer)
+	}
+	got, _ := tr.received()
+	if !bytes.Equal(got, body) {
+		t.Errorf("sink got %d bytes, want the %d sent", len(got), len(body))
+	}
+	if _, ok := tr.rc.Stats("bridge-1"); ok {
+		t.Error("raw stream has framed statistics")
+	}
+}
+
+// TestReceiverResync sends a stream over two connections, the first of
+// which loses its last frame, and checks the receiver reports the gap and
+// writes the same stream a raw receiver would.
+func TestReceiverResync(t *testing.T) {
+	tr := newTestReceiver(t)
+	session := NewSession()
+	now := time.Now()
+	const p = PacketSize
+	encode := func(frames ...Frame) []byte {
+		var b []byte
+		for i := range frames {
+			frames[i].Session = session
+			frames[i].Captured = now
+			b = frames[i].AppendTo(b)
+		}
+		return b
+	}
+
+	// Frame 2 (offset 3p, 2 packets) never arrives; the bridge then resumed
+	// at a keyframe at 8p, sending the PAT/PMT first.
+	first := encode(
+		Frame{Sequence: 0, Offset: 0, Payload: packets(2, 1)},
+		Frame{Sequence: 1, Offset: 2 * p, Payload: packets(1, 2)},
+	)
+	second := encode(
+		Frame{Sequence: 3, Offset: 8 * p, Flags: FlagHeaders | FlagResync, Payload: packets(2, 9)},
+		Frame{Sequence: 4, Offset: 8 * p, Payload: packets(3, 3)},
+	)
+	if answer := tr.post(t, true, first); answer != "" {
+		t.Errorf("first answer = %q", answer)
+	}
+	if answer := tr.post(t, true, second); answer != "" {
+		t.Errorf("second answer = %q", answer)
+	}
+
+	got, gaps := tr.received()
+	want := append(append(append(packets(2, 1), packets(1, 2)...), packets(2, 9)...), packets(3, 3)...)
+	if !bytes.Equal(got, want) {
+		t.Errorf("sink got %d bytes, want %d", len(got), len(want))
+	}
+	wantGap := Gap{Session: session, FromSequence: 2, ToSequence: 3, LostBytes: 5 * p}
+	if len(gaps) != 1 || gaps[0] != wantGap {
+		t.Errorf("gaps = %+v, want %+v", gaps, wantGap)
+	}
+	stats, ok := tr.rc.Stats("bridge-1")
+	want2 := Stats{Session: session, Sessions: 1, Frames: 4, Bytes: 8 * p, Gaps: 1, LostBytes: 5 * p}
+	if !ok || stats != want2 {
+		t.Errorf("stats = %+v, want %+v", stats, want2)
+	}
+}
+
+func TestReceiverRejectsDuplicate(t *testing.T) {
+	tr := newTestReceiver(t)
+	session := NewSession()
+	var body []byte
+	for _, seq := range []uint64{0, 1, 1, 2} {
+		f := Frame{Session: session, Sequence: seq, Offset: int64(seq) * PacketSize, Captured: time.Now(), Payload: packets(1, byte(seq))}
+		body = f.AppendTo(body)
+	}
+
+	answer := tr.post(t, true, body)
+	scanner := bufio.NewScanner(strings.NewReader(answer))
+	if !scanner.Scan() {
+		t.Fatalf("answer = %q, want an error message", answer)
+	}
+	var msg ErrorMessage
+	if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+		t.Fatalf("answer %q is not JSON: %v", answer, err)
+	}
+	if msg.Type != "error" || !strings.Contains(msg.Error, "sequence 1 repeats") {
+		t.Errorf("message = %+v", msg)
+	}
+
+	// The stream stops at the duplicate.
+	got, _ := tr.received()
+	if want := append(packets(1, 0), packets(1, 1)...); !bytes.Equal(got, want) {
+		t.Errorf("sink got %d bytes, want %d", len(got), len(want))
+	}
+}
+
+func TestReceiverRejectsMalformed(t *testing.T) {
+	tr := newTestReceiver(t)
+	answer := tr.post(t, true, packets(2, 0))
+	var msg ErrorMessage
+	if err := json.Unmarshal([]byte(strings.TrimSpace(answer)), &msg); err != nil || msg.Type != "error" || !strings.Contains(msg.Error, "bad magic") {
+		t.Errorf("answer = %q, want a bad magic error", answer)
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// maxESFrameBytes bounds one reassembled PES packet.
+const maxESFrameBytes = 8 << 20
+
+// MPEG-TS stream types the server can packetize.
+const (
+	streamH264 = 0x1b
+	streamH265 = 0x24
+	streamAAC  = 0x0f
+)
+
+// esFrame is one PES packet: an access unit of video, or one or more ADTS
+// frames of audio.
+type esFrame struct {
+	pid  int
+	pts  int64 // 90 kHz
+	data []byte
+}
+
+type pesStream struct {
+	streamType byte
+	buf        []byte
+	pts        int64
+	started    bool
+}
+
+// tsDemuxer reads frames of the first video and first audio stream of the
+// first program from MPEG-TS.
+type tsDemuxer struct {
+	r       *bufio.Reader
+	pkt     []byte
+	pmtPID  int
+	video   int
+	audio   int
+	streams map[int]*pesStream
+}
+
+func newTSDemuxer(r io.Reader) *tsDemuxer {
+	return &tsDemuxer{
+		r:       bufio.NewReaderSize(r, 64*tsPacketSize),
+		pkt:     make([]byte, tsPacketSize),
+		pmtPID:  -1,
+		video:   -1,
+		audio:   -1,
+		streams: map[int]*pesStream{},
+	}
+}
+
+// streamType returns the stream type of pid, or 0 when it is not demuxed.
+func (d *tsDemuxer) streamType(pid int) byte {
+	if s := d.streams[pid]; s != nil {
+		return s.streamType
+	}
+	return 0
+}
+
+// next returns the next complete frame. A frame is complete when the next
+// PES packet of its stream starts, so it is returned one frame late.
+func (d *tsDemuxer) next() (esFrame, error) {
+	for {
+		if _, err := io.ReadFull(d.r, d.pkt); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			return esFrame{}, err
+		}
+		pkt := d.pkt
+		if pkt[0] != tsSyncByte {
+			// The fan-out buffer only holds whole packets.
+			continue
+		}
+		pusi := pkt[1]&0x40 != 0
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		payload := tsPayload(pkt)
+		if payload == nil {
+			continue
+		}
+
+		switch {
+		case pid == 0:
+			if pusi {
+				d.parsePAT(payload)
+			}
+		case pid == d.pmtPID:
+			if pusi {
+				d.parsePMT(payload)
+			}
+		default:
+			s := d.streams[pid]
+			if s == nil {
+				continue
+			}
+			if !pusi {
+				if s.started && len(s.buf)+len(payload) <= maxESFrameBytes {
+					s.buf = append(s.buf, payload...)
+				}
+				continue
+			}
+			var done esFrame
+			complete := s.started && len(s.buf) > 0
+			if complete {
+				done = esFrame{pid: pid, pts: s.pts, data: s.buf}
+			}
+			s.buf, s.started = nil, false
+			if pts, data, ok := parsePES(payload); ok {
+				s.pts, s.started = pts, true
+				s.buf = append(make([]byte, 0, 64<<10), data...)
+			}
+			if complete {
+				return done, nil
+			}
+		}
+	}
+}
+
+// tsPayload returns the payload of a TS packet, or nil when it has none.
+func tsPayload(pkt []byte) []byte {
+	afc := pkt[3] >> 4 & 0x3
+	if afc&0x1 == 0 {
+		return nil
+	}
+	off := 4
+	if afc&0x2 != 0 {
+		off += 1 + int(pkt[4])
+	}
+	if off >= tsPacketSize {
+		return nil
+	}
+	return pkt[off:]
+}
+
+// psiSection returns the PSI section that starts in payload, after its pointer
+// field, bounded by its section_length and without the CRC.
+func psiSection(payload []byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 {
+		return nil
+	}
+	end := 3 + (int(s[1]&0x0f)<<8 | int(s[2]))
+	if end > len(s) || end < 12 {
+		return nil
+	}
+	return s[:end-4]
+}
+
+func (d *tsDemuxer) parsePAT(payload []byte) {
+	s := psiSection(payload)
+	for i := 8; i+4 <= len(s); i += 4 {
+		program := int(s[i])<<8 | int(s[i+1])
+		if program != 0 {
+			d.pmtPID = int(s[i+2]&0x1f)<<8 | int(s[i+3])
+			return
+		}
+	}
+}
+
+func (d *tsDemuxer) parsePMT(payload []byte) {
+	s := psiSection(payload)
+	if len(s) < 12 || s[0] != 0x02 {
+		return
+	}
+	i := 12 + (int(s[10]&0x0f)<<8 | int(s[11]))
+	for i+5 <= len(s) {
+		streamType := s[i]
+		pid := int(s[i+1]&0x1f)<<8 | int(s[i+2])
+		i += 5 + (int(s[i+3]&0x0f)<<8 | int(s[i+4]))
+		switch streamType {
+		case streamH264, streamH265:
+			if d.video < 0 {
+				d.video = pid
+				d.streams[pid] = &pesStream{streamType: streamType}
+			}
+		case streamAAC:
+			if d.audio < 0 {
+				d.audio = pid
+				d.streams[pid] = &pesStream{streamType: streamType}
+			}
+		}
+	}
+}
+
+// parsePES returns the PTS and the start of the payload of a PES packet.
+func parsePES(b []byte) (int64, []byte, bool) {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return 0, nil, false
+	}
+	hdr := 9 + int(b[8])
+	if hdr > len(b) || b[7]&0x80 == 0 || len(b) < 14 {
+		return 0, nil, false
+	}
+	p := b[9:14]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	return pts, b[hdr:], true
+}
+
+// maxRTPPayload keeps RTP packets under a typical MTU, as clients that relay
+// the stream over UDP expect, even though the server only sends over TCP.
+const maxRTPPayload = 1400
+
+const (
+	rtpPayloadVideo = 96
+	rtpPayloadAudio = 97
+)
+
+// rtspTrack is one media stream of the description, with what the SDP needs.
+type rtspTrack struct {
+	pid        int
+	streamType byte
+	clockRate  int
+	rtpmap     string
+	fmtp       string
+}
+
+// aacSampleRates indexes the ADTS sampling frequency index.
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// trackDescriber collects the codec parameters of the streams from the first
+// frames: the parameter sets in front of a keyframe, and an ADTS header.
+type trackDescriber struct {
+	sps, pps, vps []byte
+	video, audio  *rtspTrack
+}
+
+// add inspects f and reports whether every stream is now described.
+func (d *trackDescriber) add(dmx *tsDemuxer, f esFrame) bool {
+	switch st := dmx.streamType(f.pid); st {
+	case streamH264, streamH265:
+		if d.video == nil {
+			d.addVideo(f, st)
+		}
+	case streamAAC:
+		if d.audio == nil {
+			d.addAudio(f)
+		}
+	}
+	return d.video != nil && (dmx.audio < 0 || d.audio != nil)
+}
+
+func (d *trackDescriber) addVideo(f esFrame, st byte) {
+	for _, nal := range splitNALs(f.data) {
+		if len(nal) < 2 {
+			continue
+		}
+		if st == streamH264 {
+			switch nal[0] & 0x1f {
+			case 7:
+				d.sps = nal
+			case 8:
+				d.pps = nal
+			}
+			continue
+		}
+		switch nal[0] >> 1 & 0x3f {
+		case 32:
+			d.vps = nal
+		case 33:
+			d.sps = nal
+		case 34:
+			d.pps = nal
+		}
+	}
+	if d.sps == nil || d.pps == nil || (st == streamH265 && d.vps == nil) {
+		return
+	}
+
+	b64 := base64.StdEncoding.EncodeToString
+	t := &rtspTrack{pid: f.pid, streamType: st, clockRate: 90000}
+	if st == streamH264 {
+		t.rtpmap = fmt.Sprintf("%d H264/90000", rtpPayloadVideo)
+		t.fmtp = fmt.Sprintf("%d packetization-mode=1", rtpPayloadVideo)
+		if len(d.sps) >= 4 {
+			t.fmtp += ";profile-level-id=" + strings.ToUpper(hex.EncodeToString(d.sps[1:4]))
+		}
+		t.fmtp += ";sprop-parameter-sets=" + b64(d.sps) + "," + b64(d.pps)
+	} else {
+		t.rtpmap = fmt.Sprintf("%d H265/90000", rtpPayloadVideo)
+		t.fmtp = fmt.Sprintf("%d sprop-vps=%s;sprop-sps=%s;sprop-pps=%s", rtpPayloadVideo, b64(d.vps), b64(d.sps), b64(d.pps))
+	}
+	d.video = t
+}
+
+func (d *trackDescriber) addAudio(f esFrame) {
+	if len(f.data) < 7 || f.data[0] != 0xff || f.data[1]&0xf0 != 0xf0 {
+		return
+	}
+	objectType := int(f.data[2]>>6) + 1
+	rateIndex := int(f.data[2] >> 2 & 0x0f)
+	channels := int(f.data[2]&0x01)<<2 | int(f.data[3]>>6)
+	if rateIndex >= len(aacSampleRates) {
+		return
+	}
+	rate := aacSampleRates[rateIndex]
+	config := uint16(objectType)<<11 | uint16(rateIndex)<<7 | uint16(channels)<<3
+	d.audio = &rtspTrack{
+		pid:        f.pid,
+		streamType: streamAAC,
+		clockRate:  rate,
+		rtpmap:     fmt.Sprintf("%d mpeg4-generic/%d/%d", rtpPayloadAudio, rate, channels),
+		fmtp: fmt.Sprintf("%d profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%04X",
+			rtpPayloadAudio, config),
+	}
+}
+
+// tracks returns the described tracks, video first.
+func (d *trackDescriber) tracks() []*rtspTrack {
+	out := []*rtspTrack{d.video}
+	if d.audio != nil {
+		out = append(out, d.audio)
+	}
+	return out
+}
+
+// buildSDP returns the session description served by DESCRIBE. Track n is
+// controlled as "trackID=n" relative to the Content-Base.
+func buildSDP(tracks []*rtspTrack, name, host string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "v=0\r\no=- 0 0 IN IP4 %s\r\ns=%s\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\na=range:npt=now-\r\n", host, name)
+	for i, t := range tracks {
+		media, pt := "video", rtpPayloadVideo
+		if t.streamType == streamAAC {
+			media, pt = "audio", rtpPayloadAudio
+		}
+		fmt.Fprintf(&b, "m=%s 0 RTP/AVP %d\r\na=rtpmap:%s\r\na=fmtp:%s\r\na=control:trackID=%d\r\n", media, pt, t.rtpmap, t.fmtp, i)
+	}
+	return b.Bytes()
+}
+
+// splitNALs splits an Annex B byte stream into NAL units.
+func splitNALs(b []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nals = append(nals, trimTrailingZeros(b[start:i]))
+		}
+		i += 2
+		start = i + 1
+	}
+	if start >= 0 && start < len(b) {
+		nals = append(nals, b[start:])
+	}
+	return nals
+}
+
+// trimTrailingZeros drops the leading zero of a four-byte start code that follows.
+func trimTrailingZeros(nal []byte) []byte {
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	return nal
+}
+
+// rtpPacketizer turns the frames of one track into RTP packets.
+type rtpPacketizer struct {
+	track   *rtspTrack
+	ssrc    uint32
+	seq     uint16
+	tsBase  uint32
+	payload byte
+}
+
+// packets returns the RTP packets of f. A video access unit ends with the
+// marker bit; each audio packet carries one AAC frame.
+func (p *rtpPacketizer) packets(f esFrame) [][]byte {
+	if p.track.streamType == streamAAC {
+		return p.audioPackets(f)
+	}
+
+	ts := p.tsBase + uint32(f.pts)
+	var nals [][]byte
+	for _, nal := range splitNALs(f.data) {
+		if len(nal) == 0 || p.accessUnitDelimiter(nal) {
+			continue
+		}
+		nals = append(nals, nal)
+	}
+	var out [][]byte
+	for i, nal := range nals {
+		last := i == len(nals)-1
+		if len(nal) <= maxRTPPayload {
+			out = append(out, p.packet(ts, last, nal))
+			continue
+		}
+		out = append(out, p.fragments(ts, last, nal)...)
+	}
+	return out
+}
+
+func (p *rtpPacketizer) accessUnitDelimiter(nal []byte) bool {
+	if p.track.streamType == streamH264 {
+		return nal[0]&0x1f == 9
+	}
+	return nal[0]>>1&0x3f == 35
+}
+
+// fragments splits a large NAL unit into FU-A (H.264) or FU (H.265) packets.
+func (p *rtpPacketizer) fragments(ts uint32, last bool, nal []byte) [][]byte {
+	var header []byte
+	var fuType byte
+	if p.track.streamType == streamH264 {
+		header = []byte{nal[0]&0xe0 | 28}
+		fuType = nal[0] & 0x1f
+		nal = nal[1:]
+	} else {
+		header = []byte{nal[0]&0x81 | 49<<1, nal[1]}
+		fuType = nal[0] >> 1 & 0x3f
+		nal = nal[2:]
+	}
+
+	chunk := maxRTPPayload - len(header) - 1
+	var out [][]byte
+	for first := true; len(nal) > 0; first = false {
+		n := chunk
+		if n > len(nal) {
+			n = len(nal)
+		}
+		fu := fuType
+		if first {
+			fu |= 0x80
+		}
+		end := n == len(nal)
+		if end {
+			fu |= 0x40
+		}
+		payload := make([]byte, 0, len(header)+1+n)
+		payload = append(append(append(payload, header...), fu), nal[:n]...)
+		out = append(out, p.packet(ts, last && end, payload))
+		nal = nal[n:]
+	}
+	return out
+}
+
+// audioPackets packs each ADTS frame of f as one AAC-hbr access unit.
+func (p *rtpPacketizer) audioPackets(f esFrame) [][]byte {
+	ts := p.tsBase + uint32(f.pts*int64(p.track.clockRate)/90000)
+	var out [][]byte
+	data := f.data
+	for len(data) >= 7 && data[0] == 0xff && data[1]&0xf0 == 0xf0 {
+		header := 7
+		if data[1]&0x01 == 0 {
+			header = 9 // with CRC
+		}
+		size := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		if size < header || size > len(data) {
+			break
+		}
+		au := data[header:size]
+		payload := make([]byte, 4, 4+len(au))
+		binary.BigEndian.PutUint16(payload, 16)
+		binary.BigEndian.PutUint16(payload[2:], uint16(len(au))<<3)
+		out = append(out, p.packet(ts, true, append(payload, au...)))
+		ts += 1024
+		data = data[size:]
+	}
+	return out
+}
+
+func (p *rtpPacketizer) packet(ts uint32, marker bool, payload []byte) []byte {
+	b := make([]byte, 12, 12+len(payload))
+	b[0] = 0x80
+	b[1] = p.payload
+	if marker {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], p.seq)
+	binary.BigEndian.PutUint32(b[4:], ts)
+	binary.BigEndian.PutUint32(b[8:], p.ssrc)
+	p.seq++
+	return append(b, payload...)
+}
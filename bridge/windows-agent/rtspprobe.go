@@ -0,0 +1,780 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rtspProbeTimeout bounds a whole probe, redirects included.
+const rtspProbeTimeout = 10 * time.Second
+
+const (
+	maxRTSPRedirects    = 3
+	maxRTSPResponseBody = 1 << 20
+	rtspProbeUserAgent  = "DIFAE Bridge"
+)
+
+// The errors a probe can settle on. Anything else, such as an unexpected
+// status or a malformed answer, may be the probe's fault rather than the
+// camera's; see conclusiveProbeError.
+var (
+	errCameraUnauthorized = errors.New("the camera rejected the credentials")
+	errCameraNotFound     = errors.New("the camera has no stream at this path")
+	errCameraTimeout      = errors.New("the camera did not answer in time")
+	errCameraUnreachable  = errors.New("the camera is unreachable")
+	errCameraNoVideo      = errors.New("the camera's stream has no video track")
+)
+
+// cameraProbe is what the camera reported.
+type cameraProbe struct {
+	server  string
+	methods []string
+	// auth is the scheme the camera asked for ("basic" or "digest"), or
+	// empty when it served the stream without credentials.
+	auth   string
+	tracks []probeTrack
+}
+
+// Video returns the first video track, or nil.
+func (r *cameraProbe) video() *probeTrack {
+	for i := range r.tracks {
+		if r.tracks[i].media == "video" {
+			return &r.tracks[i]
+		}
+	}
+	return nil
+}
+
+func (r *cameraProbe) String() string {
+	parts := make([]string, 0, len(r.tracks))
+	for _, t := range r.tracks {
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// conclusiveProbeError reports whether err says the session cannot work, so
+// there is no point in starting ffmpeg. Other errors are worth letting
+// ffmpeg try.
+func conclusiveProbeError(err error) bool {
+	return errors.Is(err, errCameraUnauthorized) || errors.Is(err, errCameraNotFound) ||
+		errors.Is(err, errCameraTimeout) || errors.Is(err, errCameraUnreachable) || errors.Is(err, errCameraNoVideo)
+}
+
+// probeCamera describes the stream at rawURL, an rtsp:// URL that may carry
+// credentials. It gives up after rtspProbeTimeout.
+func probeCamera(ctx context.Context, rawURL string) (*cameraProbe, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP URL: %w", err)
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, rtspProbeTimeout)
+	defer cancel()
+
+	for redirects := 0; ; redirects++ {
+		result, location, err := probeCameraOnce(probeCtx, u)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if location == nil {
+			return result, nil
+		}
+		if redirects == maxRTSPRedirects {
+			return nil, fmt.Errorf("more than %d redirects from %s", maxRTSPRedirects, maskPassword(u.String()))
+		}
+		if location.User == nil && location.Host == u.Host {
+			location.User = u.User
+		}
+		u = location
+	}
+}
+
+// checkCamera probes the camera before FFmpeg is launched, so a wrong
+// password or path fails the session at once with a precise error. A probe
+// that is merely inconclusive leaves the verdict to FFmpeg.
+func checkCamera(ctx context.Context, rtspURL string, logger *log.Logger) error {
+	result, err := probeCamera(ctx, rtspURL)
+	switch {
+	case err == nil:
+		logger.Printf("Camera answered: %s", result)
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case conclusiveProbeError(err):
+		return fmt.Errorf("camera check failed: %w", err)
+	default:
+		logger.Printf("WARN: camera check inconclusive, starting FFmpeg anyway: %v", err)
+	}
+	return nil
+}
+
+// runProbeCommand checks the configured camera stream, or rawURL when
+// given, the way every session does, and prints what the camera reports.
+func runProbeCommand(ctx context.Context, configPath, rawURL string, out io.Writer) error {
+	if rawURL == "" {
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			return err
+		}
+		rawURL = cfg.rtspURL
+	}
+
+	fmt.Fprintf(out, "Camera:  %s\n", maskPassword(rawURL))
+	result, err := probeCamera(ctx, rawURL)
+	if err != nil {
+		return err
+	}
+	if result.server != "" {
+		fmt.Fprintf(out, "Server:  %s\n", result.server)
+	}
+	if result.auth != "" {
+		fmt.Fprintf(out, "Auth:    %s\n", result.auth)
+	}
+	for i, t := range result.tracks {
+		fmt.Fprintf(out, "Track %d: %s %s\n", i, t.media, t)
+	}
+	return nil
+}
+
+// probeCameraOnce runs one connection's exchange. A redirect is returned as the
+// location to probe next.
+func probeCameraOnce(ctx context.Context, u *url.URL) (*cameraProbe, *url.URL, error) {
+	if !strings.EqualFold(u.Scheme, "rtsp") {
+		return nil, nil, fmt.Errorf("%s:// URLs cannot be probed", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), strconv.Itoa(defaultRtspPort))
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("%w (no connection to %s)", errCameraTimeout, host)
+		}
+		return nil, nil, fmt.Errorf("%w: %v", errCameraUnreachable, err)
+	}
+	defer nc.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { nc.SetDeadline(time.Now()) })
+	defer stop()
+
+	c := &rtspProbeClient{nc: nc, br: bufio.NewReader(nc), uri: rtspRequestURI(u)}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	result := &cameraProbe{}
+	resp, err := c.do(ctx, "OPTIONS", c.uri, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// OPTIONS is only informative; cameras answer it in many odd ways.
+	result.server = resp.header.Get("Server")
+	for _, m := range strings.Split(resp.header.Get("Public"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			result.methods = append(result.methods, m)
+		}
+	}
+
+	resp, err = c.do(ctx, "DESCRIBE", c.uri, [][2]string{{"Accept", "application/sdp"}})
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.server == "" {
+		result.server = resp.header.Get("Server")
+	}
+	result.auth = c.scheme
+	switch {
+	case resp.code == 200:
+	case resp.code == 401:
+		if c.username == "" {
+			return nil, nil, fmt.Errorf("%w: it requires a username and password", errCameraUnauthorized)
+		}
+		return nil, nil, fmt.Errorf("%w (%s)", errCameraUnauthorized, resp.status())
+	case resp.code == 404:
+		return nil, nil, fmt.Errorf("%w: %s (%s)", errCameraNotFound, u.Path, resp.status())
+	case resp.code == 301 || resp.code == 302 || resp.code == 303 || resp.code == 307:
+		location, err := u.Parse(resp.header.Get("Location"))
+		if err != nil || resp.header.Get("Location") == "" {
+			return nil, nil, fmt.Errorf("DESCRIBE redirected without a valid Location (%s)", resp.status())
+		}
+		return nil, location, nil
+	default:
+		return nil, nil, fmt.Errorf("DESCRIBE answered %s", resp.status())
+	}
+
+	if ct := resp.header.Get("Content-Type"); !strings.HasPrefix(strings.ToLower(ct), "application/sdp") {
+		return nil, nil, fmt.Errorf("DESCRIBE answered %q instead of SDP", ct)
+	}
+	result.tracks = parseSDPTracks(resp.body)
+	if result.video() == nil {
+		return nil, nil, errCameraNoVideo
+	}
+	return result, nil, nil
+}
+
+// rtspRequestURI returns u as sent on the request line, without credentials.
+func rtspRequestURI(u *url.URL) string {
+	c := *u
+	c.User = nil
+	return c.String()
+}
+
+type rtspResponse struct {
+	code   int
+	reason string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (r *rtspResponse) status() string {
+	return fmt.Sprintf("%d %s", r.code, r.reason)
+}
+
+// rtspProbeClient is one RTSP connection. Once a challenge has been
+// answered, every later request carries credentials for the same scheme.
+type rtspProbeClient struct {
+	nc  net.Conn
+	br  *bufio.Reader
+	uri string
+
+	username, password string
+	cseq               int
+	scheme             string // "basic" or "digest" once challenged
+	realm, nonce       string
+	opaque, qop        string
+	nc1                int // digest nonce count
+}
+
+// do sends a request and, on a first 401, answers the challenge and sends it
+// once more.
+func (c *rtspProbeClient) do(ctx context.Context, method, uri string, header [][2]string) (*rtspResponse, error) {
+	resp, err := c.roundTrip(ctx, method, uri, header)
+	if err != nil || resp.code != 401 || c.username == "" || c.scheme != "" {
+		return resp, err
+	}
+	if !c.challenge(resp.header.Values("WWW-Authenticate")) {
+		return nil, fmt.Errorf("%w: unsupported authentication %q", errCameraUnauthorized, resp.header.Get("WWW-Authenticate"))
+	}
+	return c.roundTrip(ctx, method, uri, header)
+}
+
+func (c *rtspProbeClient) roundTrip(ctx context.Context, method, uri string, header [][2]string) (*rtspResponse, error) {
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: %s\r\n", method, uri, c.cseq, rtspProbeUserAgent)
+	if auth := c.authorization(method, uri); auth != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", auth)
+	}
+	for _, h := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(c.nc, b.String()); err != nil {
+		return nil, c.netError(ctx, err)
+	}
+
+	resp, err := c.readResponse()
+	if err != nil {
+		return nil, c.netError(ctx, err)
+	}
+	return resp, nil
+}
+
+func (c *rtspProbeClient) readResponse() (*rtspResponse, error) {
+	tp := textproto.NewReader(c.br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	codeText, reason, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeText)
+	if !strings.HasPrefix(proto, "RTSP/") || err != nil {
+		return nil, fmt.Errorf("not an RTSP server (answered %q)", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("malformed RTSP answer: %w", err)
+	}
+	resp := &rtspResponse{code: code, reason: reason, header: header}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if n > maxRTSPResponseBody {
+			return nil, fmt.Errorf("RTSP answer of %d bytes is too large", n)
+		}
+		resp.body = make([]byte, n)
+		if _, err := io.ReadFull(c.br, resp.body); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// netError classifies a failed read or write: deadline, camera hang-up or
+// a protocol problem.
+func (c *rtspProbeClient) netError(ctx context.Context, err error) error {
+	var ne net.Error
+	if ctx.Err() != nil || (errors.As(err, &ne) && ne.Timeout()) {
+		return errCameraTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("the camera closed the connection without answering")
+	}
+	return err
+}
+
+// challenge picks Digest over Basic from the camera's challenges.
+func (c *rtspProbeClient) challenge(values []string) bool {
+	for _, v := range values {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(scheme, "digest") {
+			continue
+		}
+		p := digestParams(params)
+		if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+			continue
+		}
+		c.scheme, c.realm, c.nonce, c.opaque = "digest", p["realm"], p["nonce"], p["opaque"]
+		for _, q := range strings.Split(p["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				c.qop = "auth"
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if strings.EqualFold(scheme, "basic") {
+			c.scheme = "basic"
+			return true
+		}
+	}
+	return false
+}
+
+func (c *rtspProbeClient) authorization(method, uri string) string {
+	switch c.scheme {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+	case "digest":
+		ha1 := md5Hex(c.username + ":" + c.realm + ":" + c.password)
+		ha2 := md5Hex(method + ":" + uri)
+		auth := fmt.Sprintf("Digest username=%q, realm=%q, nonce=%q, uri=%q", c.username, c.realm, c.nonce, uri)
+		if c.qop == "" {
+			auth += fmt.Sprintf(", response=%q", md5Hex(ha1+":"+c.nonce+":"+ha2))
+		} else {
+			c.nc1++
+			nc := fmt.Sprintf("%08x", c.nc1)
+			cnonce := randomHex(8)
+			response := md5Hex(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + c.qop + ":" + ha2)
+			auth += fmt.Sprintf(", response=%q, qop=%s, nc=%s, cnonce=%q", response, c.qop, nc, cnonce)
+		}
+		if c.opaque != "" {
+			auth += fmt.Sprintf(", opaque=%q", c.opaque)
+		}
+		return auth
+	}
+	return ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// probeTrack is one media description of the SDP.
+type probeTrack struct {
+	media     string // "video", "audio" or "application"
+	codec     string // the rtpmap encoding name, e.g. "H264"
+	clockRate int
+	channels  int
+	control   string
+	// profile, width and height are read from the parameter sets in the
+	// fmtp line, or from a=framesize/a=x-dimensions when the camera sends
+	// those instead.
+	profile string
+	width   int
+	height  int
+	fps     float64
+}
+
+func (t probeTrack) String() string {
+	s := t.codec
+	if t.profile != "" {
+		s += " " + t.profile
+	}
+	if t.width > 0 && t.height > 0 {
+		s += fmt.Sprintf(" %dx%d", t.width, t.height)
+	}
+	if t.fps > 0 {
+		s += " @ " + strconv.FormatFloat(t.fps, 'f', -1, 64) + " fps"
+	}
+	if t.media == "audio" && t.clockRate > 0 {
+		s += fmt.Sprintf(" %d Hz", t.clockRate)
+		if t.channels > 1 {
+			s += fmt.Sprintf(" %d channels", t.channels)
+		}
+	}
+	return s
+}
+
+// staticRTPPayloads names the RTP payload types cameras use without rtpmap.
+var staticRTPPayloads = map[string]probeTrack{
+	"0":  {media: "audio", codec: "PCMU", clockRate: 8000, channels: 1},
+	"8":  {media: "audio", codec: "PCMA", clockRate: 8000, channels: 1},
+	"14": {media: "audio", codec: "MPA", clockRate: 90000},
+	"26": {media: "video", codec: "JPEG", clockRate: 90000},
+	"32": {media: "video", codec: "MPV", clockRate: 90000},
+	"33": {media: "video", codec: "MP2T", clockRate: 90000},
+}
+
+// parseSDPTracks returns the media descriptions of an SDP body, each described
+// by its first payload type.
+func parseSDPTracks(body []byte) []probeTrack {
+	var tracks []probeTrack
+	var t *probeTrack
+	var pt string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || len(key) != 1 {
+			continue
+		}
+		if key == "m" {
+			fields := strings.Fields(value)
+			if len(fields) < 4 {
+				t = nil
+				continue
+			}
+			pt = fields[3]
+			track := staticRTPPayloads[pt]
+			track.media = fields[0]
+			tracks = append(tracks, track)
+			t = &tracks[len(tracks)-1]
+			continue
+		}
+		if key != "a" || t == nil {
+			continue
+		}
+		attr, arg, _ := strings.Cut(value, ":")
+		switch attr {
+		case "control":
+			t.control = arg
+		case "rtpmap":
+			if p, enc, ok := strings.Cut(arg, " "); ok && p == pt {
+				parts := strings.Split(enc, "/")
+				t.codec = strings.ToUpper(parts[0])
+				if len(parts) > 1 {
+					t.clockRate, _ = strconv.Atoi(parts[1])
+				}
+				if len(parts) > 2 {
+					t.channels, _ = strconv.Atoi(parts[2])
+				}
+			}
+		case "fmtp":
+			if p, params, ok := strings.Cut(arg, " "); ok && p == pt {
+				t.fmtp(params)
+			}
+		case "framesize":
+			// a=framesize:96 1920-1080
+			if _, size, ok := strings.Cut(arg, " "); ok && t.width == 0 {
+				t.width, t.height = sdpDimensions(size, "-")
+			}
+		case "x-dimensions":
+			if t.width == 0 {
+				t.width, t.height = sdpDimensions(arg, ",")
+			}
+		case "framerate":
+			t.fps, _ = strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		}
+	}
+	return tracks
+}
+
+// fmtp reads the profile and resolution from H.264 and H.265 parameter sets.
+func (t *probeTrack) fmtp(params string) {
+	p := map[string]string{}
+	for _, kv := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		p[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+
+	var info spsInfo
+	var ok bool
+	switch t.codec {
+	case "H264":
+		first, _, _ := strings.Cut(p["sprop-parameter-sets"], ",")
+		if sps, err := base64.StdEncoding.DecodeString(first); err == nil {
+			info, ok = parseH264SPS(sps)
+		}
+	case "H265", "HEVC":
+		if sps, err := base64.StdEncoding.DecodeString(p["sprop-sps"]); err == nil {
+			info, ok = parseH265SPS(sps)
+		}
+	}
+	if ok {
+		t.profile, t.width, t.height = info.profile, info.width, info.height
+	}
+}
+
+func sdpDimensions(s, sep string) (int, int) {
+	w, h, _ := strings.Cut(strings.TrimSpace(s), sep)
+	width, err1 := strconv.Atoi(strings.TrimSpace(w))
+	height, err2 := strconv.Atoi(strings.TrimSpace(h))
+	if err1 != nil || err2 != nil {
+		return 0, 0
+	}
+	return width, height
+}
+
+// spsInfo is what the probe reads from a sequence parameter set.
+type spsInfo struct {
+	profile       string
+	width, height int
+}
+
+var errShortSPS = errors.New("sequence parameter set ends early")
+
+var h264Profiles = map[uint]string{
+	66: "Baseline", 77: "Main", 88: "Extended", 100: "High", 110: "High 10",
+	122: "High 4:2:2", 244: "High 4:4:4",
+}
+
+var h265Profiles = map[uint]string{1: "Main", 2: "Main 10", 3: "Main Still Picture", 4: "RExt"}
+
+// bitReader reads the RBSP of a NAL unit, emulation prevention removed.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newBitReader(nal []byte) *bitReader {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return &bitReader{data: rbsp}
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errShortSPS
+			return 0
+		}
+		v = v<<1 | uint(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) { r.bits(n) }
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errShortSPS
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// parseH264SPS reads the profile and cropped picture size of an H.264 SPS
+// (ITU-T H.264 7.3.2.1.1).
+func parseH264SPS(nal []byte) (spsInfo, bool) {
+	r := newBitReader(nal)
+	r.skip(8) // NAL header
+	profileIDC := r.bits(8)
+	r.skip(16) // constraint flags, level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chroma := uint(1)
+	separatePlanes := false
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			separatePlanes = r.bits(1) == 1
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue()
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightUnits := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+	var left, right, top, bottom uint
+	if r.bits(1) == 1 {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return spsInfo{}, false
+	}
+
+	cropX, cropY := uint(1), 2-frameMbsOnly
+	if !separatePlanes {
+		switch chroma {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+	}
+	info := spsInfo{
+		profile: h264Profiles[profileIDC],
+		width:   int(widthMbs*16 - cropX*(left+right)),
+		height:  int((2-frameMbsOnly)*heightUnits*16 - cropY*(top+bottom)),
+	}
+	return info, info.plausible()
+}
+
+// parseH265SPS reads the profile and cropped picture size of an H.265 SPS
+// (ITU-T H.265 7.3.2.2).
+func parseH265SPS(nal []byte) (spsInfo, bool) {
+	r := newBitReader(nal)
+	r.skip(16) // NAL header
+	r.skip(4)  // sps_video_parameter_set_id
+	subLayers := int(r.bits(3))
+	r.skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level
+	r.skip(3) // general_profile_space, general_tier_flag
+	profileIDC := r.bits(5)
+	r.skip(32 + 48 + 8) // compatibility flags, constraint flags, general_level_idc
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i] = r.bits(1) == 1
+		levelPresent[i] = r.bits(1) == 1
+	}
+	if subLayers > 0 {
+		r.skip(2 * (8 - subLayers))
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chroma := r.ue()
+	if chroma == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	width, height := r.ue(), r.ue()
+	if r.bits(1) == 1 {
+		subW, subH := uint(1), uint(1)
+		switch chroma {
+		case 1:
+			subW, subH = 2, 2
+		case 2:
+			subW = 2
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		width -= subW * (left + right)
+		height -= subH * (top + bottom)
+	}
+	if r.err != nil {
+		return spsInfo{}, false
+	}
+	info := spsInfo{profile: h265Profiles[profileIDC], width: int(width), height: int(height)}
+	return info, info.plausible()
+}
+
+// plausible rejects sizes that only a corrupt SPS (or a crop larger than the
+// picture, wrapping around) produces.
+func (i spsInfo) plausible() bool {
+	return i.width > 0 && i.height > 0 && i.width <= 16384 && i.height <= 16384
+}
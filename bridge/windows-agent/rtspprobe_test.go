@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeCamera is an in-process RTSP server that answers OPTIONS and DESCRIBE.
+type fakeCamera struct {
+	auth     string // "", "basic" or "digest"; credentials are admin:secret
+	path     string
+	redirect string // Location sent for every authorised DESCRIBE
+	sdp      string
+}
+
+// start serves f on a loopback port and returns its address.
+func (f fakeCamera) start(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func (f fakeCamera) serve(c net.Conn) {
+	defer c.Close()
+	tp := textproto.NewReader(bufio.NewReader(c))
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		h, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return
+		}
+		method, uri, _ := strings.Cut(line, " ")
+		uri, _, _ = strings.Cut(uri, " ")
+		reply := func(status, header, body string) {
+			fmt.Fprintf(c, "RTSP/1.0 %s\r\nCSeq: %s\r\nServer: FakeCam\r\n%s", status, h.Get("CSeq"), header)
+			if body != "" {
+				fmt.Fprintf(c, "Content-Type: application/sdp\r\nContent-Length: %d\r\n", len(body))
+			}
+			fmt.Fprintf(c, "\r\n%s", body)
+		}
+
+		if method == "OPTIONS" {
+			reply("200 OK", "Public: OPTIONS, DESCRIBE, SETUP, PLAY\r\n", "")
+			continue
+		}
+		if !f.authorized(method, uri, h.Get("Authorization")) {
+			challenge := `WWW-Authenticate: Basic realm="cam"` + "\r\n"
+			if f.auth == "digest" {
+				challenge = `WWW-Authenticate: Digest realm="cam", nonce="n1", qop="auth", opaque="op"` + "\r\n"
+			}
+			reply("401 Unauthorized", challenge, "")
+			continue
+		}
+		switch {
+		case f.redirect != "":
+			reply("302 Found", "Location: "+f.redirect+"\r\n", "")
+		case !strings.HasSuffix(uri, f.path):
+			reply("404 Not Found", "", "")
+		default:
+			reply("200 OK", "", f.sdp)
+		}
+	}
+}
+
+func (f fakeCamera) authorized(method, uri, auth string) bool {
+	switch f.auth {
+	case "basic":
+		return auth == "Basic "+base64.StdEncoding.EncodeToString([]byte("admin:secret"))
+	case "digest":
+		p := digestParams(strings.TrimPrefix(auth, "Digest "))
+		ha1 := md5Hex("admin:cam:secret")
+		ha2 := md5Hex(method + ":" + p["uri"])
+		want := md5Hex(ha1 + ":n1:" + p["nc"] + ":" + p["cnonce"] + ":auth:" + ha2)
+		return strings.HasPrefix(auth, "Digest ") && p["uri"] == uri && p["opaque"] == "op" && p["response"] == want
+	}
+	return true
+}
+
+// bitWriter writes the fields of a parameter set for the SDP.
+type bitWriter struct {
+	b []byte
+	n int
+}
+
+func (w *bitWriter) bits(v uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>i&1 != 0 {
+			w.b[len(w.b)-1] |= 1 << (7 - w.n%8)
+		}
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	n := 0
+	for x := v; x > 1; x >>= 1 {
+		n++
+	}
+	w.bits(0, n)
+	w.bits(v, n+1)
+}
+
+// h264SPS returns a High profile SPS for 1920x1080 (1088 lines cropped by 8).
+func h264SPS() []byte {
+	w := &bitWriter{}
+	w.bits(0x67, 8)
+	w.bits(100, 8) // profile_idc
+	w.bits(0, 8)
+	w.bits(40, 8) // level_idc
+	w.ue(0)       // seq_parameter_set_id
+	w.ue(1)       // chroma_format_idc
+	w.ue(0)
+	w.ue(0)
+	w.bits(0, 1)
+	w.bits(0, 1) // no scaling matrices
+	w.ue(0)      // log2_max_frame_num_minus4
+	w.ue(0)      // pic_order_cnt_type
+	w.ue(0)
+	w.ue(4) // max_num_ref_frames
+	w.bits(0, 1)
+	w.ue(119) // 120 macroblocks wide
+	w.ue(67)  // 68 macroblocks high
+	w.bits(1, 1)
+	w.bits(1, 1)
+	w.bits(1, 1) // frame_cropping_flag
+	w.ue(0)
+	w.ue(0)
+	w.ue(0)
+	w.ue(4)
+	w.bits(1, 1)
+	return w.b
+}
+
+func h264SDP() string {
+	sps := base64.StdEncoding.EncodeToString(h264SPS())
+	return "v=0\r\ns=cam\r\n" +
+		"m=video 0 RTP/AVP 96\r\na=rtpmap:96 H264/90000\r\n" +
+		"a=fmtp:96 packetization-mode=1;sprop-parameter-sets=" + sps + ",aO48gA==\r\n" +
+		"a=control:trackID=1\r\na=framerate:25\r\n" +
+		"m=audio 0 RTP/AVP 8\r\na=control:trackID=2\r\n"
+}
+
+func TestProbeCamera(t *testing.T) {
+	for _, auth := range []string{"", "basic", "digest"} {
+		t.Run("auth="+auth, func(t *testing.T) {
+			addr := fakeCamera{auth: auth, path: "/live", sdp: h264SDP()}.start(t)
+			result, err := probeCamera(context.Background(), "rtsp://admin:secret@"+addr+"/live")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.auth != auth {
+				t.Errorf("Auth = %q, want %q", result.auth, auth)
+			}
+			if result.server != "FakeCam" {
+				t.Errorf("Server = %q", result.server)
+			}
+			if got, want := result.String(), "H264 High 1920x1080 @ 25 fps, PCMA 8000 Hz"; got != want {
+				t.Errorf("tracks = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProbeCameraUnauthorized(t *testing.T) {
+	for _, auth := range []string{"basic", "digest"} {
+		t.Run(auth, func(t *testing.T) {
+			addr := fakeCamera{auth: auth, path: "/live", sdp: h264SDP()}.start(t)
+			for _, user := range []string{"admin:wrong@", ""} {
+				_, err := probeCamera(context.Background(), "rtsp://"+user+addr+"/live")
+				if !errors.Is(err, errCameraUnauthorized) || !conclusiveProbeError(err) {
+					t.Errorf("%q: err = %v, want errCameraUnauthorized", user, err)
+				}
+				if err != nil && strings.Contains(err.Error(), "wrong") {
+					t.Errorf("%q: error reveals the password: %v", user, err)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeCameraNotFound(t *testing.T) {
+	addr := fakeCamera{path: "/live", sdp: h264SDP()}.start(t)
+	_, err := probeCamera(context.Background(), "rtsp://"+addr+"/other")
+	if !errors.Is(err, errCameraNotFound) {
+		t.Fatalf("err = %v, want errCameraNotFound", err)
+	}
+}
+
+func TestProbeCameraNoVideo(t *testing.T) {
+	addr := fakeCamera{path: "/live", sdp: "v=0\r\nm=audio 0 RTP/AVP 0\r\na=control:trackID=1\r\n"}.start(t)
+	_, err := probeCamera(context.Background(), "rtsp://"+addr+"/live")
+	if !errors.Is(err, errCameraNoVideo) || !conclusiveProbeError(err) {
+		t.Fatalf("err = %v, want errCameraNoVideo", err)
+	}
+}
+
+func TestProbeCameraUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	_, err = probeCamera(context.Background(), "rtsp://admin:secret@"+addr+"/live")
+	if !errors.Is(err, errCameraUnreachable) || !conclusiveProbeError(err) {
+		t.Fatalf("err = %v, want errCameraUnreachable", err)
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("error reveals the password: %v", err)
+	}
+}
+
+func TestProbeCameraRedirect(t *testing.T) {
+	target := fakeCamera{auth: "basic", path: "/live", sdp: h264SDP()}.start(t)
+	addr := fakeCamera{redirect: "rtsp://admin:secret@" + target + "/live"}.start(t)
+	result, err := probeCamera(context.Background(), "rtsp://"+addr+"/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.video() == nil {
+		t.Fatal("no video track after the redirect")
+	}
+}
+
+func TestProbeCameraRedirectLoopRedacted(t *testing.T) {
+	addr := fakeCamera{redirect: "/loop?token=abc123"}.start(t)
+	_, err := probeCamera(context.Background(), "rtsp://admin:secret@"+addr+"/live")
+	if err == nil || conclusiveProbeError(err) {
+		t.Fatalf("err = %v, want an inconclusive redirect error", err)
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "secret") || strings.Contains(msg, "abc123") {
+		t.Errorf("error reveals a secret: %s", msg)
+	}
+	if !strings.Contains(msg, "rtsp://admin:****@"+addr) {
+		t.Errorf("error %q does not name the camera", msg)
+	}
+}
+
+func TestProbeCameraUnsupportedScheme(t *testing.T) {
+	_, err := probeCamera(context.Background(), "rtsps://127.0.0.1:1/live")
+	if err == nil || conclusiveProbeError(err) {
+		t.Fatalf("err = %v, want an inconclusive error", err)
+	}
+}
+
+func TestRunProbeCommandMasksPassword(t *testing.T) {
+	addr := fakeCamera{auth: "digest", path: "/live", sdp: h264SDP()}.start(t)
+	var out bytes.Buffer
+	if err := runProbeCommand(context.Background(), "", "rtsp://admin:secret@"+addr+"/live", &out); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("output reveals the password:\n%s", out.String())
+	}
+	for _, want := range []string{"Camera:  rtsp://admin:****@" + addr + "/live", "Auth:    digest", "Track 0: video H264 High 1920x1080"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output lacks %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultRTSPListen     = ":8554"
+	defaultRTSPMaxClients = 16
+	// rtspDescribeTimeout bounds how long DESCRIBE waits for the codec
+	// parameters, which arrive with the next keyframe.
+	rtspDescribeTimeout = 10 * time.Second
+	// rtspSessionTimeout is advertised to clients, which send a keepalive
+	// (OPTIONS, GET_PARAMETER or RTCP) well within it. A silent client is
+	// dropped after twice as long.
+	rtspSessionTimeout = 60 * time.Second
+	// rtspWriteTimeout drops a client whose connection stopped draining.
+	rtspWriteTimeout   = 10 * time.Second
+	maxRTSPRequestBody = 64 << 10
+	rtspRealm          = "DIFAE Bridge"
+)
+
+// rtspServerConfig re-serves the relayed stream to on-site recorders and
+// monitors at rtsp://<Listen><Path> over TCP-interleaved RTP. Path defaults
+// to "/" plus the bridge ID. When Username is set, clients must log in with
+// it and Password (Digest or Basic). Listen is read at startup.
+type rtspServerConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Listen     string `json:"listen,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	MaxClients int    `json:"maxClients,omitempty"`
+}
+
+var rtspStatusText = map[int]string{
+	200: "OK",
+	401: "Unauthorized",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+func applyRTSPServerDefaults(cfg *agentConfig) {
+	r := &cfg.RTSPServer
+	if strings.TrimSpace(r.Listen) == "" {
+		r.Listen = defaultRTSPListen
+	}
+	if strings.TrimSpace(r.Path) == "" {
+		r.Path = "/" + url.PathEscape(cfg.BridgeID)
+	}
+	if r.MaxClients == 0 {
+		r.MaxClients = defaultRTSPMaxClients
+	}
+}
+
+func validateRTSPServer(r rtspServerConfig) error {
+	if !r.Enabled {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(r.Listen); err != nil {
+		return errors.New("rtspServer.listen must be host:port or :port")
+	}
+	u, err := url.Parse(r.Path)
+	if err != nil || !strings.HasPrefix(r.Path, "/") || strings.Trim(r.Path, "/") == "" || u.RawQuery != "" || u.Fragment != "" || strings.Contains(r.Path, "/trackID=") {
+		return errors.New("rtspServer.path must be a path such as /lobby")
+	}
+	if (r.Username == "") != (r.Password == "") {
+		return errors.New("rtspServer.username and password must be set together")
+	}
+	if strings.Contains(r.Username, ":") {
+		return errors.New("rtspServer.username must not contain ':'")
+	}
+	if r.MaxClients < 1 || r.MaxClients > 100 {
+		return errors.New("rtspServer.maxClients must be between 1 and 100")
+	}
+	return nil
+}
+
+// rtspServer serves the running session's ring to local RTSP clients, so
+// they cost the camera no extra connection. Between sessions it answers 503.
+type rtspServer struct {
+	logger   *log.Logger
+	controls *relayControls
+	nonce    string
+
+	mu        sync.Mutex
+	cfg       rtspServerConfig
+	clients   map[*rtspConn]struct{}
+	described *tsRing
+	tracks    []*rtspTrack
+	describe  sync.Mutex
+}
+
+func newRTSPServer(controls *relayControls, logger *log.Logger) *rtspServer {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	return &rtspServer{logger: logger, controls: controls, nonce: hex.EncodeToString(nonce), clients: map[*rtspConn]struct{}{}}
+}
+
+// configure applies a freshly loaded config to new requests. Clients
+// already playing keep their session.
+func (s *rtspServer) configure(cfg runtimeConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg.raw.RTSPServer
+}
+
+func (s *rtspServer) config() rtspServerConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cfg
+}
+
+// run accepts clients on listen until ctx ends. While the server is
+// disabled in the config, connections are refused.
+func (s *rtspServer) run(ctx context.Context, listen string) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		s.logger.Printf("WARN: local RTSP server failed to listen on %s: %v", listen, err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for c := range s.clients {
+			c.close()
+		}
+	}()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				s.logger.Printf("WARN: local RTSP server stopped: %v", err)
+			}
+			return
+		}
+		c := &rtspConn{server: s, nc: nc, br: bufio.NewReader(nc), since: time.Now(), closed: make(chan struct{}), channels: map[int]byte{}}
+		if reason := s.register(c); reason != "" {
+			s.logger.Printf("RTSP client %s refused: %s", nc.RemoteAddr(), reason)
+			nc.Close()
+			continue
+		}
+		go func() {
+			defer s.unregister(c)
+			c.serve(ctx)
+		}()
+	}
+}
+
+func (s *rtspServer) register(c *rtspConn) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.cfg.Enabled {
+		return "the RTSP server is disabled"
+	}
+	if len(s.clients) >= s.cfg.MaxClients {
+		return fmt.Sprintf("%d clients already connected", s.cfg.MaxClients)
+	}
+	s.clients[c] = struct{}{}
+	return ""
+}
+
+func (s *rtspServer) unregister(c *rtspConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// tracksFor returns the tracks of ring, reading it until every stream's
+// parameters are known. The result is kept for the rest of the session.
+func (s *rtspServer) tracksFor(ctx context.Context, ring *tsRing) ([]*rtspTrack, error) {
+	s.describe.Lock()
+	defer s.describe.Unlock()
+	s.mu.Lock()
+	if s.described == ring {
+		tracks := s.tracks
+		s.mu.Unlock()
+		return tracks, nil
+	}
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, rtspDescribeTimeout)
+	defer cancel()
+	reader := ring.liveReader()
+	go func() {
+		<-ctx.Done()
+		reader.Close()
+	}()
+
+	dmx := newTSDemuxer(reader)
+	var d trackDescriber
+	for {
+		f, err := dmx.next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("the relay session ended")
+			}
+			if ctx.Err() == nil {
+				return nil, err
+			}
+			if d.video == nil {
+				return nil, fmt.Errorf("no keyframe within %s", rtspDescribeTimeout)
+			}
+			// Audio is listed but silent; serve video alone.
+		} else if !d.add(dmx, f) {
+			continue
+		}
+		s.mu.Lock()
+		s.described, s.tracks = ring, d.tracks()
+		s.mu.Unlock()
+		return d.tracks(), nil
+	}
+}
+
+type rtspRequest struct {
+	method string
+	uri    string
+	header textproto.MIMEHeader
+}
+
+// rtspConn is one client connection. Requests are handled on the
+// connection's goroutine; once playing, a second goroutine writes the RTP
+// packets.
+type rtspConn struct {
+	server *rtspServer
+	nc     net.Conn
+	br     *bufio.Reader
+	since  time.Time
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// Request state, used by the connection's goroutine only.
+	session  string
+	ring     *tsRing
+	tracks   []*rtspTrack
+	channels map[int]byte // track index to interleaved RTP channel
+
+	mu      sync.Mutex
+	agent   string
+	playing bool
+}
+
+func (c *rtspConn) serve(ctx context.Context) {
+	defer c.close()
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(2 * rtspSessionTimeout))
+		b, err := c.br.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] == '$' {
+			// RTCP receiver reports; they only keep the session alive.
+			var hdr [4]byte
+			if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, c.br, int64(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+		req, err := readRTSPRequest(c.br)
+		if err != nil || !c.handle(ctx, req) {
+			return
+		}
+	}
+}
+
+func readRTSPRequest(br *bufio.Reader) (*rtspRequest, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("malformed request line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if n > maxRTSPRequestBody {
+			return nil, errors.New("request body too large")
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(n)); err != nil {
+			return nil, err
+		}
+	}
+	return &rtspRequest{method: parts[0], uri: parts[1], header: header}, nil
+}
+
+// handle answers req. It reports false when the connection should close.
+func (c *rtspConn) handle(ctx context.Context, req *rtspRequest) bool {
+	if ua := req.header.Get("User-Agent"); ua != "" {
+		c.mu.Lock()
+		c.agent = ua
+		c.mu.Unlock()
+	}
+	cfg := c.server.config()
+	if req.method != "OPTIONS" && !c.authorized(cfg, req) {
+		challenge := [][2]string{
+			{"WWW-Authenticate", fmt.Sprintf("Digest realm=%q, nonce=%q", rtspRealm, c.server.nonce)},
+			{"WWW-Authenticate", fmt.Sprintf("Basic realm=%q", rtspRealm)},
+		}
+		return c.respond(req, 401, challenge, nil) == nil
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		return c.respond(req, 200, [][2]string{{"Public", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}}, nil) == nil
+	case "GET_PARAMETER", "SET_PARAMETER":
+		return c.respond(req, 200, c.sessionHeader(), nil) == nil
+	case "DESCRIBE":
+		if _, ok := rtspTrackIndex(cfg.Path, req.uri, false); !ok {
+			return c.respond(req, 404, nil, nil) == nil
+		}
+		tracks, status := c.prepare(ctx)
+		if status != 200 {
+			return c.respond(req, status, nil, nil) == nil
+		}
+		host, _, _ := net.SplitHostPort(c.nc.LocalAddr().String())
+		base := req.uri
+		if !strings.HasSuffix(base, "/") {
+			base += "/"
+		}
+		body := buildSDP(tracks, "DIFAE "+strings.Trim(cfg.Path, "/"), host)
+		return c.respond(req, 200, [][2]string{{"Content-Base", base}, {"Content-Type", "application/sdp"}}, body) == nil
+	case "SETUP":
+		return c.setup(ctx, cfg, req)
+	case "PLAY":
+		return c.play(req)
+	case "TEARDOWN":
+		_ = c.respond(req, 200, nil, nil)
+		return false
+	default:
+		return c.respond(req, 501, nil, nil) == nil
+	}
+}
+
+// prepare describes the running session once per connection.
+func (c *rtspConn) prepare(ctx context.Context) ([]*rtspTrack, int) {
+	if c.ring != nil {
+		return c.tracks, 200
+	}
+	ring := c.server.controls.source()
+	if ring == nil || ring.ended() {
+		return nil, 503
+	}
+	tracks, err := c.server.tracksFor(ctx, ring)
+	if err != nil {
+		c.server.logger.Printf("WARN: RTSP client %s: %v", c.nc.RemoteAddr(), err)
+		return nil, 503
+	}
+	c.ring, c.tracks = ring, tracks
+	return tracks, 200
+}
+
+func (c *rtspConn) setup(ctx context.Context, cfg rtspServerConfig, req *rtspRequest) bool {
+	tracks, status := c.prepare(ctx)
+	if status != 200 {
+		return c.respond(req, status, nil, nil) == nil
+	}
+	i, ok := rtspTrackIndex(cfg.Path, req.uri, true)
+	if !ok || i >= len(tracks) {
+		return c.respond(req, 404, nil, nil) == nil
+	}
+	if id := rtspSessionID(req); c.session != "" && id != c.session {
+		return c.respond(req, 454, nil, nil) == nil
+	}
+	channel, ok := interleavedChannel(req.header.Get("Transport"), i)
+	if !ok {
+		// Only TCP-interleaved RTP is served.
+		return c.respond(req, 461, nil, nil) == nil
+	}
+	if c.session == "" {
+		c.session = fmt.Sprintf("%016x", mathrand.Uint64())
+	}
+	c.channels[i] = channel
+	transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+	return c.respond(req, 200, append(c.sessionHeader(), [2]string{"Transport", transport}), nil) == nil
+}
+
+func (c *rtspConn) play(req *rtspRequest) bool {
+	if c.session == "" || len(c.channels) == 0 {
+		return c.respond(req, 455, nil, nil) == nil
+	}
+	if rtspSessionID(req) != c.session {
+		return c.respond(req, 454, nil, nil) == nil
+	}
+	c.mu.Lock()
+	started := c.playing
+	c.playing = true
+	agent := c.agent
+	c.mu.Unlock()
+	if err := c.respond(req, 200, append(c.sessionHeader(), [2]string{"Range", "npt=0.000-"}), nil); err != nil {
+		return false
+	}
+	if !started {
+		if agent == "" {
+			agent = "unknown client"
+		}
+		c.server.logger.Printf("RTSP client %s playing (%s)", c.nc.RemoteAddr(), agent)
+		go c.stream()
+	}
+	return true
+}
+
+// stream sends the ring to the client until either ends. The connection is
+// closed afterwards so the client reconnects to the next session.
+func (c *rtspConn) stream() {
+	defer c.close()
+
+	reader := c.ring.liveReader()
+	go func() {
+		<-c.closed
+		reader.Close()
+	}()
+
+	type output struct {
+		*rtpPacketizer
+		channel byte
+	}
+	outputs := map[int]output{}
+	for i, ch := range c.channels {
+		t := c.tracks[i]
+		pt := byte(rtpPayloadVideo)
+		if t.streamType == streamAAC {
+			pt = rtpPayloadAudio
+		}
+		outputs[t.pid] = output{
+			rtpPacketizer: &rtpPacketizer{track: t, ssrc: mathrand.Uint32(), seq: uint16(mathrand.Uint32()), tsBase: mathrand.Uint32(), payload: pt},
+			channel:       ch,
+		}
+	}
+
+	dmx := newTSDemuxer(reader)
+	for {
+		f, err := dmx.next()
+		if err != nil {
+			if _, lost := reader.position(); lost > 0 {
+				c.server.logger.Printf("RTSP client %s fell behind and skipped %d bytes", c.nc.RemoteAddr(), lost)
+			}
+			return
+		}
+		out, ok := outputs[f.pid]
+		if !ok {
+			continue
+		}
+		for _, pkt := range out.packets(f) {
+			if err := c.writeInterleaved(out.channel, pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *rtspConn) writeInterleaved(channel byte, pkt []byte) error {
+	buf := make([]byte, 4, 4+len(pkt))
+	buf[0] = '$'
+	buf[1] = channel
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(pkt)))
+	buf = append(buf, pkt...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := c.nc.Write(buf)
+	return err
+}
+
+func (c *rtspConn) respond(req *rtspRequest, code int, header [][2]string, body []byte) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\nCSeq: %s\r\nServer: DIFAE Bridge\r\n", code, rtspStatusText[code], req.header.Get("CSeq"))
+	for _, h := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(rtspWriteTimeout))
+	_, err := io.WriteString(c.nc, b.String())
+	return err
+}
+
+func (c *rtspConn) sessionHeader() [][2]string {
+	if c.session == "" {
+		return nil
+	}
+	return [][2]string{{"Session", fmt.Sprintf("%s;timeout=%d", c.session, int(rtspSessionTimeout.Seconds()))}}
+}
+
+func (c *rtspConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.nc.Close()
+		c.mu.Lock()
+		playing := c.playing
+		c.mu.Unlock()
+		if playing {
+			c.server.logger.Printf("RTSP client %s disconnected after %s", c.nc.RemoteAddr(), time.Since(c.since).Round(time.Second))
+		}
+	})
+}
+
+// authorized checks the request's credentials when the server has any.
+// Digest is preferred; Basic is accepted for older recorders.
+func (c *rtspConn) authorized(cfg rtspServerConfig, req *rtspRequest) bool {
+	if cfg.Username == "" {
+		return true
+	}
+	scheme, value, _ := strings.Cut(req.header.Get("Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(raw, []byte(cfg.Username+":"+cfg.Password)) == 1
+	case "digest":
+		p := digestParams(value)
+		if p["username"] != cfg.Username || p["realm"] != rtspRealm || p["nonce"] != c.server.nonce {
+			return false
+		}
+		ha1 := md5Hex(cfg.Username + ":" + rtspRealm + ":" + cfg.Password)
+		ha2 := md5Hex(req.method + ":" + p["uri"])
+		want := md5Hex(ha1 + ":" + c.server.nonce + ":" + ha2)
+		return subtle.ConstantTimeCompare([]byte(p["response"]), []byte(want)) == 1
+	}
+	return false
+}
+
+// rtspTrackIndex checks that uri names path and, with track set, returns the
+// index of its "trackID=n" suffix.
+func rtspTrackIndex(path, uri string, track bool) (int, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return 0, false
+	}
+	base := strings.TrimRight(path, "/")
+	got := strings.TrimRight(u.Path, "/")
+	if !track {
+		return 0, got == base
+	}
+	rest, ok := strings.CutPrefix(got, base+"/trackID=")
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(rest)
+	return i, err == nil && i >= 0
+}
+
+// digestParams parses the comma-separated key="value" pairs of a Digest
+// Authorization header.
+func digestParams(s string) map[string]string {
+	out := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, s = rest[1:end+1], rest[end+2:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+		out[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return out
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// rtspSessionID returns the session of a request without its parameters.
+func rtspSessionID(req *rtspRequest) string {
+	id, _, _ := strings.Cut(req.header.Get("Session"), ";")
+	return strings.TrimSpace(id)
+}
+
+// interleavedChannel picks the TCP-interleaved option of a Transport header
+// and returns its RTP channel, or 2*track when the client left it to us.
+func interleavedChannel(transport string, track int) (byte, bool) {
+	for _, option := range strings.Split(transport, ",") {
+		params := strings.Split(strings.TrimSpace(option), ";")
+		if !strings.EqualFold(params[0], "RTP/AVP/TCP") {
+			continue
+		}
+		channel := 2 * track
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(p, "interleaved="); ok {
+				first, _, _ := strings.Cut(v, "-")
+				n, err := strconv.Atoi(first)
+				if err != nil || n < 0 || n > 254 {
+					return 0, false
+				}
+				channel = n
+			}
+		}
+		return byte(channel), true
+	}
+	return 0, false
+}
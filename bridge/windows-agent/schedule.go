@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	// Windows machines rarely ship a zoneinfo database.
+	_ "time/tzdata"
+)
+
+const (
+	armStateFileName      = "arm-state.json"
+	defaultArmPath        = "/api/bridge/arm"
+	defaultEventsPath     = "/api/bridge/events"
+	defaultArmPollSeconds = 10
+
+	modeAuto     = "auto"
+	modeArmed    = "armed"
+	modeDisarmed = "disarmed"
+
+	minutesPerDay = 24 * 60
+)
+
+// scheduleConfig limits relaying to weekly windows in Timezone (an IANA
+// name; empty means local time). A holiday replaces the weekly windows on its
+// date. The arm endpoint is polled and events are posted even when the
+// schedule itself is disabled.
+type scheduleConfig struct {
+	Enabled        bool            `json:"enabled"`
+	Timezone       string          `json:"timezone,omitempty"`
+	Windows        []windowConfig  `json:"windows,omitempty"`
+	Holidays       []holidayConfig `json:"holidays,omitempty"`
+	ArmEndpoint    string          `json:"armEndpoint,omitempty"`
+	EventsEndpoint string          `json:"eventsEndpoint,omitempty"`
+	PollSeconds    int             `json:"pollSeconds,omitempty"`
+}
+
+// windowConfig relays from Start to End ("HH:MM") on Days ("mon".."sun",
+// empty for every day). An End at or before Start runs past midnight.
+type windowConfig struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// holidayConfig is a date (YYYY-MM-DD) whose windows replace the weekly ones;
+// without windows the camera stays off all day.
+type holidayConfig struct {
+	Date    string         `json:"date"`
+	Name    string         `json:"name,omitempty"`
+	Windows []windowConfig `json:"windows,omitempty"`
+}
+
+// span is a window in minutes past midnight; end runs past minutesPerDay for
+// windows that cross midnight.
+type span struct {
+	start, end int
+}
+
+// schedulePlan is a compiled scheduleConfig.
+type schedulePlan struct {
+	loc      *time.Location
+	weekly   [7][]span
+	holidays map[string][]span
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compileSchedule validates cfg and builds its plan.
+func compileSchedule(cfg scheduleConfig) (*schedulePlan, error) {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("schedule.timezone %q is not a known IANA timezone", cfg.Timezone)
+	}
+	if len(cfg.Windows) == 0 && len(cfg.Holidays) == 0 {
+		return nil, errors.New("schedule is enabled but has no windows or holidays")
+	}
+
+	p := &schedulePlan{loc: loc, holidays: make(map[string][]span, len(cfg.Holidays))}
+	for i, w := range cfg.Windows {
+		s, err := compileWindow(w)
+		if err != nil {
+			return nil, fmt.Errorf("schedule.windows[%d]: %w", i, err)
+		}
+		if len(w.Days) == 0 {
+			for d := range p.weekly {
+				p.weekly[d] = append(p.weekly[d], s)
+			}
+			continue
+		}
+		for _, name := range w.Days {
+			d, ok := weekdays[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("schedule.windows[%d]: unknown day %q (use mon, tue, wed, thu, fri, sat or sun)", i, name)
+			}
+			p.weekly[d] = append(p.weekly[d], s)
+		}
+	}
+	for i, h := range cfg.Holidays {
+		if _, err := time.Parse(time.DateOnly, h.Date); err != nil {
+			return nil, fmt.Errorf("schedule.holidays[%d].date must be YYYY-MM-DD", i)
+		}
+		if _, dup := p.holidays[h.Date]; dup {
+			return nil, fmt.Errorf("schedule.holidays lists %s twice", h.Date)
+		}
+		spans := []span{}
+		for j, w := range h.Windows {
+			if len(w.Days) > 0 {
+				return nil, fmt.Errorf("schedule.holidays[%d].windows[%d] may not list days", i, j)
+			}
+			s, err := compileWindow(w)
+			if err != nil {
+				return nil, fmt.Errorf("schedule.holidays[%d].windows[%d]: %w", i, j, err)
+			}
+			spans = append(spans, s)
+		}
+		p.holidays[h.Date] = spans
+	}
+	return p, nil
+}
+
+func compileWindow(w windowConfig) (span, error) {
+	start, err := parseClock(w.Start)
+	if err != nil {
+		return span{}, fmt.Errorf("start: %w", err)
+	}
+	end, err := parseClock(w.End)
+	if err != nil {
+		return span{}, fmt.Errorf("end: %w", err)
+	}
+	if end <= start {
+		end += minutesPerDay
+	}
+	return span{start, end}, nil
+}
+
+// parseClock returns the minutes past midnight of an "HH:MM" time; "24:00"
+// is accepted as the end of the day.
+func parseClock(v string) (int, error) {
+	hh, mm, ok := strings.Cut(v, ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || len(hh) != 2 || len(mm) != 2 || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("%q is not an HH:MM time", v)
+	}
+	return h*60 + m, nil
+}
+
+// at reports whether t falls inside a window, and whether that day's windows
+// came from the weekly plan ("schedule") or a holiday.
+func (p *schedulePlan) at(t time.Time) (bool, string) {
+	local := t.In(p.loc)
+	minute := local.Hour()*60 + local.Minute()
+
+	today, reason := p.day(local)
+	for _, s := range today {
+		if s.start <= minute && minute < s.end {
+			return true, reason
+		}
+	}
+
+	// Windows that started yesterday and run past midnight.
+	yesterday, prevReason := p.day(local.AddDate(0, 0, -1))
+	for _, s := range yesterday {
+		if minute+minutesPerDay < s.end {
+			return true, prevReason
+		}
+	}
+	return false, reason
+}
+
+func (p *schedulePlan) day(t time.Time) ([]span, string) {
+	if spans, ok := p.holidays[t.Format(time.DateOnly)]; ok {
+		return spans, "holiday"
+	}
+	return p.weekly[t.Weekday()], "schedule"
+}
+
+// armState is persisted in arm-state.json. Backend is the last mode the
+// backend asked for, so a restart does not re-apply it over a local change.
+type armState struct {
+	Mode      string    `json:"mode"`
+	Source    string    `json:"source,omitempty"`
+	ChangedAt time.Time `json:"changedAt,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+}
+
+// bridgeEvent reports arm mode changes ("arm") and relay transitions
+// ("schedule") to the backend.
+type bridgeEvent struct {
+	Type   string    `json:"type"`
+	Mode   string    `json:"mode"`
+	State  string    `json:"state,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Source string    `json:"source,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+func validArmMode(mode string) bool {
+	return mode == modeAuto || mode == modeArmed || mode == modeDisarmed
+}
+
+func readArmState(path string) (armState, error) {
+	st := armState{Mode: modeAuto}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+	if err := json.Unmarshal(data, &st); err != nil || !validArmMode(st.Mode) {
+		return armState{Mode: modeAuto}, fmt.Errorf("%s is unreadable", armStateFileName)
+	}
+	return st, nil
+}
+
+func writeArmState(path string, st armState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+// runArmCommand sets the arm mode of a running agent ("arm", "disarm" or
+// "auto" on the command line); the agent picks the file up within seconds.
+func runArmCommand(statePath, command string) error {
+	mode := map[string]string{"arm": modeArmed, "disarm": modeDisarmed, "auto": modeAuto}[command]
+	st, err := readArmState(statePath)
+	if err != nil {
+		st = armState{}
+	}
+	st.Mode, st.Source, st.ChangedAt = mode, "cli", time.Now().UTC()
+	return writeArmState(statePath, st)
+}
+
+// streamGate decides whether the relay should run: the arm mode first, then
+// the schedule. It is signalled on every change of that decision.
+type streamGate struct {
+	statePath string
+	logger    *log.Logger
+	changed   chan struct{}
+
+	mu        sync.Mutex
+	cfg       runtimeConfig
+	state     armState
+	stateMod  time.Time
+	streaming bool
+	reason    string
+	reported  bool
+	pollErr   string
+}
+
+func newStreamGate(statePath string, logger *log.Logger) *streamGate {
+	g := &streamGate{statePath: statePath, logger: logger, changed: make(chan struct{}, 1), state: armState{Mode: modeAuto}}
+	g.reloadLocked()
+	return g
+}
+
+// configure applies a freshly loaded config and re-evaluates.
+func (g *streamGate) configure(cfg runtimeConfig) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.cfg = cfg
+	g.evaluateLocked(time.Now())
+}
+
+func (g *streamGate) isStreaming() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.streaming
+}
+
+// run re-evaluates every few seconds, picking up arm-state.json edits from the
+// command line, and polls the backend's arm endpoint until ctx ends.
+func (g *streamGate) run(ctx context.Context) {
+	ticker := time.NewTicker(2 * time.Second)
+	defer ticker.Stop()
+
+	var lastPoll time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.mu.Lock()
+			if g.reloadLocked() {
+				g.logger.Printf("Arm mode set to %s by %s", g.state.Mode, g.state.Source)
+				g.sendEventLocked(bridgeEvent{Type: "arm", Mode: g.state.Mode, Source: g.state.Source, At: now})
+			}
+			g.evaluateLocked(now)
+			cfg := g.cfg
+			g.mu.Unlock()
+
+			if now.Sub(lastPoll) >= time.Duration(cfg.raw.Schedule.PollSeconds)*time.Second {
+				lastPoll = now
+				g.pollBackend(ctx, cfg)
+			}
+		}
+	}
+}
+
+// reloadLocked reads arm-state.json when it changed on disk and reports
+// whether the mode changed.
+func (g *streamGate) reloadLocked() bool {
+	info, err := os.Stat(g.statePath)
+	if err != nil || info.ModTime().Equal(g.stateMod) {
+		return false
+	}
+	g.stateMod = info.ModTime()
+
+	st, err := readArmState(g.statePath)
+	if err != nil {
+		g.logger.Printf("WARN: %v; keeping arm mode %s", err, g.state.Mode)
+		return false
+	}
+	changed := st.Mode != g.state.Mode
+	g.state = st
+	return changed
+}
+
+func (g *streamGate) pollBackend(ctx context.Context, cfg runtimeConfig) {
+	mode, err := fetchArmMode(ctx, cfg)
+	if err != nil {
+		// Log each distinct failure once; backends without arm support 404.
+		if msg := err.Error(); msg != g.pollErr && ctx.Err() == nil {
+			g.logger.Printf("WARN: arm mode poll failed: %v", err)
+			g.pollErr = msg
+		}
+		return
+	}
+	g.pollErr = ""
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if mode == "" || mode == g.state.Backend {
+		return
+	}
+	g.state.Backend = mode
+	if !validArmMode(mode) {
+		g.logger.Printf("WARN: ignoring arm mode %q from backend", mode)
+	} else if mode != g.state.Mode {
+		now := time.Now()
+		g.state.Mode, g.state.Source, g.state.ChangedAt = mode, "backend", now.UTC()
+		g.logger.Printf("Arm mode set to %s by backend", mode)
+		g.sendEventLocked(bridgeEvent{Type: "arm", Mode: mode, Source: "backend", At: now})
+		g.evaluateLocked(now)
+	}
+	if err := writeArmState(g.statePath, g.state); err != nil {
+		g.logger.Printf("WARN: could not save %s: %v", armStateFileName, err)
+	} else if info, err := os.Stat(g.statePath); err == nil {
+		g.stateMod = info.ModTime()
+	}
+}
+
+func (g *streamGate) evaluateLocked(now time.Time) {
+	streaming, reason := g.decideLocked(now)
+	if g.reported && streaming == g.streaming {
+		g.reason = reason
+		return
+	}
+	flipped := g.reported && streaming != g.streaming
+	g.streaming, g.reason, g.reported = streaming, reason, true
+
+	state, verb := "stopped", "paused"
+	if streaming {
+		state, verb = "streaming", "active"
+	}
+	g.logger.Printf("Relay %s (mode %s, reason %s)", verb, g.state.Mode, reason)
+	g.sendEventLocked(bridgeEvent{Type: "schedule", Mode: g.state.Mode, State: state, Reason: reason, At: now})
+
+	if flipped {
+		select {
+		case g.changed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (g *streamGate) decideLocked(now time.Time) (bool, string) {
+	switch g.state.Mode {
+	case modeArmed:
+		return true, modeArmed
+	case modeDisarmed:
+		return false, modeDisarmed
+	}
+	if g.cfg.schedule == nil {
+		return true, "always"
+	}
+	return g.cfg.schedule.at(now)
+}
+
+// sendEventLocked posts ev in the background; events are best effort.
+func (g *streamGate) sendEventLocked(ev bridgeEvent) {
+	cfg := g.cfg
+	if cfg.eventsURL == "" {
+		return
+	}
+	go func() {
+		if err := postEvent(context.Background(), cfg, ev); err != nil {
+			g.logger.Printf("WARN: event upload failed: %v", err)
+		}
+	}()
+}
+
+func fetchArmMode(ctx context.Context, cfg runtimeConfig) (string, error) {
+	reqCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, cfg.armURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to construct arm request: %w", err)
+	}
+	setBridgeHeaders(req, cfg)
+
+	resp, err := http.DefaultClient.Do(req)
+	cfg.report(ctx, cfg.armURL, err == nil && resp.StatusCode < 500)
+	if err != nil {
+		return "", fmt.Errorf("failed to query arm mode: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("arm endpoint %s answered %d", cfg.armURL, resp.StatusCode)
+	}
+
+	var body struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid arm response: %w", err)
+	}
+	return body.Mode, nil
+}
+
+// postEvent posts a JSON event (arm, schedule, relay) to the events endpoint.
+func postEvent(ctx context.Context, cfg runtimeConfig, ev any) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, cfg.eventsURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to construct event request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	setBridgeHeaders(req, cfg)
+
+	resp, err := http.DefaultClient.Do(req)
+	cfg.report(ctx, cfg.eventsURL, err == nil && resp.StatusCode < 500)
+	if err != nil {
+		return fmt.Errorf("failed to send event: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("events endpoint %s rejected the event with %d", cfg.eventsURL, resp.StatusCode)
+	}
+	return nil
+}
+
+func setBridgeHeaders(req *http.Request, cfg runtimeConfig) {
+	req.Header.Set("X-Bridge-Id", cfg.raw.BridgeID)
+	if strings.TrimSpace(cfg.raw.APIKey) != "" {
+		req.Header.Set("X-Api-Key", cfg.raw.APIKey)
+	}
+}
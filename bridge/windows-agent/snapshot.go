@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotOutputArgs adds a second ffmpeg output that keeps overwriting a
+// single JPEG at the configured interval, reusing the relay's camera session.
+// privacy filters are applied so snapshots hide the same regions as the relay.
+func snapshotOutputArgs(cfg snapshotConfig, privacy []string, path string) []string {
+	filter := strings.Join(append([]string{fmt.Sprintf("fps=1/%d", cfg.IntervalSeconds)}, privacy...), ",")
+	if cfg.Width > 0 {
+		filter += fmt.Sprintf(",scale=%d:-2", cfg.Width)
+	}
+
+	return []string{
+		"-map", "0:v:0",
+		"-vf", filter,
+		"-q:v", strconv.Itoa(cfg.Quality),
+		"-f", "image2",
+		"-update", "1",
+		"-y", path,
+	}
+}
+
+// watchSnapshots uploads the snapshot file each time ffmpeg rewrites it.
+func watchSnapshots(ctx context.Context, cfg runtimeConfig, logger *log.Logger) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var lastSent time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(cfg.snapshotPath)
+		if err != nil || !info.ModTime().After(lastSent) {
+			continue
+		}
+
+		if err := uploadSnapshot(ctx, cfg, "interval"); err != nil {
+			if ctx.Err() == nil {
+				logger.Printf("WARN: snapshot upload failed: %v", err)
+			}
+			continue
+		}
+		lastSent = info.ModTime()
+	}
+}
+
+// uploadSnapshot sends the latest snapshot file; its mtime is the capture time.
+func uploadSnapshot(ctx context.Context, cfg runtimeConfig, reason string) error {
+	info, err := os.Stat(cfg.snapshotPath)
+	if err != nil {
+		return fmt.Errorf("no snapshot available: %w", err)
+	}
+
+	data, err := os.ReadFile(cfg.snapshotPath)
+	if err != nil {
+		return err
+	}
+
+	// ffmpeg rewrites the file in place; skip it until the JPEG is complete.
+	if !bytes.HasSuffix(data, []byte{0xff, 0xd9}) {
+		return fmt.Errorf("snapshot %s is incomplete", filepath.Base(cfg.snapshotPath))
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodPost, cfg.snapshotURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to construct snapshot request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "image/jpeg")
+	req.Header.Set("X-Bridge-Id", cfg.raw.BridgeID)
+	req.Header.Set("X-Bridge-Captured-At", info.ModTime().UTC().Format(time.RFC3339Nano))
+	req.Header.Set("X-Bridge-Snapshot-Reason", reason)
+	if strings.TrimSpace(cfg.raw.APIKey) != "" {
+		req.Header.Set("X-Api-Key", cfg.raw.APIKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	cfg.report(ctx, cfg.snapshotURL, err == nil && resp.StatusCode < 500)
+	if err != nil {
+		return fmt.Errorf("failed to send snapshot: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return fmt.Errorf("snapshot endpoint %s rejected the upload with %d: %s", cfg.snapshotURL, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return nil
+}
+
+// runSnapshotCommand uploads the newest still written by a running agent.
+// When that is more than about an interval old, no session is writing it, so
+// a fresh still is grabbed from the camera instead.
+func runSnapshotCommand(ctx context.Context, configPath string) error {
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if !cfg.raw.Snapshot.Enabled {
+		return fmt.Errorf("snapshot.enabled is false in %s", configFileName)
+	}
+
+	maxAge := time.Duration(cfg.raw.Snapshot.IntervalSeconds)*time.Second + 5*time.Second
+	if info, err := os.Stat(cfg.snapshotPath); err == nil && time.Since(info.ModTime()) <= maxAge {
+		return uploadSnapshot(ctx, cfg, "on-demand")
+	}
+	return grabSnapshot(ctx, cfg, "on-demand")
+}
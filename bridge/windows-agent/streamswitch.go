@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	streamSampleInterval = 5 * time.Second
+	// recoveredBacklog is the relay backlog, in seconds of stream, below
+	// which the sub stream counts as comfortably keeping up.
+	recoveredBacklog = 1.0
+	// maxRecoverFactor caps how far repeated fallbacks stretch the recovery
+	// period.
+	maxRecoverFactor = 8
+)
+
+// streamSwitchConfig controls automatic fallback from the camera's main
+// stream to its sub stream when the primary relay cannot keep up.
+type streamSwitchConfig struct {
+	Enabled               bool `json:"enabled"`
+	DowngradeAfterSeconds int  `json:"downgradeAfterSeconds,omitempty"`
+	RecoverAfterSeconds   int  `json:"recoverAfterSeconds,omitempty"`
+	MaxBacklogSeconds     int  `json:"maxBacklogSeconds,omitempty"`
+}
+
+// streamEvent reports a switch between the main and sub stream. The session
+// after it starts with a discontinuity.
+type streamEvent struct {
+	Type   string    `json:"type"`
+	Stream string    `json:"stream"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// linkSample is one interval of the primary relay: how fast ffmpeg produced
+// the stream, how fast it was sent, and how much is still waiting.
+type linkSample struct {
+	streaming bool
+	inputRate float64 // bytes per second
+	sentRate  float64
+	backlog   int64
+}
+
+// backlogSeconds is the backlog in seconds of stream at the input rate.
+func (s linkSample) backlogSeconds() float64 {
+	if s.inputRate <= 0 {
+		return 0
+	}
+	return float64(s.backlog) / s.inputRate
+}
+
+// streamSwitcher decides between the main and sub stream across sessions.
+// It falls back to sub after the relay backlog has stayed above
+// maxBacklogSeconds for downgradeAfterSeconds, and returns to main only
+// after recoverAfterSeconds without a backlog. A fallback soon after a
+// recovery doubles the next recovery period, so a link on the edge does not
+// flap between the two.
+type streamSwitcher struct {
+	logger  *log.Logger
+	changed chan struct{}
+
+	mu             sync.Mutex
+	cfg            streamSwitchConfig
+	onSub          bool
+	congestedSince time.Time
+	healthySince   time.Time
+	recoveredAt    time.Time
+	recoverFactor  int
+}
+
+func newStreamSwitcher(logger *log.Logger) *streamSwitcher {
+	return &streamSwitcher{logger: logger, changed: make(chan struct{}, 1), recoverFactor: 1}
+}
+
+func (s *streamSwitcher) configure(cfg streamSwitchConfig) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cfg = cfg
+	if !cfg.Enabled {
+		s.onSub = false
+	}
+}
+
+// sub reports whether the next session should relay the sub stream.
+func (s *streamSwitcher) sub() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.onSub
+}
+
+// watch samples the primary endpoint for one session until ctx ends and
+// posts an event for every switch.
+func (s *streamSwitcher) watch(ctx context.Context, cfg runtimeConfig, ring *tsRing, mon *endpointMonitor) {
+	ticker := time.NewTicker(streamSampleInterval)
+	defer ticker.Stop()
+
+	prev, prevProduced, prevAt := mon.snapshot(), ring.produced(), time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			cur, produced := mon.snapshot(), ring.produced()
+			elapsed := now.Sub(prevAt).Seconds()
+			sample := linkSample{
+				streaming: cur.State == endpointStreaming && prev.State == endpointStreaming,
+				inputRate: float64(produced-prevProduced) / elapsed,
+				sentRate:  float64(cur.BytesSent-prev.BytesSent) / elapsed,
+				backlog:   cur.BufferedBytes,
+			}
+			prev, prevProduced, prevAt = cur, produced, now
+
+			if reason, switched := s.evaluate(sample, now); switched {
+				ev := streamEvent{Type: "stream", Stream: streamMain, Reason: reason, At: now}
+				if s.sub() {
+					ev.Stream = streamSub
+				}
+				// The session is about to be stopped for the switch; the
+				// event must outlive it.
+				go func() {
+					if err := postEvent(context.WithoutCancel(ctx), cfg, ev); err != nil {
+						s.logger.Printf("WARN: event upload failed: %v", err)
+					}
+				}()
+			}
+		}
+	}
+}
+
+// evaluate applies one sample and reports whether it switched streams, and
+// why.
+func (s *streamSwitcher) evaluate(sample linkSample, now time.Time) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.cfg.Enabled || !sample.streaming {
+		// An outage is for the reconnect and failover logic, not a slow link.
+		s.congestedSince, s.healthySince = time.Time{}, time.Time{}
+		return "", false
+	}
+	backlog := sample.backlogSeconds()
+
+	if !s.onSub {
+		if backlog <= float64(s.cfg.MaxBacklogSeconds) {
+			s.congestedSince = time.Time{}
+			return "", false
+		}
+		if s.congestedSince.IsZero() {
+			s.congestedSince = now
+		}
+		congested := now.Sub(s.congestedSince)
+		if congested < time.Duration(s.cfg.DowngradeAfterSeconds)*time.Second {
+			return "", false
+		}
+
+		if !s.recoveredAt.IsZero() && now.Sub(s.recoveredAt) < s.recoverAfterLocked() && s.recoverFactor < maxRecoverFactor {
+			s.recoverFactor *= 2
+		} else {
+			s.recoverFactor = 1
+		}
+		reason := fmt.Sprintf("relay backlog %.1f s, sending %.0f of %.0f kbit/s for %s",
+			backlog, sample.sentRate*8/1000, sample.inputRate*8/1000, congested.Round(time.Second))
+		s.logger.Printf("Switching to sub stream: %s", reason)
+		s.switchLocked(true)
+		return reason, true
+	}
+
+	if backlog >= recoveredBacklog {
+		s.healthySince = time.Time{}
+		return "", false
+	}
+	if s.healthySince.IsZero() {
+		s.healthySince = now
+	}
+	healthy := now.Sub(s.healthySince)
+	if healthy < s.recoverAfterLocked() {
+		return "", false
+	}
+	reason := fmt.Sprintf("no relay backlog for %s", healthy.Round(time.Second))
+	s.logger.Printf("Switching back to main stream: %s", reason)
+	s.switchLocked(false)
+	s.recoveredAt = now
+	return reason, true
+}
+
+func (s *streamSwitcher) recoverAfterLocked() time.Duration {
+	return time.Duration(s.cfg.RecoverAfterSeconds*s.recoverFactor) * time.Second
+}
+
+func (s *streamSwitcher) switchLocked(sub bool) {
+	s.onSub = sub
+	s.congestedSince, s.healthySince = time.Time{}, time.Time{}
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func TestStreamSwitcherHysteresis(t *testing.T) {
+	s := newStreamSwitcher(log.New(io.Discard, "", 0))
+	s.configure(streamSwitchConfig{Enabled: true, DowngradeAfterSeconds: 20, RecoverAfterSeconds: 60, MaxBacklogSeconds: 6})
+
+	// A 4 Mbit/s main stream; backlog is given in seconds of it.
+	const rate = 500_000
+	sample := func(backlog float64) linkSample {
+		return linkSample{streaming: true, inputRate: rate, sentRate: rate / 2, backlog: int64(backlog * rate)}
+	}
+	now := time.Unix(1_700_000_000, 0)
+	step := func(ls linkSample) bool {
+		now = now.Add(streamSampleInterval)
+		_, switched := s.evaluate(ls, now)
+		return switched
+	}
+	run := func(d time.Duration, ls linkSample) bool {
+		for end := now.Add(d); now.Before(end); {
+			if step(ls) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// A backlog spike shorter than downgradeAfterSeconds is ridden out, and
+	// an outage does not count as congestion.
+	if run(15*time.Second, sample(10)) || step(sample(1)) {
+		t.Fatal("switched on a short spike")
+	}
+	if run(time.Minute, linkSample{backlog: 100 * rate}) {
+		t.Fatal("switched during an outage")
+	}
+
+	// Sustained congestion falls back to sub after about 20 s.
+	start := now
+	if !run(time.Minute, sample(10)) || !s.sub() {
+		t.Fatal("did not switch to sub")
+	}
+	if d := now.Sub(start); d < 20*time.Second || d > 30*time.Second {
+		t.Errorf("switched to sub after %s, want about 20s", d)
+	}
+	select {
+	case <-s.changed:
+	default:
+		t.Error("switch was not signalled")
+	}
+
+	// Recovery needs the whole period without backlog; a blip restarts it.
+	if run(50*time.Second, sample(0)) || step(sample(2)) {
+		t.Fatal("switched back too early")
+	}
+	start = now
+	if !run(2*time.Minute, sample(0)) || s.sub() {
+		t.Fatal("did not switch back to main")
+	}
+	if d := now.Sub(start); d < time.Minute {
+		t.Errorf("switched back after %s, want at least 1m", d)
+	}
+
+	// Falling back again straight away doubles the next recovery period.
+	if !run(time.Minute, sample(10)) {
+		t.Fatal("did not switch to sub again")
+	}
+	start = now
+	if !run(5*time.Minute, sample(0)) {
+		t.Fatal("did not recover again")
+	}
+	if d := now.Sub(start); d < 2*time.Minute {
+		t.Errorf("second recovery after %s, want at least 2m", d)
+	}
+}
+
+func TestStreamSwitcherDisabled(t *testing.T) {
+	s := newStreamSwitcher(log.New(io.Discard, "", 0))
+	s.configure(streamSwitchConfig{Enabled: false, DowngradeAfterSeconds: 5, RecoverAfterSeconds: 5, MaxBacklogSeconds: 1})
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		now = now.Add(streamSampleInterval)
+		if _, switched := s.evaluate(linkSample{streaming: true, inputRate: 1000, backlog: 100_000}, now); switched {
+			t.Fatal("a disabled switcher switched")
+		}
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	tsPacketSize = 188
+	tsSyncByte   = 0x47
+)
+
+// errReaderClosed is returned by a ringReader after Close, which the HTTP
+// transport calls when a relay connection ends.
+var errReaderClosed = errors.New("relay connection closed")
+
+// tsRing is a bounded buffer of whole MPEG-TS packets between ffmpeg and the
+// relay connection. Positions are absolute byte offsets into ffmpeg's output,
+// so a reader that falls behind can tell how much it lost. Keyframes (video
+// packets with the random access indicator, the video PID taken from the
+// PMT) and the latest PAT/PMT are remembered so
+// a reader can restart where a player can decode, and each packet's arrival
+// time is kept for framed relaying.
+type tsRing struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	buf        []byte
+	stamps     []int64
+	start, end int64
+	keyframes  []int64
+	pat, pmt   []byte
+	pmtPID     int
+	videoPID   int
+	closed     bool
+}
+
+func newTSRing(size int) *tsRing {
+	size -= size % tsPacketSize
+	if size < 64*tsPacketSize {
+		size = 64 * tsPacketSize
+	}
+	r := &tsRing{buf: make([]byte, size), stamps: make([]int64, size/tsPacketSize), pmtPID: -1, videoPID: -1}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// fill copies packets from src until it ends, re-synchronising on the sync
+// byte if ffmpeg's output is ever misaligned. The ring is closed on return.
+func (r *tsRing) fill(src io.Reader) error {
+	defer r.close()
+
+	br := bufio.NewReaderSize(src, 64*tsPacketSize)
+	pkt := make([]byte, tsPacketSize)
+	for {
+		if _, err := io.ReadFull(br, pkt); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		if pkt[0] != tsSyncByte {
+			// Drop bytes up to the next sync byte and read a fresh packet.
+			i := 1
+			for i < tsPacketSize && pkt[i] != tsSyncByte {
+				i++
+			}
+			n := copy(pkt, pkt[i:])
+			if _, err := io.ReadFull(br, pkt[n:]); err != nil {
+				return nil
+			}
+			if pkt[0] != tsSyncByte {
+				continue
+			}
+		}
+		r.append(pkt)
+	}
+}
+
+func (r *tsRing) append(pkt []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	switch {
+	case pid == 0:
+		r.pat = append(r.pat[:0], pkt...)
+		if p := patPMTPID(pkt); p >= 0 {
+			r.pmtPID = p
+		}
+	case pid == r.pmtPID:
+		r.pmt = append(r.pmt[:0], pkt...)
+		if p := pmtVideoPID(pkt); p >= 0 {
+			r.videoPID = p
+		}
+	case pid == r.videoPID && randomAccess(pkt):
+		r.keyframes = append(r.keyframes, r.end)
+	}
+
+	size := int64(len(r.buf))
+	if r.end-r.start == size {
+		r.start += tsPacketSize
+		for len(r.keyframes) > 0 && r.keyframes[0] < r.start {
+			r.keyframes = r.keyframes[1:]
+		}
+	}
+	copy(r.buf[r.end%size:], pkt)
+	r.stamps[r.end/tsPacketSize%int64(len(r.stamps))] = time.Now().UnixNano()
+	r.end += tsPacketSize
+	r.cond.Broadcast()
+}
+
+// stampLocked returns when the packet holding pos arrived from ffmpeg.
+func (r *tsRing) stampLocked(pos int64) time.Time {
+	if pos >= r.end {
+		return time.Now()
+	}
+	return time.Unix(0, r.stamps[pos/tsPacketSize%int64(len(r.stamps))])
+}
+
+func (r *tsRing) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+}
+
+// ended reports whether ffmpeg's output has ended.
+func (r *tsRing) ended() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed
+}
+
+// done reports whether ffmpeg's output has ended and pos has reached it.
+func (r *tsRing) done(pos int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closed && pos >= r.end
+}
+
+// produced returns how many bytes ffmpeg has written to the ring.
+func (r *tsRing) produced() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.end
+}
+
+// buffered returns how many bytes after pos are still held.
+func (r *tsRing) buffered(pos int64) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if pos < r.start {
+		pos = r.start
+	}
+	return r.end - pos
+}
+
+// reader returns a reader starting at pos. With resume set (a reconnect), it
+// starts at the first keyframe at or after pos instead, preceded by the
+// latest PAT/PMT; everything skipped counts as lost.
+func (r *tsRing) reader(pos int64, resume bool) *ringReader {
+	rr := &ringReader{ring: r, pos: pos, resync: resume}
+	if resume {
+		// Seek now when possible, so the loss is known before the first Read.
+		r.mu.Lock()
+		if rr.pos < r.start {
+			rr.lost += r.start - rr.pos
+			rr.pos = r.start
+		}
+		rr.seekLocked()
+		r.mu.Unlock()
+	}
+	return rr
+}
+
+// liveReader returns a reader starting at the newest buffered keyframe, for
+// a consumer that joins mid-stream and wants the least delay.
+func (r *tsRing) liveReader() *ringReader {
+	r.mu.Lock()
+	pos := r.end
+	if n := len(r.keyframes); n > 0 {
+		pos = r.keyframes[n-1]
+	}
+	r.mu.Unlock()
+	return r.reader(pos, true)
+}
+
+// ringReader streams the ring to one relay connection.
+type ringReader struct {
+	ring    *tsRing
+	pos     int64
+	resync  bool
+	jumped  bool
+	pending []byte
+	lost    int64
+	closed  bool
+}
+
+// tsChunk is a run of packets handed out by readChunk. headers marks a
+// repeated PAT/PMT that is not part of ffmpeg's output at offset; jumped
+// marks the first chunk after skipped bytes.
+type tsChunk struct {
+	data     []byte
+	offset   int64
+	captured time.Time
+	headers  bool
+	jumped   bool
+}
+
+// Read blocks until packets are available, the ring closes (io.EOF) or the
+// reader is closed.
+func (rr *ringReader) Read(p []byte) (int, error) {
+	c, err := rr.readChunk(p)
+	return len(c.data), err
+}
+
+// readChunk fills p like Read and describes what it returned.
+func (rr *ringReader) readChunk(p []byte) (tsChunk, error) {
+	r := rr.ring
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		if rr.closed {
+			return tsChunk{}, errReaderClosed
+		}
+		if len(rr.pending) > 0 {
+			n := copy(p, rr.pending)
+			rr.pending = rr.pending[n:]
+			return tsChunk{data: p[:n], offset: rr.pos, captured: r.stampLocked(rr.pos), headers: true, jumped: rr.takeJump()}, nil
+		}
+		if rr.pos < r.start {
+			// Overrun while the link was slow or down.
+			rr.lost += r.start - rr.pos
+			rr.pos = r.start
+			rr.resync = true
+		}
+		if rr.resync && rr.seekLocked() && len(rr.pending) > 0 {
+			continue
+		}
+		if !rr.resync && rr.pos < r.end {
+			break
+		}
+		if r.closed {
+			return tsChunk{}, io.EOF
+		}
+		r.cond.Wait()
+	}
+
+	size := int64(len(r.buf))
+	off := rr.pos % size
+	n := int64(len(p))
+	if avail := r.end - rr.pos; n > avail {
+		n = avail
+	}
+	if n > size-off {
+		n = size - off
+	}
+	copy(p, r.buf[off:off+n])
+	c := tsChunk{data: p[:n], offset: rr.pos, captured: r.stampLocked(rr.pos), jumped: rr.takeJump()}
+	rr.pos += n
+	return c, nil
+}
+
+func (rr *ringReader) takeJump() bool {
+	j := rr.jumped
+	rr.jumped = false
+	return j
+}
+
+// seekLocked moves to the first keyframe at or after pos and queues the
+// PAT/PMT in front of it. It reports false while no such keyframe exists.
+func (rr *ringReader) seekLocked() bool {
+	r := rr.ring
+	for _, k := range r.keyframes {
+		if k < rr.pos {
+			continue
+		}
+		rr.lost += k - rr.pos
+		rr.pos = k
+		rr.resync = false
+		rr.jumped = true
+		rr.pending = append(append(rr.pending[:0], r.pat...), r.pmt...)
+		return true
+	}
+	return false
+}
+
+// Close unblocks a pending Read.
+func (rr *ringReader) Close() error {
+	rr.ring.mu.Lock()
+	defer rr.ring.mu.Unlock()
+	rr.closed = true
+	rr.ring.cond.Broadcast()
+	return nil
+}
+
+// position returns the absolute offset the reader has handed out and the
+// bytes it skipped.
+func (rr *ringReader) position() (int64, int64) {
+	rr.ring.mu.Lock()
+	defer rr.ring.mu.Unlock()
+	return rr.pos, rr.lost
+}
+
+// randomAccess reports whether a packet's adaptation field carries the random
+// access indicator, which ffmpeg sets on the first packet of a keyframe. It
+// also sets it on audio frames, so only the video PID's packets count.
+func randomAccess(pkt []byte) bool {
+	return pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x40 != 0
+}
+
+// patPMTPID returns the PMT PID of the first program in a PAT packet, or -1.
+func patPMTPID(pkt []byte) int {
+	if pkt[1]&0x40 == 0 || pkt[3]&0x10 == 0 {
+		return -1
+	}
+	payload := pkt[4:]
+	if pkt[3]&0x20 != 0 {
+		if 5+int(pkt[4]) >= len(pkt) {
+			return -1
+		}
+		payload = pkt[5+int(pkt[4]):]
+	}
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return -1
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 8 {
+		return -1
+	}
+	end := 3 + (int(section[1]&0x0f)<<8 | int(section[2])) - 4 // minus CRC
+	if end > len(section) {
+		end = len(section)
+	}
+	for i := 8; i+4 <= end; i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			return int(section[i+2]&0x1f)<<8 | int(section[i+3])
+		}
+	}
+	return -1
+}
+
+// pmtVideoPID returns the PID of the first video stream in a PMT packet, or -1.
+func pmtVideoPID(pkt []byte) int {
+	if pkt[1]&0x40 == 0 {
+		return -1
+	}
+	s := psiSection(tsPayload(pkt))
+	if len(s) < 12 || s[0] != 0x02 {
+		return -1
+	}
+	for i := 12 + (int(s[10]&0x0f)<<8 | int(s[11])); i+5 <= len(s); i += 5 + (int(s[i+3]&0x0f)<<8 | int(s[i+4])) {
+		switch s[i] {
+		case 0x01, 0x02, 0x10, streamH264, streamH265:
+			return int(s[i+1]&0x1f)<<8 | int(s[i+2])
+		}
+	}
+	return -1
+}
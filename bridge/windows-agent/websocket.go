@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/difae/windows-agent/relayframe"
+)
+
+const (
+	transportPost      = "post"
+	transportWebSocket = "websocket"
+
+	wsGUID          = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsPingInterval  = 15 * time.Second
+	wsIdleTimeout   = 3 * wsPingInterval
+	wsWriteTimeout  = 30 * time.Second
+	wsHandshakeWait = 15 * time.Second
+	wsMaxControl    = 125
+	wsMaxIncoming   = 1 << 20
+	wsMessageSize   = 64 << 10
+
+	wsOpText   = 0x1
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xa
+)
+
+// wsHandshakeError means the backend was reachable but the upgrade failed:
+// the endpoint or a proxy answered with something other than 101, or cut
+// the connection. A chunked POST is the better bet then.
+type wsHandshakeError struct {
+	status int
+	err    error
+	url    string
+}
+
+func (e *wsHandshakeError) Error() string {
+	if e.err != nil {
+		return fmt.Sprintf("websocket upgrade to %s failed: %v", e.url, e.err)
+	}
+	return fmt.Sprintf("websocket upgrade to %s refused with %d", e.url, e.status)
+}
+
+// wsConn is the client side of a WebSocket connection (RFC 6455). Writes
+// come from the sender, the pinger and the pong replies, so they share a lock.
+type wsConn struct {
+	conn net.Conn
+	br   *bufio.Reader
+	wmu  sync.Mutex
+	mask []byte
+}
+
+// dialWebSocket upgrades a connection to rawURL (http or https), tunnelling
+// through the environment's HTTP proxy with CONNECT when one is configured.
+// It returns the 101 response so the caller can read negotiated headers.
+func dialWebSocket(ctx context.Context, rawURL string, header http.Header) (*wsConn, *http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid relay URL '%s': %w", rawURL, err)
+	}
+	secure := u.Scheme == "https"
+	if !secure && u.Scheme != "http" {
+		return nil, nil, fmt.Errorf("relay URL '%s' must be http or https", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		if secure {
+			addr = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			addr = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	dialCtx, cancel := context.WithTimeout(ctx, wsHandshakeWait)
+	defer cancel()
+
+	proxy, err := http.ProxyFromEnvironment(&http.Request{URL: u})
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid proxy configuration: %w", err)
+	}
+
+	var dialer net.Dialer
+	var conn net.Conn
+	if proxy != nil {
+		conn, err = dialProxy(dialCtx, &dialer, proxy, addr)
+	} else {
+		conn, err = dialer.DialContext(dialCtx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := dialCtx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if secure {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname(), NextProtos: []string{"http/1.1"}})
+		if err := tlsConn.HandshakeContext(dialCtx); err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("TLS handshake with %s failed: %w", u.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, &wsHandshakeError{err: err, url: rawURL}
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, &wsHandshakeError{err: err, url: rawURL}
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		conn.Close()
+		if resp.StatusCode >= 500 {
+			// Gateways answer 5xx while the backend restarts; retry as is.
+			return nil, resp, fmt.Errorf("websocket upgrade to %s answered %d", rawURL, resp.StatusCode)
+		}
+		return nil, resp, &wsHandshakeError{status: resp.StatusCode, url: rawURL}
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		conn.Close()
+		return nil, resp, &wsHandshakeError{status: resp.StatusCode, url: rawURL}
+	}
+
+	_ = conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, br: br, mask: make([]byte, 4)}, resp, nil
+}
+
+// dialProxy opens a CONNECT tunnel to addr through an HTTP or HTTPS proxy.
+func dialProxy(ctx context.Context, dialer *net.Dialer, proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		if proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach proxy %s: %w", proxy.Host, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %w", proxy.Host, err)
+		}
+		conn = tlsConn
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %w", proxy.Host, err)
+	}
+
+	// The proxy sends nothing after its answer until the tunnel is used, so
+	// a buffered reader cannot swallow any of the upgrade response.
+	resp, err := http.ReadResponse(bufio.NewReaderSize(conn, 1), req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %w", proxy.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s with %d", proxy.Host, addr, resp.StatusCode)
+	}
+	return conn, nil
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeFrame sends one unfragmented, masked frame.
+func (c *wsConn) writeFrame(op byte, payload []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	header := make([]byte, 2, 14)
+	header[0] = 0x80 | op
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = 0x80 | byte(n)
+	case n <= 0xffff:
+		header[1] = 0x80 | 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 0x80 | 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if _, err := rand.Read(c.mask); err != nil {
+		return err
+	}
+	header = append(header, c.mask...)
+
+	frame := make([]byte, len(header)+len(payload))
+	copy(frame, header)
+	masked := frame[len(header):]
+	for i, b := range payload {
+		masked[i] = b ^ c.mask[i%4]
+	}
+
+	_ = c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// readFrame returns the next frame from the server. Fragments are returned
+// as they arrive; the relay only acts on control frames.
+func (c *wsConn) readFrame() (byte, []byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(c.br, h[:]); err != nil {
+		return 0, nil, err
+	}
+	op := h[0] & 0x0f
+	size := uint64(h[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if op >= wsOpClose && size > wsMaxControl {
+		return 0, nil, fmt.Errorf("websocket control frame of %d bytes", size)
+	}
+	if size > wsMaxIncoming {
+		return 0, nil, fmt.Errorf("websocket frame of %d bytes exceeds %d", size, wsMaxIncoming)
+	}
+	var mask [4]byte
+	masked := h[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return op, payload, nil
+}
+
+// close sends a close frame with code and shuts the connection.
+func (c *wsConn) close(code uint16) {
+	_ = c.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+	_ = c.conn.Close()
+}
+
+// sendWebSocket streams the relay as binary messages over one WebSocket
+// connection until either side ends it, pinging every wsPingInterval so
+// proxies see traffic and a dead link is noticed within wsIdleTimeout. The
+// framed protocol is negotiated on the upgrade itself; when agreed, each
+// message carries one relay frame. Text messages from the backend are control
+// messages, acknowledged with text messages on the same connection, or
+// ignored without controls.
+func sendWebSocket(ctx context.Context, cfg runtimeConfig, open func(framed bool) io.ReadCloser, onAccepted func(status int, framed bool), controls *relayControls) (bool, error) {
+	header := make(http.Header)
+	setBridgeHeaders(&http.Request{Header: header}, cfg)
+	if cfg.raw.Relay.Framed {
+		header.Set(relayframe.ProtocolHeader, relayframe.Protocol)
+	}
+
+	ws, resp, err := dialWebSocket(ctx, cfg.relay, header)
+	if err != nil {
+		return false, err
+	}
+	framed := cfg.raw.Relay.Framed && resp.Header.Get(relayframe.ProtocolHeader) == relayframe.Protocol
+	body := open(framed)
+	onAccepted(resp.StatusCode, framed)
+
+	done := make(chan struct{})
+	readErr := make(chan error, 1)
+	var stop sync.Once
+	shutdown := func() {
+		stop.Do(func() {
+			close(done)
+			body.Close()
+		})
+	}
+	defer shutdown()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.close(1001)
+		case <-done:
+		}
+	}()
+
+	// Control messages run one at a time, away from the read loop, so a slow
+	// snapshot never delays a pong.
+	commands := make(chan []byte, 16)
+	go func() {
+		ack := func(a controlAck) error {
+			data, err := json.Marshal(a)
+			if err != nil {
+				return err
+			}
+			return ws.writeFrame(wsOpText, data)
+		}
+		for {
+			select {
+			case <-done:
+				return
+			case line := <-commands:
+				controls.dispatch(ctx, cfg, line, ack)
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			_ = ws.conn.SetReadDeadline(time.Now().Add(wsIdleTimeout))
+			op, payload, err := ws.readFrame()
+			if err != nil {
+				readErr <- err
+				shutdown()
+				return
+			}
+			switch op {
+			case wsOpPing:
+				_ = ws.writeFrame(wsOpPong, payload)
+			case wsOpText:
+				if controls == nil {
+					continue
+				}
+				select {
+				case commands <- payload:
+				default:
+					controls.logger.Printf("WARN: dropping control message; %d are already queued", cap(commands))
+				}
+			case wsOpClose:
+				ws.close(1000)
+				readErr <- errors.New("relay endpoint closed the connection")
+				shutdown()
+				return
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(wsPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := ws.writeFrame(wsOpPing, nil); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, wsMessageSize)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if werr := ws.writeFrame(wsOpBinary, buf[:n]); werr != nil {
+				ws.conn.Close()
+				select {
+				case rerr := <-readErr:
+					return true, rerr
+				default:
+				}
+				return true, fmt.Errorf("failed to write to relay websocket: %w", werr)
+			}
+		}
+		if err == nil {
+			continue
+		}
+		select {
+		case rerr := <-readErr:
+			ws.conn.Close()
+			return true, rerr
+		default:
+		}
+		if errors.Is(err, io.EOF) {
+			ws.close(1000)
+			return true, errors.New("relay stream ended")
+		}
+		ws.conn.Close()
+		return true, err
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/evidence"
+	"github.com/difaeai/windows-agent/internal/localapi"
+	"github.com/difaeai/windows-agent/internal/recorder"
+)
+
+// runExportCommand writes an evidence bundle for a time range of the local
+// recordings. It only reads the index, so it is safe while the agent runs.
+func runExportCommand(args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	fromFlag := flags.String("from", "", "start of the range (RFC 3339 or Unix seconds)")
+	toFlag := flags.String("to", "", "end of the range (default now)")
+	output := flags.String("o", "", "bundle path (default evidence-<bridge>-<from>.zip)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	from, err := localapi.ParseTime(*fromFlag)
+	if err != nil {
+		return fmt.Errorf("invalid -from: %w", err)
+	}
+	to := time.Now()
+	if *toFlag != "" {
+		if to, err = localapi.ParseTime(*toFlag); err != nil {
+			return fmt.Errorf("invalid -to: %w", err)
+		}
+	}
+	if !to.After(from) || to.Sub(from) > evidence.MaxRange {
+		return fmt.Errorf("-to must be after -from and within %s", evidence.MaxRange)
+	}
+
+	cfg, err := config.LoadFromExecutable()
+	if err != nil {
+		return err
+	}
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot locate executable: %w", err)
+	}
+	key, err := evidence.LoadKey(evidence.KeyPath(exePath))
+	if err != nil {
+		return fmt.Errorf("no signing key (run the agent once to create it): %w", err)
+	}
+	index, err := recorder.LoadIndex(recordingDir(cfg, filepath.Dir(exePath)))
+	if err != nil {
+		return err
+	}
+
+	exporter := &evidence.Exporter{Index: index, Key: key, BridgeID: cfg.BridgeID, Camera: cfg.RtspURL, AgentVersion: agentVersion}
+	chunks := index.Range(from, to)
+	if err := exporter.Check(chunks); err != nil {
+		return err
+	}
+
+	path := *output
+	if path == "" {
+		path = evidence.BundleName(cfg.BridgeID, from)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create bundle: %w", err)
+	}
+
+	manifest, err := exporter.Write(f, from, to, chunks)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return err
+	}
+
+	logger.Printf("Evidence bundle saved to %s (%d segments, signed by %s)", path, len(manifest.Segments), manifest.Fingerprint)
+	return nil
+}
+
+// runVerifyCommand checks a bundle offline and prints what it covers.
+func runVerifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	trusted := flags.String("key", "", "require this signer (base64 public key or SHA256: fingerprint)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: agent verify [-key KEY] bundle.zip")
+	}
+
+	manifest, err := evidence.Verify(flags.Arg(0), *trusted)
+	if manifest.Format != "" {
+		fmt.Printf("Bridge:    %s\n", manifest.BridgeID)
+		fmt.Printf("Camera:    %s\n", manifest.Camera)
+		fmt.Printf("Range:     %s to %s\n", manifest.From.Format(time.RFC3339), manifest.To.Format(time.RFC3339))
+		fmt.Printf("Exported:  %s (agent %s)\n", manifest.ExportedAt.Format(time.RFC3339), manifest.AgentVersion)
+		fmt.Printf("Signed by: %s\n", manifest.Fingerprint)
+		fmt.Printf("Segments:  %d\n", len(manifest.Segments))
+	}
+	if err != nil {
+		return err
+	}
+
+	if *trusted == "" {
+		fmt.Println("Bundle is intact. Compare the signer fingerprint with the one registered for this bridge, or pass -key.")
+	} else {
+		fmt.Println("Bundle is intact and signed by the trusted key.")
+	}
+	return nil
+}
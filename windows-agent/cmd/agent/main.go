@@ -3,7 +3,9 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/ed25519"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -11,18 +13,82 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/difaeai/windows-agent/internal/abr"
 	"github.com/difaeai/windows-agent/internal/api"
+	"github.com/difaeai/windows-agent/internal/clip"
 	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/events"
+	"github.com/difaeai/windows-agent/internal/evidence"
+	"github.com/difaeai/windows-agent/internal/failover"
+	"github.com/difaeai/windows-agent/internal/fanout"
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+	"github.com/difaeai/windows-agent/internal/llhls"
+	"github.com/difaeai/windows-agent/internal/localapi"
 	"github.com/difaeai/windows-agent/internal/logging"
+	"github.com/difaeai/windows-agent/internal/motion"
+	"github.com/difaeai/windows-agent/internal/presence"
+	"github.com/difaeai/windows-agent/internal/privacy"
+	"github.com/difaeai/windows-agent/internal/push"
+	"github.com/difaeai/windows-agent/internal/recorder"
+	"github.com/difaeai/windows-agent/internal/rtspprobe"
+	"github.com/difaeai/windows-agent/internal/rtspserver"
+	"github.com/difaeai/windows-agent/internal/sampler"
+	"github.com/difaeai/windows-agent/internal/schedule"
+	"github.com/difaeai/windows-agent/internal/snapshot"
+	"github.com/difaeai/windows-agent/internal/streamswitch"
+	"github.com/difaeai/windows-agent/internal/tamper"
 	"github.com/difaeai/windows-agent/internal/uploader"
+	"github.com/difaeai/windows-agent/internal/vod"
 )
 
 const agentVersion = "1.0.0"
 
+// services are the long-lived helpers that attach to every pipeline run.
+type services struct {
+	upl     *uploader.Uploader
+	rec     *recorder.Recorder
+	clipper *clip.Clipper
+	tamper  *tamper.Detector
+	motion  *motion.Detector
+	sampler *sampler.Sampler
+	pusher  *push.Pusher
+	rtsp    *rtspserver.Server
+}
+
 func main() {
 	logger := logging.New()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "snapshot":
+			if err := runSnapshotCommand(os.Args[2:], logger); err != nil {
+				logger.Fatalf("snapshot failed: %v", err)
+			}
+			return
+		case "export":
+			if err := runExportCommand(os.Args[2:], logger); err != nil {
+				logger.Fatalf("export failed: %v", err)
+			}
+			return
+		case "verify":
+			if err := runVerifyCommand(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "VERIFICATION FAILED: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		case "probe":
+			if err := runProbeCommand(os.Args[2:]); err != nil {
+				fmt.Fprintf(os.Stderr, "PROBE FAILED: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	logger.Println("Agent started")
 
 	cfg, err := config.LoadFromExecutable()
@@ -36,7 +102,22 @@ func main() {
 
 	logger.Printf("Loaded config for bridge %s", cfg.BridgeID)
 	logger.Printf("Connecting to backend %s", cfg.BackendURL)
-	logger.Printf("Testing RTSP URL at %s", cfg.RtspURL)
+	if len(cfg.Backends) > 1 {
+		logger.Printf("Backend failover enabled (%s)", strings.Join(cfg.Backends, ", "))
+	}
+	logger.Printf("Testing RTSP URL at %s", logging.RedactURL(cfg.RtspURL))
+	if cfg.LowLatency.Enabled {
+		logger.Printf("Low-latency HLS enabled (%dms parts, %dms segments)", cfg.LowLatency.PartDurationMs, cfg.LowLatency.SegmentDurationMs)
+	}
+	if cfg.Audio.Mode != config.AudioOff {
+		logger.Printf("Audio enabled (mode %s)", cfg.Audio.Mode)
+	}
+	if privacy.Active(cfg.Privacy) {
+		logger.Printf("Privacy masks/overlays enabled (%d masks, %d overlays); video is transcoded with libx264", len(cfg.Privacy.Masks), len(cfg.Privacy.Overlays))
+	}
+	if cfg.ABR.Enabled {
+		logger.Printf("Adaptive bitrate enabled (variants: %s)", strings.Join(abr.Names(cfg.ABR), ", "))
+	}
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer stop()
@@ -44,11 +125,211 @@ func main() {
 	exePath, _ := os.Executable()
 	baseDir := filepath.Dir(exePath)
 	workDir := filepath.Join(baseDir, "hls")
+	signingKey, created, err := evidence.LoadOrCreateKey(evidence.KeyPath(exePath))
+	if err != nil {
+		logger.Printf("Evidence signing unavailable: %v", err)
+	} else if created {
+		logger.Printf("Created evidence signing key %s", evidence.Fingerprint(signingKey.Public().(ed25519.PublicKey)))
+	}
+	backends := failover.New(cfg, logger)
 	upl := uploader.New(cfg.UploadBaseURL, cfg.BridgeID, cfg.APIKey, logger)
+	upl.Backends = backends
+	go backends.Run(ctx)
+	logger.Printf("Active backend: %s", backends.Active())
+
+	// running is set while a pipeline is writing fresh segments.
+	var running atomic.Bool
+	if cfg.Snapshot.Enabled {
+		logger.Printf("Snapshots enabled every %ds", cfg.Snapshot.IntervalSeconds)
+		snapshotter := snapshot.New(cfg.Snapshot, snapshotSource(cfg, workDir), upl, logger)
+		snapshotter.Gate = running.Load
+		go snapshotter.Run(ctx)
+	}
+
+	svc := services{upl: upl}
+	if cfg.Recording.Enabled {
+		svc.rec, err = openRecorder(cfg, baseDir, logger)
+		if err != nil {
+			logger.Fatalf("recording setup failed: %v", err)
+		}
+		go svc.rec.Retain(ctx)
+	}
+
+	if cfg.Clips.Enabled {
+		logger.Printf("Event clips enabled (%ds pre-roll, %ds post-roll)", cfg.Clips.PreRollSeconds, cfg.Clips.PostRollSeconds)
+		svc.clipper = clip.New(cfg.Clips, cfg.BridgeID, upl, logger)
+		go svc.clipper.Run(ctx)
+		go svc.clipper.Poll(ctx, time.Duration(cfg.PollIntervalMs)*time.Millisecond)
+	}
+
+	queue := events.New(upl, logger)
+	go queue.Run(ctx)
+	backends.OnSwitch = func(from, to, reason string) {
+		queue.Send(failover.Event{Type: "failover", From: from, To: to, Reason: reason, At: time.Now()})
+	}
+
+	if cfg.Tamper.Enabled {
+		logger.Printf("Tamper detection enabled (%d fps analysis)", cfg.Tamper.AnalysisFps)
+		svc.tamper = tamper.New(cfg.Tamper, queue, logger)
+	}
+
+	if cfg.Motion.Enabled {
+		logger.Printf("Motion detection enabled (%dx%d at %d fps, sensitivity %d)", cfg.Motion.Width, cfg.Motion.Height, cfg.Motion.Fps, cfg.Motion.Sensitivity)
+		svc.motion = motion.New(cfg.Motion, queue, logger)
+		if cfg.Motion.TriggerClips && svc.clipper != nil {
+			clipper := svc.clipper
+			svc.motion.OnStart = func(ev motion.Event) {
+				box := fmt.Sprintf("%.3f,%.3f,%.3f,%.3f", ev.Box.X, ev.Box.Y, ev.Box.Width, ev.Box.Height)
+				if _, err := clipper.Trigger(clip.Event{Reason: "motion", At: ev.Start, Metadata: map[string]string{"box": box}}); err != nil {
+					logger.Printf("Motion clip not triggered: %v", err)
+				}
+			}
+		}
+	}
+
+	if cfg.Sampler.Enabled {
+		logger.Printf("Frame sampler enabled (%s, %g fps)", cfg.Sampler.Mode, cfg.Sampler.Fps)
+		svc.sampler = sampler.New(cfg.Sampler, cfg.Privacy, cfg.BridgeID, upl, logger)
+		if cfg.Sampler.Mode == config.SamplerMotion && svc.motion != nil {
+			svc.sampler.Gate = svc.motion.Active
+		}
+		go svc.sampler.Run(ctx)
+	}
+
+	if len(cfg.Outputs) > 0 {
+		names := make([]string, len(cfg.Outputs))
+		for i, out := range cfg.Outputs {
+			names[i] = out.Name + " " + logging.RedactURL(out.URL)
+		}
+		logger.Printf("Push outputs enabled (%s)", strings.Join(names, ", "))
+		svc.pusher = push.New(cfg, queue, logger)
+	}
+
+	if cfg.RTSPServer.Enabled {
+		logger.Printf("Local RTSP server enabled (rtsp://%s%s, up to %d clients)", cfg.RTSPServer.Listen, cfg.RTSPServer.Path, cfg.RTSPServer.MaxClients)
+		svc.rtsp = rtspserver.New(cfg.RTSPServer, logger)
+		go func() {
+			if err := svc.rtsp.Run(ctx); err != nil {
+				logger.Printf("Local RTSP server stopped: %v", err)
+			}
+		}()
+	}
+
+	gate, err := schedule.New(cfg, filepath.Join(baseDir, schedule.StateFilename), upl, queue, logger)
+	if err != nil {
+		logger.Fatalf("schedule setup failed: %v", err)
+	}
+	if cfg.Schedule.Enabled {
+		logger.Printf("Streaming schedule enabled (%d windows, %d holidays)", len(cfg.Schedule.Windows), len(cfg.Schedule.Holidays))
+	}
+	go gate.Run(ctx)
+
+	var demand *presence.Watcher
+	var demandChanged <-chan struct{}
+	if cfg.OnDemand.Enabled {
+		logger.Printf("On-demand streaming enabled (%ds idle timeout)", cfg.OnDemand.IdleTimeoutSeconds)
+		demand = presence.New(cfg.OnDemand, upl, logger)
+		demand.Idle = idleSnapshot(cfg, gate, upl, logger)
+		demandChanged = demand.Changed()
+		go demand.Run(ctx)
+	}
+	wanted := func() bool {
+		return gate.Streaming() && (demand == nil || demand.Wanted())
+	}
+
+	if cfg.LocalAPI.Enabled {
+		server := localapi.New(cfg.LocalAPI, logger)
+		server.Handle(schedule.Path, gate.Handler())
+		server.Handle(failover.Path, backends.Handler())
+		if svc.pusher != nil {
+			server.Handle(push.Path, svc.pusher.Handler())
+		}
+		if svc.rtsp != nil {
+			server.Handle(rtspserver.Path, svc.rtsp.Handler())
+		}
+		if svc.clipper != nil {
+			server.Handle("/api/clips", svc.clipper.Handler())
+		}
+		if svc.rec != nil {
+			cameras := map[string]*recorder.Index{cfg.BridgeID: svc.rec.Index()}
+			server.Handle(vod.Prefix, vod.New(cameras, logger))
+			if signingKey != nil {
+				exporter := &evidence.Exporter{Index: svc.rec.Index(), Key: signingKey, BridgeID: cfg.BridgeID, Camera: cfg.RtspURL, AgentVersion: agentVersion}
+				server.Handle(evidence.Prefix, evidence.Handler(map[string]*evidence.Exporter{cfg.BridgeID: exporter}, logger))
+			}
+		}
+		go func() {
+			if err := server.Run(ctx); err != nil {
+				logger.Printf("Local API stopped: %v", err)
+			}
+		}()
+	}
+
+	var switcher *streamswitch.Controller
+	if cfg.StreamSwitch.Enabled {
+		switcher = streamswitch.New(cfg.StreamSwitch, upl, logger)
+		go switcher.Run(ctx)
+	}
+	// lastOnSub is the stream of the previous run, so only a real main/sub
+	// switch is marked as a discontinuity.
+	lastOnSub, ran := false, false
 
 	backoff := 5 * time.Second
 	for ctx.Err() == nil {
-		if err := runPipeline(ctx, cfg.RtspURL, workDir, upl, logger); err != nil && ctx.Err() == nil {
+		// Drop stale signals; the state is read fresh below.
+		select {
+		case <-gate.Changed():
+		default:
+		}
+		select {
+		case <-demandChanged:
+		default:
+		}
+		if !wanted() {
+			select {
+			case <-ctx.Done():
+			case <-gate.Changed():
+			case <-demandChanged:
+			}
+			continue
+		}
+
+		runCfg := cfg
+		runCtx, cancelRun := context.WithCancel(ctx)
+		var switched <-chan struct{}
+		streamChanged := false
+		if switcher != nil {
+			onSub := switcher.OnSub()
+			if onSub {
+				runCfg.RtspURL = cfg.SubRtspURL
+				logger.Printf("Using sub stream %s", logging.RedactURL(cfg.SubRtspURL))
+			}
+			streamChanged = ran && onSub != lastOnSub
+			lastOnSub, ran = onSub, true
+			switched = switcher.Changed()
+		}
+		go func() {
+			select {
+			case <-switched:
+			case <-gate.Changed():
+			case <-demandChanged:
+			case <-runCtx.Done():
+				return
+			}
+			cancelRun()
+		}()
+
+		running.Store(true)
+		err := runPipeline(runCtx, runCfg, workDir, streamChanged, svc, logger)
+		running.Store(false)
+		restarted := runCtx.Err() != nil && ctx.Err() == nil
+		cancelRun()
+		if restarted {
+			backoff = 5 * time.Second
+			continue
+		}
+
+		if err != nil && ctx.Err() == nil {
 			logger.Printf("Pipeline error: %v", err)
 			logger.Printf("Reconnecting to RTSP in %s", backoff)
 			wait(ctx, backoff)
@@ -62,6 +343,115 @@ func main() {
 	logger.Println("Agent shutting down")
 }
 
+// idleSnapshot returns the on-demand idle callback: a still taken straight
+// from the camera, unless the schedule or arm mode keeps the camera off.
+func idleSnapshot(cfg config.AgentConfig, gate *schedule.Controller, upl *uploader.Uploader, logger *log.Logger) func(context.Context) {
+	filters := privacy.Filters(cfg.Privacy, cfg.BridgeID)
+	return func(ctx context.Context) {
+		if !gate.Streaming() {
+			return
+		}
+		capturedAt := time.Now()
+		data, err := snapshot.CaptureCamera(ctx, cfg.RtspURL, filters, cfg.Snapshot)
+		if err == nil {
+			err = upl.UploadSnapshot(ctx, data, capturedAt, snapshot.ReasonIdle)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				logger.Printf("Idle snapshot failed: %v", err)
+			}
+			return
+		}
+		logger.Printf("Idle snapshot uploaded (%d bytes)", len(data))
+	}
+}
+
+// runSnapshotCommand uploads a one-off snapshot taken from the segments a
+// running agent is writing, without touching the camera.
+func runSnapshotCommand(args []string, logger *log.Logger) error {
+	flags := flag.NewFlagSet("snapshot", flag.ContinueOnError)
+	output := flags.String("o", "", "also save the JPEG to this path")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadFromExecutable()
+	if err != nil {
+		return err
+	}
+
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot locate executable: %w", err)
+	}
+
+	path, capturedAt, err := snapshotSource(cfg, filepath.Join(filepath.Dir(exePath), "hls"))()
+	if err != nil {
+		return fmt.Errorf("is the agent running? %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	data, err := snapshot.Capture(ctx, path, cfg.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	if *output != "" {
+		if err := os.WriteFile(*output, data, 0o644); err != nil {
+			return fmt.Errorf("failed to save snapshot: %w", err)
+		}
+		logger.Printf("Snapshot saved to %s", *output)
+	}
+
+	upl := uploader.New(cfg.UploadBaseURL, cfg.BridgeID, cfg.APIKey, logger)
+	if err := upl.UploadSnapshot(ctx, data, capturedAt, snapshot.ReasonOnDemand); err != nil {
+		return err
+	}
+
+	logger.Printf("Snapshot uploaded (captured %s)", capturedAt.Format(time.RFC3339))
+	return nil
+}
+
+// openRecorder loads the recording index, resolving the directory relative
+// to the executable and keeping one sub-directory per bridge.
+func openRecorder(cfg config.AgentConfig, baseDir string, logger *log.Logger) (*recorder.Recorder, error) {
+	dir := recordingDir(cfg, baseDir)
+	index, err := recorder.OpenIndex(dir, time.Duration(cfg.Recording.ChunkSeconds)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	chunks := index.Chunks()
+	if len(chunks) > 0 {
+		logger.Printf("Recording to %s (%d chunks since %s)", dir, len(chunks), chunks[0].Start.Format(time.RFC3339))
+	} else {
+		logger.Printf("Recording to %s", dir)
+	}
+	return recorder.New(cfg.Recording, index, logger), nil
+}
+
+func recordingDir(cfg config.AgentConfig, baseDir string) string {
+	dir := cfg.Recording.Directory
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(baseDir, dir)
+	}
+	return filepath.Join(dir, cfg.BridgeID)
+}
+
+// snapshotSource picks where stills come from for the configured pipeline.
+func snapshotSource(cfg config.AgentConfig, workDir string) snapshot.Source {
+	switch {
+	case cfg.LowLatency.Enabled:
+		return snapshot.PartSource(workDir)
+	case cfg.ABR.Enabled:
+		return snapshot.PlaylistSource(filepath.Join(workDir, abr.SourceName))
+	default:
+		return snapshot.PlaylistSource(workDir)
+	}
+}
+
 func pairAndPersist(logger *log.Logger) (config.AgentConfig, error) {
 	fmt.Println("DIFAE Bridge Agent")
 	fmt.Println("Enter pairing code from the web dashboard:")
@@ -73,6 +463,18 @@ func pairAndPersist(logger *log.Logger) (config.AgentConfig, error) {
 	machineID, _ := os.Hostname()
 	attempts := 0
 
+	// The signing key is created before pairing so its public half can be
+	// registered with the backend alongside the bridge.
+	var publicKey string
+	if exePath, err := os.Executable(); err == nil {
+		key, _, err := evidence.LoadOrCreateKey(evidence.KeyPath(exePath))
+		if err != nil {
+			logger.Printf("Could not create evidence signing key: %v", err)
+		} else {
+			publicKey = evidence.EncodePublicKey(key.Public().(ed25519.PublicKey))
+		}
+	}
+
 	for {
 		fmt.Print("> ")
 		code, _ := reader.ReadString('\n')
@@ -81,7 +483,7 @@ func pairAndPersist(logger *log.Logger) (config.AgentConfig, error) {
 			continue
 		}
 
-		cfg, err := client.Pair(code, agentVersion, machineID)
+		cfg, err := client.Pair(code, agentVersion, machineID, publicKey)
 		if err == nil {
 			exePath, exeErr := os.Executable()
 			if exeErr == nil {
@@ -110,48 +512,140 @@ func pairAndPersist(logger *log.Logger) (config.AgentConfig, error) {
 	}
 }
 
-func runPipeline(ctx context.Context, rtspURL, outputDir string, upl *uploader.Uploader, logger *log.Logger) error {
+// runPipeline runs ffmpeg once. streamChanged marks a run on a different
+// camera stream than the last, which starts with a discontinuity.
+func runPipeline(ctx context.Context, cfg config.AgentConfig, outputDir string, streamChanged bool, svc services, logger *log.Logger) error {
+	probed, err := checkCamera(ctx, cfg.RtspURL, logger)
+	if err != nil {
+		return err
+	}
+
 	_ = os.RemoveAll(outputDir)
 	if err := os.MkdirAll(outputDir, 0o755); err != nil {
 		return fmt.Errorf("failed to prepare output directory: %w", err)
 	}
 
-	manifestPath := filepath.Join(outputDir, "out.m3u8")
-	args := []string{
-		"-hide_banner",
-		"-rtsp_transport", "tcp",
-		"-i", rtspURL,
-		"-an",
-		"-c:v", "copy",
-		"-f", "hls",
-		"-hls_time", "2",
-		"-hls_list_size", "5",
-		"-hls_flags", "delete_segments",
-		"-y",
-		manifestPath,
+	rtspURL := cfg.RtspURL
+	args := hlsArgs(cfg, outputDir, streamChanged)
+	upl := svc.upl
+	monitor := func(ctx context.Context) { upl.MonitorOutput(ctx, outputDir) }
+	if cfg.LowLatency.Enabled {
+		args = llhls.Args(cfg, outputDir)
+		packager := llhls.NewPackager(outputDir, cfg.LowLatency, upl, logger)
+		packager.Epoch = cfg.StreamSwitch.Enabled
+		packager.Discontinuity = streamChanged
+		monitor = packager.Run
+	}
+	if cfg.ABR.Enabled {
+		publisher := abr.NewPublisher(outputDir, cfg, upl, logger)
+		if err := publisher.Prepare(); err != nil {
+			return fmt.Errorf("failed to prepare variant directories: %w", err)
+		}
+		// An inconclusive probe leaves the audio track to ffmpeg, as before.
+		args = abr.Args(cfg, outputDir, probed == nil || probed.Audio() != nil)
+		monitor = publisher.Run
+	}
+	monitors := []func(context.Context){monitor}
+
+	if svc.rec != nil {
+		session := svc.rec.Session()
+		args = append(args, session.Args(cfg)...)
+		monitors = append(monitors, session.Follow)
+	}
+
+	if svc.tamper != nil {
+		session := svc.tamper.Session(outputDir)
+		args = append(args, session.Args()...)
+		monitors = append(monitors, session.Follow)
+	}
+
+	if svc.sampler != nil {
+		session := svc.sampler.Session(outputDir)
+		args = append(args, session.Args()...)
+		monitors = append(monitors, session.Follow)
+	}
+
+	var motionSession *motion.Session
+	if svc.motion != nil {
+		session, err := svc.motion.Session()
+		if err != nil {
+			return err
+		}
+		motionSession = session
+		args = append(args, session.Args()...)
+		monitors = append(monitors, session.Follow)
+	}
+
+	// Consumers outside this process read a copy of the camera stream
+	// instead of opening their own camera connection.
+	var tap *fanout.Tap
+	if svc.pusher != nil || svc.rtsp != nil {
+		t, err := fanout.NewTap()
+		if err != nil {
+			if motionSession != nil {
+				motionSession.Close()
+			}
+			return err
+		}
+		tap = t
+		args = append(args, tap.OutputArgs(push.TapAudio(cfg))...)
+		monitors = append(monitors, func(ctx context.Context) {
+			if err := tap.Run(ctx); err != nil && ctx.Err() == nil {
+				logger.Printf("Fan-out stopped: %v", err)
+			}
+		})
+		if svc.pusher != nil {
+			monitors = append(monitors, func(ctx context.Context) { svc.pusher.Run(ctx, tap) })
+		}
+		if svc.rtsp != nil {
+			monitors = append(monitors, func(ctx context.Context) { svc.rtsp.Serve(ctx, tap) })
+		}
+	}
+
+	if svc.clipper != nil {
+		switch {
+		case cfg.LowLatency.Enabled:
+			monitors = append(monitors, svc.clipper.FollowParts(outputDir))
+		case cfg.ABR.Enabled:
+			monitors = append(monitors, svc.clipper.FollowPlaylist(filepath.Join(outputDir, abr.SourceName)))
+		default:
+			monitors = append(monitors, svc.clipper.FollowPlaylist(outputDir))
+		}
 	}
 
 	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stdout
+	if motionSession != nil {
+		cmd.Stdout = motionSession.Stdout()
+	}
 
-	logger.Printf("Starting ffmpeg: ffmpeg %s", strings.Join(args, " "))
-	logger.Printf("Attempting RTSP connection to %s", rtspURL)
+	logger.Printf("Starting ffmpeg: ffmpeg %s", strings.Join(logging.RedactArgs(args), " "))
+	logger.Printf("Attempting RTSP connection to %s", logging.RedactURL(rtspURL))
 
 	if err := cmd.Start(); err != nil {
+		if motionSession != nil {
+			motionSession.Close()
+		}
+		if tap != nil {
+			tap.Close()
+		}
 		return fmt.Errorf("failed to start ffmpeg: %w", err)
 	}
 
 	monitorCtx, cancel := context.WithCancel(ctx)
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		upl.MonitorOutput(monitorCtx, outputDir)
-	}()
+	var wg sync.WaitGroup
+	for _, m := range monitors {
+		wg.Add(1)
+		go func(m func(context.Context)) {
+			defer wg.Done()
+			m(monitorCtx)
+		}(m)
+	}
 
-	err := cmd.Wait()
+	err = cmd.Wait()
 	cancel()
-	<-done
+	wg.Wait()
 
 	if ctx.Err() != nil {
 		return ctx.Err()
@@ -165,6 +659,98 @@ func runPipeline(ctx context.Context, rtspURL, outputDir string, upl *uploader.U
 	return fmt.Errorf("ffmpeg exited unexpectedly")
 }
 
+// checkCamera probes the camera before ffmpeg is started, so a wrong
+// password or path fails the run at once with a precise error. A probe that
+// is merely inconclusive leaves the verdict to ffmpeg and returns a nil
+// result.
+func checkCamera(ctx context.Context, rtspURL string, logger *log.Logger) (*rtspprobe.Result, error) {
+	result, err := rtspprobe.Probe(ctx, rtspURL)
+	switch {
+	case err == nil:
+		logger.Printf("Camera answered: %s", result)
+		return result, nil
+	case ctx.Err() != nil:
+		return nil, ctx.Err()
+	case rtspprobe.Conclusive(err):
+		return nil, fmt.Errorf("camera check failed: %w", err)
+	default:
+		logger.Printf("Camera check inconclusive, starting ffmpeg anyway: %v", err)
+	}
+	return nil, nil
+}
+
+// runProbeCommand checks the camera the way every pipeline run does and
+// prints what it reports.
+func runProbeCommand(args []string) error {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	sub := flags.Bool("sub", false, "probe subRtspUrl instead of rtspUrl")
+	target := flags.String("url", "", "probe this RTSP URL instead of the configured one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	rtspURL := *target
+	if rtspURL == "" {
+		cfg, err := config.LoadFromExecutable()
+		if err != nil {
+			return err
+		}
+		rtspURL = cfg.RtspURL
+		if *sub {
+			if cfg.SubRtspURL == "" {
+				return errors.New("subRtspUrl is not set in agent-config.json")
+			}
+			rtspURL = cfg.SubRtspURL
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	fmt.Printf("Camera:  %s\n", logging.RedactURL(rtspURL))
+	result, err := rtspprobe.Probe(ctx, rtspURL)
+	if err != nil {
+		return err
+	}
+	if result.Server != "" {
+		fmt.Printf("Server:  %s\n", result.Server)
+	}
+	if result.Auth != "" {
+		fmt.Printf("Auth:    %s\n", result.Auth)
+	}
+	for i, t := range result.Tracks {
+		fmt.Printf("Track %d: %s %s\n", i, t.Media, t)
+	}
+	return nil
+}
+
+func hlsArgs(cfg config.AgentConfig, outputDir string, discontinuity bool) []string {
+	manifestPath := filepath.Join(outputDir, "out.m3u8")
+	args := ffmpeg.InputArgs(cfg.RtspURL)
+	args = append(args, ffmpeg.MapArgs(cfg.Audio)...)
+	args = append(args, ffmpeg.AudioArgs(cfg.Audio)...)
+	args = append(args, ffmpeg.VideoArgs(cfg, 2)...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", "2",
+		"-hls_list_size", "5",
+	)
+	if discontinuity {
+		args = append(args, "-hls_flags", "delete_segments+discont_start")
+	} else {
+		args = append(args, "-hls_flags", "delete_segments")
+	}
+	if cfg.StreamSwitch.Enabled {
+		// Runs on either stream share one timeline, so segments are
+		// numbered from the wall clock rather than from zero.
+		args = append(args, "-hls_start_number_source", "epoch")
+	}
+	return append(args,
+		"-y",
+		manifestPath,
+	)
+}
+
 func wait(ctx context.Context, d time.Duration) {
 	select {
 	case <-ctx.Done():
@@ -0,0 +1,306 @@
+// Package abr produces an adaptive bitrate ladder from a single ffmpeg run and
+// publishes the variant playlists together with a generated master playlist.
+package abr
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+	"github.com/difaeai/windows-agent/internal/privacy"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+// SourceName is the variant that carries the camera stream without re-encoding.
+const SourceName = "source"
+
+const (
+	segmentSeconds = 2
+	playlistName   = "out.m3u8"
+)
+
+// Variant is one entry of the master playlist.
+type Variant struct {
+	Name      string
+	Width     int
+	Height    int
+	Bandwidth int
+	Codecs    string
+}
+
+// Args returns ffmpeg arguments that copy the camera stream into the source
+// variant and encode each configured rendition with libx264 in the same run.
+// Every variant carries its own copy of the audio track when audio is enabled
+// and cameraAudio says the camera sends one: -var_stream_map cannot name an
+// audio stream that is missing, so a camera without a microphone gets
+// video-only variants.
+func Args(cfg config.AgentConfig, outputDir string, cameraAudio bool) []string {
+	args := ffmpeg.InputArgs(cfg.RtspURL)
+	withAudio := cfg.Audio.Mode != config.AudioOff && cameraAudio
+	renditions := cfg.ABR.Renditions
+
+	for i := 0; i <= len(renditions); i++ {
+		args = append(args, "-map", "0:v:0")
+		if withAudio {
+			args = append(args, "-map", "0:a:0?")
+		}
+	}
+	if withAudio {
+		args = append(args, ffmpeg.AudioArgs(cfg.Audio)...)
+	} else {
+		args = append(args, "-an")
+	}
+
+	// Privacy masks and overlays apply to every variant, the source
+	// included, which then has to be re-encoded too.
+	masks := privacy.Filters(cfg.Privacy, cfg.BridgeID)
+	streamMap := []string{variantStreams(0, withAudio) + ",name:" + SourceName}
+	if len(masks) > 0 {
+		args = append(args, ffmpeg.EncodeArgs(cfg, "v:0", strings.Join(masks, ","), segmentSeconds)...)
+	} else {
+		args = append(args, "-c:v:0", "copy")
+	}
+	for i, r := range renditions {
+		idx := strconv.Itoa(i + 1)
+		chain := append(append([]string{}, masks...), fmt.Sprintf("scale=-2:%d", r.Height))
+		args = append(args,
+			"-filter:v:"+idx, strings.Join(chain, ","),
+			"-c:v:"+idx, "libx264",
+			"-preset:v:"+idx, "veryfast",
+			"-tune:v:"+idx, "zerolatency",
+			"-b:v:"+idx, fmt.Sprintf("%dk", r.BitrateKbps),
+			"-maxrate:v:"+idx, fmt.Sprintf("%dk", r.BitrateKbps),
+			"-bufsize:v:"+idx, fmt.Sprintf("%dk", 2*r.BitrateKbps),
+			"-force_key_frames:v:"+idx, fmt.Sprintf("expr:gte(t,n_forced*%d)", segmentSeconds),
+		)
+		streamMap = append(streamMap, variantStreams(i+1, withAudio)+",name:"+r.Name)
+	}
+
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(segmentSeconds),
+		"-hls_list_size", "5",
+		"-hls_flags", "delete_segments+independent_segments",
+		"-var_stream_map", strings.Join(streamMap, " "),
+		"-hls_segment_filename", filepath.Join(outputDir, "%v", "seg%d.ts"),
+		"-y",
+		filepath.Join(outputDir, "%v", playlistName),
+	)
+
+	return args
+}
+
+func variantStreams(i int, withAudio bool) string {
+	if withAudio {
+		return fmt.Sprintf("v:%d,a:%d", i, i)
+	}
+	return fmt.Sprintf("v:%d", i)
+}
+
+// Names lists the variant directory names in ladder order.
+func Names(cfg config.ABRConfig) []string {
+	names := []string{SourceName}
+	for _, r := range cfg.Renditions {
+		names = append(names, r.Name)
+	}
+	return names
+}
+
+// MasterPlaylist renders a master playlist; variants with an unknown
+// bandwidth are left out because BANDWIDTH is mandatory. Only ABR mode has a
+// master playlist, so only it can announce CODECS; a single-rendition stream
+// is served as a media playlist and players learn the codecs from the
+// segments.
+func MasterPlaylist(variants []Variant) []byte {
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:3\n")
+	b.WriteString("#EXT-X-INDEPENDENT-SEGMENTS\n")
+
+	for _, v := range variants {
+		if v.Bandwidth <= 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", v.Bandwidth)
+		if v.Width > 0 && v.Height > 0 {
+			fmt.Fprintf(&b, ",RESOLUTION=%dx%d", v.Width, v.Height)
+		}
+		if v.Codecs != "" {
+			fmt.Fprintf(&b, ",CODECS=\"%s\"", v.Codecs)
+		}
+		fmt.Fprintf(&b, ",NAME=\"%s\"\n%s/index.m3u8\n", v.Name, v.Name)
+	}
+
+	return []byte(b.String())
+}
+
+// Publisher uploads every variant under its own path and keeps the master
+// playlist in step with the measured source bitrate and probed stream details.
+type Publisher struct {
+	dir    string
+	cfg    config.AgentConfig
+	upl    *uploader.Uploader
+	logger *log.Logger
+}
+
+// NewPublisher returns a publisher for ffmpeg output written to dir.
+func NewPublisher(dir string, cfg config.AgentConfig, upl *uploader.Uploader, logger *log.Logger) *Publisher {
+	return &Publisher{dir: dir, cfg: cfg, upl: upl, logger: logger}
+}
+
+// Prepare creates the per-variant output directories ffmpeg writes into.
+func (p *Publisher) Prepare() error {
+	for _, name := range Names(p.cfg.ABR) {
+		if err := os.MkdirAll(filepath.Join(p.dir, name), 0o755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run uploads variant output until ctx is cancelled.
+func (p *Publisher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, name := range Names(p.cfg.ABR) {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			p.upl.Variant(name).MonitorOutput(ctx, filepath.Join(p.dir, name))
+		}(name)
+	}
+
+	p.publishMaster(ctx)
+	wg.Wait()
+}
+
+func (p *Publisher) publishMaster(ctx context.Context) {
+	ticker := time.NewTicker(segmentSeconds * time.Second)
+	defer ticker.Stop()
+
+	var (
+		published  []byte
+		sourcePeak int
+		warned     bool
+	)
+	probed := make(map[string]ffmpeg.StreamInfo)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, name := range Names(p.cfg.ABR) {
+			if _, ok := probed[name]; ok {
+				continue
+			}
+			if info, ok := probeVariant(ctx, filepath.Join(p.dir, name)); ok {
+				probed[name] = info
+			}
+		}
+
+		if info, ok := probed[SourceName]; ok && !warned && p.cfg.Audio.Mode == config.AudioCopy &&
+			info.AudioCodec != "" && ffmpeg.AudioCodecTag(info.AudioCodec, info.AudioProfile) == "" {
+			p.logger.Printf("WARN: camera audio codec %s is not playable over HLS; set audio.mode to %q", info.AudioCodec, config.AudioAAC)
+			warned = true
+		}
+
+		if bw := measureBandwidth(filepath.Join(p.dir, SourceName)); bw > sourcePeak {
+			sourcePeak = bw
+		}
+
+		master := MasterPlaylist(p.variants(probed, sourcePeak))
+		if bytes.Equal(master, published) {
+			continue
+		}
+
+		if err := p.upl.UploadManifest(ctx, master); err != nil {
+			p.logger.Printf("Master playlist upload failed: %v", err)
+			continue
+		}
+		published = master
+		p.logger.Printf("Master playlist uploaded (%d variants)", bytes.Count(master, []byte("#EXT-X-STREAM-INF")))
+	}
+}
+
+func (p *Publisher) variants(probed map[string]ffmpeg.StreamInfo, sourceBandwidth int) []Variant {
+	source := probed[SourceName]
+	variants := []Variant{{
+		Name:      SourceName,
+		Width:     source.Width,
+		Height:    source.Height,
+		Bandwidth: roundBandwidth(sourceBandwidth),
+		Codecs:    source.Codecs(),
+	}}
+
+	for _, r := range p.cfg.ABR.Renditions {
+		info := probed[r.Name]
+		v := Variant{
+			Name:      r.Name,
+			Width:     info.Width,
+			Height:    r.Height,
+			Bandwidth: (r.BitrateKbps + p.cfg.Audio.BitrateKbps) * 1100,
+			Codecs:    info.Codecs(),
+		}
+		variants = append(variants, v)
+	}
+	return variants
+}
+
+// roundBandwidth rounds the measured peak up to the next 100 kbit/s so small
+// fluctuations do not cause a new master playlist upload.
+func roundBandwidth(bps int) int {
+	if bps <= 0 {
+		return 0
+	}
+	const step = 100_000
+	return (bps + step - 1) / step * step
+}
+
+// measureBandwidth returns the peak segment bitrate listed in a variant playlist.
+func measureBandwidth(dir string) int {
+	segments, err := ffmpeg.ReadPlaylist(filepath.Join(dir, playlistName))
+	if err != nil {
+		return 0
+	}
+
+	peak := 0
+	for _, seg := range segments {
+		if seg.Duration <= 0 {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(dir, seg.Name))
+		if err != nil {
+			continue
+		}
+		if bps := int(float64(info.Size()*8) / seg.Duration); bps > peak {
+			peak = bps
+		}
+	}
+
+	return peak
+}
+
+// probeVariant inspects the oldest segment still present in a variant directory.
+func probeVariant(ctx context.Context, dir string) (ffmpeg.StreamInfo, bool) {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.ts"))
+	if len(matches) == 0 {
+		return ffmpeg.StreamInfo{}, false
+	}
+
+	info, err := ffmpeg.Probe(ctx, matches[0])
+	if err != nil || info.VideoCodec == "" {
+		return ffmpeg.StreamInfo{}, false
+	}
+	return info, true
+}
@@ -35,14 +35,18 @@ type pairRequest struct {
 	PairCode     string `json:"pairCode"`
 	AgentVersion string `json:"agentVersion,omitempty"`
 	MachineID    string `json:"machineId,omitempty"`
+	SigningKey   string `json:"signingKey,omitempty"`
 }
 
-// Pair exchanges a code for the full bridge configuration.
-func (c *Client) Pair(pairCode, agentVersion, machineID string) (config.AgentConfig, error) {
+// Pair exchanges a code for the full bridge configuration. signingKey is the
+// agent's evidence-signing public key, registered so exports can be checked
+// against the key the backend knows for this bridge.
+func (c *Client) Pair(pairCode, agentVersion, machineID, signingKey string) (config.AgentConfig, error) {
 	payload := pairRequest{
 		PairCode:     pairCode,
 		AgentVersion: agentVersion,
 		MachineID:    machineID,
+		SigningKey:   signingKey,
 	}
 
 	body, err := json.Marshal(payload)
@@ -0,0 +1,82 @@
+package clip
+
+import (
+	"sync"
+	"time"
+)
+
+// Piece is one HLS segment or LL-HLS part held in the pre-roll buffer.
+type Piece struct {
+	Data        []byte
+	Start       time.Time
+	End         time.Time
+	Independent bool
+}
+
+// Buffer keeps the most recent pieces of the HLS output in memory.
+type Buffer struct {
+	keep time.Duration
+
+	mu     sync.Mutex
+	pieces []Piece
+	added  chan struct{}
+}
+
+// NewBuffer returns a buffer holding roughly keep worth of media.
+func NewBuffer(keep time.Duration) *Buffer {
+	return &Buffer{keep: keep, added: make(chan struct{})}
+}
+
+// Add appends a piece and evicts pieces that ended more than keep ago.
+func (b *Buffer) Add(p Piece) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pieces = append(b.pieces, p)
+	cutoff := p.End.Add(-b.keep)
+	drop := 0
+	for drop < len(b.pieces)-1 && b.pieces[drop].End.Before(cutoff) {
+		drop++
+	}
+	b.pieces = append([]Piece(nil), b.pieces[drop:]...)
+
+	close(b.added)
+	b.added = make(chan struct{})
+}
+
+// Newest returns the end time of the newest piece and a channel that is
+// closed when the next piece arrives.
+func (b *Buffer) Newest() (time.Time, <-chan struct{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pieces) == 0 {
+		return time.Time{}, b.added
+	}
+	return b.pieces[len(b.pieces)-1].End, b.added
+}
+
+// Range returns the pieces overlapping [from, to], widened backwards to the
+// nearest independent piece so the result starts on a keyframe.
+func (b *Buffer) Range(from, to time.Time) []Piece {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	first, last := -1, -1
+	for i, p := range b.pieces {
+		if p.End.After(from) && !p.Start.After(to) {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	for first > 0 && !b.pieces[first].Independent {
+		first--
+	}
+
+	return append([]Piece(nil), b.pieces[first:last+1]...)
+}
@@ -0,0 +1,229 @@
+// Package clip keeps a short pre-roll of the HLS output in memory and turns
+// triggers into MP4 clips covering a few seconds before and after the event.
+package clip
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+// ErrBusy is returned when too many clips are already pending.
+var ErrBusy = errors.New("too many clips in progress")
+
+const (
+	// maxClips bounds the clips being waited for, assembled or uploaded at
+	// once.
+	maxClips = 8
+	// uploadTimeout bounds one clip's upload, retries included.
+	uploadTimeout = 5 * time.Minute
+)
+
+// Event is a trigger for a clip.
+type Event struct {
+	ID       string            `json:"id"`
+	Reason   string            `json:"reason"`
+	At       time.Time         `json:"at"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Clipper turns events into clips from its pre-roll buffer.
+type Clipper struct {
+	cfg      config.ClipConfig
+	bridgeID string
+	buffer   *Buffer
+	upl      *uploader.Uploader
+	logger   *log.Logger
+	pending  chan Event
+	// slots holds one token per clip in progress, from Trigger until its
+	// upload finishes or fails.
+	slots chan struct{}
+}
+
+// New returns a clipper whose buffer holds the pre-roll plus enough slack for
+// the post-roll to arrive before the clip is assembled.
+func New(cfg config.ClipConfig, bridgeID string, upl *uploader.Uploader, logger *log.Logger) *Clipper {
+	keep := time.Duration(cfg.PreRollSeconds+cfg.PostRollSeconds)*time.Second + 15*time.Second
+	return &Clipper{
+		cfg:      cfg,
+		bridgeID: bridgeID,
+		buffer:   NewBuffer(keep),
+		upl:      upl,
+		logger:   logger,
+		pending:  make(chan Event, maxClips),
+		slots:    make(chan struct{}, maxClips),
+	}
+}
+
+// Trigger queues a clip for ev, filling in its ID and time when unset.
+func (c *Clipper) Trigger(ev Event) (Event, error) {
+	if ev.ID == "" {
+		ev.ID = newID()
+	}
+	if ev.At.IsZero() {
+		ev.At = time.Now()
+	}
+
+	select {
+	case c.slots <- struct{}{}:
+	default:
+		return ev, ErrBusy
+	}
+	// pending is as large as slots, so this never blocks.
+	c.pending <- ev
+	c.logger.Printf("Clip %s triggered (%s)", ev.ID, ev.Reason)
+	return ev, nil
+}
+
+// Run assembles and uploads clips until ctx is cancelled. Clips are built
+// concurrently because each one waits for its own post-roll; Trigger keeps
+// at most maxClips of them in progress.
+func (c *Clipper) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev := <-c.pending:
+			go func(ev Event) {
+				defer func() { <-c.slots }()
+				if err := c.produce(ctx, ev); err != nil && ctx.Err() == nil {
+					c.logger.Printf("Clip %s failed: %v", ev.ID, err)
+				}
+			}(ev)
+		}
+	}
+}
+
+type clipMetadata struct {
+	Event
+	BridgeID        string    `json:"bridgeId"`
+	Start           time.Time `json:"start"`
+	End             time.Time `json:"end"`
+	DurationSeconds float64   `json:"durationSeconds"`
+}
+
+func (c *Clipper) produce(ctx context.Context, ev Event) error {
+	from := ev.At.Add(-time.Duration(c.cfg.PreRollSeconds) * time.Second)
+	to := ev.At.Add(time.Duration(c.cfg.PostRollSeconds) * time.Second)
+
+	c.waitFor(ctx, to, time.Until(to)+30*time.Second)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	pieces := c.buffer.Range(from, to)
+	if len(pieces) == 0 {
+		return fmt.Errorf("no buffered video between %s and %s", from.Format(time.RFC3339), to.Format(time.RFC3339))
+	}
+
+	data, err := remux(ctx, pieces)
+	if err != nil {
+		return err
+	}
+
+	start, end := pieces[0].Start, pieces[len(pieces)-1].End
+	meta, err := json.Marshal(clipMetadata{
+		Event:           ev,
+		BridgeID:        c.bridgeID,
+		Start:           start,
+		End:             end,
+		DurationSeconds: end.Sub(start).Seconds(),
+	})
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("clip-%s-%s.mp4", start.UTC().Format("20060102T150405Z"), ev.ID)
+	uploadCtx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	if err := c.upl.UploadClip(uploadCtx, name, data, meta); err != nil {
+		return err
+	}
+
+	c.logger.Printf("Clip %s uploaded (%s, %.1fs, %d bytes)", ev.ID, name, end.Sub(start).Seconds(), len(data))
+	return nil
+}
+
+// waitFor blocks until the buffer holds media up to t, or timeout passes.
+func (c *Clipper) waitFor(ctx context.Context, t time.Time, timeout time.Duration) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		newest, next := c.buffer.Newest()
+		if !newest.Before(t) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-next:
+		}
+	}
+}
+
+// remux joins MPEG-TS pieces and rewraps them as a faststart MP4. Audio is
+// re-encoded to AAC because G.711 cannot be stored in MP4.
+func remux(ctx context.Context, pieces []Piece) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "difae-clip-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "clip.ts")
+	var joined bytes.Buffer
+	for _, p := range pieces {
+		joined.Write(p.Data)
+	}
+	if err := os.WriteFile(input, joined.Bytes(), 0o644); err != nil {
+		return nil, err
+	}
+
+	output := filepath.Join(dir, "clip.mp4")
+	remuxCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(remuxCtx, "ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error",
+		"-fflags", "+genpts",
+		"-i", input,
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-c:v", "copy",
+		"-c:a", "aac",
+		"-movflags", "+faststart",
+		"-y", output,
+	)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg remux failed: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return os.ReadFile(output)
+}
+
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,98 @@
+package clip
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+	"github.com/difaeai/windows-agent/internal/llhls"
+	"github.com/difaeai/windows-agent/internal/tail"
+)
+
+// FollowPlaylist copies each new segment listed in an ffmpeg HLS playlist
+// into the buffer. It is meant to run for the lifetime of one ffmpeg process.
+func (c *Clipper) FollowPlaylist(dir string) func(context.Context) {
+	return func(ctx context.Context) {
+		seen := make(map[string]bool)
+		c.poll(ctx, 500*time.Millisecond, func() {
+			segments, err := ffmpeg.ReadPlaylist(filepath.Join(dir, "out.m3u8"))
+			if err != nil {
+				return
+			}
+			for _, seg := range segments {
+				if seen[seg.Name] {
+					continue
+				}
+				if piece, ok := readPiece(filepath.Join(dir, seg.Name), seg.Duration, true); ok {
+					seen[seg.Name] = true
+					c.buffer.Add(piece)
+				}
+			}
+		})
+	}
+}
+
+// FollowParts copies each new LL-HLS part into the buffer.
+func (c *Clipper) FollowParts(dir string) func(context.Context) {
+	return func(ctx context.Context) {
+		var offset int64
+		c.poll(ctx, 100*time.Millisecond, func() {
+			lines, next, err := tail.ReadLines(filepath.Join(dir, llhls.ListFilename), offset)
+			if err != nil {
+				return
+			}
+			offset = next
+
+			for _, line := range lines {
+				fields := strings.Split(line, ",")
+				if len(fields) != 3 {
+					continue
+				}
+				start, _ := strconv.ParseFloat(fields[1], 64)
+				end, _ := strconv.ParseFloat(fields[2], 64)
+				if piece, ok := readPiece(filepath.Join(dir, filepath.Base(fields[0])), end-start, false); ok {
+					c.buffer.Add(piece)
+				}
+			}
+		})
+	}
+}
+
+func (c *Clipper) poll(ctx context.Context, every time.Duration, fn func()) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// readPiece loads a finished file; its wall-clock end is its mtime. HLS
+// segments produced with -c copy always start on a keyframe, parts may not.
+func readPiece(path string, duration float64, keyframeAligned bool) (Piece, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Piece{}, false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Piece{}, false
+	}
+
+	end := info.ModTime()
+	return Piece{
+		Data:        data,
+		Start:       end.Add(-time.Duration(duration * float64(time.Second))),
+		End:         end,
+		Independent: keyframeAligned || llhls.StartsIndependent(data),
+	}, true
+}
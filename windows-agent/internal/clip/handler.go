@@ -0,0 +1,44 @@
+package clip
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/difaeai/windows-agent/internal/localapi"
+)
+
+type triggerRequest struct {
+	Reason   string            `json:"reason"`
+	Metadata map[string]string `json:"metadata"`
+}
+
+// Handler serves POST /api/clips, which triggers a clip for "now".
+func (c *Clipper) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			localapi.WriteError(w, http.StatusMethodNotAllowed, "use POST")
+			return
+		}
+
+		var req triggerRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				localapi.WriteError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+		}
+		if req.Reason == "" {
+			req.Reason = "api"
+		}
+
+		ev, err := c.Trigger(Event{Reason: req.Reason, Metadata: req.Metadata})
+		if errors.Is(err, ErrBusy) {
+			localapi.WriteError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+
+		localapi.WriteJSON(w, http.StatusAccepted, ev)
+	})
+}
@@ -0,0 +1,67 @@
+package clip
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// requestMemory is how long a backend request's ID is remembered, so the
+// backend has time to see the clip before it stops asking for it.
+const requestMemory = 10 * time.Minute
+
+// Poll asks the backend for clips every interval until ctx ends and triggers
+// each request once. A request refused with ErrBusy is tried again on the
+// next poll.
+func (c *Clipper) Poll(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	seen := make(map[string]time.Time)
+	var lastErr string
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for id, at := range seen {
+				if now.Sub(at) > requestMemory {
+					delete(seen, id)
+				}
+			}
+
+			reqCtx, cancel := context.WithTimeout(ctx, interval)
+			requests, err := c.upl.FetchClipRequests(reqCtx)
+			cancel()
+			if err != nil {
+				// Log each distinct failure once; backends without clip
+				// requests 404.
+				if msg := err.Error(); msg != lastErr && ctx.Err() == nil {
+					c.logger.Printf("Clip request poll failed: %v", err)
+					lastErr = msg
+				}
+				continue
+			}
+			lastErr = ""
+
+			for _, req := range requests {
+				if req.ID == "" {
+					continue
+				}
+				if _, ok := seen[req.ID]; ok {
+					continue
+				}
+				reason := req.Reason
+				if reason == "" {
+					reason = "backend"
+				}
+				_, err := c.Trigger(Event{ID: req.ID, Reason: reason, At: req.At, Metadata: req.Metadata})
+				if errors.Is(err, ErrBusy) {
+					c.logger.Printf("Clip %s requested by the backend deferred: %v", req.ID, err)
+					break
+				}
+				seen[req.ID] = now
+			}
+		}
+	}
+}
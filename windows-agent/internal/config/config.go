@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const DefaultConfigFilename = "agent-config.json"
@@ -15,9 +20,295 @@ type AgentConfig struct {
 	BridgeID       string `json:"bridgeId"`
 	APIKey         string `json:"apiKey"`
 	RtspURL        string `json:"rtspUrl"`
+	SubRtspURL     string `json:"subRtspUrl,omitempty"`
 	BackendURL     string `json:"backendUrl"`
 	UploadBaseURL  string `json:"uploadBaseUrl,omitempty"`
 	PollIntervalMs int    `json:"pollIntervalMs,omitempty"`
+
+	// Backends, when set, is an ordered list of upload base URLs that
+	// replaces UploadBaseURL; see FailoverConfig.
+	Backends []string       `json:"backends,omitempty"`
+	Failover FailoverConfig `json:"failover"`
+
+	LowLatency LowLatencyConfig `json:"lowLatency"`
+	ABR        ABRConfig        `json:"abr"`
+	Audio      AudioConfig      `json:"audio"`
+
+	StreamSwitch StreamSwitchConfig `json:"streamSwitch"`
+	Snapshot     SnapshotConfig     `json:"snapshot"`
+	Recording    RecordingConfig    `json:"recording"`
+	Clips        ClipConfig         `json:"clips"`
+	LocalAPI     LocalAPIConfig     `json:"localApi"`
+	Tamper       TamperConfig       `json:"tamper"`
+	Motion       MotionConfig       `json:"motion"`
+	Sampler      SamplerConfig      `json:"sampler"`
+	Privacy      PrivacyConfig      `json:"privacy"`
+	Schedule     ScheduleConfig     `json:"schedule"`
+	OnDemand     OnDemandConfig     `json:"onDemand"`
+
+	// Outputs push the camera to media servers outside DIFAE.
+	Outputs []OutputConfig `json:"outputs,omitempty"`
+
+	RTSPServer RTSPServerConfig `json:"rtspServer"`
+}
+
+// RTSPServerConfig re-serves the camera to on-site consumers at
+// rtsp://<Listen><Path> over TCP-interleaved RTP, sharing the agent's camera
+// connection. Path defaults to "/" plus the bridge ID. When Username is set,
+// clients must log in with it and Password (Digest or Basic).
+type RTSPServerConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Listen     string `json:"listen,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Password   string `json:"password,omitempty"`
+	MaxClients int    `json:"maxClients,omitempty"`
+}
+
+// OutputConfig is an extra push of the camera, next to the HLS upload, to an
+// RTMP or RTMPS server (rtmp:// or rtmps:// URL, stream key included) or an
+// SRT listener in caller mode (srt:// URL). Video is copied, or masked like
+// the HLS stream when privacy masks or overlays are set. Audio is "aac"
+// (the default for RTMP, which most servers require), "copy" (the default
+// for SRT) or "off". LatencyMs and Passphrase apply to SRT only.
+type OutputConfig struct {
+	Name       string `json:"name,omitempty"`
+	URL        string `json:"url"`
+	Audio      string `json:"audio,omitempty"`
+	LatencyMs  int    `json:"latencyMs,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// FailoverConfig moves uploads to the next healthy backend in Backends after
+// FailureThreshold consecutive failed requests, and back to an earlier one
+// once its HealthPath has answered for FailbackSeconds. Every backend's
+// HealthPath is probed every ProbeIntervalSeconds.
+type FailoverConfig struct {
+	HealthPath           string `json:"healthPath,omitempty"`
+	ProbeIntervalSeconds int    `json:"probeIntervalSeconds,omitempty"`
+	FailureThreshold     int    `json:"failureThreshold,omitempty"`
+	FailbackSeconds      int    `json:"failbackSeconds,omitempty"`
+}
+
+// OnDemandConfig runs the pipeline only while the backend reports viewers,
+// stopping IdleTimeoutSeconds after the last one leaves. While idle, a still
+// is taken from the camera every IdleSnapshotSeconds (negative disables) so
+// the dashboard keeps a current thumbnail.
+type OnDemandConfig struct {
+	Enabled             bool `json:"enabled"`
+	IdleTimeoutSeconds  int  `json:"idleTimeoutSeconds,omitempty"`
+	IdleSnapshotSeconds int  `json:"idleSnapshotSeconds,omitempty"`
+}
+
+// ScheduleConfig limits streaming to weekly windows in Timezone (an IANA
+// name; empty means the machine's local time). A holiday replaces the weekly
+// windows on its date, and one without windows keeps the camera off all day.
+type ScheduleConfig struct {
+	Enabled  bool            `json:"enabled"`
+	Timezone string          `json:"timezone,omitempty"`
+	Windows  []WindowConfig  `json:"windows,omitempty"`
+	Holidays []HolidayConfig `json:"holidays,omitempty"`
+}
+
+// WindowConfig streams from Start to End ("HH:MM") on Days ("mon".."sun",
+// empty for every day). An End at or before Start runs past midnight.
+type WindowConfig struct {
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+}
+
+// HolidayConfig is a date (YYYY-MM-DD) whose windows replace the weekly ones.
+type HolidayConfig struct {
+	Date    string         `json:"date"`
+	Name    string         `json:"name,omitempty"`
+	Windows []WindowConfig `json:"windows,omitempty"`
+}
+
+// PrivacyConfig lists regions blacked out and text burned into the video
+// before it leaves the site. Any mask or overlay switches the streamed video
+// from copy to a libx264 transcode.
+type PrivacyConfig struct {
+	Masks      []MaskConfig    `json:"masks,omitempty"`
+	Overlays   []OverlayConfig `json:"overlays,omitempty"`
+	CameraName string          `json:"cameraName,omitempty"`
+	FontFile   string          `json:"fontFile,omitempty"`
+	Crf        int             `json:"crf,omitempty"`
+	Preset     string          `json:"preset,omitempty"`
+}
+
+// MaskConfig is a rectangle (X, Y, Width, Height) or, when Points is set, a
+// polygon. Coordinates are frame-relative (0-1 from the top-left corner).
+type MaskConfig struct {
+	X      float64      `json:"x,omitempty"`
+	Y      float64      `json:"y,omitempty"`
+	Width  float64      `json:"width,omitempty"`
+	Height float64      `json:"height,omitempty"`
+	Points [][2]float64 `json:"points,omitempty"`
+}
+
+// Overlay positions accepted in OverlayConfig.Position.
+const (
+	OverlayTopLeft     = "top-left"
+	OverlayTopRight    = "top-right"
+	OverlayBottomLeft  = "bottom-left"
+	OverlayBottomRight = "bottom-right"
+)
+
+// OverlayConfig is a burned-in text line. Text may contain {time}, {date},
+// {camera} and {bridge} placeholders.
+type OverlayConfig struct {
+	Text       string `json:"text"`
+	Position   string `json:"position,omitempty"`
+	FontSize   int    `json:"fontSize,omitempty"`
+	Color      string `json:"color,omitempty"`
+	Background bool   `json:"background,omitempty"`
+}
+
+// Sampler modes accepted in SamplerConfig.Mode.
+const (
+	SamplerContinuous = "continuous"
+	SamplerMotion     = "motion"
+)
+
+// SamplerConfig controls JPEG frames sampled for the cloud analytics ingest.
+// Endpoint overrides the default analysis-frames URL under uploadBaseUrl.
+type SamplerConfig struct {
+	Enabled           bool    `json:"enabled"`
+	Mode              string  `json:"mode,omitempty"`
+	Fps               float64 `json:"fps,omitempty"`
+	Width             int     `json:"width,omitempty"`
+	Quality           int     `json:"quality,omitempty"`
+	BatchFrames       int     `json:"batchFrames,omitempty"`
+	BatchSeconds      int     `json:"batchSeconds,omitempty"`
+	MaxPendingBatches int     `json:"maxPendingBatches,omitempty"`
+	Endpoint          string  `json:"endpoint,omitempty"`
+}
+
+// MotionConfig controls CPU motion detection on a downscaled grayscale copy
+// of the stream. Sensitivity runs from 1 (only large changes) to 100.
+type MotionConfig struct {
+	Enabled        bool         `json:"enabled"`
+	Width          int          `json:"width,omitempty"`
+	Height         int          `json:"height,omitempty"`
+	Fps            int          `json:"fps,omitempty"`
+	Sensitivity    int          `json:"sensitivity,omitempty"`
+	MinAreaPercent float64      `json:"minAreaPercent,omitempty"`
+	StartFrames    int          `json:"startFrames,omitempty"`
+	StopSeconds    int          `json:"stopSeconds,omitempty"`
+	IgnoreZones    []ZoneConfig `json:"ignoreZones,omitempty"`
+	TriggerClips   bool         `json:"triggerClips,omitempty"`
+}
+
+// ZoneConfig is a rectangle in frame-relative coordinates (0-1 from the
+// top-left corner), so it survives resolution changes.
+type ZoneConfig struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// TamperConfig controls blackout, frozen-frame and scene-change detection on
+// a low-fps analysis branch of the pipeline. A negative BlackSeconds,
+// FreezeSeconds or SceneThreshold disables that detector.
+type TamperConfig struct {
+	Enabled             bool    `json:"enabled"`
+	AnalysisFps         int     `json:"analysisFps,omitempty"`
+	BlackSeconds        float64 `json:"blackSeconds,omitempty"`
+	BlackRatio          float64 `json:"blackRatio,omitempty"`
+	BlackPixelThreshold float64 `json:"blackPixelThreshold,omitempty"`
+	FreezeSeconds       float64 `json:"freezeSeconds,omitempty"`
+	FreezeNoiseDb       float64 `json:"freezeNoiseDb,omitempty"`
+	SceneThreshold      float64 `json:"sceneThreshold,omitempty"`
+}
+
+// ClipConfig controls event clips assembled from an in-memory pre-roll buffer.
+type ClipConfig struct {
+	Enabled         bool `json:"enabled"`
+	PreRollSeconds  int  `json:"preRollSeconds,omitempty"`
+	PostRollSeconds int  `json:"postRollSeconds,omitempty"`
+}
+
+// LocalAPIConfig controls the agent's embedded HTTP server for on-site use.
+type LocalAPIConfig struct {
+	Enabled bool   `json:"enabled"`
+	Listen  string `json:"listen,omitempty"`
+	Token   string `json:"token,omitempty"`
+}
+
+// Recording formats accepted in RecordingConfig.Format.
+const (
+	RecordingTS  = "ts"
+	RecordingMP4 = "mp4"
+)
+
+// RecordingConfig controls continuous local recording and its retention.
+// Directory is resolved relative to the executable when not absolute; a
+// negative MaxAgeHours keeps footage until the disk limit is reached.
+type RecordingConfig struct {
+	Enabled        bool    `json:"enabled"`
+	Directory      string  `json:"directory,omitempty"`
+	Format         string  `json:"format,omitempty"`
+	ChunkSeconds   int     `json:"chunkSeconds,omitempty"`
+	MaxAgeHours    int     `json:"maxAgeHours,omitempty"`
+	MaxDiskPercent float64 `json:"maxDiskPercent,omitempty"`
+}
+
+// SnapshotConfig controls periodic JPEG stills taken from the HLS output.
+type SnapshotConfig struct {
+	Enabled         bool `json:"enabled"`
+	IntervalSeconds int  `json:"intervalSeconds,omitempty"`
+	Width           int  `json:"width,omitempty"`
+	Quality         int  `json:"quality,omitempty"`
+}
+
+// StreamSwitchConfig controls automatic fallback from the main stream to the
+// camera's low-bitrate sub stream (SubRtspURL) when uploads cannot keep up.
+type StreamSwitchConfig struct {
+	Enabled               bool    `json:"enabled"`
+	DowngradeAfterSeconds int     `json:"downgradeAfterSeconds,omitempty"`
+	RecoverAfterSeconds   int     `json:"recoverAfterSeconds,omitempty"`
+	MaxBacklogSegments    int     `json:"maxBacklogSegments,omitempty"`
+	Headroom              float64 `json:"headroom,omitempty"`
+	MainBitrateKbps       int     `json:"mainBitrateKbps,omitempty"`
+}
+
+// Audio modes accepted in AudioConfig.Mode.
+const (
+	AudioOff  = "off"
+	AudioCopy = "copy"
+	AudioAAC  = "aac"
+)
+
+// AudioConfig selects whether the camera's audio track is dropped, passed
+// through, or transcoded to AAC (for G.711 and other codecs HLS cannot play).
+type AudioConfig struct {
+	Mode        string `json:"mode,omitempty"`
+	BitrateKbps int    `json:"bitrateKbps,omitempty"`
+	SampleRate  int    `json:"sampleRate,omitempty"`
+}
+
+// LowLatencyConfig controls LL-HLS output with partial segments.
+type LowLatencyConfig struct {
+	Enabled           bool `json:"enabled"`
+	PartDurationMs    int  `json:"partDurationMs,omitempty"`
+	SegmentDurationMs int  `json:"segmentDurationMs,omitempty"`
+	PlaylistSegments  int  `json:"playlistSegments,omitempty"`
+}
+
+// ABRConfig controls the adaptive bitrate ladder. The camera stream is always
+// published untouched as the "source" rendition; Renditions are scaled copies.
+type ABRConfig struct {
+	Enabled    bool              `json:"enabled"`
+	Renditions []RenditionConfig `json:"renditions,omitempty"`
+}
+
+// RenditionConfig describes one software-scaled rendition of the ABR ladder.
+type RenditionConfig struct {
+	Name        string `json:"name,omitempty"`
+	Height      int    `json:"height"`
+	BitrateKbps int    `json:"bitrateKbps"`
 }
 
 // ResolvePath returns the expected config path based on the executable location.
@@ -93,11 +384,222 @@ func applyDefaults(cfg AgentConfig) AgentConfig {
 	if cfg.UploadBaseURL == "" {
 		cfg.UploadBaseURL = cfg.BackendURL
 	}
+	if len(cfg.Backends) > 0 {
+		cfg.UploadBaseURL = cfg.Backends[0]
+	}
+	for i := range cfg.Outputs {
+		out := &cfg.Outputs[i]
+		if out.Name == "" {
+			out.Name = fmt.Sprintf("output-%d", i+1)
+		}
+		if out.Audio == "" {
+			out.Audio = AudioAAC
+			if strings.HasPrefix(out.URL, "srt:") {
+				out.Audio = AudioCopy
+			}
+		}
+		if out.LatencyMs == 0 {
+			out.LatencyMs = 200
+		}
+	}
+	if cfg.Failover.HealthPath == "" {
+		cfg.Failover.HealthPath = "/api/health"
+	}
+	if cfg.Failover.ProbeIntervalSeconds == 0 {
+		cfg.Failover.ProbeIntervalSeconds = 15
+	}
+	if cfg.Failover.FailureThreshold == 0 {
+		cfg.Failover.FailureThreshold = 3
+	}
+	if cfg.Failover.FailbackSeconds == 0 {
+		cfg.Failover.FailbackSeconds = 120
+	}
 
 	if cfg.PollIntervalMs == 0 {
 		cfg.PollIntervalMs = 5000
 	}
 
+	if cfg.LowLatency.PartDurationMs == 0 {
+		cfg.LowLatency.PartDurationMs = 500
+	}
+	if cfg.LowLatency.SegmentDurationMs == 0 {
+		cfg.LowLatency.SegmentDurationMs = 2000
+	}
+	if cfg.LowLatency.PlaylistSegments == 0 {
+		cfg.LowLatency.PlaylistSegments = 5
+	}
+
+	if cfg.Audio.Mode == "" {
+		cfg.Audio.Mode = AudioOff
+	}
+	if cfg.Audio.Mode == AudioAAC && cfg.Audio.BitrateKbps == 0 {
+		cfg.Audio.BitrateKbps = 64
+	}
+
+	if cfg.StreamSwitch.DowngradeAfterSeconds == 0 {
+		cfg.StreamSwitch.DowngradeAfterSeconds = 20
+	}
+	if cfg.StreamSwitch.RecoverAfterSeconds == 0 {
+		cfg.StreamSwitch.RecoverAfterSeconds = 120
+	}
+	if cfg.StreamSwitch.MaxBacklogSegments == 0 {
+		cfg.StreamSwitch.MaxBacklogSegments = 3
+	}
+	if cfg.StreamSwitch.Headroom == 0 {
+		cfg.StreamSwitch.Headroom = 1.5
+	}
+	if cfg.StreamSwitch.MainBitrateKbps == 0 {
+		cfg.StreamSwitch.MainBitrateKbps = 4000
+	}
+
+	if cfg.OnDemand.IdleTimeoutSeconds == 0 {
+		cfg.OnDemand.IdleTimeoutSeconds = 60
+	}
+	if cfg.OnDemand.IdleSnapshotSeconds == 0 {
+		cfg.OnDemand.IdleSnapshotSeconds = 300
+	}
+
+	if cfg.Snapshot.IntervalSeconds == 0 {
+		cfg.Snapshot.IntervalSeconds = 60
+	}
+	if cfg.Snapshot.Quality == 0 {
+		cfg.Snapshot.Quality = 5
+	}
+
+	if cfg.Recording.Directory == "" {
+		cfg.Recording.Directory = "recordings"
+	}
+	if cfg.Recording.Format == "" {
+		cfg.Recording.Format = RecordingTS
+	}
+	if cfg.Recording.ChunkSeconds == 0 {
+		cfg.Recording.ChunkSeconds = 60
+	}
+	if cfg.Recording.MaxAgeHours == 0 {
+		cfg.Recording.MaxAgeHours = 7 * 24
+	}
+	if cfg.Recording.MaxDiskPercent == 0 {
+		cfg.Recording.MaxDiskPercent = 90
+	}
+
+	if cfg.Clips.PreRollSeconds == 0 {
+		cfg.Clips.PreRollSeconds = 10
+	}
+	if cfg.Clips.PostRollSeconds == 0 {
+		cfg.Clips.PostRollSeconds = 20
+	}
+
+	if cfg.Tamper.AnalysisFps == 0 {
+		cfg.Tamper.AnalysisFps = 2
+	}
+	if cfg.Tamper.BlackSeconds == 0 {
+		cfg.Tamper.BlackSeconds = 10
+	}
+	if cfg.Tamper.BlackRatio == 0 {
+		cfg.Tamper.BlackRatio = 0.98
+	}
+	if cfg.Tamper.BlackPixelThreshold == 0 {
+		cfg.Tamper.BlackPixelThreshold = 0.10
+	}
+	if cfg.Tamper.FreezeSeconds == 0 {
+		cfg.Tamper.FreezeSeconds = 30
+	}
+	if cfg.Tamper.FreezeNoiseDb == 0 {
+		cfg.Tamper.FreezeNoiseDb = -60
+	}
+	if cfg.Tamper.SceneThreshold == 0 {
+		cfg.Tamper.SceneThreshold = 40
+	}
+
+	if cfg.Motion.Width == 0 {
+		cfg.Motion.Width = 160
+	}
+	if cfg.Motion.Height == 0 {
+		cfg.Motion.Height = 90
+	}
+	if cfg.Motion.Fps == 0 {
+		cfg.Motion.Fps = 5
+	}
+	if cfg.Motion.Sensitivity == 0 {
+		cfg.Motion.Sensitivity = 50
+	}
+	if cfg.Motion.MinAreaPercent == 0 {
+		cfg.Motion.MinAreaPercent = 0.5
+	}
+	if cfg.Motion.StartFrames == 0 {
+		cfg.Motion.StartFrames = 3
+	}
+	if cfg.Motion.StopSeconds == 0 {
+		cfg.Motion.StopSeconds = 5
+	}
+
+	if cfg.Sampler.Mode == "" {
+		cfg.Sampler.Mode = SamplerContinuous
+	}
+	if cfg.Sampler.Fps == 0 {
+		cfg.Sampler.Fps = 1
+	}
+	if cfg.Sampler.Width == 0 {
+		cfg.Sampler.Width = 640
+	}
+	if cfg.Sampler.Quality == 0 {
+		cfg.Sampler.Quality = 5
+	}
+	if cfg.Sampler.BatchFrames == 0 {
+		cfg.Sampler.BatchFrames = 10
+	}
+	if cfg.Sampler.BatchSeconds == 0 {
+		cfg.Sampler.BatchSeconds = 5
+	}
+	if cfg.Sampler.MaxPendingBatches == 0 {
+		cfg.Sampler.MaxPendingBatches = 3
+	}
+
+	if cfg.Privacy.Crf == 0 {
+		cfg.Privacy.Crf = 23
+	}
+	if cfg.Privacy.Preset == "" {
+		cfg.Privacy.Preset = "veryfast"
+	}
+	for i := range cfg.Privacy.Overlays {
+		o := &cfg.Privacy.Overlays[i]
+		if o.Position == "" {
+			o.Position = OverlayTopLeft
+		}
+		if o.FontSize == 0 {
+			o.FontSize = 24
+		}
+		if o.Color == "" {
+			o.Color = "white"
+		}
+	}
+
+	if cfg.LocalAPI.Listen == "" {
+		cfg.LocalAPI.Listen = "127.0.0.1:8787"
+	}
+
+	if cfg.RTSPServer.Listen == "" {
+		cfg.RTSPServer.Listen = ":8554"
+	}
+	if cfg.RTSPServer.Path == "" {
+		cfg.RTSPServer.Path = "/" + url.PathEscape(cfg.BridgeID)
+	}
+	if cfg.RTSPServer.MaxClients == 0 {
+		cfg.RTSPServer.MaxClients = 16
+	}
+
+	if cfg.ABR.Enabled && len(cfg.ABR.Renditions) == 0 {
+		cfg.ABR.Renditions = []RenditionConfig{
+			{Height: 720, BitrateKbps: 2000},
+			{Height: 360, BitrateKbps: 600},
+		}
+	}
+	for i := range cfg.ABR.Renditions {
+		if cfg.ABR.Renditions[i].Name == "" {
+			cfg.ABR.Renditions[i].Name = strconv.Itoa(cfg.ABR.Renditions[i].Height) + "p"
+		}
+	}
+
 	return cfg
 }
 
@@ -117,5 +619,382 @@ func validate(cfg AgentConfig) error {
 	if cfg.UploadBaseURL == "" {
 		return errors.New("uploadBaseUrl is required in agent-config.json")
 	}
+	if err := validateBackends(cfg.Backends, cfg.Failover); err != nil {
+		return err
+	}
+	if err := validateOutputs(cfg.Outputs); err != nil {
+		return err
+	}
+	if cfg.LowLatency.Enabled {
+		if cfg.LowLatency.PartDurationMs < 100 {
+			return errors.New("lowLatency.partDurationMs must be at least 100 in agent-config.json")
+		}
+		if cfg.LowLatency.SegmentDurationMs < cfg.LowLatency.PartDurationMs {
+			return errors.New("lowLatency.segmentDurationMs must not be shorter than partDurationMs in agent-config.json")
+		}
+	}
+	switch cfg.Audio.Mode {
+	case AudioOff, AudioCopy, AudioAAC:
+	default:
+		return fmt.Errorf("audio.mode must be %q, %q or %q in agent-config.json", AudioOff, AudioCopy, AudioAAC)
+	}
+	if cfg.StreamSwitch.Enabled {
+		if cfg.SubRtspURL == "" {
+			return errors.New("subRtspUrl is required when streamSwitch is enabled in agent-config.json")
+		}
+		if cfg.ABR.Enabled {
+			return errors.New("streamSwitch and abr cannot both be enabled in agent-config.json")
+		}
+		if cfg.StreamSwitch.Headroom < 1 {
+			return errors.New("streamSwitch.headroom must be at least 1 in agent-config.json")
+		}
+	}
+	if cfg.Snapshot.Enabled {
+		if cfg.Snapshot.IntervalSeconds < 1 {
+			return errors.New("snapshot.intervalSeconds must be positive in agent-config.json")
+		}
+		if cfg.Snapshot.Quality < 2 || cfg.Snapshot.Quality > 31 {
+			return errors.New("snapshot.quality must be between 2 (best) and 31 in agent-config.json")
+		}
+	}
+	if cfg.Recording.Enabled {
+		if cfg.Recording.Format != RecordingTS && cfg.Recording.Format != RecordingMP4 {
+			return fmt.Errorf("recording.format must be %q or %q in agent-config.json", RecordingTS, RecordingMP4)
+		}
+		if cfg.Recording.ChunkSeconds < 10 {
+			return errors.New("recording.chunkSeconds must be at least 10 in agent-config.json")
+		}
+		if cfg.Recording.MaxDiskPercent < 0 || cfg.Recording.MaxDiskPercent > 100 {
+			return errors.New("recording.maxDiskPercent must be between 0 and 100 in agent-config.json")
+		}
+	}
+	if cfg.Clips.Enabled {
+		if cfg.Clips.PreRollSeconds < 0 || cfg.Clips.PostRollSeconds < 0 {
+			return errors.New("clips.preRollSeconds and clips.postRollSeconds must not be negative in agent-config.json")
+		}
+		if cfg.Clips.PreRollSeconds+cfg.Clips.PostRollSeconds > 600 {
+			return errors.New("clips may not be longer than 10 minutes in agent-config.json")
+		}
+	}
+	if cfg.Tamper.Enabled {
+		if cfg.Tamper.AnalysisFps < 1 || cfg.Tamper.AnalysisFps > 10 {
+			return errors.New("tamper.analysisFps must be between 1 and 10 in agent-config.json")
+		}
+		if cfg.Tamper.BlackRatio <= 0 || cfg.Tamper.BlackRatio > 1 || cfg.Tamper.BlackPixelThreshold <= 0 || cfg.Tamper.BlackPixelThreshold > 1 {
+			return errors.New("tamper.blackRatio and tamper.blackPixelThreshold must be between 0 and 1 in agent-config.json")
+		}
+		if cfg.Tamper.FreezeNoiseDb >= 0 {
+			return errors.New("tamper.freezeNoiseDb must be negative in agent-config.json")
+		}
+		if cfg.Tamper.SceneThreshold > 100 {
+			return errors.New("tamper.sceneThreshold must not exceed 100 in agent-config.json")
+		}
+		if cfg.Tamper.BlackSeconds < 0 && cfg.Tamper.FreezeSeconds < 0 && cfg.Tamper.SceneThreshold < 0 {
+			return errors.New("tamper is enabled but every detector is disabled in agent-config.json")
+		}
+	}
+	if cfg.Motion.Enabled {
+		if err := validateMotion(cfg.Motion); err != nil {
+			return err
+		}
+		if cfg.Motion.TriggerClips && !cfg.Clips.Enabled {
+			return errors.New("motion.triggerClips requires clips to be enabled in agent-config.json")
+		}
+	}
+	if cfg.Sampler.Enabled {
+		switch cfg.Sampler.Mode {
+		case SamplerContinuous:
+		case SamplerMotion:
+			if !cfg.Motion.Enabled {
+				return errors.New("sampler.mode \"motion\" requires motion to be enabled in agent-config.json")
+			}
+		default:
+			return fmt.Errorf("sampler.mode must be %q or %q in agent-config.json", SamplerContinuous, SamplerMotion)
+		}
+		if cfg.Sampler.Fps <= 0 || cfg.Sampler.Fps > 10 {
+			return errors.New("sampler.fps must be above 0 and at most 10 in agent-config.json")
+		}
+		if cfg.Sampler.Width < 16 || cfg.Sampler.Width%2 != 0 {
+			return errors.New("sampler.width must be an even number of at least 16 in agent-config.json")
+		}
+		if cfg.Sampler.Quality < 2 || cfg.Sampler.Quality > 31 {
+			return errors.New("sampler.quality must be between 2 (best) and 31 in agent-config.json")
+		}
+		if cfg.Sampler.BatchFrames < 1 || cfg.Sampler.BatchSeconds < 1 || cfg.Sampler.MaxPendingBatches < 1 {
+			return errors.New("sampler.batchFrames, batchSeconds and maxPendingBatches must be positive in agent-config.json")
+		}
+	}
+	if err := validatePrivacy(cfg.Privacy); err != nil {
+		return err
+	}
+	if cfg.OnDemand.Enabled {
+		if cfg.OnDemand.IdleTimeoutSeconds < 5 {
+			return errors.New("onDemand.idleTimeoutSeconds must be at least 5 in agent-config.json")
+		}
+		if cfg.OnDemand.IdleSnapshotSeconds > 0 && cfg.OnDemand.IdleSnapshotSeconds < 30 {
+			return errors.New("onDemand.idleSnapshotSeconds must be at least 30, or negative to disable, in agent-config.json")
+		}
+	}
+	if cfg.Schedule.Enabled {
+		if err := validateSchedule(cfg.Schedule); err != nil {
+			return err
+		}
+	}
+	if cfg.LocalAPI.Enabled && len(cfg.LocalAPI.Token) < 16 {
+		return errors.New("localApi.token must be at least 16 characters in agent-config.json")
+	}
+	if cfg.RTSPServer.Enabled {
+		if err := validateRTSPServer(cfg.RTSPServer); err != nil {
+			return err
+		}
+	}
+	if cfg.ABR.Enabled {
+		if cfg.LowLatency.Enabled {
+			return errors.New("abr and lowLatency cannot both be enabled in agent-config.json")
+		}
+		if err := validateRenditions(cfg.ABR.Renditions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateBackends(backends []string, f FailoverConfig) error {
+	seen := make(map[string]bool, len(backends))
+	for i, b := range backends {
+		u, err := url.Parse(b)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("backends[%d] must be an http or https URL in agent-config.json", i)
+		}
+		key := strings.TrimRight(b, "/")
+		if seen[key] {
+			return fmt.Errorf("backends[%d] is listed twice in agent-config.json", i)
+		}
+		seen[key] = true
+	}
+	if !strings.HasPrefix(f.HealthPath, "/") {
+		return errors.New("failover.healthPath must start with / in agent-config.json")
+	}
+	if f.ProbeIntervalSeconds < 1 || f.FailureThreshold < 1 || f.FailbackSeconds < 0 {
+		return errors.New("failover.probeIntervalSeconds and failureThreshold must be positive and failbackSeconds not negative in agent-config.json")
+	}
+	return nil
+}
+
+func validateOutputs(outputs []OutputConfig) error {
+	seen := make(map[string]bool, len(outputs))
+	for i, out := range outputs {
+		if seen[out.Name] {
+			return fmt.Errorf("outputs[%d].name %q is used twice in agent-config.json", i, out.Name)
+		}
+		seen[out.Name] = true
+		u, err := url.Parse(out.URL)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("outputs[%d].url must be an rtmp://, rtmps:// or srt:// URL in agent-config.json", i)
+		}
+		switch u.Scheme {
+		case "rtmp", "rtmps", "srt":
+		default:
+			return fmt.Errorf("outputs[%d].url must be an rtmp://, rtmps:// or srt:// URL in agent-config.json", i)
+		}
+		switch out.Audio {
+		case AudioOff, AudioCopy, AudioAAC:
+		default:
+			return fmt.Errorf("outputs[%d].audio must be %q, %q or %q in agent-config.json", i, AudioOff, AudioCopy, AudioAAC)
+		}
+		if out.LatencyMs < 20 || out.LatencyMs > 8000 {
+			return fmt.Errorf("outputs[%d].latencyMs must be between 20 and 8000 in agent-config.json", i)
+		}
+		if n := len(out.Passphrase); n != 0 && (n < 10 || n > 79) {
+			return fmt.Errorf("outputs[%d].passphrase must be 10 to 79 characters in agent-config.json", i)
+		}
+	}
+	return nil
+}
+
+func validateRTSPServer(r RTSPServerConfig) error {
+	if _, _, err := net.SplitHostPort(r.Listen); err != nil {
+		return errors.New("rtspServer.listen must be host:port or :port in agent-config.json")
+	}
+	u, err := url.Parse(r.Path)
+	if err != nil || !strings.HasPrefix(r.Path, "/") || strings.Trim(r.Path, "/") == "" || u.RawQuery != "" || u.Fragment != "" || strings.Contains(r.Path, "/trackID=") {
+		return errors.New("rtspServer.path must be a path such as /lobby in agent-config.json")
+	}
+	if (r.Username == "") != (r.Password == "") {
+		return errors.New("rtspServer.username and password must be set together in agent-config.json")
+	}
+	if strings.Contains(r.Username, ":") {
+		return errors.New("rtspServer.username must not contain ':' in agent-config.json")
+	}
+	if r.MaxClients < 1 || r.MaxClients > 100 {
+		return errors.New("rtspServer.maxClients must be between 1 and 100 in agent-config.json")
+	}
+	return nil
+}
+
+func validateMotion(m MotionConfig) error {
+	if m.Width < 16 || m.Height < 16 || m.Width > 640 || m.Height > 360 || m.Width%2 != 0 || m.Height%2 != 0 {
+		return errors.New("motion.width and motion.height must be even and between 16x16 and 640x360 in agent-config.json")
+	}
+	if m.Fps < 1 || m.Fps > 15 {
+		return errors.New("motion.fps must be between 1 and 15 in agent-config.json")
+	}
+	if m.Sensitivity < 1 || m.Sensitivity > 100 {
+		return errors.New("motion.sensitivity must be between 1 and 100 in agent-config.json")
+	}
+	if m.MinAreaPercent <= 0 || m.MinAreaPercent > 100 {
+		return errors.New("motion.minAreaPercent must be between 0 and 100 in agent-config.json")
+	}
+	if m.StartFrames < 1 || m.StopSeconds < 1 {
+		return errors.New("motion.startFrames and motion.stopSeconds must be positive in agent-config.json")
+	}
+	for i, z := range m.IgnoreZones {
+		if z.X < 0 || z.Y < 0 || z.Width <= 0 || z.Height <= 0 || z.X+z.Width > 1 || z.Y+z.Height > 1 {
+			return fmt.Errorf("motion.ignoreZones[%d] must lie within the frame (0-1 coordinates) in agent-config.json", i)
+		}
+	}
+	return nil
+}
+
+func validatePrivacy(p PrivacyConfig) error {
+	inFrame := func(v float64) bool { return v >= 0 && v <= 1 }
+	for i, m := range p.Masks {
+		if len(m.Points) > 0 {
+			if len(m.Points) < 3 {
+				return fmt.Errorf("privacy.masks[%d] polygon needs at least 3 points in agent-config.json", i)
+			}
+			for _, pt := range m.Points {
+				if !inFrame(pt[0]) || !inFrame(pt[1]) {
+					return fmt.Errorf("privacy.masks[%d] has a point outside the frame (0-1 coordinates) in agent-config.json", i)
+				}
+			}
+			continue
+		}
+		if m.Width <= 0 || m.Height <= 0 || !inFrame(m.X) || !inFrame(m.Y) || m.X+m.Width > 1 || m.Y+m.Height > 1 {
+			return fmt.Errorf("privacy.masks[%d] must lie within the frame (0-1 coordinates) in agent-config.json", i)
+		}
+	}
+	for i, o := range p.Overlays {
+		if o.Text == "" {
+			return fmt.Errorf("privacy.overlays[%d].text is required in agent-config.json", i)
+		}
+		switch o.Position {
+		case OverlayTopLeft, OverlayTopRight, OverlayBottomLeft, OverlayBottomRight:
+		default:
+			return fmt.Errorf("privacy.overlays[%d].position must be top-left, top-right, bottom-left or bottom-right in agent-config.json", i)
+		}
+		if o.FontSize < 6 || o.FontSize > 200 {
+			return fmt.Errorf("privacy.overlays[%d].fontSize must be between 6 and 200 in agent-config.json", i)
+		}
+	}
+	if p.Crf < 0 || p.Crf > 51 {
+		return errors.New("privacy.crf must be between 0 and 51 in agent-config.json")
+	}
+	return nil
+}
+
+func validateRenditions(renditions []RenditionConfig) error {
+	seen := map[string]bool{"source": true}
+	for _, r := range renditions {
+		if r.Height <= 0 || r.Height%2 != 0 {
+			return fmt.Errorf("abr rendition %q needs a positive, even height in agent-config.json", r.Name)
+		}
+		if r.BitrateKbps <= 0 {
+			return fmt.Errorf("abr rendition %q needs a positive bitrateKbps in agent-config.json", r.Name)
+		}
+		if !isPathSafe(r.Name) {
+			return fmt.Errorf("abr rendition name %q may only contain letters, digits, '-' and '_'", r.Name)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("abr rendition name %q is reserved or duplicated in agent-config.json", r.Name)
+		}
+		seen[r.Name] = true
+	}
+	return nil
+}
+
+// isPathSafe reports whether name can be used as a single URL/path component.
+func isPathSafe(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func validateSchedule(s ScheduleConfig) error {
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return fmt.Errorf("schedule.timezone %q is not a known IANA timezone in agent-config.json", s.Timezone)
+	}
+	if len(s.Windows) == 0 && len(s.Holidays) == 0 {
+		return errors.New("schedule is enabled but has no windows or holidays in agent-config.json")
+	}
+	for i, w := range s.Windows {
+		if err := validateWindow(w); err != nil {
+			return fmt.Errorf("schedule.windows[%d]: %w in agent-config.json", i, err)
+		}
+	}
+	seen := make(map[string]bool, len(s.Holidays))
+	for i, h := range s.Holidays {
+		if _, err := time.Parse(time.DateOnly, h.Date); err != nil {
+			return fmt.Errorf("schedule.holidays[%d].date must be YYYY-MM-DD in agent-config.json", i)
+		}
+		if seen[h.Date] {
+			return fmt.Errorf("schedule.holidays lists %s twice in agent-config.json", h.Date)
+		}
+		seen[h.Date] = true
+		for j, w := range h.Windows {
+			if len(w.Days) > 0 {
+				return fmt.Errorf("schedule.holidays[%d].windows[%d] may not list days in agent-config.json", i, j)
+			}
+			if err := validateWindow(w); err != nil {
+				return fmt.Errorf("schedule.holidays[%d].windows[%d]: %w in agent-config.json", i, j, err)
+			}
+		}
+	}
 	return nil
 }
+
+func validateWindow(w WindowConfig) error {
+	for _, d := range w.Days {
+		if _, ok := ParseWeekday(d); !ok {
+			return fmt.Errorf("unknown day %q (use mon, tue, wed, thu, fri, sat or sun)", d)
+		}
+	}
+	if _, err := ParseClock(w.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if _, err := ParseClock(w.End); err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+	return nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseWeekday maps a schedule day name ("mon".."sun") to a weekday.
+func ParseWeekday(name string) (time.Weekday, bool) {
+	d, ok := weekdays[strings.ToLower(name)]
+	return d, ok
+}
+
+// ParseClock returns the minutes past midnight of an "HH:MM" time; "24:00"
+// is accepted as the end of the day.
+func ParseClock(v string) (int, error) {
+	hh, mm, ok := strings.Cut(v, ":")
+	h, errH := strconv.Atoi(hh)
+	m, errM := strconv.Atoi(mm)
+	if !ok || len(hh) != 2 || len(mm) != 2 || errH != nil || errM != nil || h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m != 0) {
+		return 0, fmt.Errorf("%q is not an HH:MM time", v)
+	}
+	return h*60 + m, nil
+}
@@ -0,0 +1,63 @@
+// Package events queues JSON events (tamper alerts, motion and similar) and
+// uploads them to the backend in order.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+// uploadTimeout bounds one event's upload, retries included, so a backend
+// that stays down does not hold up the rest of the queue forever.
+const uploadTimeout = 2 * time.Minute
+
+// Queue buffers events so detectors never block on the network.
+type Queue struct {
+	upl     *uploader.Uploader
+	logger  *log.Logger
+	pending chan []byte
+}
+
+// New returns a queue; call Run to start uploading.
+func New(upl *uploader.Uploader, logger *log.Logger) *Queue {
+	return &Queue{upl: upl, logger: logger, pending: make(chan []byte, 128)}
+}
+
+// Send queues v for upload, dropping it if the queue is full.
+func (q *Queue) Send(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		q.logger.Printf("Could not encode event: %v", err)
+		return
+	}
+
+	select {
+	case q.pending <- data:
+	default:
+		q.logger.Printf("Event queue full; dropping %s", data)
+	}
+}
+
+// Run uploads queued events until ctx ends.
+func (q *Queue) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case data := <-q.pending:
+			q.upload(ctx, data)
+		}
+	}
+}
+
+func (q *Queue) upload(ctx context.Context, data []byte) {
+	ctx, cancel := context.WithTimeout(ctx, uploadTimeout)
+	defer cancel()
+	if err := q.upl.UploadEvent(ctx, data); err != nil && ctx.Err() != context.Canceled {
+		q.logger.Printf("Event upload failed; dropping %s: %v", data, err)
+	}
+}
@@ -0,0 +1,67 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+func TestQueueDropsRejectedEvent(t *testing.T) {
+	var mu sync.Mutex
+	var got []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		got = append(got, string(body))
+		mu.Unlock()
+		if strings.Contains(string(body), "bad") {
+			http.Error(w, "unknown event type", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	q := New(uploader.New(srv.URL, "bridge-1", "", logger), logger)
+	q.Send(map[string]string{"type": "bad"})
+	q.Send(map[string]string{"type": "tamper"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() { q.Run(ctx); close(done) }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(got)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backend got %d events, want the rejected one and the next", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if !strings.Contains(got[1], "tamper") {
+		t.Errorf("second upload = %s, want the tamper event", got[1])
+	}
+	if out := logs.String(); !strings.Contains(out, "dropping") || strings.Contains(out, "Retrying") {
+		t.Errorf("log = %q; the rejected event should be dropped without a retry", out)
+	}
+}
@@ -0,0 +1,171 @@
+// Package evidence exports recorded footage as tamper-evident bundles: a zip
+// of the recorded chunks plus a manifest of their SHA-256 hashes, signed with
+// the agent's ed25519 key, and verifies such bundles offline.
+package evidence
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/logging"
+	"github.com/difaeai/windows-agent/internal/recorder"
+)
+
+// Bundle layout.
+const (
+	FormatVersion    = "difae-evidence/1"
+	ManifestFilename = "manifest.json"
+	SignatureFile    = "manifest.sig"
+	footageDir       = "footage/"
+)
+
+// Hash origins recorded per segment.
+const (
+	HashedAtCapture = "capture"
+	HashedAtExport  = "export"
+)
+
+// Manifest describes a bundle. The signature in manifest.sig covers the
+// exact bytes of manifest.json.
+type Manifest struct {
+	Format       string    `json:"format"`
+	BridgeID     string    `json:"bridgeId"`
+	Camera       string    `json:"camera"`
+	AgentVersion string    `json:"agentVersion"`
+	From         time.Time `json:"from"`
+	To           time.Time `json:"to"`
+	ExportedAt   time.Time `json:"exportedAt"`
+	PublicKey    string    `json:"publicKey"`
+	Fingerprint  string    `json:"fingerprint"`
+	Segments     []Segment `json:"segments"`
+}
+
+// Segment is one recorded chunk in the bundle.
+type Segment struct {
+	File  string    `json:"file"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Bytes int64     `json:"bytes"`
+	// SHA256 is the hex digest of the file as included in the bundle.
+	SHA256 string `json:"sha256"`
+	// HashedAt is "capture" when the digest matches the one taken as the
+	// chunk was recorded, or "export" for chunks recorded before hashing
+	// was available.
+	HashedAt string `json:"hashedAt"`
+}
+
+// Exporter builds bundles for one camera's recordings.
+type Exporter struct {
+	Index        *recorder.Index
+	Key          ed25519.PrivateKey
+	BridgeID     string
+	Camera       string
+	AgentVersion string
+}
+
+// Check confirms every chunk still matches its capture-time hash, so an
+// export can be refused before anything is written.
+func (e *Exporter) Check(chunks []recorder.Chunk) error {
+	if len(chunks) == 0 {
+		return fmt.Errorf("no recordings in range")
+	}
+	for _, c := range chunks {
+		if c.SHA256 == "" {
+			continue
+		}
+		sum, err := recorder.HashFile(c.Path(e.Index.Dir()))
+		if err != nil {
+			return fmt.Errorf("%s: %w", c.File, err)
+		}
+		if sum != c.SHA256 {
+			return fmt.Errorf("%s no longer matches its capture hash", c.File)
+		}
+	}
+	return nil
+}
+
+// Write streams a bundle for chunks to out. Each file is hashed as it is
+// copied, so a file changing after Check still fails the export.
+func (e *Exporter) Write(out io.Writer, from, to time.Time, chunks []recorder.Chunk) (Manifest, error) {
+	pub := e.Key.Public().(ed25519.PublicKey)
+	manifest := Manifest{
+		Format:       FormatVersion,
+		BridgeID:     e.BridgeID,
+		Camera:       logging.RedactURL(e.Camera),
+		AgentVersion: e.AgentVersion,
+		From:         from.UTC(),
+		To:           to.UTC(),
+		ExportedAt:   time.Now().UTC(),
+		PublicKey:    EncodePublicKey(pub),
+		Fingerprint:  Fingerprint(pub),
+	}
+
+	zw := zip.NewWriter(out)
+	for _, c := range chunks {
+		seg, err := e.writeChunk(zw, c)
+		if err != nil {
+			return Manifest{}, err
+		}
+		manifest.Segments = append(manifest.Segments, seg)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return Manifest{}, err
+	}
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(e.Key, data))
+
+	if err := writeEntry(zw, ManifestFilename, data); err != nil {
+		return Manifest{}, err
+	}
+	if err := writeEntry(zw, SignatureFile, []byte(signature+"\n")); err != nil {
+		return Manifest{}, err
+	}
+	return manifest, zw.Close()
+}
+
+func (e *Exporter) writeChunk(zw *zip.Writer, c recorder.Chunk) (Segment, error) {
+	f, err := os.Open(c.Path(e.Index.Dir()))
+	if err != nil {
+		return Segment{}, fmt.Errorf("%s: %w", c.File, err)
+	}
+	defer f.Close()
+
+	// Video is already compressed; storing keeps exports fast.
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: footageDir + c.File, Method: zip.Store, Modified: c.End})
+	if err != nil {
+		return Segment{}, err
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), f)
+	if err != nil {
+		return Segment{}, fmt.Errorf("%s: %w", c.File, err)
+	}
+
+	seg := Segment{File: c.File, Start: c.Start.UTC(), End: c.End.UTC(), Bytes: n, SHA256: hex.EncodeToString(h.Sum(nil)), HashedAt: HashedAtExport}
+	if c.SHA256 != "" {
+		if seg.SHA256 != c.SHA256 {
+			return Segment{}, fmt.Errorf("%s no longer matches its capture hash", c.File)
+		}
+		seg.HashedAt = HashedAtCapture
+	}
+	return seg, nil
+}
+
+func writeEntry(zw *zip.Writer, name string, data []byte) error {
+	w, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,67 @@
+package evidence
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/localapi"
+)
+
+// Prefix is the local API path the handler is mounted on.
+const Prefix = "/api/evidence/"
+
+// MaxRange bounds a single export.
+const MaxRange = 24 * time.Hour
+
+// Handler serves GET /api/evidence/<camera>?from=&to= as a bundle download.
+func Handler(exporters map[string]*Exporter, logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			localapi.WriteError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+
+		camera := strings.TrimPrefix(r.URL.Path, Prefix)
+		exporter, ok := exporters[camera]
+		if !ok {
+			localapi.WriteError(w, http.StatusNotFound, "unknown camera")
+			return
+		}
+
+		from, to, err := localapi.ParseRange(r, MaxRange)
+		if err != nil {
+			localapi.WriteError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		chunks := exporter.Index.Range(from, to)
+		if len(chunks) == 0 {
+			localapi.WriteError(w, http.StatusNotFound, "no recordings in range")
+			return
+		}
+		if err := exporter.Check(chunks); err != nil {
+			logger.Printf("Evidence export refused: %v", err)
+			localapi.WriteError(w, http.StatusConflict, err.Error())
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", BundleName(camera, from)))
+		manifest, err := exporter.Write(w, from, to, chunks)
+		if err != nil {
+			// Headers are already sent; the truncated zip will not open.
+			logger.Printf("Evidence export failed: %v", err)
+			return
+		}
+		logger.Printf("Evidence bundle exported (%d segments, %s to %s)", len(manifest.Segments), from.Format(time.RFC3339), to.Format(time.RFC3339))
+	})
+}
+
+// BundleName is the suggested file name for a bundle.
+func BundleName(camera string, from time.Time) string {
+	return fmt.Sprintf("evidence-%s-%s.zip", camera, from.UTC().Format("20060102T150405Z"))
+}
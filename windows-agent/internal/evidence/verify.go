@@ -0,0 +1,114 @@
+package evidence
+
+import (
+	"archive/zip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Verify checks a bundle offline: the manifest signature, every listed
+// file's size and hash, and that no unlisted footage was added. When
+// trustedKey is non-empty (a base64 public key or its fingerprint) the
+// bundle must also be signed by that key. The manifest is returned even
+// when verification fails, for reporting; problems are joined in the error.
+func Verify(path, trustedKey string) (Manifest, error) {
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("failed to open bundle: %w", err)
+	}
+	defer zr.Close()
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	data, err := readEntry(files, ManifestFilename)
+	if err != nil {
+		return Manifest{}, err
+	}
+	sigText, err := readEntry(files, SignatureFile)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	if manifest.Format != FormatVersion {
+		return manifest, fmt.Errorf("unsupported bundle format %q", manifest.Format)
+	}
+
+	pub, err := DecodePublicKey(manifest.PublicKey)
+	if err != nil {
+		return manifest, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sigText)))
+	if err != nil || !ed25519.Verify(pub, data, signature) {
+		return manifest, fmt.Errorf("manifest signature is invalid")
+	}
+	if manifest.Fingerprint != Fingerprint(pub) {
+		return manifest, fmt.Errorf("manifest fingerprint does not match its public key")
+	}
+	if trustedKey != "" && trustedKey != manifest.PublicKey && trustedKey != Fingerprint(pub) {
+		return manifest, fmt.Errorf("bundle was signed by %s, not the trusted key", Fingerprint(pub))
+	}
+
+	var problems []error
+	listed := make(map[string]bool, len(manifest.Segments))
+	for _, seg := range manifest.Segments {
+		listed[footageDir+seg.File] = true
+		if err := checkSegment(files, seg); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	for name := range files {
+		if strings.HasPrefix(name, footageDir) && !listed[name] {
+			problems = append(problems, fmt.Errorf("%s is not listed in the manifest", name))
+		}
+	}
+	return manifest, errors.Join(problems...)
+}
+
+func checkSegment(files map[string]*zip.File, seg Segment) error {
+	f, ok := files[footageDir+seg.File]
+	if !ok {
+		return fmt.Errorf("%s is missing", seg.File)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("%s: %w", seg.File, err)
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", seg.File, err)
+	}
+	if n != seg.Bytes || hex.EncodeToString(h.Sum(nil)) != seg.SHA256 {
+		return fmt.Errorf("%s has been modified", seg.File)
+	}
+	return nil
+}
+
+func readEntry(files map[string]*zip.File, name string) ([]byte, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("bundle has no %s", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
@@ -0,0 +1,289 @@
+// Package failover picks the backend the agent uploads to from an ordered
+// list. Requests report their outcome; enough consecutive failures move the
+// agent to the next healthy backend, and a health probe of every backend
+// brings it back to an earlier one once that has been stable for a while.
+package failover
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+)
+
+// Path is where the local API serves the backend status.
+const Path = "/api/backends"
+
+const probeTimeout = 5 * time.Second
+
+// Selector tracks the active backend and the health of the others.
+type Selector struct {
+	// OnSwitch, if set, is called after the active backend changes.
+	OnSwitch func(from, to, reason string)
+
+	cfg    config.FailoverConfig
+	logger *log.Logger
+	client *http.Client
+
+	mu       sync.Mutex
+	backends []*backend
+	active   int
+	failures int
+}
+
+type backend struct {
+	url          string
+	healthy      bool
+	healthySince time.Time
+	lastProbe    time.Time
+	lastError    string
+}
+
+// Event is queued for the backend when the active backend changes. It is
+// delivered to the new backend.
+type Event struct {
+	Type   string    `json:"type"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Reason string    `json:"reason"`
+	At     time.Time `json:"at"`
+}
+
+// Status is the selector's state as served by the local API.
+type Status struct {
+	Active   string          `json:"active"`
+	Failures int             `json:"failures"`
+	Backends []BackendStatus `json:"backends"`
+}
+
+// BackendStatus describes one backend in the list.
+type BackendStatus struct {
+	URL          string     `json:"url"`
+	Active       bool       `json:"active"`
+	Healthy      bool       `json:"healthy"`
+	HealthySince *time.Time `json:"healthySince,omitempty"`
+	LastProbe    *time.Time `json:"lastProbe,omitempty"`
+	LastError    string     `json:"lastError,omitempty"`
+}
+
+// New returns a selector over cfg.Backends, or over the single upload base
+// URL when no list is configured. Backends count as healthy until a probe
+// says otherwise, and the first one starts active.
+func New(cfg config.AgentConfig, logger *log.Logger) *Selector {
+	urls := cfg.Backends
+	if len(urls) == 0 {
+		urls = []string{cfg.UploadBaseURL}
+	}
+	s := &Selector{cfg: cfg.Failover, logger: logger, client: &http.Client{Timeout: probeTimeout}}
+	now := time.Now()
+	for _, u := range urls {
+		s.backends = append(s.backends, &backend{url: strings.TrimRight(u, "/"), healthy: true, healthySince: now})
+	}
+	return s
+}
+
+// Active returns the base URL requests should go to.
+func (s *Selector) Active() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.backends[s.active].url
+}
+
+// Report records the outcome of a request to requestURL. Only requests to
+// the active backend, by scheme and host, count; ok is false for network errors and 5xx answers.
+func (s *Selector) Report(requestURL string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !sameOrigin(requestURL, s.backends[s.active].url) {
+		return
+	}
+	if ok {
+		s.failures = 0
+		return
+	}
+	s.failures++
+	if s.failures >= s.cfg.FailureThreshold {
+		s.failoverLocked("requests keep failing")
+	}
+}
+
+// Run probes every backend's health path until ctx ends. With a single
+// backend there is nothing to choose between, so it returns at once.
+func (s *Selector) Run(ctx context.Context) {
+	if len(s.backends) < 2 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(s.cfg.ProbeIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		s.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Status returns the current state.
+func (s *Selector) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := Status{Active: s.backends[s.active].url, Failures: s.failures}
+	for i, b := range s.backends {
+		bs := BackendStatus{URL: b.url, Active: i == s.active, Healthy: b.healthy, LastError: b.lastError}
+		if b.healthy {
+			since := b.healthySince
+			bs.HealthySince = &since
+		}
+		if !b.lastProbe.IsZero() {
+			probed := b.lastProbe
+			bs.LastProbe = &probed
+		}
+		st.Backends = append(st.Backends, bs)
+	}
+	return st
+}
+
+func (s *Selector) probeAll(ctx context.Context) {
+	s.mu.Lock()
+	urls := make([]string, len(s.backends))
+	for i, b := range s.backends {
+		urls[i] = b.url
+	}
+	s.mu.Unlock()
+
+	results := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			results[i] = s.probe(ctx, u)
+		}(i, u)
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for i, err := range results {
+		b := s.backends[i]
+		b.lastProbe = now
+		if err == nil {
+			if !b.healthy {
+				b.healthy = true
+				b.healthySince = now
+				s.logger.Printf("Backend %s is healthy again", b.url)
+			}
+			b.lastError = ""
+			continue
+		}
+		if b.healthy {
+			s.logger.Printf("Backend %s failed its health check: %v", b.url, err)
+		}
+		b.healthy = false
+		b.lastError = err.Error()
+		if i == s.active {
+			// An unhealthy active backend counts like a failed request, so
+			// an idle agent still moves on.
+			s.failures++
+		}
+	}
+
+	if s.failures >= s.cfg.FailureThreshold {
+		s.failoverLocked("health checks keep failing")
+	}
+	stable := time.Duration(s.cfg.FailbackSeconds) * time.Second
+	for i := 0; i < s.active; i++ {
+		if b := s.backends[i]; b.healthy && now.Sub(b.healthySince) >= stable {
+			s.switchLocked(i, "failback after "+stable.String()+" healthy")
+			break
+		}
+	}
+}
+
+func (s *Selector) probe(ctx context.Context, base string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+s.cfg.HealthPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check answered %s", resp.Status)
+	}
+	return nil
+}
+
+// failoverLocked moves to the next healthy backend after the active one,
+// wrapping around. If none is healthy the agent stays where it is. The
+// failing backend's stability window starts over, so a backend that passes
+// health checks but fails requests is not failed back to straight away.
+func (s *Selector) failoverLocked(reason string) {
+	s.failures = 0
+	s.backends[s.active].healthySince = time.Now()
+	for k := 1; k < len(s.backends); k++ {
+		i := (s.active + k) % len(s.backends)
+		if s.backends[i].healthy {
+			s.switchLocked(i, reason)
+			return
+		}
+	}
+	if len(s.backends) > 1 {
+		s.logger.Printf("Backend %s is failing (%s) but no other backend is healthy", s.backends[s.active].url, reason)
+	}
+}
+
+func (s *Selector) switchLocked(i int, reason string) {
+	from := s.backends[s.active].url
+	to := s.backends[i].url
+	s.active = i
+	s.failures = 0
+	s.logger.Printf("Active backend: %s (was %s; %s)", to, from, reason)
+	if s.OnSwitch != nil {
+		go s.OnSwitch(from, to, reason)
+	}
+}
+
+// sameOrigin reports whether a and b have the same scheme, host and port.
+func sameOrigin(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(hostWithPort(ua), hostWithPort(ub))
+}
+
+// hostWithPort returns u's host with the scheme's default port made explicit.
+func hostWithPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		switch strings.ToLower(u.Scheme) {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
@@ -0,0 +1,19 @@
+package failover
+
+import (
+	"net/http"
+
+	"github.com/difaeai/windows-agent/internal/localapi"
+)
+
+// Handler serves GET with the active backend and the health of each one.
+func (s *Selector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			localapi.WriteError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		localapi.WriteJSON(w, http.StatusOK, s.Status())
+	})
+}
@@ -0,0 +1,293 @@
+package fanout
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+)
+
+const (
+	packetSize = 188
+	syncByte   = 0x47
+)
+
+// errReaderClosed is returned by a Reader after Close.
+var errReaderClosed = errors.New("fan-out reader closed")
+
+// ring is a bounded buffer of whole MPEG-TS packets. Positions are absolute
+// byte offsets into the stream, so a reader that falls behind can tell how
+// much it lost. Keyframes (packets of the PMT's video stream with the random
+// access indicator) and the latest PAT/PMT are remembered so a reader can
+// start where a decoder can.
+type ring struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	buf        []byte
+	start, end int64
+	keyframes  []int64
+	pat, pmt   []byte
+	pmtPID     int
+	videoPID   int
+	closed     bool
+}
+
+func newRing(size int) *ring {
+	size -= size % packetSize
+	if size < 64*packetSize {
+		size = 64 * packetSize
+	}
+	r := &ring{buf: make([]byte, size), pmtPID: -1, videoPID: -1}
+	r.cond = sync.NewCond(&r.mu)
+	return r
+}
+
+// fill copies packets from src until it ends, re-synchronising on the sync
+// byte if the stream is ever misaligned. The ring is closed on return.
+func (r *ring) fill(src io.Reader) error {
+	defer r.close()
+
+	br := bufio.NewReaderSize(src, 64*packetSize)
+	pkt := make([]byte, packetSize)
+	for {
+		if _, err := io.ReadFull(br, pkt); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+			return err
+		}
+		if pkt[0] != syncByte {
+			i := 1
+			for i < packetSize && pkt[i] != syncByte {
+				i++
+			}
+			n := copy(pkt, pkt[i:])
+			if _, err := io.ReadFull(br, pkt[n:]); err != nil {
+				return nil
+			}
+			if pkt[0] != syncByte {
+				continue
+			}
+		}
+		r.append(pkt)
+	}
+}
+
+func (r *ring) append(pkt []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	switch {
+	case pid == 0:
+		r.pat = append(r.pat[:0], pkt...)
+		if p := patPMTPID(pkt); p >= 0 {
+			r.pmtPID = p
+		}
+	case pid == r.pmtPID:
+		r.pmt = append(r.pmt[:0], pkt...)
+		if p := pmtVideoPID(pkt); p >= 0 {
+			r.videoPID = p
+		}
+	case pid == r.videoPID && randomAccess(pkt):
+		r.keyframes = append(r.keyframes, r.end)
+	}
+
+	size := int64(len(r.buf))
+	if r.end-r.start == size {
+		r.start += packetSize
+		for len(r.keyframes) > 0 && r.keyframes[0] < r.start {
+			r.keyframes = r.keyframes[1:]
+		}
+	}
+	copy(r.buf[r.end%size:], pkt)
+	r.end += packetSize
+	r.cond.Broadcast()
+}
+
+func (r *ring) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cond.Broadcast()
+}
+
+// Reader streams the ring to one consumer from a keyframe. A reader that
+// falls a whole buffer behind skips ahead to the next keyframe rather than
+// holding back the source or the other readers.
+type Reader struct {
+	ring    *ring
+	pos     int64
+	resync  bool
+	pending []byte
+	lost    int64
+	closed  bool
+}
+
+// reader returns a reader starting at the newest buffered keyframe, preceded
+// by the latest PAT/PMT, or at the next keyframe when none is buffered yet.
+func (r *ring) reader() *Reader {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rr := &Reader{ring: r, pos: r.end, resync: true}
+	if n := len(r.keyframes); n > 0 {
+		rr.pos = r.keyframes[n-1]
+	}
+	rr.seekLocked()
+	return rr
+}
+
+// Read blocks until packets are available, the source ends (io.EOF) or the
+// reader is closed.
+func (rr *Reader) Read(p []byte) (int, error) {
+	r := rr.ring
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		if rr.closed {
+			return 0, errReaderClosed
+		}
+		if len(rr.pending) > 0 {
+			n := copy(p, rr.pending)
+			rr.pending = rr.pending[n:]
+			return n, nil
+		}
+		if rr.pos < r.start {
+			// Overrun while the consumer was slow.
+			rr.lost += r.start - rr.pos
+			rr.pos = r.start
+			rr.resync = true
+		}
+		if rr.resync && rr.seekLocked() && len(rr.pending) > 0 {
+			continue
+		}
+		if !rr.resync && rr.pos < r.end {
+			break
+		}
+		if r.closed {
+			return 0, io.EOF
+		}
+		r.cond.Wait()
+	}
+
+	size := int64(len(r.buf))
+	off := rr.pos % size
+	n := int64(len(p))
+	if avail := r.end - rr.pos; n > avail {
+		n = avail
+	}
+	if n > size-off {
+		n = size - off
+	}
+	copy(p, r.buf[off:off+n])
+	rr.pos += n
+	return int(n), nil
+}
+
+// seekLocked moves to the first keyframe at or after pos and queues the
+// PAT/PMT in front of it. It reports false while no such keyframe exists.
+func (rr *Reader) seekLocked() bool {
+	r := rr.ring
+	for _, k := range r.keyframes {
+		if k < rr.pos {
+			continue
+		}
+		rr.lost += k - rr.pos
+		rr.pos = k
+		rr.resync = false
+		rr.pending = append(append(rr.pending[:0], r.pat...), r.pmt...)
+		return true
+	}
+	return false
+}
+
+// Close unblocks a pending Read.
+func (rr *Reader) Close() error {
+	rr.ring.mu.Lock()
+	defer rr.ring.mu.Unlock()
+	rr.closed = true
+	rr.ring.cond.Broadcast()
+	return nil
+}
+
+// Lost returns how many bytes the reader skipped because it fell behind.
+func (rr *Reader) Lost() int64 {
+	rr.ring.mu.Lock()
+	defer rr.ring.mu.Unlock()
+	return rr.lost
+}
+
+// randomAccess reports whether a packet's adaptation field carries the random
+// access indicator, which ffmpeg sets on the first packet of a keyframe. It
+// also sets it on audio frames, so only the video PID's packets count.
+func randomAccess(pkt []byte) bool {
+	return pkt[3]&0x20 != 0 && pkt[4] > 0 && pkt[5]&0x40 != 0
+}
+
+// patPMTPID returns the PMT PID of the first program in a PAT packet, or -1.
+func patPMTPID(pkt []byte) int {
+	section := psiSection(pkt)
+	if len(section) < 8 {
+		return -1
+	}
+	end := len(section)
+	for i := 8; i+4 <= end; i += 4 {
+		program := int(section[i])<<8 | int(section[i+1])
+		if program != 0 {
+			return int(section[i+2]&0x1f)<<8 | int(section[i+3])
+		}
+	}
+	return -1
+}
+
+// pmtVideoPID returns the PID of the first video stream in a PMT packet, or
+// -1, recognising the same stream types as the LL-HLS packager.
+func pmtVideoPID(pkt []byte) int {
+	section := psiSection(pkt)
+	if len(section) < 12 || section[0] != 0x02 {
+		return -1
+	}
+	i := 12 + (int(section[10]&0x0f)<<8 | int(section[11]))
+	for i+5 <= len(section) {
+		streamType := section[i]
+		pid := int(section[i+1]&0x1f)<<8 | int(section[i+2])
+		switch streamType {
+		case 0x01, 0x02, 0x10, 0x1b, 0x24:
+			return pid
+		}
+		i += 5 + (int(section[i+3]&0x0f)<<8 | int(section[i+4]))
+	}
+	return -1
+}
+
+// psiSection returns the PSI section that starts in a packet, after its
+// pointer field and without the CRC, or nil when the packet starts none.
+func psiSection(pkt []byte) []byte {
+	if pkt[1]&0x40 == 0 || pkt[3]&0x10 == 0 {
+		return nil
+	}
+	payload := pkt[4:]
+	if pkt[3]&0x20 != 0 {
+		if 5+int(pkt[4]) >= len(pkt) {
+			return nil
+		}
+		payload = pkt[5+int(pkt[4]):]
+	}
+	if len(payload) < 1 || int(payload[0])+1 > len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if len(section) < 3 {
+		return nil
+	}
+	end := 3 + (int(section[1]&0x0f)<<8 | int(section[2])) - 4 // minus CRC
+	if end > len(section) {
+		end = len(section)
+	}
+	if end < 0 {
+		return nil
+	}
+	return section[:end]
+}
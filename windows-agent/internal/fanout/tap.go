@@ -0,0 +1,102 @@
+// Package fanout shares the pipeline's camera connection with consumers that
+// need the stream outside the main ffmpeg process, such as push outputs. The
+// pipeline ffmpeg copies the camera's video, unchanged, as MPEG-TS to a
+// loopback listener; a Tap buffers that copy in a bounded ring and hands each
+// consumer its own Reader. Cameras commonly allow only a few RTSP sessions, so
+// nothing else opens one while the pipeline runs.
+package fanout
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+)
+
+// BufferBytes is the size of the ring. At typical camera bitrates it holds
+// several GOPs, which is how far a consumer may fall behind before it skips
+// ahead to a newer keyframe.
+const BufferBytes = 16 << 20
+
+// Tap receives the copy of the camera stream from the pipeline ffmpeg.
+type Tap struct {
+	listener net.Listener
+	ring     *ring
+}
+
+// NewTap listens on a free loopback port. The tap must be closed, or run, so
+// the port is released.
+func NewTap() (*Tap, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the fan-out listener: %w", err)
+	}
+	return &Tap{listener: ln, ring: newRing(BufferBytes)}, nil
+}
+
+// OutputArgs returns the ffmpeg output that sends input 0 to the tap, with
+// video copied and audio handled as configured: MPEG-TS cannot carry G.711,
+// so copying every camera's audio would stop the pipeline. It goes after the
+// pipeline's other outputs.
+func (t *Tap) OutputArgs(audio config.AudioConfig) []string {
+	args := ffmpeg.MapArgs(audio)
+	args = append(args, "-c:v", "copy")
+	args = append(args, ffmpeg.AudioArgs(audio)...)
+	return append(args, "-f", "mpegts", "tcp://"+t.listener.Addr().String())
+}
+
+// Run accepts the pipeline's connection and buffers it until ffmpeg closes it
+// or ctx ends. Readers see io.EOF afterwards. There is no accept deadline:
+// ffmpeg connects only once the camera answers, and a refused connection
+// would stop the whole pipeline. The ring never blocks the connection.
+func (t *Tap) Run(ctx context.Context) error {
+	defer t.ring.close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+
+	var conn net.Conn
+	select {
+	case c, ok := <-accepted:
+		t.listener.Close()
+		if !ok {
+			return fmt.Errorf("fan-out listener closed")
+		}
+		conn = c
+	case <-ctx.Done():
+		t.listener.Close()
+		return ctx.Err()
+	}
+	defer conn.Close()
+
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	if err := t.ring.fill(conn); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// Reader returns a reader starting at the newest buffered keyframe. Readers
+// are independent: a slow one skips data rather than delaying the pipeline
+// or the others.
+func (t *Tap) Reader() *Reader {
+	return t.ring.reader()
+}
+
+// Close releases the listener of a tap that never ran.
+func (t *Tap) Close() error {
+	t.ring.close()
+	return t.listener.Close()
+}
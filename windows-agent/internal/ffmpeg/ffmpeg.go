@@ -0,0 +1,202 @@
+// Package ffmpeg holds the ffmpeg/ffprobe command-line pieces shared by the
+// agent's HLS pipelines.
+package ffmpeg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/privacy"
+)
+
+// InputArgs returns the arguments that open the camera stream.
+func InputArgs(rtspURL string) []string {
+	return []string{
+		"-hide_banner",
+		"-rtsp_transport", "tcp",
+		"-i", rtspURL,
+	}
+}
+
+// MapArgs selects the first video stream and, when audio is enabled, the first
+// audio stream. A camera without a microphone is tolerated.
+func MapArgs(audio config.AudioConfig) []string {
+	if audio.Mode == config.AudioOff {
+		return []string{"-map", "0:v:0"}
+	}
+	return []string{"-map", "0:v:0", "-map", "0:a:0?"}
+}
+
+// VideoArgs returns the video codec arguments for a streamed output: a plain
+// copy, or a filtered libx264 encode when privacy masks or overlays are set.
+// Keyframes are then forced every keyframeSeconds to keep segments aligned.
+func VideoArgs(cfg config.AgentConfig, keyframeSeconds float64) []string {
+	if !privacy.Active(cfg.Privacy) {
+		return []string{"-c:v", "copy"}
+	}
+	return EncodeArgs(cfg, "v", strings.Join(privacy.Filters(cfg.Privacy, cfg.BridgeID), ","), keyframeSeconds)
+}
+
+// EncodeArgs returns libx264 arguments for the video stream selected by spec
+// ("v" for all video, "v:1" for the second), applying filters first.
+func EncodeArgs(cfg config.AgentConfig, spec, filters string, keyframeSeconds float64) []string {
+	return []string{
+		"-filter:" + spec, filters,
+		"-c:" + spec, "libx264",
+		"-preset:" + spec, cfg.Privacy.Preset,
+		"-tune:" + spec, "zerolatency",
+		"-crf:" + spec, strconv.Itoa(cfg.Privacy.Crf),
+		"-pix_fmt:" + spec, "yuv420p",
+		"-force_key_frames:" + spec, "expr:gte(t,n_forced*" + strconv.FormatFloat(keyframeSeconds, 'f', -1, 64) + ")",
+	}
+}
+
+// AudioArgs returns the audio codec arguments for the configured mode.
+func AudioArgs(audio config.AudioConfig) []string {
+	switch audio.Mode {
+	case config.AudioCopy:
+		return []string{"-c:a", "copy"}
+	case config.AudioAAC:
+		args := []string{"-c:a", "aac", "-b:a", fmt.Sprintf("%dk", audio.BitrateKbps)}
+		if audio.SampleRate > 0 {
+			args = append(args, "-ar", strconv.Itoa(audio.SampleRate))
+		}
+		return args
+	default:
+		return []string{"-an"}
+	}
+}
+
+// StreamInfo describes the first video and audio stream of a media file.
+type StreamInfo struct {
+	VideoCodec   string
+	VideoProfile string
+	VideoLevel   int
+	Width        int
+	Height       int
+	AudioCodec   string
+	AudioProfile string
+}
+
+// Probe runs ffprobe against a local file, typically a freshly written segment.
+func Probe(ctx context.Context, path string) (StreamInfo, error) {
+	probeCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(probeCtx, "ffprobe",
+		"-v", "error",
+		"-show_entries", "stream=codec_type,codec_name,profile,level,width,height",
+		"-of", "json",
+		path,
+	).Output()
+	if err != nil {
+		return StreamInfo{}, fmt.Errorf("ffprobe %s: %w", path, err)
+	}
+
+	var result struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Profile   string `json:"profile"`
+			Level     int    `json:"level"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &result); err != nil {
+		return StreamInfo{}, fmt.Errorf("decode ffprobe output: %w", err)
+	}
+
+	var info StreamInfo
+	for _, s := range result.Streams {
+		switch {
+		case s.CodecType == "video" && info.VideoCodec == "":
+			info.VideoCodec = s.CodecName
+			info.VideoProfile = s.Profile
+			info.VideoLevel = s.Level
+			info.Width = s.Width
+			info.Height = s.Height
+		case s.CodecType == "audio" && info.AudioCodec == "":
+			info.AudioCodec = s.CodecName
+			info.AudioProfile = s.Profile
+		}
+	}
+
+	return info, nil
+}
+
+// Codecs returns the RFC 6381 CODECS attribute value for the streams, or ""
+// when any stream cannot be described (the attribute is then best omitted).
+func (s StreamInfo) Codecs() string {
+	video := videoCodecTag(s.VideoCodec, s.VideoProfile, s.VideoLevel)
+	if video == "" {
+		return ""
+	}
+	if s.AudioCodec == "" {
+		return video
+	}
+
+	audio := AudioCodecTag(s.AudioCodec, s.AudioProfile)
+	if audio == "" {
+		return ""
+	}
+	return video + "," + audio
+}
+
+// AudioCodecTag maps an ffprobe audio codec to its HLS CODECS identifier. It
+// returns "" for codecs HLS players cannot decode, such as G.711.
+func AudioCodecTag(codec, profile string) string {
+	switch codec {
+	case "aac":
+		switch profile {
+		case "HE-AAC":
+			return "mp4a.40.5"
+		case "HE-AACv2":
+			return "mp4a.40.29"
+		}
+		return "mp4a.40.2"
+	case "mp3":
+		return "mp4a.40.34"
+	case "ac3":
+		return "ac-3"
+	case "eac3":
+		return "ec-3"
+	}
+	return ""
+}
+
+func videoCodecTag(codec, profile string, level int) string {
+	switch codec {
+	case "h264":
+		prefix := map[string]string{
+			"Constrained Baseline": "42E0",
+			"Baseline":             "4200",
+			"Main":                 "4D40",
+			"Extended":             "5800",
+			"High":                 "6400",
+			"High 10":              "6E00",
+			"High 4:2:2":           "7A00",
+		}[profile]
+		if prefix == "" || level <= 0 {
+			return ""
+		}
+		return fmt.Sprintf("avc1.%s%02X", prefix, level)
+	case "hevc":
+		if level <= 0 {
+			return ""
+		}
+		switch profile {
+		case "Main":
+			return fmt.Sprintf("hvc1.1.6.L%d.B0", level)
+		case "Main 10":
+			return fmt.Sprintf("hvc1.2.4.L%d.B0", level)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+package ffmpeg
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Segment is one entry of a media playlist written by ffmpeg's hls muxer.
+type Segment struct {
+	Name     string
+	Duration float64
+}
+
+// ReadPlaylist lists the segments of an HLS media playlist, oldest first.
+func ReadPlaylist(path string) ([]Segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		segments []Segment
+		duration float64
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimPrefix(line, "#EXTINF:")
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value = value[:i]
+			}
+			duration, _ = strconv.ParseFloat(value, 64)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segments = append(segments, Segment{Name: line, Duration: duration})
+			duration = 0
+		}
+	}
+
+	return segments, scanner.Err()
+}
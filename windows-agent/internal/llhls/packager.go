@@ -0,0 +1,313 @@
+// Package llhls turns short MPEG-TS parts written by ffmpeg into a low-latency
+// HLS stream and publishes each part as soon as it is complete.
+package llhls
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+	"github.com/difaeai/windows-agent/internal/tail"
+)
+
+const (
+	// ListFilename is the CSV segment list ffmpeg appends to after each part.
+	ListFilename = "parts.csv"
+	partPattern  = "part%08d.ts"
+	segPattern   = "seg%08d.ts"
+)
+
+// Publisher uploads LL-HLS output to the backend.
+type Publisher interface {
+	UploadPart(ctx context.Context, name string, msn, part int, independent bool, data []byte) error
+	UploadSegment(ctx context.Context, name string, data []byte) error
+	UploadManifestAt(ctx context.Context, data []byte, msn, part int) error
+}
+
+// Args returns the ffmpeg arguments that write fixed-duration parts, cutting
+// on non-keyframes so part length does not depend on the camera GOP.
+func Args(cfg config.AgentConfig, outputDir string) []string {
+	args := ffmpeg.InputArgs(cfg.RtspURL)
+	args = append(args, ffmpeg.MapArgs(cfg.Audio)...)
+	args = append(args, ffmpeg.AudioArgs(cfg.Audio)...)
+	args = append(args, ffmpeg.VideoArgs(cfg, seconds(cfg.LowLatency.SegmentDurationMs))...)
+	return append(args,
+		"-f", "segment",
+		"-segment_time", strconv.FormatFloat(seconds(cfg.LowLatency.PartDurationMs), 'f', 3, 64),
+		"-break_non_keyframes", "1",
+		"-segment_format", "mpegts",
+		"-segment_list", filepath.Join(outputDir, ListFilename),
+		"-segment_list_type", "csv",
+		"-reset_timestamps", "0",
+		"-y",
+		filepath.Join(outputDir, partPattern),
+	)
+}
+
+// Packager groups parts into segments and keeps the backend playlist current.
+type Packager struct {
+	dir    string
+	cfg    config.LowLatencyConfig
+	pub    Publisher
+	logger *log.Logger
+
+	// Epoch numbers segments from the wall clock, so consecutive runs form a
+	// single timeline. Discontinuity also marks the first segment with
+	// EXT-X-DISCONTINUITY, for a run on a different camera stream.
+	Epoch         bool
+	Discontinuity bool
+}
+
+// NewPackager returns a packager that reads ffmpeg output from dir.
+func NewPackager(dir string, cfg config.LowLatencyConfig, pub Publisher, logger *log.Logger) *Packager {
+	return &Packager{dir: dir, cfg: cfg, pub: pub, logger: logger}
+}
+
+// Run follows the part list until ctx is cancelled. It polls far more often
+// than the regular HLS monitor because each part is only a fraction of a second.
+// Uploads run on their own goroutine, so a slow backend delays neither the
+// playlist nor the cleanup of evicted parts.
+func (p *Packager) Run(ctx context.Context) {
+	playlist := NewPlaylist(seconds(p.cfg.PartDurationMs), seconds(p.cfg.SegmentDurationMs), p.cfg.PlaylistSegments)
+	if p.Epoch || p.Discontinuity {
+		playlist.StartAt(int(time.Now().Unix()), p.Discontinuity)
+	}
+	listPath := filepath.Join(p.dir, ListFilename)
+	target := seconds(p.cfg.SegmentDurationMs)
+
+	queue := make(chan upload, uploadQueueSize)
+	go p.upload(ctx, queue)
+
+	var (
+		offset  int64
+		segData bytes.Buffer
+	)
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lines, next, err := tail.ReadLines(listPath, offset)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				p.logger.Printf("Failed to read part list: %v", err)
+			}
+			continue
+		}
+		offset = next
+
+		for _, line := range lines {
+			name, duration, ok := parseEntry(line)
+			if !ok {
+				p.logger.Printf("Skipping malformed part entry %q", line)
+				continue
+			}
+
+			data, err := os.ReadFile(filepath.Join(p.dir, name))
+			if err != nil {
+				p.logger.Printf("Read part error: %v", err)
+				continue
+			}
+
+			part := Part{Name: name, Duration: duration, Independent: StartsIndependent(data)}
+
+			// Segments are cut at the first keyframe past the target, so
+			// each one starts with an independent part. A camera that sends
+			// no keyframe for far too long gets a cut anyway.
+			open := playlist.OpenDuration()
+			if (part.Independent && open >= target) || open >= maxSegmentTargets*target {
+				msn, _ := playlist.Position()
+				closed, evicted := playlist.CloseSegment(fmt.Sprintf(segPattern, msn))
+				segment := append([]byte(nil), segData.Bytes()...)
+				segData.Reset()
+
+				p.enqueue(queue, upload{name: closed.Name, run: func(ctx context.Context) error {
+					return p.pub.UploadSegment(ctx, closed.Name, segment)
+				}})
+				p.removeParts(evicted)
+			}
+
+			playlist.AddPart(part)
+			segData.Write(data)
+			msn, index := playlist.Position()
+			p.enqueue(queue, upload{name: name, run: func(ctx context.Context) error {
+				return p.pub.UploadPart(ctx, name, msn, index, part.Independent, data)
+			}})
+
+			playlist.SetPreloadHint(nextPartName(name))
+			manifest := playlist.Render()
+			p.enqueue(queue, upload{name: "playlist", run: func(ctx context.Context) error {
+				return p.pub.UploadManifestAt(ctx, manifest, msn, index)
+			}})
+		}
+	}
+}
+
+const (
+	// uploadQueueSize bounds the uploads waiting for the backend: parts,
+	// segments and playlists of several segments at typical settings.
+	uploadQueueSize = 64
+	// maxSegmentTargets caps a segment at this many target durations when
+	// no keyframe arrives to cut it.
+	maxSegmentTargets = 4
+)
+
+// upload is one queued request to the backend. Its deadline is fixed when it
+// is queued, so time spent waiting counts against it.
+type upload struct {
+	name     string
+	deadline time.Time
+	run      func(context.Context) error
+}
+
+// enqueue queues u, dropping the oldest upload when the backend has fallen
+// that far behind; it would reach viewers too late anyway.
+func (p *Packager) enqueue(queue chan upload, u upload) {
+	u.deadline = time.Now().Add(2 * time.Duration(p.cfg.SegmentDurationMs) * time.Millisecond)
+	for {
+		select {
+		case queue <- u:
+			return
+		default:
+		}
+		select {
+		case old := <-queue:
+			p.logger.Printf("Upload queue full; dropping %s", old.name)
+		default:
+		}
+	}
+}
+
+// upload sends queued uploads in order until ctx ends. Each is bounded to a
+// couple of segment durations from when it was queued; a part that cannot be
+// delivered by then is useless to low-latency viewers.
+func (p *Packager) upload(ctx context.Context, queue chan upload) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case u := <-queue:
+			uploadCtx, cancel := context.WithDeadline(ctx, u.deadline)
+			err := u.run(uploadCtx)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				p.logger.Printf("Upload failed for %s: %v", u.name, err)
+			}
+		}
+	}
+}
+
+func (p *Packager) removeParts(segments []Segment) {
+	for _, seg := range segments {
+		for _, part := range seg.Parts {
+			if err := os.Remove(filepath.Join(p.dir, part.Name)); err != nil && !os.IsNotExist(err) {
+				p.logger.Printf("Could not remove %s: %v", part.Name, err)
+			}
+		}
+	}
+}
+
+// parseEntry decodes a "name,start,end" line from ffmpeg's CSV segment list.
+func parseEntry(line string) (string, float64, bool) {
+	fields := strings.Split(line, ",")
+	if len(fields) != 3 {
+		return "", 0, false
+	}
+
+	start, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return "", 0, false
+	}
+	end, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return "", 0, false
+	}
+
+	return filepath.Base(fields[0]), end - start, true
+}
+
+func nextPartName(name string) string {
+	var n int
+	if _, err := fmt.Sscanf(name, partPattern, &n); err != nil {
+		return ""
+	}
+	return fmt.Sprintf(partPattern, n+1)
+}
+
+func seconds(ms int) float64 {
+	return float64(ms) / 1000
+}
+
+// PartFollower finds the newest part that starts with a keyframe, for
+// consumers that need a decodable frame. It tails the part list from where
+// it left off instead of rereading it, and starts over when the next ffmpeg
+// run writes a new list.
+type PartFollower struct {
+	dir string
+
+	mu       sync.Mutex
+	list     os.FileInfo
+	offset   int64
+	name     string
+	duration float64
+}
+
+// NewPartFollower returns a follower of the part list in dir.
+func NewPartFollower(dir string) *PartFollower {
+	return &PartFollower{dir: dir}
+}
+
+// LatestIndependentPart returns the path and duration of the newest part
+// that starts with a keyframe.
+func (f *PartFollower) LatestIndependentPart() (string, float64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	listPath := filepath.Join(f.dir, ListFilename)
+	info, err := os.Stat(listPath)
+	if err != nil {
+		return "", 0, err
+	}
+	if f.list == nil || !os.SameFile(f.list, info) || info.Size() < f.offset {
+		f.offset, f.name = 0, ""
+	}
+	f.list = info
+
+	lines, next, err := tail.ReadLines(listPath, f.offset)
+	if err != nil {
+		return "", 0, err
+	}
+	f.offset = next
+
+	for _, line := range lines {
+		name, duration, ok := parseEntry(line)
+		if !ok {
+			continue
+		}
+		// Parts of evicted segments are deleted; a newer one follows.
+		data, err := os.ReadFile(filepath.Join(f.dir, name))
+		if err == nil && StartsIndependent(data) {
+			f.name, f.duration = name, duration
+		}
+	}
+
+	if f.name == "" {
+		return "", 0, fmt.Errorf("no independent part in %s", f.dir)
+	}
+	return filepath.Join(f.dir, f.name), f.duration, nil
+}
@@ -0,0 +1,166 @@
+package llhls
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Part is a single partial segment listed with EXT-X-PART.
+type Part struct {
+	Name        string
+	Duration    float64
+	Independent bool
+}
+
+// Segment is a full media segment made up of consecutive parts.
+type Segment struct {
+	Sequence      int
+	Name          string
+	Duration      float64
+	Parts         []Part
+	Discontinuity bool
+}
+
+// Playlist is the rolling LL-HLS media playlist published for a stream.
+type Playlist struct {
+	PartTarget    float64
+	TargetSeconds float64
+	MaxSegments   int
+
+	segments              []Segment
+	open                  Segment
+	nextPart              string
+	discontinuitySequence int
+}
+
+// NewPlaylist returns an empty playlist for the given part and segment targets.
+func NewPlaylist(partTarget, segmentTarget float64, maxSegments int) *Playlist {
+	return &Playlist{
+		PartTarget:    partTarget,
+		TargetSeconds: segmentTarget,
+		MaxSegments:   maxSegments,
+	}
+}
+
+// StartAt sets the media sequence number of the first segment and optionally
+// marks it as a discontinuity, e.g. after the camera stream was switched.
+func (p *Playlist) StartAt(sequence int, discontinuity bool) {
+	p.open.Sequence = sequence
+	p.open.Discontinuity = discontinuity
+}
+
+// AddPart appends a completed part to the open segment.
+func (p *Playlist) AddPart(part Part) {
+	p.open.Parts = append(p.open.Parts, part)
+	p.open.Duration += part.Duration
+}
+
+// OpenDuration reports how much media the open segment holds so far.
+func (p *Playlist) OpenDuration() float64 {
+	return p.open.Duration
+}
+
+// Position returns the media sequence number and part index of the newest part.
+func (p *Playlist) Position() (msn, part int) {
+	if len(p.open.Parts) == 0 {
+		if len(p.segments) == 0 {
+			return 0, -1
+		}
+		last := p.segments[len(p.segments)-1]
+		return last.Sequence, len(last.Parts) - 1
+	}
+	return p.open.Sequence, len(p.open.Parts) - 1
+}
+
+// CloseSegment promotes the open segment to a full segment named name and
+// returns it along with any segments that fell out of the playlist window.
+func (p *Playlist) CloseSegment(name string) (closed Segment, evicted []Segment) {
+	closed = p.open
+	closed.Name = name
+	p.segments = append(p.segments, closed)
+	p.open = Segment{Sequence: closed.Sequence + 1}
+
+	if p.MaxSegments > 0 && len(p.segments) > p.MaxSegments {
+		drop := len(p.segments) - p.MaxSegments
+		evicted = append(evicted, p.segments[:drop]...)
+		for _, seg := range p.segments[:drop] {
+			if seg.Discontinuity {
+				p.discontinuitySequence++
+			}
+		}
+		p.segments = append([]Segment(nil), p.segments[drop:]...)
+	}
+
+	return closed, evicted
+}
+
+// SetPreloadHint records the name of the part ffmpeg is currently writing.
+func (p *Playlist) SetPreloadHint(name string) {
+	p.nextPart = name
+}
+
+// Render writes the playlist in LL-HLS format. Parts are only listed for the
+// most recent segments, as recommended by the specification.
+func (p *Playlist) Render() []byte {
+	var b strings.Builder
+
+	mediaSequence := p.open.Sequence
+	if len(p.segments) > 0 {
+		mediaSequence = p.segments[0].Sequence
+	}
+
+	target := int(math.Ceil(p.TargetSeconds + p.PartTarget))
+	for _, seg := range p.segments {
+		if d := int(math.Ceil(seg.Duration)); d > target {
+			target = d
+		}
+	}
+
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", p.PartTarget)
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", 3*p.PartTarget)
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", mediaSequence)
+	if p.discontinuitySequence > 0 {
+		fmt.Fprintf(&b, "#EXT-X-DISCONTINUITY-SEQUENCE:%d\n", p.discontinuitySequence)
+	}
+
+	partWindow := 3 * p.TargetSeconds
+	listedFrom := len(p.segments)
+	for covered := p.open.Duration; listedFrom > 0 && covered < partWindow; {
+		listedFrom--
+		covered += p.segments[listedFrom].Duration
+	}
+
+	for i, seg := range p.segments {
+		if seg.Discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if i >= listedFrom {
+			writeParts(&b, seg.Parts)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.Duration, seg.Name)
+	}
+
+	if p.open.Discontinuity && len(p.open.Parts) > 0 {
+		b.WriteString("#EXT-X-DISCONTINUITY\n")
+	}
+	writeParts(&b, p.open.Parts)
+	if p.nextPart != "" {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"%s\"\n", p.nextPart)
+	}
+
+	return []byte(b.String())
+}
+
+func writeParts(b *strings.Builder, parts []Part) {
+	for _, part := range parts {
+		fmt.Fprintf(b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"", part.Duration, part.Name)
+		if part.Independent {
+			b.WriteString(",INDEPENDENT=YES")
+		}
+		b.WriteString("\n")
+	}
+}
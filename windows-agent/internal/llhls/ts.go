@@ -0,0 +1,99 @@
+package llhls
+
+const tsPacketSize = 188
+
+// StartsIndependent reports whether the first video PES in an MPEG-TS buffer
+// is flagged as a random access point, i.e. the part can be decoded on its own.
+func StartsIndependent(data []byte) bool {
+	pmtPID := -1
+	videoPID := -1
+
+	for off := 0; off+tsPacketSize <= len(data); off += tsPacketSize {
+		pkt := data[off : off+tsPacketSize]
+		if pkt[0] != 0x47 {
+			return false
+		}
+
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		unitStart := pkt[1]&0x40 != 0
+		adaptation := pkt[3]&0x20 != 0
+		payload := payloadOf(pkt)
+
+		switch {
+		case pid == 0 && unitStart && pmtPID < 0:
+			pmtPID = parsePAT(payload)
+		case pid == pmtPID && unitStart && videoPID < 0:
+			videoPID = parsePMT(payload)
+		case pid == videoPID && unitStart:
+			return adaptation && pkt[4] > 0 && pkt[5]&0x40 != 0
+		}
+	}
+
+	return false
+}
+
+func payloadOf(pkt []byte) []byte {
+	start := 4
+	if pkt[3]&0x20 != 0 {
+		start += 1 + int(pkt[4])
+	}
+	if pkt[3]&0x10 == 0 || start >= len(pkt) {
+		return nil
+	}
+	return pkt[start:]
+}
+
+// section skips the pointer field and returns the PSI section body.
+func section(payload []byte) []byte {
+	if len(payload) == 0 {
+		return nil
+	}
+	start := 1 + int(payload[0])
+	if start+3 > len(payload) {
+		return nil
+	}
+	sec := payload[start:]
+	length := int(sec[1]&0x0f)<<8 | int(sec[2])
+	if 3+length > len(sec) {
+		return nil
+	}
+	return sec[:3+length]
+}
+
+func parsePAT(payload []byte) int {
+	sec := section(payload)
+	// Header is 8 bytes, trailing CRC is 4 bytes.
+	for i := 8; i+4 <= len(sec)-4; i += 4 {
+		program := int(sec[i])<<8 | int(sec[i+1])
+		if program != 0 {
+			return int(sec[i+2]&0x1f)<<8 | int(sec[i+3])
+		}
+	}
+	return -1
+}
+
+func parsePMT(payload []byte) int {
+	sec := section(payload)
+	if len(sec) < 12 {
+		return -1
+	}
+	infoLen := int(sec[10]&0x0f)<<8 | int(sec[11])
+	for i := 12 + infoLen; i+5 <= len(sec)-4; {
+		streamType := sec[i]
+		pid := int(sec[i+1]&0x1f)<<8 | int(sec[i+2])
+		esInfoLen := int(sec[i+3]&0x0f)<<8 | int(sec[i+4])
+		if isVideoStreamType(streamType) {
+			return pid
+		}
+		i += 5 + esInfoLen
+	}
+	return -1
+}
+
+func isVideoStreamType(t byte) bool {
+	switch t {
+	case 0x01, 0x02, 0x10, 0x1b, 0x24:
+		return true
+	}
+	return false
+}
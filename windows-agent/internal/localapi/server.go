@@ -0,0 +1,132 @@
+// Package localapi is the agent's embedded HTTP server for on-site staff and
+// local integrations. Every request must carry the configured token.
+package localapi
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+)
+
+// Server routes authenticated requests to registered handlers.
+type Server struct {
+	cfg    config.LocalAPIConfig
+	mux    *http.ServeMux
+	logger *log.Logger
+}
+
+// New returns a server that is not yet listening.
+func New(cfg config.LocalAPIConfig, logger *log.Logger) *Server {
+	return &Server{cfg: cfg, mux: http.NewServeMux(), logger: logger}
+}
+
+// Handle registers a handler; authentication is applied to all routes.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Handler returns the authenticated handler, e.g. for httptest servers.
+func (s *Server) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="difae-agent"`)
+			WriteError(w, http.StatusUnauthorized, "missing or invalid token")
+			return
+		}
+		s.mux.ServeHTTP(w, r)
+	})
+}
+
+// Run serves until ctx is cancelled.
+func (s *Server) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	s.logger.Printf("Local API listening on %s", listener.Addr())
+	if err := srv.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// authorized accepts the token as a bearer token or, for media players that
+// cannot set headers, as a token query parameter.
+func (s *Server) authorized(r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) == 1
+}
+
+// WriteJSON writes v as a JSON response.
+func WriteJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes a JSON error body.
+func WriteError(w http.ResponseWriter, status int, message string) {
+	WriteJSON(w, status, map[string]string{"error": message})
+}
+
+// ParseRange reads the from/to query parameters as RFC 3339 times or Unix
+// seconds. to defaults to now; the range may not be longer than max.
+func ParseRange(r *http.Request, max time.Duration) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	from, err := ParseTime(q.Get("from"))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid or missing from: %w", err)
+	}
+
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		if to, err = ParseTime(v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	if !to.After(from) {
+		return time.Time{}, time.Time{}, fmt.Errorf("to must be after from")
+	}
+	if to.Sub(from) > max {
+		return time.Time{}, time.Time{}, fmt.Errorf("range may not exceed %s", max)
+	}
+	return from, to, nil
+}
+
+// ParseTime accepts an RFC 3339 time or Unix seconds.
+func ParseTime(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, fmt.Errorf("empty time")
+	}
+	if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(unix, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
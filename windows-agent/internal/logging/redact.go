@@ -0,0 +1,63 @@
+package logging
+
+import (
+	"net/url"
+	"strings"
+)
+
+// secretQueryKeys are query options whose values are credentials, such as an
+// SRT passphrase or stream id, or a camera's access token.
+var secretQueryKeys = map[string]bool{
+	"passphrase": true, "streamid": true, "password": true, "pass": true, "pwd": true,
+	"token": true, "key": true, "auth": true, "secret": true, "signature": true,
+}
+
+// RedactURL hides the secrets of a camera or output URL for logs, status and
+// exported files: the password, secret query options, and the stream key
+// that ends an RTMP URL. The username and the rest of the URL are kept so
+// the log still says which camera or server is meant.
+func RedactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "(invalid URL)"
+	}
+	if u.User != nil {
+		u.User = url.User(u.User.Username())
+	}
+	if u.RawQuery != "" {
+		params := strings.Split(u.RawQuery, "&")
+		for i, p := range params {
+			key, _, ok := strings.Cut(p, "=")
+			if ok && secretQueryKeys[strings.ToLower(key)] {
+				params[i] = key + "=****"
+			}
+		}
+		u.RawQuery = strings.Join(params, "&")
+	}
+	scheme := strings.ToLower(u.Scheme)
+	if scheme == "rtmp" || scheme == "rtmps" {
+		if i := strings.LastIndex(u.Path, "/"); i > 0 && i < len(u.Path)-1 {
+			u.Path = u.Path[:i+1]
+			u.RawPath = ""
+			s := u.String()
+			if q := strings.IndexAny(s, "?#"); q >= 0 {
+				return s[:q] + "****" + s[q:]
+			}
+			return s + "****"
+		}
+	}
+	return u.String()
+}
+
+// RedactArgs returns a copy of an ffmpeg command line for logging, with every
+// URL argument redacted like RedactURL.
+func RedactArgs(args []string) []string {
+	out := make([]string, len(args))
+	for i, arg := range args {
+		if strings.Contains(arg, "://") {
+			arg = RedactURL(arg)
+		}
+		out[i] = arg
+	}
+	return out
+}
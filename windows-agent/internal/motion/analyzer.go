@@ -0,0 +1,114 @@
+package motion
+
+import "github.com/difaeai/windows-agent/internal/config"
+
+// Box is a rectangle in frame-relative coordinates (0-1 from the top-left).
+type Box struct {
+	X      float64 `json:"x"`
+	Y      float64 `json:"y"`
+	Width  float64 `json:"width"`
+	Height float64 `json:"height"`
+}
+
+// union returns the smallest box containing b and o; a zero box is empty.
+func (b Box) union(o Box) Box {
+	if b.Width == 0 || b.Height == 0 {
+		return o
+	}
+	if o.Width == 0 || o.Height == 0 {
+		return b
+	}
+	x0, y0 := min(b.X, o.X), min(b.Y, o.Y)
+	x1, y1 := max(b.X+b.Width, o.X+o.Width), max(b.Y+b.Height, o.Y+o.Height)
+	return Box{X: x0, Y: y0, Width: x1 - x0, Height: y1 - y0}
+}
+
+// analyzer compares consecutive grayscale frames pixel by pixel.
+type analyzer struct {
+	width, height int
+	threshold     int
+	active        int
+	minChanged    int
+	ignored       []bool
+	prev, spare   []byte
+}
+
+// newAnalyzer maps sensitivity 1-100 to a per-pixel luma difference of
+// roughly 64 down to 5, and rasterises the ignore zones into a mask.
+func newAnalyzer(cfg config.MotionConfig) *analyzer {
+	a := &analyzer{
+		width:     cfg.Width,
+		height:    cfg.Height,
+		threshold: 5 + (100-cfg.Sensitivity)*60/100,
+		ignored:   make([]bool, cfg.Width*cfg.Height),
+	}
+
+	for _, z := range cfg.IgnoreZones {
+		x0, y0 := int(z.X*float64(a.width)), int(z.Y*float64(a.height))
+		x1, y1 := int((z.X+z.Width)*float64(a.width)+0.5), int((z.Y+z.Height)*float64(a.height)+0.5)
+		for y := y0; y < y1 && y < a.height; y++ {
+			for x := x0; x < x1 && x < a.width; x++ {
+				a.ignored[y*a.width+x] = true
+			}
+		}
+	}
+
+	for _, ignored := range a.ignored {
+		if !ignored {
+			a.active++
+		}
+	}
+	a.minChanged = max(1, int(float64(a.active)*cfg.MinAreaPercent/100))
+	return a
+}
+
+// frameSize is the byte length of one raw gray frame.
+func (a *analyzer) frameSize() int {
+	return a.width * a.height
+}
+
+// process compares frame with the previous one. It reports the share of
+// watched pixels that changed (in percent), their bounding box, and whether
+// that is enough to count as motion. frame is copied, so callers may reuse it.
+func (a *analyzer) process(frame []byte) (area float64, box Box, moved bool) {
+	prev := a.prev
+	a.prev = append(a.spare[:0], frame...)
+	a.spare = prev
+	if len(prev) != len(frame) {
+		return 0, Box{}, false
+	}
+
+	changed := 0
+	minX, minY, maxX, maxY := a.width, a.height, -1, -1
+	for y := 0; y < a.height; y++ {
+		row := y * a.width
+		for x := 0; x < a.width; x++ {
+			i := row + x
+			if a.ignored[i] {
+				continue
+			}
+			diff := int(frame[i]) - int(prev[i])
+			if diff < 0 {
+				diff = -diff
+			}
+			if diff <= a.threshold {
+				continue
+			}
+			changed++
+			minX, minY = min(minX, x), min(minY, y)
+			maxX, maxY = max(maxX, x), max(maxY, y)
+		}
+	}
+	if changed == 0 || a.active == 0 {
+		return 0, Box{}, false
+	}
+
+	w, h := float64(a.width), float64(a.height)
+	box = Box{
+		X:      float64(minX) / w,
+		Y:      float64(minY) / h,
+		Width:  float64(maxX-minX+1) / w,
+		Height: float64(maxY-minY+1) / h,
+	}
+	return float64(changed) * 100 / float64(a.active), box, changed >= a.minChanged
+}
@@ -0,0 +1,183 @@
+// Package motion detects movement on the CPU from a downscaled grayscale
+// copy of the stream that ffmpeg writes as raw frames to its stdout, and
+// reports debounced motion start and stop events.
+package motion
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/events"
+)
+
+// Event states.
+const (
+	StateStarted = "started"
+	StateEnded   = "ended"
+)
+
+// Event is the JSON body sent to the backend's events endpoint. Box and
+// AreaPercent cover the whole motion period on "ended".
+type Event struct {
+	Type            string     `json:"type"`
+	State           string     `json:"state"`
+	Start           time.Time  `json:"start"`
+	End             *time.Time `json:"end,omitempty"`
+	DurationSeconds float64    `json:"durationSeconds,omitempty"`
+	Box             Box        `json:"box"`
+	AreaPercent     float64    `json:"areaPercent"`
+	Interrupted     bool       `json:"interrupted,omitempty"`
+}
+
+// Detector attaches a motion analysis output to pipeline runs.
+type Detector struct {
+	cfg    config.MotionConfig
+	events *events.Queue
+	logger *log.Logger
+
+	// OnStart, when set, is called as each motion period begins, e.g. to
+	// trigger a clip. It must not block.
+	OnStart func(Event)
+
+	active atomic.Bool
+}
+
+// New returns a detector reporting to the given event queue.
+func New(cfg config.MotionConfig, queue *events.Queue, logger *log.Logger) *Detector {
+	return &Detector{cfg: cfg, events: queue, logger: logger}
+}
+
+// Active reports whether a motion period is in progress.
+func (d *Detector) Active() bool {
+	return d.active.Load()
+}
+
+// Session is the frame pipe of one ffmpeg run.
+type Session struct {
+	d    *Detector
+	r, w *os.File
+}
+
+// Session opens the pipe that ffmpeg's stdout is connected to.
+func (d *Detector) Session() (*Session, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create motion frame pipe: %w", err)
+	}
+	return &Session{d: d, r: r, w: w}, nil
+}
+
+// Args returns the ffmpeg output arguments writing raw gray frames to stdout.
+func (s *Session) Args() []string {
+	cfg := s.d.cfg
+	return []string{
+		"-map", "0:v:0",
+		"-an", "-sn", "-dn",
+		"-vf", fmt.Sprintf("fps=%d,scale=%d:%d:flags=area,format=gray", cfg.Fps, cfg.Width, cfg.Height),
+		"-f", "rawvideo",
+		"pipe:1",
+	}
+}
+
+// Stdout is the write end of the pipe, to be used as ffmpeg's stdout.
+func (s *Session) Stdout() *os.File {
+	return s.w
+}
+
+// Close releases both ends of the pipe; used when ffmpeg failed to start.
+func (s *Session) Close() {
+	_ = s.w.Close()
+	_ = s.r.Close()
+}
+
+// Follow reads frames until ffmpeg exits or ctx ends. Motion starts after
+// StartFrames consecutive moving frames and stops after StopSeconds without.
+func (s *Session) Follow(ctx context.Context) {
+	// ffmpeg holds its own copy of the write end; closing ours lets reads
+	// see EOF when it exits.
+	_ = s.w.Close()
+	defer s.r.Close()
+	go func() {
+		<-ctx.Done()
+		_ = s.r.Close()
+	}()
+
+	cfg := s.d.cfg
+	a := newAnalyzer(cfg)
+	frame := make([]byte, a.frameSize())
+	quiet := time.Duration(cfg.StopSeconds) * time.Second
+
+	var (
+		streak     int
+		firstMoved time.Time
+		active     bool
+		start      time.Time
+		lastMotion time.Time
+		box        Box
+		peak       float64
+	)
+
+	for {
+		if _, err := io.ReadFull(s.r, frame); err != nil {
+			if active {
+				s.end(start, time.Now(), box, peak, true)
+				s.d.active.Store(false)
+			}
+			return
+		}
+		now := time.Now()
+
+		area, frameBox, moved := a.process(frame)
+		if !moved {
+			streak = 0
+			if active && now.Sub(lastMotion) >= quiet {
+				s.end(start, lastMotion, box, peak, false)
+				active = false
+				s.d.active.Store(false)
+			}
+			continue
+		}
+
+		if streak == 0 {
+			firstMoved = now
+		}
+		streak++
+		lastMotion = now
+		if active {
+			box = box.union(frameBox)
+			peak = max(peak, area)
+			continue
+		}
+		if streak >= cfg.StartFrames {
+			active = true
+			s.d.active.Store(true)
+			start, box, peak = firstMoved, frameBox, area
+			ev := Event{Type: "motion", State: StateStarted, Start: start, Box: box, AreaPercent: area}
+			s.d.logger.Printf("Motion started (%.1f%% of watched area)", area)
+			s.d.events.Send(ev)
+			if s.d.OnStart != nil {
+				s.d.OnStart(ev)
+			}
+		}
+	}
+}
+
+func (s *Session) end(start, end time.Time, box Box, peak float64, interrupted bool) {
+	s.d.logger.Printf("Motion ended after %s", end.Sub(start).Round(time.Second))
+	s.d.events.Send(Event{
+		Type:            "motion",
+		State:           StateEnded,
+		Start:           start,
+		End:             &end,
+		DurationSeconds: end.Sub(start).Seconds(),
+		Box:             box,
+		AreaPercent:     peak,
+		Interrupted:     interrupted,
+	})
+}
@@ -0,0 +1,149 @@
+// Package presence drives on-demand streaming: it keeps a long-poll open to
+// the backend for the bridge's viewer count and decides when the pipeline
+// should run.
+package presence
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+// pollWait is how long the backend may hold a viewer request; it stays below
+// the uploader's request timeout.
+const pollWait = 15 * time.Second
+
+// Watcher tracks viewers and signals when the pipeline should start or stop.
+type Watcher struct {
+	// Idle, if set, is called every IdleSnapshotSeconds while the pipeline
+	// is not wanted, to keep the dashboard's thumbnail current.
+	Idle func(ctx context.Context)
+
+	cfg    config.OnDemandConfig
+	upl    *uploader.Uploader
+	logger *log.Logger
+
+	mu       sync.Mutex
+	viewers  int
+	wanted   bool
+	lastSeen time.Time
+	changed  chan struct{}
+}
+
+// New returns a watcher that starts idle.
+func New(cfg config.OnDemandConfig, upl *uploader.Uploader, logger *log.Logger) *Watcher {
+	return &Watcher{cfg: cfg, upl: upl, logger: logger, changed: make(chan struct{}, 1)}
+}
+
+// Wanted reports whether the pipeline should run.
+func (w *Watcher) Wanted() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.wanted
+}
+
+// Changed is signalled whenever Wanted flips.
+func (w *Watcher) Changed() <-chan struct{} {
+	return w.changed
+}
+
+// Run polls for viewers, applies the idle timeout and takes idle snapshots
+// until ctx ends.
+func (w *Watcher) Run(ctx context.Context) {
+	go w.poll(ctx)
+
+	check := time.NewTicker(time.Second)
+	defer check.Stop()
+
+	var idle <-chan time.Time
+	if w.cfg.IdleSnapshotSeconds > 0 && w.Idle != nil {
+		ticker := time.NewTicker(time.Duration(w.cfg.IdleSnapshotSeconds) * time.Second)
+		defer ticker.Stop()
+		idle = ticker.C
+		w.Idle(ctx)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-check.C:
+			w.expire(now)
+		case <-idle:
+			if !w.Wanted() {
+				w.Idle(ctx)
+			}
+		}
+	}
+}
+
+func (w *Watcher) poll(ctx context.Context) {
+	var lastErr string
+	for ctx.Err() == nil {
+		w.mu.Lock()
+		known := w.viewers
+		w.mu.Unlock()
+
+		n, err := w.upl.FetchViewers(ctx, known, pollWait)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// Without the backend nobody can be watching; let the idle
+			// timeout run and log each distinct failure once.
+			if msg := err.Error(); msg != lastErr {
+				w.logger.Printf("Viewer poll failed: %v", err)
+				lastErr = msg
+			}
+			w.update(0, time.Now())
+			select {
+			case <-ctx.Done():
+			case <-time.After(5 * time.Second):
+			}
+			continue
+		}
+		lastErr = ""
+		w.update(n, time.Now())
+	}
+}
+
+func (w *Watcher) update(viewers int, now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	previous := w.viewers
+	w.viewers = viewers
+	switch {
+	case viewers > 0:
+		w.lastSeen = now
+		if !w.wanted {
+			w.logger.Printf("%d viewer(s) connected; starting pipeline", viewers)
+			w.setLocked(true)
+		}
+	case previous > 0:
+		w.lastSeen = now
+		w.logger.Printf("No viewers left; stopping pipeline in %ds unless one returns", w.cfg.IdleTimeoutSeconds)
+	}
+}
+
+func (w *Watcher) expire(now time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.wanted && w.viewers == 0 && now.Sub(w.lastSeen) >= time.Duration(w.cfg.IdleTimeoutSeconds)*time.Second {
+		w.logger.Printf("Idle for %ds; stopping pipeline until a viewer connects", w.cfg.IdleTimeoutSeconds)
+		w.setLocked(false)
+	}
+}
+
+func (w *Watcher) setLocked(wanted bool) {
+	w.wanted = wanted
+	select {
+	case w.changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,119 @@
+// Package privacy turns the configured privacy masks and text overlays into
+// ffmpeg filters that are burned into the video before it leaves the site.
+package privacy
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/difaeai/windows-agent/internal/config"
+)
+
+// windowsFont is used for overlays when no fontFile is configured, as
+// Windows ffmpeg builds often lack a working fontconfig setup.
+const windowsFont = `C:\Windows\Fonts\arial.ttf`
+
+// Active reports whether any mask or overlay is configured.
+func Active(cfg config.PrivacyConfig) bool {
+	return len(cfg.Masks) > 0 || len(cfg.Overlays) > 0
+}
+
+// Filters returns the drawbox/drawtext filters for cfg, escaped for use in a
+// filter chain, or nil when nothing is configured. Masks come first so an
+// overlay is never hidden by one.
+func Filters(cfg config.PrivacyConfig, bridgeID string) []string {
+	var filters []string
+	for _, m := range cfg.Masks {
+		for _, r := range maskRects(m) {
+			filters = append(filters, drawbox(r))
+		}
+	}
+
+	font := cfg.FontFile
+	if font == "" && runtime.GOOS == "windows" {
+		font = windowsFont
+	}
+	for _, o := range cfg.Overlays {
+		filters = append(filters, drawtext(o, expand(o.Text, cfg.CameraName, bridgeID), font))
+	}
+	return filters
+}
+
+// drawbox fills r, growing it by a pixel each way so rounding never leaves
+// a gap between neighbouring boxes.
+func drawbox(r rect) string {
+	return fmt.Sprintf("drawbox=x=iw*%s-1:y=ih*%s-1:w=iw*%s+2:h=ih*%s+2:color=black:t=fill",
+		num(r.x), num(r.y), num(r.w), num(r.h))
+}
+
+func drawtext(o config.OverlayConfig, text, font string) string {
+	margin := strconv.Itoa(max(4, o.FontSize/2))
+	x, y := margin, margin
+	if o.Position == config.OverlayTopRight || o.Position == config.OverlayBottomRight {
+		x = "w-tw-" + margin
+	}
+	if o.Position == config.OverlayBottomLeft || o.Position == config.OverlayBottomRight {
+		y = "h-th-" + margin
+	}
+
+	opts := []string{
+		"text=" + escapeValue(text),
+		"fontsize=" + strconv.Itoa(o.FontSize),
+		"fontcolor=" + escapeValue(o.Color),
+		"x=" + x,
+		"y=" + y,
+	}
+	if o.Background {
+		opts = append(opts, "box=1", "boxcolor=black@0.5", "boxborderw="+strconv.Itoa(max(2, o.FontSize/4)))
+	}
+	if font != "" {
+		opts = append(opts, "fontfile="+escapeValue(strings.ReplaceAll(font, `\`, "/")))
+	}
+	return "drawtext=" + strings.Join(opts, ":")
+}
+
+// expand replaces template placeholders with drawtext text, escaping the
+// literal parts for drawtext's own %{...} expansion.
+func expand(template, camera, bridgeID string) string {
+	literal := strings.NewReplacer(`\`, `\\`, `%`, `\%`)
+	return strings.NewReplacer(
+		"{time}", `%{localtime:%Y-%m-%d %H\:%M\:%S}`,
+		"{date}", `%{localtime:%Y-%m-%d}`,
+		"{camera}", literal.Replace(camera),
+		"{bridge}", literal.Replace(bridgeID),
+	).Replace(literalExceptPlaceholders(template, literal))
+}
+
+// literalExceptPlaceholders escapes everything but the {name} placeholders.
+func literalExceptPlaceholders(template string, literal *strings.Replacer) string {
+	var b strings.Builder
+	for template != "" {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			b.WriteString(literal.Replace(template))
+			break
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			b.WriteString(literal.Replace(template))
+			break
+		}
+		b.WriteString(literal.Replace(template[:start]))
+		b.WriteString(template[start : start+end+1])
+		template = template[start+end+1:]
+	}
+	return b.String()
+}
+
+// escapeValue escapes an option value twice: once for the filter's option
+// parser and once for the filter graph parser.
+func escapeValue(v string) string {
+	option := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`).Replace(v)
+	return strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`).Replace(option)
+}
+
+func num(v float64) string {
+	return strconv.FormatFloat(v, 'f', 5, 64)
+}
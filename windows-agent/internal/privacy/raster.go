@@ -0,0 +1,116 @@
+package privacy
+
+import "github.com/difaeai/windows-agent/internal/config"
+
+// Polygon masks are approximated on a grid of gridW x gridH cells. A cell is
+// blacked out if the polygon touches it at all, so the mask only ever errs on
+// the side of hiding more.
+const (
+	gridW = 128
+	gridH = 72
+)
+
+// rect is a frame-relative rectangle.
+type rect struct {
+	x, y, w, h float64
+}
+
+type point struct {
+	x, y float64
+}
+
+// maskRects returns the rectangles covering a mask.
+func maskRects(m config.MaskConfig) []rect {
+	if len(m.Points) == 0 {
+		return []rect{{m.X, m.Y, m.Width, m.Height}}
+	}
+
+	poly := make([]point, len(m.Points))
+	for i, p := range m.Points {
+		poly[i] = point{p[0], p[1]}
+	}
+
+	cw, ch := 1.0/gridW, 1.0/gridH
+	var rects []rect
+	var open []rect // runs of the previous row, extended downwards while identical
+	for row := 0; row < gridH; row++ {
+		var runs []rect
+		for col := 0; col < gridW; {
+			if !touches(poly, float64(col)*cw, float64(row)*ch, cw, ch) {
+				col++
+				continue
+			}
+			start := col
+			for col < gridW && touches(poly, float64(col)*cw, float64(row)*ch, cw, ch) {
+				col++
+			}
+			runs = append(runs, rect{float64(start) * cw, float64(row) * ch, float64(col-start) * cw, ch})
+		}
+
+		var next []rect
+		for _, r := range runs {
+			merged := false
+			for i, o := range open {
+				if o.x == r.x && o.w == r.w {
+					open[i].h += ch
+					next = append(next, open[i])
+					open = append(open[:i], open[i+1:]...)
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				next = append(next, r)
+			}
+		}
+		rects = append(rects, open...)
+		open = next
+	}
+	return append(rects, open...)
+}
+
+// touches reports whether the polygon overlaps the cell at (x, y).
+func touches(poly []point, x, y, w, h float64) bool {
+	corners := []point{{x, y}, {x + w, y}, {x, y + h}, {x + w, y + h}}
+	for _, c := range corners {
+		if inside(poly, c) {
+			return true
+		}
+	}
+	for i := range poly {
+		a, b := poly[i], poly[(i+1)%len(poly)]
+		if a.x >= x && a.x <= x+w && a.y >= y && a.y <= y+h {
+			return true
+		}
+		for j := range corners {
+			// Cell edges: top, right, bottom, left.
+			c, d := corners[[]int{0, 1, 3, 2}[j]], corners[[]int{1, 3, 2, 0}[j]]
+			if segmentsCross(a, b, c, d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// inside is the even-odd point-in-polygon test.
+func inside(poly []point, p point) bool {
+	in := false
+	for i, j := 0, len(poly)-1; i < len(poly); j, i = i, i+1 {
+		a, b := poly[i], poly[j]
+		if (a.y > p.y) != (b.y > p.y) && p.x < (b.x-a.x)*(p.y-a.y)/(b.y-a.y)+a.x {
+			in = !in
+		}
+	}
+	return in
+}
+
+func segmentsCross(a, b, c, d point) bool {
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return ((d1 > 0) != (d2 > 0)) && ((d3 > 0) != (d4 > 0))
+}
+
+func cross(o, a, b point) float64 {
+	return (a.x-o.x)*(b.y-o.y) - (a.y-o.y)*(b.x-o.x)
+}
@@ -0,0 +1,19 @@
+package push
+
+import (
+	"net/http"
+
+	"github.com/difaeai/windows-agent/internal/localapi"
+)
+
+// Handler serves GET with the state of every output.
+func (p *Pusher) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			localapi.WriteError(w, http.StatusMethodNotAllowed, "use GET")
+			return
+		}
+		localapi.WriteJSON(w, http.StatusOK, p.Status())
+	})
+}
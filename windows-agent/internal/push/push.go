@@ -0,0 +1,367 @@
+// Package push sends the camera to media servers outside DIFAE, over RTMP(S)
+// or SRT in caller mode, next to the HLS upload. Each output is its own
+// ffmpeg process, restarted with back-off when the server drops it, so one
+// unreachable server never disturbs the others or the HLS pipeline. Outputs
+// read the pipeline's fan-out tap rather than opening the camera again.
+package push
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/events"
+	"github.com/difaeai/windows-agent/internal/fanout"
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+	"github.com/difaeai/windows-agent/internal/logging"
+)
+
+// Path is where the local API serves the outputs' status.
+const Path = "/api/outputs"
+
+// Output states reported in Status.
+const (
+	StateConnecting = "connecting"
+	StateStreaming  = "streaming"
+	StateBackoff    = "backoff"
+	StateStopped    = "stopped"
+)
+
+// The restart back-off; variables so tests need not wait minutes.
+var (
+	minBackoff = 2 * time.Second
+	maxBackoff = time.Minute
+	// A run that streamed this long resets the back-off.
+	stableRun = time.Minute
+)
+
+// ioTimeout is how long ffmpeg waits on a stalled server, in microseconds.
+const ioTimeout = "10000000"
+
+// Event is sent to the backend when an output connects, drops or cannot
+// connect. Repeated failed attempts are reported once.
+type Event struct {
+	Type  string    `json:"type"`
+	Name  string    `json:"name"`
+	URL   string    `json:"url"`
+	State string    `json:"state"`
+	Error string    `json:"error,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// Status describes one output as served by the local API.
+type Status struct {
+	Name           string     `json:"name"`
+	URL            string     `json:"url"`
+	State          string     `json:"state"`
+	ConnectedSince *time.Time `json:"connectedSince,omitempty"`
+	Connections    int        `json:"connections"`
+	BytesSent      int64      `json:"bytesSent"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorAt    *time.Time `json:"lastErrorAt,omitempty"`
+}
+
+// Pusher runs the configured outputs while a pipeline runs.
+type Pusher struct {
+	cfg     config.AgentConfig
+	events  *events.Queue
+	logger  *log.Logger
+	outputs []*output
+}
+
+type output struct {
+	cfg    config.OutputConfig
+	logger *log.Logger
+
+	mu       sync.Mutex
+	status   Status
+	sent     int64 // bytes sent by earlier runs
+	reported bool  // a failure was reported since the last connection
+}
+
+// New returns a pusher for cfg.Outputs reporting to the given event queue.
+func New(cfg config.AgentConfig, queue *events.Queue, logger *log.Logger) *Pusher {
+	p := &Pusher{cfg: cfg, events: queue, logger: logger}
+	for _, out := range cfg.Outputs {
+		prefixed := log.New(logger.Writer(), logger.Prefix()+"[output "+out.Name+"] ", logger.Flags()|log.Lmsgprefix)
+		p.outputs = append(p.outputs, &output{
+			cfg:    out,
+			logger: prefixed,
+			status: Status{Name: out.Name, URL: logging.RedactURL(out.URL), State: StateStopped},
+		})
+	}
+	return p
+}
+
+// Run pushes the stream buffered by tap to every output until ctx ends.
+func (p *Pusher) Run(ctx context.Context, tap *fanout.Tap) {
+	var wg sync.WaitGroup
+	for _, o := range p.outputs {
+		wg.Add(1)
+		go func(o *output) {
+			defer wg.Done()
+			p.supervise(ctx, o, tap)
+		}(o)
+	}
+	wg.Wait()
+}
+
+// Status returns the state of every output.
+func (p *Pusher) Status() []Status {
+	out := make([]Status, 0, len(p.outputs))
+	for _, o := range p.outputs {
+		out = append(out, o.snapshot())
+	}
+	return out
+}
+
+func (p *Pusher) supervise(ctx context.Context, o *output, tap *fanout.Tap) {
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := p.runOnce(ctx, o, tap)
+		if ctx.Err() != nil {
+			o.stopped()
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("ffmpeg exited")
+		}
+		if time.Since(started) >= stableRun {
+			backoff = minBackoff
+		}
+		if connected, report := o.failed(err); report {
+			state := "failed"
+			if connected {
+				state = "disconnected"
+			}
+			p.events.Send(Event{Type: "output", Name: o.cfg.Name, URL: logging.RedactURL(o.cfg.URL), State: state, Error: err.Error(), At: time.Now()})
+		}
+		o.logger.Printf("Output stopped: %v; restarting in %s", err, backoff)
+
+		select {
+		case <-ctx.Done():
+			o.stopped()
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// runOnce runs one ffmpeg process for o until it exits. ffmpeg reads the tap
+// on stdin and reports its progress on stdout; the first report with bytes
+// written means the server accepted the stream.
+func (p *Pusher) runOnce(ctx context.Context, o *output, tap *fanout.Tap) error {
+	args := Args(p.cfg, o.cfg)
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	o.connecting()
+	o.logger.Printf("Pushing to %s", logging.RedactURL(o.cfg.URL))
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start ffmpeg: %w", err)
+	}
+
+	// The reader is closed once ffmpeg exits, which unblocks the copy even
+	// while the tap is idle.
+	reader := tap.Reader()
+	go func() {
+		_, _ = io.Copy(stdin, reader)
+		stdin.Close()
+	}()
+
+	var lastLine string
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			// ffmpeg names the output URL in its errors.
+			if line := o.scrub(strings.TrimSpace(scanner.Text())); line != "" {
+				o.logger.Printf("ffmpeg: %s", line)
+				lastLine = line
+			}
+		}
+	}()
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok || key != "total_size" {
+			continue
+		}
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && n > 0 {
+			if o.progress(n) {
+				o.logger.Printf("Connected to %s", logging.RedactURL(o.cfg.URL))
+				p.events.Send(Event{Type: "output", Name: o.cfg.Name, URL: logging.RedactURL(o.cfg.URL), State: "connected", At: time.Now()})
+			}
+		}
+	}
+	_, _ = io.Copy(io.Discard, stdout)
+	wg.Wait()
+
+	err = cmd.Wait()
+	reader.Close()
+	if lost := reader.Lost(); lost > 0 {
+		o.logger.Printf("Output fell behind and skipped %d bytes", lost)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if lastLine != "" {
+		return fmt.Errorf("ffmpeg exited (%v): %s", err, lastLine)
+	}
+	if err != nil {
+		return fmt.Errorf("ffmpeg exited: %w", err)
+	}
+	return nil
+}
+
+// TapAudio returns the audio the fan-out tap should carry for the outputs:
+// the pipeline's own audio, or AAC when the pipeline drops audio but an
+// output wants it.
+func TapAudio(cfg config.AgentConfig) config.AudioConfig {
+	if cfg.Audio.Mode != config.AudioOff {
+		return cfg.Audio
+	}
+	for _, out := range cfg.Outputs {
+		if out.Audio != config.AudioOff {
+			return config.AudioConfig{Mode: config.AudioAAC, BitrateKbps: 128, SampleRate: cfg.Audio.SampleRate}
+		}
+	}
+	return cfg.Audio
+}
+
+// Args returns the ffmpeg arguments that push MPEG-TS from stdin to out. The
+// tap carries the camera's video unchanged, so privacy masks are applied
+// here, along with the output's audio mode.
+func Args(cfg config.AgentConfig, out config.OutputConfig) []string {
+	audio := config.AudioConfig{Mode: out.Audio, BitrateKbps: cfg.Audio.BitrateKbps, SampleRate: cfg.Audio.SampleRate}
+	if audio.BitrateKbps == 0 {
+		audio.BitrateKbps = 128
+	}
+
+	args := []string{"-nostats", "-loglevel", "warning", "-progress", "pipe:1", "-f", "mpegts", "-i", "pipe:0"}
+	args = append(args, ffmpeg.MapArgs(audio)...)
+	args = append(args, ffmpeg.VideoArgs(cfg, 2)...)
+	args = append(args, ffmpeg.AudioArgs(audio)...)
+	args = append(args, "-rw_timeout", ioTimeout)
+	if strings.HasPrefix(out.URL, "srt:") {
+		return append(args, "-f", "mpegts", SRTURL(out))
+	}
+	return append(args, "-f", "flv", "-flvflags", "no_duration_filesize", out.URL)
+}
+
+// SRTURL returns out.URL with the caller-mode options ffmpeg needs. Options
+// already present in the URL are kept; ffmpeg takes latency in microseconds.
+func SRTURL(out config.OutputConfig) string {
+	u, err := url.Parse(out.URL)
+	if err != nil {
+		return out.URL
+	}
+	q := u.Query()
+	set := func(key, value string) {
+		if q.Get(key) == "" {
+			q.Set(key, value)
+		}
+	}
+	set("mode", "caller")
+	set("latency", strconv.Itoa(out.LatencyMs*1000))
+	set("pkt_size", "1316")
+	if out.Passphrase != "" {
+		set("passphrase", out.Passphrase)
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// scrub removes the output URL, and with it any stream key or passphrase,
+// from an ffmpeg log line.
+func (o *output) scrub(line string) string {
+	redacted := logging.RedactURL(o.cfg.URL)
+	for _, secret := range []string{SRTURL(o.cfg), o.cfg.URL} {
+		line = strings.ReplaceAll(line, secret, redacted)
+	}
+	return line
+}
+
+func (o *output) connecting() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.status.State = StateConnecting
+}
+
+// progress records the bytes written by the running process and reports
+// whether this is the first report of the run.
+func (o *output) progress(total int64) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.status.BytesSent = o.sent + total
+	if o.status.State == StateStreaming {
+		return false
+	}
+	now := time.Now()
+	o.status.State = StateStreaming
+	o.status.ConnectedSince = &now
+	o.status.Connections++
+	o.reported = false
+	return true
+}
+
+// failed records the end of a run. It reports whether the output had
+// connected, and whether the failure should be reported to the backend.
+func (o *output) failed(err error) (connected, report bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	connected = o.status.State == StateStreaming
+	report = !o.reported
+	o.reported = true
+	o.endRunLocked(StateBackoff)
+	now := time.Now()
+	o.status.LastError = err.Error()
+	o.status.LastErrorAt = &now
+	return connected, report
+}
+
+func (o *output) stopped() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.endRunLocked(StateStopped)
+}
+
+func (o *output) endRunLocked(state string) {
+	o.sent = o.status.BytesSent
+	o.status.State = state
+	o.status.ConnectedSince = nil
+}
+
+func (o *output) snapshot() Status {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.status
+}
@@ -0,0 +1,470 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/events"
+	"github.com/difaeai/windows-agent/internal/fanout"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+// The back-off test needs ffmpeg to fail on cue, so the test binary doubles
+// as ffmpeg there: the test puts a copy named ffmpeg on PATH, and it runs
+// fakeFFmpeg when started with this variable set. Everything else runs the
+// real ffmpeg against a real ffmpeg listener and is skipped without one.
+const fakeFFmpegEnv = "PUSH_TEST_FAKE_FFMPEG"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeFFmpegEnv) == "1" {
+		fakeFFmpeg(os.Args[1:])
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// fakeFFmpeg fails the way ffmpeg does when its output URL (the last
+// argument) refuses the connection, naming the full URL in its error.
+func fakeFFmpeg(args []string) {
+	fmt.Fprintf(os.Stderr, "%s: Connection refused\n", args[len(args)-1])
+	os.Exit(1)
+}
+
+// installFakeFFmpeg puts the fake first on PATH for the rest of the test.
+func installFakeFFmpeg(t *testing.T) {
+	t.Helper()
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	name := "ffmpeg"
+	if runtime.GOOS == "windows" {
+		name += ".exe"
+	}
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	t.Setenv(fakeFFmpegEnv, "1")
+}
+
+// fastBackoff shortens the restart delays for the test.
+func fastBackoff(t *testing.T, initial, limit time.Duration) {
+	oldMin, oldMax := minBackoff, maxBackoff
+	minBackoff, maxBackoff = initial, limit
+	t.Cleanup(func() { minBackoff, maxBackoff = oldMin, oldMax })
+}
+
+// requireFFmpeg skips the test unless ffmpeg is on PATH with the protocol
+// and libx264, which encodes the test source.
+func requireFFmpeg(t *testing.T, protocol string) {
+	t.Helper()
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not on PATH")
+	}
+	for _, probe := range [][2]string{{"-protocols", protocol}, {"-encoders", "libx264"}} {
+		out, err := exec.Command(path, "-hide_banner", probe[0]).Output()
+		if err != nil || !hasField(string(out), probe[1]) {
+			t.Skipf("ffmpeg lacks %s", probe[1])
+		}
+	}
+}
+
+func hasField(list, name string) bool {
+	for _, line := range strings.Split(list, "\n") {
+		for _, f := range strings.Fields(line) {
+			if f == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// freeAddr returns a loopback address nothing listens on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+// ffmpegListener is a real ffmpeg server, "-listen 1" for RTMP or
+// mode=listener for SRT, that records the stream it receives to a file.
+type ffmpegListener struct {
+	cmd  *exec.Cmd
+	out  string
+	done chan struct{}
+	logs syncBuffer
+}
+
+func startListener(t *testing.T, input ...string) *ffmpegListener {
+	t.Helper()
+	l := &ffmpegListener{out: filepath.Join(t.TempDir(), "received.ts"), done: make(chan struct{})}
+	args := append([]string{"-hide_banner", "-loglevel", "error"}, input...)
+	args = append(args, "-c", "copy", "-f", "mpegts", "-y", l.out)
+	l.cmd = exec.Command("ffmpeg", args...)
+	l.cmd.Stderr = &l.logs
+	if err := l.cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = l.cmd.Wait()
+		close(l.done)
+	}()
+	t.Cleanup(l.stop)
+	return l
+}
+
+// received returns what the listener has recorded so far.
+func (l *ffmpegListener) received() []byte {
+	data, _ := os.ReadFile(l.out)
+	return data
+}
+
+// stop kills the listener, dropping the sender's connection.
+func (l *ffmpegListener) stop() {
+	_ = l.cmd.Process.Kill()
+	<-l.done
+}
+
+// connectedStates drops a leading "failed": the listener cannot be probed
+// without taking its one connection, so the first attempt may beat it.
+func connectedStates(states []string) []string {
+	if len(states) > 0 && states[0] == "failed" {
+		return states[1:]
+	}
+	return states
+}
+
+// feedTapFFmpeg starts a tap fed by a real ffmpeg encoding a test pattern to
+// H.264 in real time, with a keyframe every second, until the test ends.
+func feedTapFFmpeg(t *testing.T, ctx context.Context) *fanout.Tap {
+	t.Helper()
+	tap, err := fanout.NewTap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tap.Run(ctx)
+	args := tap.OutputArgs(config.AudioConfig{Mode: config.AudioOff})
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-loglevel", "error", "-re",
+		"-f", "lavfi", "-i", "testsrc2=size=320x240:rate=25",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-g", "25", "-pix_fmt", "yuv420p",
+		"-f", "mpegts", args[len(args)-1])
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cmd.Wait() })
+	return tap
+}
+
+// waitReceived waits until l has recorded some MPEG-TS.
+func waitReceived(t *testing.T, l *ffmpegListener) {
+	t.Helper()
+	waitFor(t, "the listener to record the stream", func() bool {
+		data := l.received()
+		return len(data) >= 16*188 && data[0] == 0x47
+	})
+}
+
+// feedTap starts a tap and keeps writing MPEG-TS with a keyframe every few
+// packets to it until the test ends.
+func feedTap(t *testing.T, ctx context.Context) *fanout.Tap {
+	t.Helper()
+	tap, err := fanout.NewTap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tap.Run(ctx)
+	args := tap.OutputArgs(config.AudioConfig{Mode: config.AudioOff})
+	conn, err := net.Dial("tcp", strings.TrimPrefix(args[len(args)-1], "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := func(pid int, start, keyframe bool, payload []byte) []byte {
+		pkt := []byte{0x47, byte(pid>>8) & 0x1f, byte(pid), 0x30}
+		if start {
+			pkt[1] |= 0x40
+		}
+		flags := byte(0)
+		if keyframe {
+			flags = 0x40
+		}
+		stuffing := 188 - 4 - len(payload)
+		pkt = append(pkt, byte(stuffing-1), flags)
+		pkt = append(pkt, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+		return append(pkt, payload...)
+	}
+	pat := packet(0, true, false, []byte{0, 0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00, 0, 0, 0, 0})
+	pmt := packet(0x1000, true, false, []byte{0, 0x02, 0xb0, 18, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00,
+		0x1b, 0xe1, 0x00, 0xf0, 0x00, 0, 0, 0, 0})
+	go func() {
+		defer conn.Close()
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		for i := 0; ; i++ {
+			chunk := append(append([]byte{}, pat...), pmt...)
+			for j := 0; j < 20; j++ {
+				chunk = append(chunk, packet(0x100, j == 0, j == 0, []byte{0, 0, 1, 0xe0})...)
+			}
+			if _, err := conn.Write(chunk); err != nil {
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return tap
+}
+
+// eventSink is a backend that collects the events it is sent.
+type eventSink struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+func (s *eventSink) start(t *testing.T, ctx context.Context) *events.Queue {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e Event
+		if err := json.NewDecoder(r.Body).Decode(&e); err == nil && e.Type == "output" {
+			s.mu.Lock()
+			s.events = append(s.events, e)
+			s.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	queue := events.New(uploader.New(srv.URL, "bridge-1", "key", log.New(io.Discard, "", 0)), log.New(io.Discard, "", 0))
+	go queue.Run(ctx)
+	return queue
+}
+
+func (s *eventSink) states() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []string
+	for _, e := range s.events {
+		out = append(out, e.State)
+	}
+	return out
+}
+
+func (s *eventSink) all() []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// syncBuffer collects log output from several goroutines.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.b.String()
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReconnectAfterDrop(t *testing.T) {
+	requireFFmpeg(t, "rtmp")
+	fastBackoff(t, 200*time.Millisecond, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr := freeAddr(t)
+	rawURL := "rtmp://" + addr + "/live/s3cr3t-key"
+	first := startListener(t, "-listen", "1", "-i", rawURL)
+
+	var sink eventSink
+	var logs syncBuffer
+	cfg := config.AgentConfig{Outputs: []config.OutputConfig{{Name: "youtube", URL: rawURL, Audio: config.AudioOff}}}
+	p := New(cfg, sink.start(t, ctx), log.New(&logs, "", 0))
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, feedTapFFmpeg(t, ctx))
+		close(done)
+	}()
+
+	waitFor(t, "the first connection", func() bool { return p.Status()[0].State == StateStreaming })
+	waitReceived(t, first)
+
+	// The server goes away mid-stream and comes back on the same address.
+	first.stop()
+	second := startListener(t, "-listen", "1", "-i", rawURL)
+	waitFor(t, "the second connection", func() bool {
+		st := p.Status()[0]
+		return st.Connections == 2 && st.State == StateStreaming
+	})
+	waitReceived(t, second)
+	waitFor(t, "three events", func() bool { return len(connectedStates(sink.states())) >= 3 })
+	if got, want := strings.Join(connectedStates(sink.states()), ","), "connected,disconnected,connected"; got != want {
+		t.Errorf("events = %s, want %s", got, want)
+	}
+
+	redacted := "rtmp://" + addr + "/live/****"
+	st := p.Status()[0]
+	if st.URL != redacted {
+		t.Errorf("status URL = %q, want %q", st.URL, redacted)
+	}
+	if st.BytesSent == 0 || st.LastError == "" {
+		t.Errorf("status = %+v, want bytes sent and the drop's error", st)
+	}
+	if strings.Contains(st.LastError, "s3cr3t") {
+		t.Errorf("status error reveals the stream key: %s", st.LastError)
+	}
+	for _, e := range sink.all() {
+		if e.URL != redacted || strings.Contains(e.Error, "s3cr3t") {
+			t.Errorf("event reveals the stream key: %+v", e)
+		}
+	}
+
+	cancel()
+	<-done
+	if got := p.Status()[0].State; got != StateStopped {
+		t.Errorf("state after the pipeline stopped = %s", got)
+	}
+	out := logs.String()
+	if strings.Contains(out, "s3cr3t") {
+		t.Errorf("log reveals the stream key:\n%s", out)
+	}
+	for _, want := range []string{"[output youtube] Pushing to " + redacted, "Connected to " + redacted, "Output stopped: "} {
+		if !strings.Contains(out, want) {
+			t.Errorf("log lacks %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestPushSRT(t *testing.T) {
+	requireFFmpeg(t, "srt")
+	fastBackoff(t, 200*time.Millisecond, time.Second)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	addr := freeAddr(t)
+	const passphrase = "hunter22hunter22"
+	l := startListener(t, "-i", "srt://"+addr+"?mode=listener&passphrase="+passphrase)
+
+	var sink eventSink
+	var logs syncBuffer
+	out := config.OutputConfig{Name: "srt", URL: "srt://" + addr + "?streamid=abc", Audio: config.AudioOff, LatencyMs: 200, Passphrase: passphrase}
+	p := New(config.AgentConfig{Outputs: []config.OutputConfig{out}}, sink.start(t, ctx), log.New(&logs, "", 0))
+	go p.Run(ctx, feedTapFFmpeg(t, ctx))
+
+	waitFor(t, "the connection", func() bool { return p.Status()[0].State == StateStreaming })
+	waitReceived(t, l)
+	waitFor(t, "the connected event", func() bool { return len(connectedStates(sink.states())) > 0 })
+	if got := connectedStates(sink.states()); len(got) != 1 {
+		t.Errorf("events = %v, want a single connected", got)
+	}
+
+	st := p.Status()[0]
+	if st.Connections != 1 || st.BytesSent == 0 {
+		t.Errorf("status = %+v, want one connection with bytes sent", st)
+	}
+	if strings.Contains(st.URL+logs.String(), passphrase) || strings.Contains(st.URL, "abc") {
+		t.Errorf("status or log reveals the SRT passphrase or stream id: %+v\n%s", st, logs.String())
+	}
+}
+
+func TestBackoffWhileUnreachable(t *testing.T) {
+	installFakeFFmpeg(t)
+	fastBackoff(t, 50*time.Millisecond, 200*time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var sink eventSink
+	cfg := config.AgentConfig{Outputs: []config.OutputConfig{{Name: "srt", URL: "srt://" + addr + "?passphrase=hunter22&streamid=abc", Audio: config.AudioOff}}}
+	p := New(cfg, sink.start(t, ctx), log.New(io.Discard, "", 0))
+	go p.Run(ctx, feedTap(t, ctx))
+
+	// Each failed attempt sets LastErrorAt; the gaps between them are the
+	// back-off plus the time ffmpeg takes to fail.
+	var failures []time.Time
+	waitFor(t, "six failed attempts", func() bool {
+		st := p.Status()[0]
+		if st.LastErrorAt != nil && (len(failures) == 0 || !st.LastErrorAt.Equal(failures[len(failures)-1])) {
+			failures = append(failures, *st.LastErrorAt)
+		}
+		return len(failures) >= 6
+	})
+	want := []time.Duration{50, 100, 200, 200, 200}
+	for i, w := range want {
+		gap := failures[i+1].Sub(failures[i])
+		if gap < w*time.Millisecond {
+			t.Errorf("attempt %d came %s after the previous, want at least %dms", i+2, gap, w)
+		}
+		if gap > w*time.Millisecond+time.Second {
+			t.Errorf("attempt %d came %s after the previous, want about %dms", i+2, gap, w)
+		}
+	}
+
+	st := p.Status()[0]
+	if st.State != StateBackoff && st.State != StateConnecting {
+		t.Errorf("state = %s", st.State)
+	}
+	if st.Connections != 0 {
+		t.Errorf("connections = %d", st.Connections)
+	}
+	if strings.Contains(st.URL+st.LastError, "hunter22") || strings.Contains(st.URL+st.LastError, "abc") {
+		t.Errorf("status reveals the SRT passphrase or stream id: %+v", st)
+	}
+	waitFor(t, "the failure event", func() bool { return len(sink.states()) > 0 })
+	if got := sink.states(); len(got) != 1 || got[0] != "failed" {
+		t.Errorf("events = %v, want a single failed", got)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+
+package recorder
+
+import "syscall"
+
+// diskUsage returns the percentage of the volume holding path that is in use,
+// computed like df: blocks reserved for root count as unavailable.
+func diskUsage(path string) (float64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+
+	used := float64(st.Blocks-st.Bfree) * float64(st.Bsize)
+	avail := float64(st.Bavail) * float64(st.Bsize)
+	if used+avail == 0 {
+		return 0, nil
+	}
+	return used / (used + avail) * 100, nil
+}
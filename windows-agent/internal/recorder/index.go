@@ -0,0 +1,274 @@
+package recorder
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const indexFilename = "index.jsonl"
+
+// Chunk is one recorded file and the wall-clock span it covers.
+type Chunk struct {
+	File  string    `json:"file"`
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Bytes int64     `json:"bytes"`
+	// SHA256 is the hex digest taken when the chunk was indexed, so later
+	// exports can show the file is unchanged since capture.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Path returns the chunk's location inside dir.
+func (c Chunk) Path(dir string) string {
+	return filepath.Join(dir, c.File)
+}
+
+// Index is the persistent, time-ordered list of chunks in a recording
+// directory. New chunks are appended to index.jsonl; deletions rewrite it.
+type Index struct {
+	dir         string
+	chunkLength time.Duration
+
+	mu     sync.Mutex
+	chunks []Chunk
+}
+
+// OpenIndex loads the index for dir, dropping entries whose files are gone
+// and adopting chunk files that were never indexed (e.g. after a crash).
+// chunkLength is used to estimate the start of chunks cut short by a crash.
+func OpenIndex(dir string, chunkLength time.Duration) (*Index, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to prepare recordings directory: %w", err)
+	}
+
+	idx := &Index{dir: dir, chunkLength: chunkLength}
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.adoptLocked()
+	return idx, idx.rewriteLocked()
+}
+
+// LoadIndex reads the index for dir without adopting or rewriting anything,
+// for tools that run alongside the agent.
+func LoadIndex(dir string) (*Index, error) {
+	idx := &Index{dir: dir}
+	if err := idx.load(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// Dir returns the recording directory the index describes.
+func (i *Index) Dir() string {
+	return i.dir
+}
+
+// Add records a completed chunk.
+func (i *Index) Add(c Chunk) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.insertLocked(c)
+
+	f, err := os.OpenFile(filepath.Join(i.dir, indexFilename), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open recording index: %w", err)
+	}
+	defer f.Close()
+
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to append to recording index: %w", err)
+	}
+	return f.Sync()
+}
+
+// Adopt indexes chunk files left behind by an ffmpeg run that ended before
+// it could list them.
+func (i *Index) Adopt() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.adoptLocked() == 0 {
+		return nil
+	}
+	return i.rewriteLocked()
+}
+
+// Range returns the chunks overlapping [from, to), oldest first.
+func (i *Index) Range(from, to time.Time) []Chunk {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var out []Chunk
+	for _, c := range i.chunks {
+		if c.End.After(from) && c.Start.Before(to) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Chunks returns a copy of every indexed chunk, oldest first.
+func (i *Index) Chunks() []Chunk {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return append([]Chunk(nil), i.chunks...)
+}
+
+// RemoveOldest deletes the oldest chunk's file and index entry.
+func (i *Index) RemoveOldest() (Chunk, bool, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if len(i.chunks) == 0 {
+		return Chunk{}, false, nil
+	}
+
+	oldest := i.chunks[0]
+	if err := os.Remove(oldest.Path(i.dir)); err != nil && !os.IsNotExist(err) {
+		return oldest, false, fmt.Errorf("failed to delete %s: %w", oldest.File, err)
+	}
+	i.chunks = i.chunks[1:]
+	return oldest, true, i.rewriteLocked()
+}
+
+func (i *Index) load() error {
+	f, err := os.Open(filepath.Join(i.dir, indexFilename))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read recording index: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var c Chunk
+		if err := json.Unmarshal(scanner.Bytes(), &c); err != nil {
+			// A torn final line from a power cut; the file is re-adopted below.
+			continue
+		}
+		if _, err := os.Stat(c.Path(i.dir)); err != nil {
+			continue
+		}
+		i.insertLocked(c)
+	}
+	return scanner.Err()
+}
+
+// adoptLocked indexes chunk files that are missing from the index. Finished
+// chunks carry their start time in the name; a chunk ffmpeg was still writing
+// is renamed after a start estimated from its run and mtime.
+func (i *Index) adoptLocked() int {
+	known := make(map[string]bool, len(i.chunks))
+	for _, c := range i.chunks {
+		known[c.File] = true
+	}
+
+	entries, err := os.ReadDir(i.dir)
+	if err != nil {
+		return 0
+	}
+
+	adopted := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || known[name] {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || info.Size() == 0 {
+			continue
+		}
+
+		start, ok := parseChunkName(name)
+		if !ok {
+			runStart, ok := parseRawName(name)
+			if !ok {
+				continue
+			}
+			start = info.ModTime().Add(-i.chunkLength)
+			if start.Before(runStart) {
+				start = runStart
+			}
+
+			final, err := renameChunk(filepath.Join(i.dir, name), start)
+			if err != nil {
+				continue
+			}
+			name = final
+		}
+
+		sum, _ := HashFile(filepath.Join(i.dir, name))
+		i.insertLocked(Chunk{File: name, Start: start, End: info.ModTime(), Bytes: info.Size(), SHA256: sum})
+		adopted++
+	}
+	return adopted
+}
+
+// HashFile returns the hex SHA-256 digest of a file.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (i *Index) insertLocked(c Chunk) {
+	for n, existing := range i.chunks {
+		if existing.File == c.File {
+			i.chunks[n] = c
+			return
+		}
+	}
+	i.chunks = append(i.chunks, c)
+	sort.Slice(i.chunks, func(a, b int) bool { return i.chunks[a].Start.Before(i.chunks[b].Start) })
+}
+
+func (i *Index) rewriteLocked() error {
+	var b strings.Builder
+	for _, c := range i.chunks {
+		line, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		b.Write(line)
+		b.WriteByte('\n')
+	}
+
+	path := filepath.Join(i.dir, indexFilename)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o644); err != nil {
+		return fmt.Errorf("failed to write recording index: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace recording index: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+// Package recorder keeps continuous local recordings of the camera in
+// time-indexed chunks, independent of the rolling HLS output directory.
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+	"github.com/difaeai/windows-agent/internal/tail"
+)
+
+const (
+	// chunkTimeLayout names finished chunks after their start. Milliseconds
+	// keep chunks cut within the same second, around a restart, apart.
+	chunkTimeLayout = "20060102T150405.000Z"
+	// secondChunkTimeLayout is how chunks were named before milliseconds.
+	secondChunkTimeLayout = "20060102T150405Z"
+	rawPrefix             = "rec-"
+)
+
+// Recorder adds a chunked recording output to the ffmpeg pipeline, indexes
+// finished chunks, and enforces the retention policy.
+type Recorder struct {
+	cfg    config.RecordingConfig
+	index  *Index
+	logger *log.Logger
+}
+
+// New returns a recorder writing into index's directory.
+func New(cfg config.RecordingConfig, index *Index, logger *log.Logger) *Recorder {
+	return &Recorder{cfg: cfg, index: index, logger: logger}
+}
+
+// Index returns the recording index, for lookups by time range.
+func (r *Recorder) Index() *Index {
+	return r.index
+}
+
+// Session is the recording output of one ffmpeg run.
+type Session struct {
+	r     *Recorder
+	start time.Time
+}
+
+// Session prepares a recording output for a new pipeline run.
+func (r *Recorder) Session() *Session {
+	return &Session{r: r, start: time.Now()}
+}
+
+// Args returns the ffmpeg output arguments for the recording. Chunks are cut
+// on wall-clock boundaries and written under a per-run name until complete.
+func (s *Session) Args(cfg config.AgentConfig) []string {
+	args := ffmpeg.MapArgs(cfg.Audio)
+	args = append(args, "-c:v", "copy")
+	args = append(args, ffmpeg.AudioArgs(cfg.Audio)...)
+	args = append(args,
+		"-f", "segment",
+		"-segment_time", strconv.Itoa(s.r.cfg.ChunkSeconds),
+		"-segment_atclocktime", "1",
+		"-reset_timestamps", "1",
+		"-segment_list", s.listPath(),
+		"-segment_list_type", "csv",
+	)
+	if s.r.cfg.Format == config.RecordingMP4 {
+		args = append(args,
+			"-segment_format", "mp4",
+			"-segment_format_options", "movflags=+frag_keyframe+empty_moov+default_base_moof",
+		)
+	} else {
+		args = append(args, "-segment_format", "mpegts")
+	}
+
+	return append(args, filepath.Join(s.r.index.Dir(), fmt.Sprintf("%s%d-%%06d.%s", rawPrefix, s.start.Unix(), s.r.cfg.Format)))
+}
+
+func (s *Session) listPath() string {
+	return filepath.Join(s.r.index.Dir(), fmt.Sprintf("%s%d.csv", rawPrefix, s.start.Unix()))
+}
+
+// Follow indexes chunks as ffmpeg finishes them. Each finished chunk is
+// renamed after its UTC start time, taken as its completion time minus its
+// duration. When ctx ends, the chunk cut short by the run is adopted too.
+func (s *Session) Follow(ctx context.Context) {
+	defer func() {
+		_ = os.Remove(s.listPath())
+		if err := s.r.index.Adopt(); err != nil {
+			s.r.logger.Printf("Recording index update failed: %v", err)
+		}
+	}()
+
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	var offset int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lines, next, err := tail.ReadLines(s.listPath(), offset)
+		if err != nil {
+			continue
+		}
+		offset = next
+
+		for _, line := range lines {
+			if err := s.index(line, time.Now()); err != nil {
+				s.r.logger.Printf("Recording chunk not indexed: %v", err)
+			}
+		}
+	}
+}
+
+func (s *Session) index(line string, seenAt time.Time) error {
+	fields := strings.Split(line, ",")
+	if len(fields) != 3 {
+		return fmt.Errorf("malformed chunk entry %q", line)
+	}
+	startOffset, err1 := strconv.ParseFloat(fields[1], 64)
+	endOffset, err2 := strconv.ParseFloat(fields[2], 64)
+	if err1 != nil || err2 != nil {
+		return fmt.Errorf("malformed chunk entry %q", line)
+	}
+
+	raw := filepath.Join(s.r.index.Dir(), filepath.Base(fields[0]))
+	info, err := os.Stat(raw)
+	if err != nil {
+		return err
+	}
+
+	duration := time.Duration((endOffset - startOffset) * float64(time.Second))
+	end := info.ModTime()
+	if end.After(seenAt) {
+		end = seenAt
+	}
+	start := end.Add(-duration)
+
+	name, err := renameChunk(raw, start)
+	if err != nil {
+		return err
+	}
+
+	sum, err := HashFile(filepath.Join(s.r.index.Dir(), name))
+	if err != nil {
+		return err
+	}
+	return s.r.index.Add(Chunk{File: name, Start: start, End: end, Bytes: info.Size(), SHA256: sum})
+}
+
+// Retain enforces the age and disk-usage limits once a minute.
+func (r *Recorder) Retain(ctx context.Context) {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+
+	for {
+		r.enforce(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Recorder) enforce(now time.Time) {
+	if r.cfg.MaxAgeHours > 0 {
+		cutoff := now.Add(-time.Duration(r.cfg.MaxAgeHours) * time.Hour)
+		for {
+			chunks := r.index.Chunks()
+			if len(chunks) == 0 || !chunks[0].End.Before(cutoff) {
+				break
+			}
+			if !r.removeOldest("older than retention age") {
+				break
+			}
+		}
+	}
+
+	if r.cfg.MaxDiskPercent > 0 {
+		for {
+			used, err := diskUsage(r.index.Dir())
+			if err != nil {
+				r.logger.Printf("Could not read disk usage: %v", err)
+				break
+			}
+			// Never delete the chunk being written or the last finished one.
+			if used <= r.cfg.MaxDiskPercent || len(r.index.Chunks()) <= 1 {
+				break
+			}
+			if !r.removeOldest(fmt.Sprintf("disk %.1f%% full", used)) {
+				break
+			}
+		}
+	}
+}
+
+func (r *Recorder) removeOldest(reason string) bool {
+	chunk, ok, err := r.index.RemoveOldest()
+	if err != nil {
+		r.logger.Printf("Recording retention failed: %v", err)
+		return false
+	}
+	if ok {
+		r.logger.Printf("Deleted recording %s (%s)", chunk.File, reason)
+	}
+	return ok
+}
+
+func chunkName(start time.Time, ext string) string {
+	return start.UTC().Format(chunkTimeLayout) + ext
+}
+
+// renameChunk gives the in-progress chunk raw its final name beside it. It
+// refuses to replace a recording that already has that name.
+func renameChunk(raw string, start time.Time) (string, error) {
+	name := chunkName(start, filepath.Ext(raw))
+	final := filepath.Join(filepath.Dir(raw), name)
+	if _, err := os.Lstat(final); err == nil {
+		return "", fmt.Errorf("recording %s already exists; leaving %s in place", name, filepath.Base(raw))
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.Rename(raw, final); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func parseChunkName(name string) (time.Time, bool) {
+	ext := filepath.Ext(name)
+	if ext != ".ts" && ext != ".mp4" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{chunkTimeLayout, secondChunkTimeLayout} {
+		if start, err := time.Parse(layout, strings.TrimSuffix(name, ext)); err == nil {
+			return start, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// parseRawName returns the run start of an in-progress chunk name such as
+// rec-1760000000-000042.ts.
+func parseRawName(name string) (time.Time, bool) {
+	ext := filepath.Ext(name)
+	if (ext != ".ts" && ext != ".mp4") || !strings.HasPrefix(name, rawPrefix) {
+		return time.Time{}, false
+	}
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, rawPrefix), ext), "-")
+	if len(parts) != 2 {
+		return time.Time{}, false
+	}
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(unix, 0), true
+}
@@ -0,0 +1,405 @@
+// Package rtspprobe checks a camera over RTSP without ffmpeg: it sends
+// OPTIONS and DESCRIBE, answering Basic or Digest challenges, and reads the
+// tracks from the SDP. Running it before the pipeline turns a wrong
+// password, a wrong path or an unreachable camera into a precise error
+// within seconds instead of an ffmpeg exit.
+package rtspprobe
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/logging"
+)
+
+// Timeout bounds a whole probe, redirects included.
+const Timeout = 10 * time.Second
+
+const (
+	defaultPort  = "554"
+	maxRedirects = 3
+	maxBodyBytes = 1 << 20
+	userAgent    = "DIFAE Agent"
+)
+
+// The errors a probe can settle on. Anything else, such as an unexpected
+// status or a malformed answer, may be the probe's fault rather than the
+// camera's; see Conclusive.
+var (
+	ErrUnauthorized = errors.New("the camera rejected the credentials")
+	ErrNotFound     = errors.New("the camera has no stream at this path")
+	ErrTimeout      = errors.New("the camera did not answer in time")
+	ErrUnreachable  = errors.New("the camera is unreachable")
+	ErrNoVideo      = errors.New("the camera's stream has no video track")
+)
+
+// Result is what the camera reported.
+type Result struct {
+	Server  string   `json:"server,omitempty"`
+	Methods []string `json:"methods,omitempty"`
+	// Auth is the scheme the camera asked for ("basic" or "digest"), or
+	// empty when it served the stream without credentials.
+	Auth   string  `json:"auth,omitempty"`
+	Tracks []Track `json:"tracks"`
+}
+
+// Video returns the first video track, or nil.
+func (r *Result) Video() *Track {
+	for i := range r.Tracks {
+		if r.Tracks[i].Media == "video" {
+			return &r.Tracks[i]
+		}
+	}
+	return nil
+}
+
+// Audio returns the first audio track, or nil when the camera sends none.
+func (r *Result) Audio() *Track {
+	for i := range r.Tracks {
+		if r.Tracks[i].Media == "audio" {
+			return &r.Tracks[i]
+		}
+	}
+	return nil
+}
+
+func (r *Result) String() string {
+	parts := make([]string, 0, len(r.Tracks))
+	for _, t := range r.Tracks {
+		parts = append(parts, t.String())
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Conclusive reports whether err says the pipeline cannot work, so there is
+// no point in starting ffmpeg. Other errors are worth letting ffmpeg try.
+func Conclusive(err error) bool {
+	return errors.Is(err, ErrUnauthorized) || errors.Is(err, ErrNotFound) ||
+		errors.Is(err, ErrTimeout) || errors.Is(err, ErrUnreachable) || errors.Is(err, ErrNoVideo)
+}
+
+// Probe describes the stream at rawURL, an rtsp:// URL that may carry
+// credentials. It gives up after Timeout.
+func Probe(ctx context.Context, rawURL string) (*Result, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTSP URL: %w", err)
+	}
+	probeCtx, cancel := context.WithTimeout(ctx, Timeout)
+	defer cancel()
+
+	for redirects := 0; ; redirects++ {
+		result, location, err := probe(probeCtx, u)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if location == nil {
+			return result, nil
+		}
+		if redirects == maxRedirects {
+			return nil, fmt.Errorf("more than %d redirects from %s", maxRedirects, logging.RedactURL(u.String()))
+		}
+		if location.User == nil && location.Host == u.Host {
+			location.User = u.User
+		}
+		u = location
+	}
+}
+
+// probe runs one connection's exchange. A redirect is returned as the
+// location to probe next.
+func probe(ctx context.Context, u *url.URL) (*Result, *url.URL, error) {
+	if !strings.EqualFold(u.Scheme, "rtsp") {
+		return nil, nil, fmt.Errorf("%s:// URLs cannot be probed", u.Scheme)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, nil, fmt.Errorf("%w (no connection to %s)", ErrTimeout, host)
+		}
+		return nil, nil, fmt.Errorf("%w: %v", ErrUnreachable, err)
+	}
+	defer nc.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { nc.SetDeadline(time.Now()) })
+	defer stop()
+
+	c := &client{nc: nc, br: bufio.NewReader(nc), uri: requestURI(u)}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+
+	result := &Result{}
+	resp, err := c.do(ctx, "OPTIONS", c.uri, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// OPTIONS is only informative; cameras answer it in many odd ways.
+	result.Server = resp.header.Get("Server")
+	for _, m := range strings.Split(resp.header.Get("Public"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			result.Methods = append(result.Methods, m)
+		}
+	}
+
+	resp, err = c.do(ctx, "DESCRIBE", c.uri, [][2]string{{"Accept", "application/sdp"}})
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.Server == "" {
+		result.Server = resp.header.Get("Server")
+	}
+	result.Auth = c.scheme
+	switch {
+	case resp.code == 200:
+	case resp.code == 401:
+		if c.username == "" {
+			return nil, nil, fmt.Errorf("%w: it requires a username and password", ErrUnauthorized)
+		}
+		return nil, nil, fmt.Errorf("%w (%s)", ErrUnauthorized, resp.status())
+	case resp.code == 404:
+		return nil, nil, fmt.Errorf("%w: %s (%s)", ErrNotFound, u.Path, resp.status())
+	case resp.code == 301 || resp.code == 302 || resp.code == 303 || resp.code == 307:
+		location, err := u.Parse(resp.header.Get("Location"))
+		if err != nil || resp.header.Get("Location") == "" {
+			return nil, nil, fmt.Errorf("DESCRIBE redirected without a valid Location (%s)", resp.status())
+		}
+		return nil, location, nil
+	default:
+		return nil, nil, fmt.Errorf("DESCRIBE answered %s", resp.status())
+	}
+
+	if ct := resp.header.Get("Content-Type"); !strings.HasPrefix(strings.ToLower(ct), "application/sdp") {
+		return nil, nil, fmt.Errorf("DESCRIBE answered %q instead of SDP", ct)
+	}
+	result.Tracks = parseSDP(resp.body)
+	if result.Video() == nil {
+		return nil, nil, ErrNoVideo
+	}
+	return result, nil, nil
+}
+
+// requestURI returns u as sent on the request line, without credentials.
+func requestURI(u *url.URL) string {
+	c := *u
+	c.User = nil
+	return c.String()
+}
+
+type response struct {
+	code   int
+	reason string
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (r *response) status() string {
+	return fmt.Sprintf("%d %s", r.code, r.reason)
+}
+
+// client is one RTSP connection. Once a challenge has been answered, every
+// later request carries credentials for the same scheme.
+type client struct {
+	nc  net.Conn
+	br  *bufio.Reader
+	uri string
+
+	username, password string
+	cseq               int
+	scheme             string // "basic" or "digest" once challenged
+	realm, nonce       string
+	opaque, qop        string
+	nc1                int // digest nonce count
+}
+
+// do sends a request and, on a first 401, answers the challenge and sends it
+// once more.
+func (c *client) do(ctx context.Context, method, uri string, header [][2]string) (*response, error) {
+	resp, err := c.roundTrip(ctx, method, uri, header)
+	if err != nil || resp.code != 401 || c.username == "" || c.scheme != "" {
+		return resp, err
+	}
+	if !c.challenge(resp.header.Values("WWW-Authenticate")) {
+		return nil, fmt.Errorf("%w: unsupported authentication %q", ErrUnauthorized, resp.header.Get("WWW-Authenticate"))
+	}
+	return c.roundTrip(ctx, method, uri, header)
+}
+
+func (c *client) roundTrip(ctx context.Context, method, uri string, header [][2]string) (*response, error) {
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\nUser-Agent: %s\r\n", method, uri, c.cseq, userAgent)
+	if auth := c.authorization(method, uri); auth != "" {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", auth)
+	}
+	for _, h := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(c.nc, b.String()); err != nil {
+		return nil, c.netError(ctx, err)
+	}
+
+	resp, err := c.readResponse()
+	if err != nil {
+		return nil, c.netError(ctx, err)
+	}
+	return resp, nil
+}
+
+func (c *client) readResponse() (*response, error) {
+	tp := textproto.NewReader(c.br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, rest, _ := strings.Cut(line, " ")
+	codeText, reason, _ := strings.Cut(rest, " ")
+	code, err := strconv.Atoi(codeText)
+	if !strings.HasPrefix(proto, "RTSP/") || err != nil {
+		return nil, fmt.Errorf("not an RTSP server (answered %q)", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("malformed RTSP answer: %w", err)
+	}
+	resp := &response{code: code, reason: reason, header: header}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if n > maxBodyBytes {
+			return nil, fmt.Errorf("RTSP answer of %d bytes is too large", n)
+		}
+		resp.body = make([]byte, n)
+		if _, err := io.ReadFull(c.br, resp.body); err != nil {
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+// netError classifies a failed read or write: deadline, camera hang-up or
+// a protocol problem.
+func (c *client) netError(ctx context.Context, err error) error {
+	var ne net.Error
+	if ctx.Err() != nil || (errors.As(err, &ne) && ne.Timeout()) {
+		return ErrTimeout
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return errors.New("the camera closed the connection without answering")
+	}
+	return err
+}
+
+// challenge picks Digest over Basic from the camera's challenges.
+func (c *client) challenge(values []string) bool {
+	for _, v := range values {
+		scheme, params, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if !strings.EqualFold(scheme, "digest") {
+			continue
+		}
+		p := digestParams(params)
+		if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+			continue
+		}
+		c.scheme, c.realm, c.nonce, c.opaque = "digest", p["realm"], p["nonce"], p["opaque"]
+		for _, q := range strings.Split(p["qop"], ",") {
+			if strings.TrimSpace(q) == "auth" {
+				c.qop = "auth"
+			}
+		}
+		return true
+	}
+	for _, v := range values {
+		scheme, _, _ := strings.Cut(strings.TrimSpace(v), " ")
+		if strings.EqualFold(scheme, "basic") {
+			c.scheme = "basic"
+			return true
+		}
+	}
+	return false
+}
+
+func (c *client) authorization(method, uri string) string {
+	switch c.scheme {
+	case "basic":
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.username+":"+c.password))
+	case "digest":
+		ha1 := md5Hex(c.username + ":" + c.realm + ":" + c.password)
+		ha2 := md5Hex(method + ":" + uri)
+		auth := fmt.Sprintf("Digest username=%q, realm=%q, nonce=%q, uri=%q", c.username, c.realm, c.nonce, uri)
+		if c.qop == "" {
+			auth += fmt.Sprintf(", response=%q", md5Hex(ha1+":"+c.nonce+":"+ha2))
+		} else {
+			c.nc1++
+			nc := fmt.Sprintf("%08x", c.nc1)
+			cnonce := randomHex(8)
+			response := md5Hex(ha1 + ":" + c.nonce + ":" + nc + ":" + cnonce + ":" + c.qop + ":" + ha2)
+			auth += fmt.Sprintf(", response=%q, qop=%s, nc=%s, cnonce=%q", response, c.qop, nc, cnonce)
+		}
+		if c.opaque != "" {
+			auth += fmt.Sprintf(", opaque=%q", c.opaque)
+		}
+		return auth
+	}
+	return ""
+}
+
+// digestParams parses the comma-separated key="value" pairs of a Digest
+// challenge.
+func digestParams(s string) map[string]string {
+	out := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, s = rest[1:end+1], rest[end+2:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+		out[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return out
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+package rtspprobe
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Track is one media description of the SDP.
+type Track struct {
+	Media     string `json:"media"` // "video", "audio" or "application"
+	Codec     string `json:"codec"` // the rtpmap encoding name, e.g. "H264"
+	ClockRate int    `json:"clockRate,omitempty"`
+	Channels  int    `json:"channels,omitempty"`
+	Control   string `json:"control,omitempty"`
+	// Profile, Width and Height are read from the parameter sets in the
+	// fmtp line, or from a=framesize/a=x-dimensions when the camera sends
+	// those instead.
+	Profile string  `json:"profile,omitempty"`
+	Width   int     `json:"width,omitempty"`
+	Height  int     `json:"height,omitempty"`
+	FPS     float64 `json:"fps,omitempty"`
+}
+
+func (t Track) String() string {
+	s := t.Codec
+	if t.Profile != "" {
+		s += " " + t.Profile
+	}
+	if t.Width > 0 && t.Height > 0 {
+		s += fmt.Sprintf(" %dx%d", t.Width, t.Height)
+	}
+	if t.FPS > 0 {
+		s += " @ " + strconv.FormatFloat(t.FPS, 'f', -1, 64) + " fps"
+	}
+	if t.Media == "audio" && t.ClockRate > 0 {
+		s += fmt.Sprintf(" %d Hz", t.ClockRate)
+		if t.Channels > 1 {
+			s += fmt.Sprintf(" %d channels", t.Channels)
+		}
+	}
+	return s
+}
+
+// staticPayloads names the RTP payload types cameras use without rtpmap.
+var staticPayloads = map[string]Track{
+	"0":  {Media: "audio", Codec: "PCMU", ClockRate: 8000, Channels: 1},
+	"8":  {Media: "audio", Codec: "PCMA", ClockRate: 8000, Channels: 1},
+	"14": {Media: "audio", Codec: "MPA", ClockRate: 90000},
+	"26": {Media: "video", Codec: "JPEG", ClockRate: 90000},
+	"32": {Media: "video", Codec: "MPV", ClockRate: 90000},
+	"33": {Media: "video", Codec: "MP2T", ClockRate: 90000},
+}
+
+// parseSDP returns the media descriptions of an SDP body, each described
+// by its first payload type.
+func parseSDP(body []byte) []Track {
+	var tracks []Track
+	var t *Track
+	var pt string
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimRight(line, "\r")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || len(key) != 1 {
+			continue
+		}
+		if key == "m" {
+			fields := strings.Fields(value)
+			if len(fields) < 4 {
+				t = nil
+				continue
+			}
+			pt = fields[3]
+			track := staticPayloads[pt]
+			track.Media = fields[0]
+			tracks = append(tracks, track)
+			t = &tracks[len(tracks)-1]
+			continue
+		}
+		if key != "a" || t == nil {
+			continue
+		}
+		attr, arg, _ := strings.Cut(value, ":")
+		switch attr {
+		case "control":
+			t.Control = arg
+		case "rtpmap":
+			if p, enc, ok := strings.Cut(arg, " "); ok && p == pt {
+				parts := strings.Split(enc, "/")
+				t.Codec = strings.ToUpper(parts[0])
+				if len(parts) > 1 {
+					t.ClockRate, _ = strconv.Atoi(parts[1])
+				}
+				if len(parts) > 2 {
+					t.Channels, _ = strconv.Atoi(parts[2])
+				}
+			}
+		case "fmtp":
+			if p, params, ok := strings.Cut(arg, " "); ok && p == pt {
+				t.fmtp(params)
+			}
+		case "framesize":
+			// a=framesize:96 1920-1080
+			if _, size, ok := strings.Cut(arg, " "); ok && t.Width == 0 {
+				t.Width, t.Height = dimensions(size, "-")
+			}
+		case "x-dimensions":
+			if t.Width == 0 {
+				t.Width, t.Height = dimensions(arg, ",")
+			}
+		case "framerate":
+			t.FPS, _ = strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		}
+	}
+	return tracks
+}
+
+// fmtp reads the profile and resolution from H.264 and H.265 parameter sets.
+func (t *Track) fmtp(params string) {
+	p := map[string]string{}
+	for _, kv := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(kv), "=")
+		p[strings.ToLower(k)] = strings.TrimSpace(v)
+	}
+
+	var info spsInfo
+	var ok bool
+	switch t.Codec {
+	case "H264":
+		first, _, _ := strings.Cut(p["sprop-parameter-sets"], ",")
+		if sps, err := base64.StdEncoding.DecodeString(first); err == nil {
+			info, ok = parseH264SPS(sps)
+		}
+	case "H265", "HEVC":
+		if sps, err := base64.StdEncoding.DecodeString(p["sprop-sps"]); err == nil {
+			info, ok = parseH265SPS(sps)
+		}
+	}
+	if ok {
+		t.Profile, t.Width, t.Height = info.profile, info.width, info.height
+	}
+}
+
+func dimensions(s, sep string) (int, int) {
+	w, h, _ := strings.Cut(strings.TrimSpace(s), sep)
+	width, err1 := strconv.Atoi(strings.TrimSpace(w))
+	height, err2 := strconv.Atoi(strings.TrimSpace(h))
+	if err1 != nil || err2 != nil {
+		return 0, 0
+	}
+	return width, height
+}
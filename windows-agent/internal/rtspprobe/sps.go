@@ -0,0 +1,234 @@
+package rtspprobe
+
+import "errors"
+
+// spsInfo is what the probe reads from a sequence parameter set.
+type spsInfo struct {
+	profile       string
+	width, height int
+}
+
+var errShortSPS = errors.New("sequence parameter set ends early")
+
+var h264Profiles = map[uint]string{
+	66: "Baseline", 77: "Main", 88: "Extended", 100: "High", 110: "High 10",
+	122: "High 4:2:2", 244: "High 4:4:4",
+}
+
+var h265Profiles = map[uint]string{1: "Main", 2: "Main 10", 3: "Main Still Picture", 4: "RExt"}
+
+// bitReader reads the RBSP of a NAL unit, emulation prevention removed.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func newBitReader(nal []byte) *bitReader {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return &bitReader{data: rbsp}
+}
+
+func (r *bitReader) bits(n int) uint {
+	var v uint
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.err = errShortSPS
+			return 0
+		}
+		v = v<<1 | uint(r.data[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+func (r *bitReader) skip(n int) { r.bits(n) }
+
+// ue reads an unsigned Exp-Golomb code.
+func (r *bitReader) ue() uint {
+	zeros := 0
+	for r.bits(1) == 0 {
+		if r.err != nil || zeros > 31 {
+			r.err = errShortSPS
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// se reads a signed Exp-Golomb code.
+func (r *bitReader) se() int {
+	v := r.ue()
+	if v&1 == 1 {
+		return int(v+1) / 2
+	}
+	return -int(v / 2)
+}
+
+// parseH264SPS reads the profile and cropped picture size of an H.264 SPS
+// (ITU-T H.264 7.3.2.1.1).
+func parseH264SPS(nal []byte) (spsInfo, bool) {
+	r := newBitReader(nal)
+	r.skip(8) // NAL header
+	profileIDC := r.bits(8)
+	r.skip(16) // constraint flags, level_idc
+	r.ue()     // seq_parameter_set_id
+
+	chroma := uint(1)
+	separatePlanes := false
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chroma = r.ue()
+		if chroma == 3 {
+			separatePlanes = r.bits(1) == 1
+		}
+		r.ue()    // bit_depth_luma_minus8
+		r.ue()    // bit_depth_chroma_minus8
+		r.skip(1) // qpprime_y_zero_transform_bypass_flag
+		if r.bits(1) == 1 {
+			lists := 8
+			if chroma == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if r.bits(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := 8, 8
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	r.ue()          // log2_max_frame_num_minus4
+	switch r.ue() { // pic_order_cnt_type
+	case 0:
+		r.ue()
+	case 1:
+		r.skip(1)
+		r.se()
+		r.se()
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // max_num_ref_frames
+	r.skip(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := r.ue() + 1
+	heightUnits := r.ue() + 1
+	frameMbsOnly := r.bits(1)
+	if frameMbsOnly == 0 {
+		r.skip(1) // mb_adaptive_frame_field_flag
+	}
+	r.skip(1) // direct_8x8_inference_flag
+	var left, right, top, bottom uint
+	if r.bits(1) == 1 {
+		left, right, top, bottom = r.ue(), r.ue(), r.ue(), r.ue()
+	}
+	if r.err != nil {
+		return spsInfo{}, false
+	}
+
+	cropX, cropY := uint(1), 2-frameMbsOnly
+	if !separatePlanes {
+		switch chroma {
+		case 1:
+			cropX, cropY = 2, 2*(2-frameMbsOnly)
+		case 2:
+			cropX = 2
+		}
+	}
+	info := spsInfo{
+		profile: h264Profiles[profileIDC],
+		width:   int(widthMbs*16 - cropX*(left+right)),
+		height:  int((2-frameMbsOnly)*heightUnits*16 - cropY*(top+bottom)),
+	}
+	return info, info.plausible()
+}
+
+// parseH265SPS reads the profile and cropped picture size of an H.265 SPS
+// (ITU-T H.265 7.3.2.2).
+func parseH265SPS(nal []byte) (spsInfo, bool) {
+	r := newBitReader(nal)
+	r.skip(16) // NAL header
+	r.skip(4)  // sps_video_parameter_set_id
+	subLayers := int(r.bits(3))
+	r.skip(1) // sps_temporal_id_nesting_flag
+
+	// profile_tier_level
+	r.skip(3) // general_profile_space, general_tier_flag
+	profileIDC := r.bits(5)
+	r.skip(32 + 48 + 8) // compatibility flags, constraint flags, general_level_idc
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i] = r.bits(1) == 1
+		levelPresent[i] = r.bits(1) == 1
+	}
+	if subLayers > 0 {
+		r.skip(2 * (8 - subLayers))
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			r.skip(88)
+		}
+		if levelPresent[i] {
+			r.skip(8)
+		}
+	}
+
+	r.ue() // sps_seq_parameter_set_id
+	chroma := r.ue()
+	if chroma == 3 {
+		r.skip(1) // separate_colour_plane_flag
+	}
+	width, height := r.ue(), r.ue()
+	if r.bits(1) == 1 {
+		subW, subH := uint(1), uint(1)
+		switch chroma {
+		case 1:
+			subW, subH = 2, 2
+		case 2:
+			subW = 2
+		}
+		left, right, top, bottom := r.ue(), r.ue(), r.ue(), r.ue()
+		width -= subW * (left + right)
+		height -= subH * (top + bottom)
+	}
+	if r.err != nil {
+		return spsInfo{}, false
+	}
+	info := spsInfo{profile: h265Profiles[profileIDC], width: int(width), height: int(height)}
+	return info, info.plausible()
+}
+
+// plausible rejects sizes that only a corrupt SPS (or a crop larger than the
+// picture, wrapping around) produces.
+func (i spsInfo) plausible() bool {
+	return i.width > 0 && i.height > 0 && i.width <= 16384 && i.height <= 16384
+}
@@ -0,0 +1,510 @@
+package rtspserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/fanout"
+)
+
+const (
+	// sessionTimeout is advertised to clients, which send a keepalive
+	// (OPTIONS, GET_PARAMETER or RTCP) well within it. A silent client is
+	// dropped after twice as long.
+	sessionTimeout = 60 * time.Second
+	// writeTimeout drops a client whose connection stopped draining.
+	writeTimeout = 10 * time.Second
+	// maxRequestBody bounds the body of a request, e.g. GET_PARAMETER.
+	maxRequestBody = 64 << 10
+)
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	401: "Unauthorized",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	503: "Service Unavailable",
+}
+
+type request struct {
+	method string
+	uri    string
+	header textproto.MIMEHeader
+}
+
+// conn is one client connection. Requests are handled on the connection's
+// goroutine; once playing, a second goroutine writes the RTP packets.
+type conn struct {
+	server *Server
+	nc     net.Conn
+	br     *bufio.Reader
+	since  time.Time
+
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	// Request state, used by the connection's goroutine only.
+	session  string
+	source   *source
+	tracks   []*track
+	channels map[int]byte // track index to interleaved RTP channel
+
+	mu        sync.Mutex
+	userAgent string
+	playing   bool
+	sent      int64
+	reader    *fanout.Reader
+}
+
+func newConn(s *Server, nc net.Conn) *conn {
+	return &conn{
+		server:   s,
+		nc:       nc,
+		br:       bufio.NewReader(nc),
+		since:    time.Now(),
+		closed:   make(chan struct{}),
+		channels: map[int]byte{},
+	}
+}
+
+func (c *conn) serve(ctx context.Context) {
+	defer c.close()
+	for {
+		c.nc.SetReadDeadline(time.Now().Add(2 * sessionTimeout))
+		b, err := c.br.Peek(1)
+		if err != nil {
+			return
+		}
+		if b[0] == '$' {
+			// RTCP receiver reports; they only keep the session alive.
+			var hdr [4]byte
+			if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+				return
+			}
+			if _, err := io.CopyN(io.Discard, c.br, int64(binary.BigEndian.Uint16(hdr[2:]))); err != nil {
+				return
+			}
+			continue
+		}
+		req, err := readRequest(c.br)
+		if err != nil {
+			return
+		}
+		if !c.handle(ctx, req) {
+			return
+		}
+	}
+}
+
+func readRequest(br *bufio.Reader) (*request, error) {
+	tp := textproto.NewReader(br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("malformed request line %q", line)
+	}
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := strconv.Atoi(header.Get("Content-Length")); n > 0 {
+		if n > maxRequestBody {
+			return nil, errors.New("request body too large")
+		}
+		if _, err := io.CopyN(io.Discard, br, int64(n)); err != nil {
+			return nil, err
+		}
+	}
+	return &request{method: parts[0], uri: parts[1], header: header}, nil
+}
+
+// handle answers req. It reports false when the connection should close.
+func (c *conn) handle(ctx context.Context, req *request) bool {
+	c.mu.Lock()
+	if ua := req.header.Get("User-Agent"); ua != "" {
+		c.userAgent = ua
+	}
+	c.mu.Unlock()
+
+	if req.method != "OPTIONS" && !c.authorized(req) {
+		return c.respond(req, 401, c.challenge(), nil) == nil
+	}
+
+	switch req.method {
+	case "OPTIONS":
+		return c.respond(req, 200, [][2]string{{"Public", "OPTIONS, DESCRIBE, SETUP, PLAY, TEARDOWN, GET_PARAMETER"}}, nil) == nil
+	case "GET_PARAMETER", "SET_PARAMETER":
+		return c.respond(req, 200, c.sessionHeader(), nil) == nil
+	case "DESCRIBE":
+		return c.describe(ctx, req)
+	case "SETUP":
+		return c.setup(ctx, req)
+	case "PLAY":
+		return c.play(req)
+	case "TEARDOWN":
+		_ = c.respond(req, 200, nil, nil)
+		return false
+	default:
+		return c.respond(req, 501, nil, nil) == nil
+	}
+}
+
+func (c *conn) describe(ctx context.Context, req *request) bool {
+	if _, ok := c.trackIndex(req.uri, false); !ok {
+		return c.respond(req, 404, nil, nil) == nil
+	}
+	tracks, status := c.prepare(ctx)
+	if status != 200 {
+		return c.respond(req, status, nil, nil) == nil
+	}
+	host, _, _ := net.SplitHostPort(c.nc.LocalAddr().String())
+	body := sdp(tracks, "DIFAE "+strings.Trim(c.server.cfg.Path, "/"), host)
+	base := req.uri
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return c.respond(req, 200, [][2]string{{"Content-Base", base}, {"Content-Type", "application/sdp"}}, body) == nil
+}
+
+// prepare describes the current source once per connection.
+func (c *conn) prepare(ctx context.Context) ([]*track, int) {
+	if c.source != nil {
+		return c.tracks, 200
+	}
+	src := c.server.current()
+	if src == nil {
+		return nil, 503
+	}
+	tracks, err := src.describe(ctx)
+	if err != nil {
+		if !errors.Is(err, errNoSource) {
+			c.server.logger.Printf("RTSP client %s: %v", c.nc.RemoteAddr(), err)
+		}
+		return nil, 503
+	}
+	c.source, c.tracks = src, tracks
+	return tracks, 200
+}
+
+func (c *conn) setup(ctx context.Context, req *request) bool {
+	tracks, status := c.prepare(ctx)
+	if status != 200 {
+		return c.respond(req, status, nil, nil) == nil
+	}
+	i, ok := c.trackIndex(req.uri, true)
+	if !ok || i >= len(tracks) {
+		return c.respond(req, 404, nil, nil) == nil
+	}
+	if id := sessionID(req); c.session != "" && id != c.session {
+		return c.respond(req, 454, nil, nil) == nil
+	}
+
+	channel, ok := interleavedChannel(req.header.Get("Transport"), i)
+	if !ok {
+		// Only TCP-interleaved RTP is served.
+		return c.respond(req, 461, nil, nil) == nil
+	}
+	if c.session == "" {
+		c.session = randomHex(8)
+	}
+	c.channels[i] = channel
+	transport := fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d", channel, channel+1)
+	return c.respond(req, 200, append(c.sessionHeader(), [2]string{"Transport", transport}), nil) == nil
+}
+
+func (c *conn) play(req *request) bool {
+	if c.session == "" || len(c.channels) == 0 {
+		return c.respond(req, 455, nil, nil) == nil
+	}
+	if sessionID(req) != c.session {
+		return c.respond(req, 454, nil, nil) == nil
+	}
+	c.mu.Lock()
+	started := c.playing
+	c.playing = true
+	c.mu.Unlock()
+	if err := c.respond(req, 200, append(c.sessionHeader(), [2]string{"Range", "npt=0.000-"}), nil); err != nil {
+		return false
+	}
+	if !started {
+		c.server.logger.Printf("RTSP client %s playing (%s)", c.nc.RemoteAddr(), c.userAgentOrUnknown())
+		go c.stream()
+	}
+	return true
+}
+
+// stream sends the source to the client until either ends. The connection
+// is closed afterwards so the client reconnects to the next pipeline run.
+func (c *conn) stream() {
+	defer c.close()
+
+	reader := c.source.tap.Reader()
+	c.mu.Lock()
+	c.reader = reader
+	c.mu.Unlock()
+	go func() {
+		select {
+		case <-c.source.done:
+		case <-c.closed:
+		}
+		reader.Close()
+	}()
+
+	type output struct {
+		*packetizer
+		channel byte
+	}
+	outputs := map[int]output{}
+	for i, ch := range c.channels {
+		t := c.tracks[i]
+		pt := byte(payloadVideo)
+		if t.streamType == streamAAC {
+			pt = payloadAudio
+		}
+		outputs[t.pid] = output{
+			packetizer: &packetizer{track: t, ssrc: rand.Uint32(), seq: uint16(rand.Uint32()), tsBase: rand.Uint32(), payload: pt},
+			channel:    ch,
+		}
+	}
+
+	dmx := newDemuxer(reader)
+	for {
+		f, err := dmx.next()
+		if err != nil {
+			return
+		}
+		out, ok := outputs[f.pid]
+		if !ok {
+			continue
+		}
+		for _, pkt := range out.packets(f) {
+			if err := c.writeInterleaved(out.channel, pkt); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) writeInterleaved(channel byte, pkt []byte) error {
+	buf := make([]byte, 4, 4+len(pkt))
+	buf[0] = '$'
+	buf[1] = channel
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(pkt)))
+	buf = append(buf, pkt...)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if _, err := c.nc.Write(buf); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.sent += int64(len(buf))
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *conn) respond(req *request, code int, header [][2]string, body []byte) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %d %s\r\nCSeq: %s\r\nServer: DIFAE Agent\r\n", code, statusText[code], req.header.Get("CSeq"))
+	for _, h := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", h[0], h[1])
+	}
+	if len(body) > 0 {
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	b.WriteString("\r\n")
+	b.Write(body)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.nc.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := io.WriteString(c.nc, b.String())
+	return err
+}
+
+func (c *conn) sessionHeader() [][2]string {
+	if c.session == "" {
+		return nil
+	}
+	return [][2]string{{"Session", fmt.Sprintf("%s;timeout=%d", c.session, int(sessionTimeout.Seconds()))}}
+}
+
+// trackIndex checks that uri names the camera path and, with track set,
+// returns the index of its "trackID=n" suffix.
+func (c *conn) trackIndex(uri string, track bool) (int, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return 0, false
+	}
+	base := strings.TrimRight(c.server.cfg.Path, "/")
+	path := strings.TrimRight(u.Path, "/")
+	if !track {
+		return 0, path == base
+	}
+	rest, ok := strings.CutPrefix(path, base+"/trackID=")
+	if !ok {
+		return 0, false
+	}
+	i, err := strconv.Atoi(rest)
+	return i, err == nil && i >= 0
+}
+
+func (c *conn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.nc.Close()
+		c.mu.Lock()
+		playing := c.playing
+		c.mu.Unlock()
+		if playing {
+			c.server.logger.Printf("RTSP client %s disconnected after %s", c.nc.RemoteAddr(), time.Since(c.since).Round(time.Second))
+		}
+	})
+}
+
+func (c *conn) status() ClientStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := ClientStatus{
+		Remote:    c.nc.RemoteAddr().String(),
+		UserAgent: c.userAgent,
+		Since:     c.since,
+		Playing:   c.playing,
+		BytesSent: c.sent,
+	}
+	if c.reader != nil {
+		st.BytesLost = c.reader.Lost()
+	}
+	return st
+}
+
+func (c *conn) userAgentOrUnknown() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.userAgent == "" {
+		return "unknown client"
+	}
+	return c.userAgent
+}
+
+// authorized checks the request's credentials when the server has any.
+// Digest is preferred; Basic is accepted for older recorders.
+func (c *conn) authorized(req *request) bool {
+	cfg := c.server.cfg
+	if cfg.Username == "" {
+		return true
+	}
+	scheme, value, _ := strings.Cut(req.header.Get("Authorization"), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return false
+		}
+		want := cfg.Username + ":" + cfg.Password
+		return subtle.ConstantTimeCompare(raw, []byte(want)) == 1
+	case "digest":
+		p := digestParams(value)
+		if p["username"] != cfg.Username || p["realm"] != c.server.realm || p["nonce"] != c.server.nonce {
+			return false
+		}
+		ha1 := md5Hex(cfg.Username + ":" + c.server.realm + ":" + cfg.Password)
+		ha2 := md5Hex(req.method + ":" + p["uri"])
+		want := md5Hex(ha1 + ":" + c.server.nonce + ":" + ha2)
+		return subtle.ConstantTimeCompare([]byte(p["response"]), []byte(want)) == 1
+	}
+	return false
+}
+
+func (c *conn) challenge() [][2]string {
+	return [][2]string{
+		{"WWW-Authenticate", fmt.Sprintf("Digest realm=%q, nonce=%q", c.server.realm, c.server.nonce)},
+		{"WWW-Authenticate", fmt.Sprintf("Basic realm=%q", c.server.realm)},
+	}
+}
+
+// digestParams parses the comma-separated key="value" pairs of a Digest
+// Authorization header.
+func digestParams(s string) map[string]string {
+	out := map[string]string{}
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				break
+			}
+			value, s = rest[1:end+1], rest[end+2:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+		}
+		out[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return out
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionID returns the session of a request without its parameters.
+func sessionID(req *request) string {
+	id, _, _ := strings.Cut(req.header.Get("Session"), ";")
+	return strings.TrimSpace(id)
+}
+
+// interleavedChannel picks the TCP-interleaved option of a Transport header
+// and returns its RTP channel, or 2*track when the client left it to us.
+func interleavedChannel(transport string, track int) (byte, bool) {
+	for _, option := range strings.Split(transport, ",") {
+		params := strings.Split(strings.TrimSpace(option), ";")
+		if !strings.EqualFold(params[0], "RTP/AVP/TCP") {
+			continue
+		}
+		channel := 2 * track
+		for _, p := range params[1:] {
+			if v, ok := strings.CutPrefix(p, "interleaved="); ok {
+				first, _, _ := strings.Cut(v, "-")
+				n, err := strconv.Atoi(first)
+				if err != nil || n < 0 || n > 254 {
+					return 0, false
+				}
+				channel = n
+			}
+		}
+		return byte(channel), true
+	}
+	return 0, false
+}
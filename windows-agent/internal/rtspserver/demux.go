@@ -0,0 +1,209 @@
+package rtspserver
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+const (
+	packetSize = 188
+	syncByte   = 0x47
+
+	// maxFrameBytes bounds one reassembled PES packet.
+	maxFrameBytes = 8 << 20
+)
+
+// MPEG-TS stream types the server can packetize.
+const (
+	streamH264 = 0x1b
+	streamH265 = 0x24
+	streamAAC  = 0x0f
+)
+
+// frame is one PES packet: an access unit of video, or one or more ADTS
+// frames of audio.
+type frame struct {
+	pid  int
+	pts  int64 // 90 kHz
+	data []byte
+}
+
+type pesStream struct {
+	streamType byte
+	buf        []byte
+	pts        int64
+	started    bool
+}
+
+// demuxer reads frames of the first video and first audio stream of the
+// first program from MPEG-TS.
+type demuxer struct {
+	r       *bufio.Reader
+	pkt     []byte
+	pmtPID  int
+	video   int
+	audio   int
+	streams map[int]*pesStream
+}
+
+func newDemuxer(r io.Reader) *demuxer {
+	return &demuxer{
+		r:       bufio.NewReaderSize(r, 64*packetSize),
+		pkt:     make([]byte, packetSize),
+		pmtPID:  -1,
+		video:   -1,
+		audio:   -1,
+		streams: map[int]*pesStream{},
+	}
+}
+
+// streamType returns the stream type of pid, or 0 when it is not demuxed.
+func (d *demuxer) streamType(pid int) byte {
+	if s := d.streams[pid]; s != nil {
+		return s.streamType
+	}
+	return 0
+}
+
+// next returns the next complete frame. A frame is complete when the next
+// PES packet of its stream starts, so it is returned one frame late.
+func (d *demuxer) next() (frame, error) {
+	for {
+		if _, err := io.ReadFull(d.r, d.pkt); err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				err = io.EOF
+			}
+			return frame{}, err
+		}
+		pkt := d.pkt
+		if pkt[0] != syncByte {
+			// The fan-out buffer only holds whole packets.
+			continue
+		}
+		pusi := pkt[1]&0x40 != 0
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		payload := tsPayload(pkt)
+		if payload == nil {
+			continue
+		}
+
+		switch {
+		case pid == 0:
+			if pusi {
+				d.parsePAT(payload)
+			}
+		case pid == d.pmtPID:
+			if pusi {
+				d.parsePMT(payload)
+			}
+		default:
+			s := d.streams[pid]
+			if s == nil {
+				continue
+			}
+			if !pusi {
+				if s.started && len(s.buf)+len(payload) <= maxFrameBytes {
+					s.buf = append(s.buf, payload...)
+				}
+				continue
+			}
+			var done frame
+			complete := s.started && len(s.buf) > 0
+			if complete {
+				done = frame{pid: pid, pts: s.pts, data: s.buf}
+			}
+			s.buf, s.started = nil, false
+			if pts, data, ok := parsePES(payload); ok {
+				s.pts, s.started = pts, true
+				s.buf = append(make([]byte, 0, 64<<10), data...)
+			}
+			if complete {
+				return done, nil
+			}
+		}
+	}
+}
+
+// tsPayload returns the payload of a TS packet, or nil when it has none.
+func tsPayload(pkt []byte) []byte {
+	afc := pkt[3] >> 4 & 0x3
+	if afc&0x1 == 0 {
+		return nil
+	}
+	off := 4
+	if afc&0x2 != 0 {
+		off += 1 + int(pkt[4])
+	}
+	if off >= packetSize {
+		return nil
+	}
+	return pkt[off:]
+}
+
+// section returns the PSI section that starts in payload, after its pointer
+// field, bounded by its section_length and without the CRC.
+func section(payload []byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0]) >= len(payload) {
+		return nil
+	}
+	s := payload[1+int(payload[0]):]
+	if len(s) < 3 {
+		return nil
+	}
+	end := 3 + (int(s[1]&0x0f)<<8 | int(s[2]))
+	if end > len(s) || end < 12 {
+		return nil
+	}
+	return s[:end-4]
+}
+
+func (d *demuxer) parsePAT(payload []byte) {
+	s := section(payload)
+	for i := 8; i+4 <= len(s); i += 4 {
+		program := int(s[i])<<8 | int(s[i+1])
+		if program != 0 {
+			d.pmtPID = int(s[i+2]&0x1f)<<8 | int(s[i+3])
+			return
+		}
+	}
+}
+
+func (d *demuxer) parsePMT(payload []byte) {
+	s := section(payload)
+	if len(s) < 12 || s[0] != 0x02 {
+		return
+	}
+	i := 12 + (int(s[10]&0x0f)<<8 | int(s[11]))
+	for i+5 <= len(s) {
+		streamType := s[i]
+		pid := int(s[i+1]&0x1f)<<8 | int(s[i+2])
+		i += 5 + (int(s[i+3]&0x0f)<<8 | int(s[i+4]))
+		switch streamType {
+		case streamH264, streamH265:
+			if d.video < 0 {
+				d.video = pid
+				d.streams[pid] = &pesStream{streamType: streamType}
+			}
+		case streamAAC:
+			if d.audio < 0 {
+				d.audio = pid
+				d.streams[pid] = &pesStream{streamType: streamType}
+			}
+		}
+	}
+}
+
+// parsePES returns the PTS and the start of the payload of a PES packet.
+func parsePES(b []byte) (int64, []byte, bool) {
+	if len(b) < 9 || b[0] != 0 || b[1] != 0 || b[2] != 1 {
+		return 0, nil, false
+	}
+	hdr := 9 + int(b[8])
+	if hdr > len(b) || b[7]&0x80 == 0 || len(b) < 14 {
+		return 0, nil, false
+	}
+	p := b[9:14]
+	pts := int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+	return pts, b[hdr:], true
+}
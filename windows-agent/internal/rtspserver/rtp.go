@@ -0,0 +1,289 @@
+package rtspserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// maxPayload keeps RTP packets under a typical MTU, as clients that relay
+// the stream over UDP expect, even though the server only sends over TCP.
+const maxPayload = 1400
+
+const (
+	payloadVideo = 96
+	payloadAudio = 97
+)
+
+// track is one media stream of the description, with what the SDP needs.
+type track struct {
+	pid        int
+	streamType byte
+	clockRate  int
+	rtpmap     string
+	fmtp       string
+}
+
+// aacSampleRates indexes the ADTS sampling frequency index.
+var aacSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// describer collects the codec parameters of the streams from the first
+// frames: the parameter sets in front of a keyframe, and an ADTS header.
+type describer struct {
+	sps, pps, vps []byte
+	video, audio  *track
+}
+
+// add inspects f and reports whether every stream is now described.
+func (d *describer) add(dmx *demuxer, f frame) bool {
+	switch st := dmx.streamType(f.pid); st {
+	case streamH264, streamH265:
+		if d.video == nil {
+			d.addVideo(f, st)
+		}
+	case streamAAC:
+		if d.audio == nil {
+			d.addAudio(f)
+		}
+	}
+	return d.video != nil && (dmx.audio < 0 || d.audio != nil)
+}
+
+func (d *describer) addVideo(f frame, st byte) {
+	for _, nal := range splitNALs(f.data) {
+		if len(nal) < 2 {
+			continue
+		}
+		if st == streamH264 {
+			switch nal[0] & 0x1f {
+			case 7:
+				d.sps = nal
+			case 8:
+				d.pps = nal
+			}
+			continue
+		}
+		switch nal[0] >> 1 & 0x3f {
+		case 32:
+			d.vps = nal
+		case 33:
+			d.sps = nal
+		case 34:
+			d.pps = nal
+		}
+	}
+	if d.sps == nil || d.pps == nil || (st == streamH265 && d.vps == nil) {
+		return
+	}
+
+	b64 := base64.StdEncoding.EncodeToString
+	t := &track{pid: f.pid, streamType: st, clockRate: 90000}
+	if st == streamH264 {
+		t.rtpmap = fmt.Sprintf("%d H264/90000", payloadVideo)
+		t.fmtp = fmt.Sprintf("%d packetization-mode=1", payloadVideo)
+		if len(d.sps) >= 4 {
+			t.fmtp += ";profile-level-id=" + strings.ToUpper(hex.EncodeToString(d.sps[1:4]))
+		}
+		t.fmtp += ";sprop-parameter-sets=" + b64(d.sps) + "," + b64(d.pps)
+	} else {
+		t.rtpmap = fmt.Sprintf("%d H265/90000", payloadVideo)
+		t.fmtp = fmt.Sprintf("%d sprop-vps=%s;sprop-sps=%s;sprop-pps=%s", payloadVideo, b64(d.vps), b64(d.sps), b64(d.pps))
+	}
+	d.video = t
+}
+
+func (d *describer) addAudio(f frame) {
+	if len(f.data) < 7 || f.data[0] != 0xff || f.data[1]&0xf0 != 0xf0 {
+		return
+	}
+	objectType := int(f.data[2]>>6) + 1
+	rateIndex := int(f.data[2] >> 2 & 0x0f)
+	channels := int(f.data[2]&0x01)<<2 | int(f.data[3]>>6)
+	if rateIndex >= len(aacSampleRates) {
+		return
+	}
+	rate := aacSampleRates[rateIndex]
+	config := uint16(objectType)<<11 | uint16(rateIndex)<<7 | uint16(channels)<<3
+	d.audio = &track{
+		pid:        f.pid,
+		streamType: streamAAC,
+		clockRate:  rate,
+		rtpmap:     fmt.Sprintf("%d mpeg4-generic/%d/%d", payloadAudio, rate, channels),
+		fmtp: fmt.Sprintf("%d profile-level-id=1;mode=AAC-hbr;sizelength=13;indexlength=3;indexdeltalength=3;config=%04X",
+			payloadAudio, config),
+	}
+}
+
+// tracks returns the described tracks, video first.
+func (d *describer) tracks() []*track {
+	out := []*track{d.video}
+	if d.audio != nil {
+		out = append(out, d.audio)
+	}
+	return out
+}
+
+// sdp returns the session description served by DESCRIBE. Track n is
+// controlled as "trackID=n" relative to the Content-Base.
+func sdp(tracks []*track, name, host string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "v=0\r\no=- 0 0 IN IP4 %s\r\ns=%s\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\na=range:npt=now-\r\n", host, name)
+	for i, t := range tracks {
+		media, pt := "video", payloadVideo
+		if t.streamType == streamAAC {
+			media, pt = "audio", payloadAudio
+		}
+		fmt.Fprintf(&b, "m=%s 0 RTP/AVP %d\r\na=rtpmap:%s\r\na=fmtp:%s\r\na=control:trackID=%d\r\n", media, pt, t.rtpmap, t.fmtp, i)
+	}
+	return b.Bytes()
+}
+
+// splitNALs splits an Annex B byte stream into NAL units.
+func splitNALs(b []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); i++ {
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nals = append(nals, trimZeros(b[start:i]))
+		}
+		i += 2
+		start = i + 1
+	}
+	if start >= 0 && start < len(b) {
+		nals = append(nals, b[start:])
+	}
+	return nals
+}
+
+// trimZeros drops the leading zero of a four-byte start code that follows.
+func trimZeros(nal []byte) []byte {
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	return nal
+}
+
+// packetizer turns the frames of one track into RTP packets.
+type packetizer struct {
+	track   *track
+	ssrc    uint32
+	seq     uint16
+	tsBase  uint32
+	payload byte
+}
+
+// packets returns the RTP packets of f. A video access unit ends with the
+// marker bit; each audio packet carries one AAC frame.
+func (p *packetizer) packets(f frame) [][]byte {
+	if p.track.streamType == streamAAC {
+		return p.audioPackets(f)
+	}
+
+	ts := p.tsBase + uint32(f.pts)
+	var nals [][]byte
+	for _, nal := range splitNALs(f.data) {
+		if len(nal) == 0 || p.accessUnitDelimiter(nal) {
+			continue
+		}
+		nals = append(nals, nal)
+	}
+	var out [][]byte
+	for i, nal := range nals {
+		last := i == len(nals)-1
+		if len(nal) <= maxPayload {
+			out = append(out, p.packet(ts, last, nal))
+			continue
+		}
+		out = append(out, p.fragments(ts, last, nal)...)
+	}
+	return out
+}
+
+func (p *packetizer) accessUnitDelimiter(nal []byte) bool {
+	if p.track.streamType == streamH264 {
+		return nal[0]&0x1f == 9
+	}
+	return nal[0]>>1&0x3f == 35
+}
+
+// fragments splits a large NAL unit into FU-A (H.264) or FU (H.265) packets.
+func (p *packetizer) fragments(ts uint32, last bool, nal []byte) [][]byte {
+	var header []byte
+	var fuType byte
+	if p.track.streamType == streamH264 {
+		header = []byte{nal[0]&0xe0 | 28}
+		fuType = nal[0] & 0x1f
+		nal = nal[1:]
+	} else {
+		header = []byte{nal[0]&0x81 | 49<<1, nal[1]}
+		fuType = nal[0] >> 1 & 0x3f
+		nal = nal[2:]
+	}
+
+	chunk := maxPayload - len(header) - 1
+	var out [][]byte
+	for first := true; len(nal) > 0; first = false {
+		n := chunk
+		if n > len(nal) {
+			n = len(nal)
+		}
+		fu := fuType
+		if first {
+			fu |= 0x80
+		}
+		end := n == len(nal)
+		if end {
+			fu |= 0x40
+		}
+		payload := make([]byte, 0, len(header)+1+n)
+		payload = append(append(append(payload, header...), fu), nal[:n]...)
+		out = append(out, p.packet(ts, last && end, payload))
+		nal = nal[n:]
+	}
+	return out
+}
+
+// audioPackets packs each ADTS frame of f as one AAC-hbr access unit.
+func (p *packetizer) audioPackets(f frame) [][]byte {
+	ts := p.tsBase + uint32(f.pts*int64(p.track.clockRate)/90000)
+	var out [][]byte
+	data := f.data
+	for len(data) >= 7 && data[0] == 0xff && data[1]&0xf0 == 0xf0 {
+		header := 7
+		if data[1]&0x01 == 0 {
+			header = 9 // with CRC
+		}
+		size := int(data[3]&0x03)<<11 | int(data[4])<<3 | int(data[5]>>5)
+		if size < header || size > len(data) {
+			break
+		}
+		au := data[header:size]
+		payload := make([]byte, 4, 4+len(au))
+		binary.BigEndian.PutUint16(payload, 16)
+		binary.BigEndian.PutUint16(payload[2:], uint16(len(au))<<3)
+		out = append(out, p.packet(ts, true, append(payload, au...)))
+		ts += 1024
+		data = data[size:]
+	}
+	return out
+}
+
+func (p *packetizer) packet(ts uint32, marker bool, payload []byte) []byte {
+	b := make([]byte, 12, 12+len(payload))
+	b[0] = 0x80
+	b[1] = p.payload
+	if marker {
+		b[1] |= 0x80
+	}
+	binary.BigEndian.PutUint16(b[2:], p.seq)
+	binary.BigEndian.PutUint32(b[4:], ts)
+	binary.BigEndian.PutUint32(b[8:], p.ssrc)
+	p.seq++
+	return append(b, payload...)
+}
@@ -0,0 +1,228 @@
+// Package rtspserver re-serves the camera to on-site consumers such as NVRs
+// and guard-room monitors over RTSP with TCP-interleaved RTP. It reads the
+// pipeline's fan-out tap, so any number of local viewers cost the camera no
+// more than the agent's own connection. Video is sent as H.264 or H.265 and
+// audio, when the tap carries AAC, as MPEG-4 AAC.
+package rtspserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/fanout"
+)
+
+// Path is where the local API serves the connected clients.
+const Path = "/api/rtsp"
+
+// describeTimeout bounds how long DESCRIBE waits for the codec parameters,
+// which arrive with the next keyframe.
+const describeTimeout = 10 * time.Second
+
+// errNoSource is answered with 503 while the pipeline is stopped.
+var errNoSource = errors.New("the camera is not streaming")
+
+// ClientStatus describes one connected client as served by the local API.
+type ClientStatus struct {
+	Remote    string    `json:"remote"`
+	UserAgent string    `json:"userAgent,omitempty"`
+	Since     time.Time `json:"since"`
+	Playing   bool      `json:"playing"`
+	BytesSent int64     `json:"bytesSent"`
+	BytesLost int64     `json:"bytesLost"`
+}
+
+// Server accepts RTSP clients for the camera at cfg.Path.
+type Server struct {
+	cfg    config.RTSPServerConfig
+	logger *log.Logger
+	realm  string
+	nonce  string
+
+	mu      sync.Mutex
+	source  *source
+	clients map[*conn]struct{}
+}
+
+// source is one pipeline run's tap. Its description is probed once, by the
+// first client, and ends with the run.
+type source struct {
+	tap  *fanout.Tap
+	done chan struct{}
+
+	mu     sync.Mutex
+	tracks []*track
+}
+
+// New returns a server for cfg. Nothing is served until Run and Serve.
+func New(cfg config.RTSPServerConfig, logger *log.Logger) *Server {
+	return &Server{
+		cfg:     cfg,
+		logger:  logger,
+		realm:   "DIFAE Agent",
+		nonce:   randomHex(16),
+		clients: map[*conn]struct{}{},
+	}
+}
+
+// Run accepts clients on cfg.Listen until ctx ends.
+func (s *Server) Run(ctx context.Context) error {
+	ln, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", s.cfg.Listen, err)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for c := range s.clients {
+			c.close()
+		}
+	}()
+
+	for {
+		nc, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return err
+		}
+		c := newConn(s, nc)
+		if !s.register(c) {
+			s.logger.Printf("RTSP client %s refused: %d clients already connected", nc.RemoteAddr(), s.cfg.MaxClients)
+			nc.Close()
+			continue
+		}
+		go func() {
+			defer s.unregister(c)
+			c.serve(ctx)
+		}()
+	}
+}
+
+// Serve offers tap to clients until ctx ends, when playing clients are
+// disconnected so they reconnect to the next run.
+func (s *Server) Serve(ctx context.Context, tap *fanout.Tap) {
+	src := &source{tap: tap, done: make(chan struct{})}
+	s.mu.Lock()
+	s.source = src
+	s.mu.Unlock()
+
+	<-ctx.Done()
+
+	s.mu.Lock()
+	if s.source == src {
+		s.source = nil
+	}
+	s.mu.Unlock()
+	close(src.done)
+}
+
+// Status returns every connected client.
+func (s *Server) Status() []ClientStatus {
+	s.mu.Lock()
+	clients := make([]*conn, 0, len(s.clients))
+	for c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+
+	out := make([]ClientStatus, 0, len(clients))
+	for _, c := range clients {
+		out = append(out, c.status())
+	}
+	return out
+}
+
+func (s *Server) current() *source {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.source
+}
+
+func (s *Server) register(c *conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.clients) >= s.cfg.MaxClients {
+		return false
+	}
+	s.clients[c] = struct{}{}
+	return true
+}
+
+func (s *Server) unregister(c *conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.clients, c)
+}
+
+// describe returns the source's tracks, reading the tap until every stream's
+// parameters are known.
+func (src *source) describe(ctx context.Context) ([]*track, error) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.tracks != nil {
+		return src.tracks, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, describeTimeout)
+	defer cancel()
+	reader := src.tap.Reader()
+	go func() {
+		select {
+		case <-src.done:
+		case <-ctx.Done():
+		}
+		reader.Close()
+	}()
+
+	dmx := newDemuxer(reader)
+	var d describer
+	for {
+		f, err := dmx.next()
+		if err != nil {
+			select {
+			case <-src.done:
+				return nil, errNoSource
+			default:
+			}
+			if errors.Is(err, io.EOF) {
+				return nil, errNoSource
+			}
+			if ctx.Err() != nil {
+				if d.video != nil {
+					// Audio is listed but silent; serve video alone.
+					src.tracks = d.tracks()
+					return src.tracks, nil
+				}
+				return nil, fmt.Errorf("no keyframe from the camera within %s", describeTimeout)
+			}
+			return nil, err
+		}
+		if d.add(dmx, f) {
+			src.tracks = d.tracks()
+			return src.tracks, nil
+		}
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,514 @@
+package rtspserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/fanout"
+)
+
+const (
+	testPMTPID   = 0x1000
+	testVideoPID = 0x100
+)
+
+var (
+	testSPS = []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xd9, 0x40, 0x78}
+	testPPS = []byte{0x68, 0xeb, 0xe3, 0xcb}
+)
+
+// tsPacket returns one MPEG-TS packet carrying payload (at most 182 bytes),
+// padded with adaptation field stuffing.
+func tsPacket(pid int, start, randomAccess bool, payload []byte) []byte {
+	pkt := []byte{syncByte, byte(pid>>8) & 0x1f, byte(pid), 0x30}
+	if start {
+		pkt[1] |= 0x40
+	}
+	stuffing := packetSize - 4 - len(payload)
+	flags := byte(0)
+	if randomAccess {
+		flags = 0x40
+	}
+	pkt = append(pkt, byte(stuffing-1), flags)
+	pkt = append(pkt, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+	return append(pkt, payload...)
+}
+
+// psi returns the packet of a PAT or PMT section, with a dummy CRC.
+func psi(pid int, tableID byte, body []byte) []byte {
+	section := []byte{tableID, 0xb0, byte(5 + len(body) + 4), 0, 1, 0xc1, 0, 0}
+	section = append(append(section, body...), 0, 0, 0, 0)
+	return tsPacket(pid, true, false, append([]byte{0}, section...))
+}
+
+// testStreamStart returns the PAT and a PMT listing one H.264 stream.
+func testStreamStart() []byte {
+	pat := psi(0, 0x00, []byte{0, 1, 0xe0 | testPMTPID>>8, testPMTPID & 0xff})
+	pmt := psi(testPMTPID, 0x02, []byte{
+		0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0, // PCR PID, program info
+		streamH264, 0xe0 | testVideoPID>>8, testVideoPID & 0xff, 0xf0, 0,
+	})
+	return append(pat, pmt...)
+}
+
+// pesPackets returns the packets of one video access unit at pts.
+func pesPackets(pts int64, keyframe bool, au []byte) []byte {
+	pes := []byte{0, 0, 1, 0xe0, 0, 0, 0x80, 0x80, 5,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), byte(pts>>14) | 1, byte(pts >> 7), byte(pts<<1) | 1}
+	pes = append(pes, au...)
+
+	var out []byte
+	for first := true; len(pes) > 0; first = false {
+		n := min(len(pes), 182)
+		out = append(out, tsPacket(testVideoPID, first, first && keyframe, pes[:n])...)
+		pes = pes[n:]
+	}
+	return out
+}
+
+func annexB(nals ...[]byte) []byte {
+	var b []byte
+	for _, nal := range nals {
+		b = append(append(b, 0, 0, 0, 1), nal...)
+	}
+	return b
+}
+
+// testIDR is large enough to be sent as FU-A fragments.
+func testIDR() []byte {
+	idr := make([]byte, 3000)
+	idr[0] = 0x65
+	for i := 1; i < len(idr); i++ {
+		idr[i] = byte(i%250) + 1
+	}
+	return idr
+}
+
+// startSource feeds a keyframe and two following frames to a tap served by
+// a new server, and returns the server's address.
+func startSource(t *testing.T, cfg config.RTSPServerConfig) string {
+	t.Helper()
+	return startServer(t, cfg, func(ctx context.Context, addr string) {
+		feed, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { feed.Close() })
+
+		stream := testStreamStart()
+		stream = append(stream, pesPackets(0, true, annexB(testSPS, testPPS, testIDR()))...)
+		stream = append(stream, pesPackets(3600, false, annexB([]byte{0x41, 0x9a, 0x01}))...)
+		stream = append(stream, pesPackets(7200, false, annexB([]byte{0x41, 0x9a, 0x02}))...)
+		if _, err := feed.Write(stream); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// startServer serves a tap that feed writes MPEG-TS to at addr, and returns
+// the server's address.
+func startServer(t *testing.T, cfg config.RTSPServerConfig, feed func(ctx context.Context, addr string)) string {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen = ln.Addr().String()
+	ln.Close()
+	if cfg.Path == "" {
+		cfg.Path = "/cam"
+	}
+	cfg.MaxClients = 4
+
+	tap, err := fanout.NewTap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tap.Run(ctx)
+	args := tap.OutputArgs(config.AudioConfig{Mode: config.AudioOff})
+	feed(ctx, strings.TrimPrefix(args[len(args)-1], "tcp://"))
+
+	s := New(cfg, log.New(io.Discard, "", 0))
+	go s.Serve(ctx, tap)
+	go s.Run(ctx)
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c, err := net.Dial("tcp", cfg.Listen)
+		if err == nil {
+			c.Close()
+			return cfg.Listen
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// requirePlayers skips the test unless ffmpeg, with libx264 for the test
+// source, and ffprobe are on PATH.
+func requirePlayers(t *testing.T) (ffmpeg, ffprobe string) {
+	t.Helper()
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not on PATH")
+	}
+	ffprobe, err = exec.LookPath("ffprobe")
+	if err != nil {
+		t.Skip("ffprobe not on PATH")
+	}
+	if out, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output(); err != nil || !strings.Contains(string(out), " libx264 ") {
+		t.Skip("ffmpeg lacks libx264")
+	}
+	return ffmpeg, ffprobe
+}
+
+// feedFFmpeg has a real ffmpeg encode a test pattern to H.264 and a tone to
+// AAC in real time and send them to addr until ctx ends.
+func feedFFmpeg(t *testing.T, ctx context.Context, ffmpeg, addr string) {
+	t.Helper()
+	cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-loglevel", "error", "-re",
+		"-f", "lavfi", "-i", "testsrc2=size=320x240:rate=25",
+		"-f", "lavfi", "-i", "sine=frequency=1000:sample_rate=48000",
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-g", "25", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "64k",
+		"-f", "mpegts", "tcp://"+addr)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = cmd.Wait() })
+}
+
+// rtspClient speaks just enough RTSP over one connection for the tests.
+type rtspClient struct {
+	t    *testing.T
+	nc   net.Conn
+	br   *bufio.Reader
+	cseq int
+	auth func(method, uri string) string
+}
+
+type rtspAnswer struct {
+	code   int
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func dialRTSP(t *testing.T, addr string) *rtspClient {
+	t.Helper()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	nc.SetDeadline(time.Now().Add(15 * time.Second))
+	return &rtspClient{t: t, nc: nc, br: bufio.NewReader(nc)}
+}
+
+func (c *rtspClient) request(method, uri string, header ...string) rtspAnswer {
+	c.t.Helper()
+	c.cseq++
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s RTSP/1.0\r\nCSeq: %d\r\n", method, uri, c.cseq)
+	if c.auth != nil {
+		fmt.Fprintf(&b, "Authorization: %s\r\n", c.auth(method, uri))
+	}
+	for _, h := range header {
+		fmt.Fprintf(&b, "%s\r\n", h)
+	}
+	b.WriteString("\r\n")
+	if _, err := io.WriteString(c.nc, b.String()); err != nil {
+		c.t.Fatal(err)
+	}
+
+	tp := textproto.NewReader(c.br)
+	line, err := tp.ReadLine()
+	if err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		c.t.Fatalf("%s: malformed status line %q", method, line)
+	}
+	code, _ := strconv.Atoi(fields[1])
+	h, err := tp.ReadMIMEHeader()
+	if err != nil {
+		c.t.Fatalf("%s: %v", method, err)
+	}
+	answer := rtspAnswer{code: code, header: h}
+	if n, _ := strconv.Atoi(h.Get("Content-Length")); n > 0 {
+		answer.body = make([]byte, n)
+		if _, err := io.ReadFull(c.br, answer.body); err != nil {
+			c.t.Fatal(err)
+		}
+	}
+	return answer
+}
+
+// readRTP returns the next interleaved packet and its channel.
+func (c *rtspClient) readRTP() (byte, []byte) {
+	c.t.Helper()
+	var hdr [4]byte
+	if _, err := io.ReadFull(c.br, hdr[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	if hdr[0] != '$' {
+		c.t.Fatalf("expected an interleaved packet, got %q", hdr[:])
+	}
+	pkt := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+	if _, err := io.ReadFull(c.br, pkt); err != nil {
+		c.t.Fatal(err)
+	}
+	return hdr[1], pkt
+}
+
+// digestAuth answers the server's Digest challenge.
+func digestAuth(challenge, username, password string) func(method, uri string) string {
+	p := digestParams(strings.TrimPrefix(challenge, "Digest "))
+	return func(method, uri string) string {
+		ha1 := md5Hex(username + ":" + p["realm"] + ":" + password)
+		response := md5Hex(ha1 + ":" + p["nonce"] + ":" + md5Hex(method+":"+uri))
+		return fmt.Sprintf("Digest username=%q, realm=%q, nonce=%q, uri=%q, response=%q", username, p["realm"], p["nonce"], uri, response)
+	}
+}
+
+func digestChallenge(h textproto.MIMEHeader) string {
+	for _, v := range h.Values("WWW-Authenticate") {
+		if strings.HasPrefix(v, "Digest ") {
+			return v
+		}
+	}
+	return ""
+}
+
+func TestPlay(t *testing.T) {
+	addr := startSource(t, config.RTSPServerConfig{Username: "viewer", Password: "pw"})
+	base := "rtsp://" + addr + "/cam"
+	c := dialRTSP(t, addr)
+
+	if a := c.request("OPTIONS", base); a.code != 200 {
+		t.Fatalf("OPTIONS answered %d", a.code)
+	}
+	a := c.request("DESCRIBE", base)
+	if a.code != 401 {
+		t.Fatalf("DESCRIBE without credentials answered %d, want 401", a.code)
+	}
+	c.auth = digestAuth(digestChallenge(a.header), "viewer", "pw")
+
+	a = c.request("DESCRIBE", base, "Accept: application/sdp")
+	if a.code != 200 {
+		t.Fatalf("DESCRIBE answered %d", a.code)
+	}
+	b64 := base64.StdEncoding.EncodeToString
+	for _, want := range []string{"m=video 0 RTP/AVP 96", "a=rtpmap:96 H264/90000",
+		"sprop-parameter-sets=" + b64(testSPS) + "," + b64(testPPS), "a=control:trackID=0"} {
+		if !strings.Contains(string(a.body), want) {
+			t.Errorf("SDP lacks %q:\n%s", want, a.body)
+		}
+	}
+	if strings.Contains(string(a.body), "m=audio") {
+		t.Errorf("SDP lists audio the stream does not have:\n%s", a.body)
+	}
+
+	a = c.request("SETUP", a.header.Get("Content-Base")+"trackID=0", "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+	if a.code != 200 {
+		t.Fatalf("SETUP answered %d", a.code)
+	}
+	if got := a.header.Get("Transport"); got != "RTP/AVP/TCP;unicast;interleaved=0-1" {
+		t.Errorf("Transport = %q", got)
+	}
+	session, _, _ := strings.Cut(a.header.Get("Session"), ";")
+	if a := c.request("PLAY", base, "Session: "+session); a.code != 200 {
+		t.Fatalf("PLAY answered %d", a.code)
+	}
+
+	// The keyframe comes first: SPS, PPS and the IDR slice in FU-A
+	// fragments, then the next frame 3600 ticks (40 ms) later.
+	var (
+		nals      [][]byte
+		fu        []byte
+		seq       uint16
+		stamps    []uint32
+		markers   int
+		ssrc      uint32
+		first     = true
+		lastStamp uint32
+	)
+	for len(nals) < 4 {
+		channel, pkt := c.readRTP()
+		if channel != 0 {
+			t.Fatalf("RTP on channel %d, want 0", channel)
+		}
+		if len(pkt) < 13 || pkt[0] != 0x80 || pkt[1]&0x7f != payloadVideo {
+			t.Fatalf("malformed RTP packet % x", pkt[:min(len(pkt), 16)])
+		}
+		pktSeq := binary.BigEndian.Uint16(pkt[2:])
+		stamp := binary.BigEndian.Uint32(pkt[4:])
+		pktSSRC := binary.BigEndian.Uint32(pkt[8:])
+		if first {
+			seq, ssrc, first = pktSeq, pktSSRC, false
+		} else if pktSeq != seq+1 || pktSSRC != ssrc {
+			t.Fatalf("packet %d (ssrc %x) follows %d (ssrc %x)", pktSeq, pktSSRC, seq, ssrc)
+		}
+		seq = pktSeq
+		if len(stamps) == 0 || stamp != lastStamp {
+			stamps = append(stamps, stamp)
+			lastStamp = stamp
+		}
+		if pkt[1]&0x80 != 0 {
+			markers++
+		}
+
+		payload := pkt[12:]
+		if payload[0]&0x1f != 28 {
+			nals = append(nals, payload)
+			continue
+		}
+		if payload[1]&0x80 != 0 {
+			fu = []byte{payload[0]&0xe0 | payload[1]&0x1f}
+		}
+		fu = append(fu, payload[2:]...)
+		if payload[1]&0x40 != 0 {
+			nals = append(nals, fu)
+		}
+	}
+
+	if !bytes.Equal(nals[0], testSPS) || !bytes.Equal(nals[1], testPPS) {
+		t.Errorf("parameter sets = % x, % x", nals[0], nals[1])
+	}
+	if !bytes.Equal(nals[2], testIDR()) {
+		t.Errorf("reassembled IDR slice differs (%d bytes)", len(nals[2]))
+	}
+	if !bytes.Equal(nals[3], []byte{0x41, 0x9a, 0x01}) {
+		t.Errorf("second frame = % x", nals[3])
+	}
+	if len(stamps) != 2 || stamps[1]-stamps[0] != 3600 {
+		t.Errorf("timestamps = %v, want two 3600 apart", stamps)
+	}
+	if markers != 2 {
+		t.Errorf("%d packets with the marker bit, want one per frame", markers)
+	}
+}
+
+func TestBadCredentials(t *testing.T) {
+	addr := startSource(t, config.RTSPServerConfig{Username: "viewer", Password: "pw"})
+	base := "rtsp://" + addr + "/cam"
+
+	c := dialRTSP(t, addr)
+	challenge := digestChallenge(c.request("DESCRIBE", base).header)
+	if challenge == "" {
+		t.Fatal("no Digest challenge")
+	}
+
+	basic := func(userinfo string) func(string, string) string {
+		return func(string, string) string { return "Basic " + base64.StdEncoding.EncodeToString([]byte(userinfo)) }
+	}
+	for name, auth := range map[string]func(string, string) string{
+		"digest wrong password": digestAuth(challenge, "viewer", "wrong"),
+		"digest wrong user":     digestAuth(challenge, "admin", "pw"),
+		"digest stale nonce":    digestAuth(`Digest realm="DIFAE Agent", nonce="0000"`, "viewer", "pw"),
+		"basic wrong password":  basic("viewer:wrong"),
+		"garbage":               func(string, string) string { return "Bearer pw" },
+	} {
+		c.auth = auth
+		for _, method := range []string{"DESCRIBE", "SETUP", "PLAY"} {
+			uri := base
+			if method == "SETUP" {
+				uri += "/trackID=0"
+			}
+			a := c.request(method, uri, "Transport: RTP/AVP/TCP;unicast;interleaved=0-1")
+			if a.code != 401 {
+				t.Errorf("%s: %s answered %d, want 401", name, method, a.code)
+			}
+			if len(a.header.Values("WWW-Authenticate")) == 0 {
+				t.Errorf("%s: %s answered without a challenge", name, method)
+			}
+		}
+	}
+
+	c.auth = basic("viewer:pw")
+	if a := c.request("DESCRIBE", base); a.code != 200 {
+		t.Errorf("DESCRIBE with Basic credentials answered %d", a.code)
+	}
+}
+
+func TestWrongPath(t *testing.T) {
+	addr := startSource(t, config.RTSPServerConfig{})
+	c := dialRTSP(t, addr)
+	if a := c.request("DESCRIBE", "rtsp://"+addr+"/other"); a.code != 404 {
+		t.Errorf("DESCRIBE of another path answered %d, want 404", a.code)
+	}
+	if a := c.request("DESCRIBE", "rtsp://"+addr+"/cam"); a.code != 200 {
+		t.Errorf("DESCRIBE without configured credentials answered %d", a.code)
+	}
+}
+
+func TestPlaybackFFmpeg(t *testing.T) {
+	ffmpeg, ffprobe := requirePlayers(t)
+	addr := startServer(t, config.RTSPServerConfig{Username: "viewer", Password: "pw"}, func(ctx context.Context, addr string) {
+		feedFFmpeg(t, ctx, ffmpeg, addr)
+	})
+	url := "rtsp://viewer:pw@" + addr + "/cam"
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, ffprobe, "-v", "error", "-rtsp_transport", "tcp",
+		"-show_entries", "stream=codec_type,codec_name,width,height,sample_rate", "-of", "json", url).Output()
+	if err != nil {
+		t.Fatalf("ffprobe: %v", err)
+	}
+	var probe struct {
+		Streams []struct {
+			CodecType  string `json:"codec_type"`
+			CodecName  string `json:"codec_name"`
+			Width      int    `json:"width"`
+			Height     int    `json:"height"`
+			SampleRate string `json:"sample_rate"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(out, &probe); err != nil {
+		t.Fatalf("ffprobe output: %v\n%s", err, out)
+	}
+	var got []string
+	for _, st := range probe.Streams {
+		switch st.CodecType {
+		case "video":
+			got = append(got, fmt.Sprintf("%s %dx%d", st.CodecName, st.Width, st.Height))
+		case "audio":
+			got = append(got, st.CodecName+" "+st.SampleRate)
+		}
+	}
+	if strings.Join(got, ", ") != "h264 320x240, aac 48000" {
+		t.Errorf("ffprobe sees %v, want H.264 320x240 and AAC 48 kHz", got)
+	}
+
+	// ffmpeg plays two seconds of it, decoding every frame.
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg, "-hide_banner", "-nostats", "-loglevel", "error", "-rtsp_transport", "tcp",
+		"-i", url, "-frames:v", "50", "-progress", "pipe:1", "-f", "null", "-")
+	cmd.Stderr = &stderr
+	out, err = cmd.Output()
+	if err != nil {
+		t.Fatalf("ffmpeg: %v\n%s", err, stderr.String())
+	}
+	if !strings.Contains(string(out), "frame=50\n") {
+		t.Errorf("ffmpeg did not decode 50 frames:\n%s", out)
+	}
+}
@@ -0,0 +1,248 @@
+// Package sampler extracts JPEG frames at a low rate and batch-uploads them
+// to the cloud analytics ingest, so the backend does not have to decode the
+// video again. Uploads never queue without limit: when the endpoint falls
+// behind, the oldest batches are dropped.
+package sampler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/privacy"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+const (
+	framesDir    = "frames"
+	framePattern = "f%09d.jpg"
+
+	// dropLogInterval limits how often dropped frames are reported.
+	dropLogInterval = 30 * time.Second
+)
+
+// FrameInfo describes one frame in a batch's metadata.
+type FrameInfo struct {
+	File       string    `json:"file"`
+	CapturedAt time.Time `json:"capturedAt"`
+}
+
+// BatchMetadata is the "metadata" form field of each upload.
+type BatchMetadata struct {
+	CameraID string      `json:"cameraId"`
+	Mode     string      `json:"mode"`
+	Frames   []FrameInfo `json:"frames"`
+}
+
+type batch struct {
+	meta  BatchMetadata
+	parts []uploader.FramePart
+}
+
+// Sampler collects frames from pipeline sessions and uploads them in batches.
+type Sampler struct {
+	cfg      config.SamplerConfig
+	privacy  config.PrivacyConfig
+	cameraID string
+	upl      *uploader.Uploader
+	logger   *log.Logger
+	pending  chan batch
+
+	// Gate, when set, is consulted for every frame; frames arriving while it
+	// returns false are discarded (e.g. outside motion periods).
+	Gate func() bool
+
+	mu       sync.Mutex
+	dropped  int
+	lastDrop time.Time
+}
+
+// New returns a sampler applying the given privacy settings to its frames;
+// call Run to start uploading.
+func New(cfg config.SamplerConfig, privacyCfg config.PrivacyConfig, cameraID string, upl *uploader.Uploader, logger *log.Logger) *Sampler {
+	return &Sampler{
+		cfg:      cfg,
+		privacy:  privacyCfg,
+		cameraID: cameraID,
+		upl:      upl,
+		logger:   logger,
+		pending:  make(chan batch, cfg.MaxPendingBatches),
+	}
+}
+
+// Run uploads batches one at a time until ctx ends.
+func (s *Sampler) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case b := <-s.pending:
+			data, err := json.Marshal(b.meta)
+			if err != nil {
+				continue
+			}
+			uploadCtx, cancel := context.WithTimeout(ctx, time.Duration(s.cfg.BatchSeconds)*time.Second*3)
+			err = s.upl.UploadFrames(uploadCtx, s.cfg.Endpoint, data, b.parts)
+			cancel()
+			if err != nil && ctx.Err() == nil {
+				s.drop(len(b.parts), fmt.Sprintf("upload failed: %v", err))
+			}
+		}
+	}
+}
+
+// enqueue hands a batch to Run, evicting the oldest waiting batch when the
+// queue is full.
+func (s *Sampler) enqueue(b batch) {
+	for {
+		select {
+		case s.pending <- b:
+			return
+		default:
+		}
+		select {
+		case old := <-s.pending:
+			s.drop(len(old.parts), "analysis endpoint is falling behind")
+		default:
+		}
+	}
+}
+
+func (s *Sampler) drop(frames int, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.dropped += frames
+	if time.Since(s.lastDrop) < dropLogInterval {
+		return
+	}
+	s.logger.Printf("Dropped %d analysis frames (%s)", s.dropped, reason)
+	s.dropped = 0
+	s.lastDrop = time.Now()
+}
+
+// Session is the frame output of one ffmpeg run.
+type Session struct {
+	s   *Sampler
+	dir string
+}
+
+// Session prepares a frame output writing into dir. The frames directory is
+// created up front because the image2 muxer does not create it.
+func (s *Sampler) Session(dir string) *Session {
+	ss := &Session{s: s, dir: filepath.Join(dir, framesDir)}
+	if err := os.MkdirAll(ss.dir, 0o755); err != nil {
+		s.logger.Printf("Could not create frame directory: %v", err)
+	}
+	return ss
+}
+
+// Args returns the ffmpeg output arguments writing numbered JPEGs. Privacy
+// masks and overlays are applied, as the frames leave the site.
+func (ss *Session) Args() []string {
+	cfg := ss.s.cfg
+	filters := []string{"fps=" + strconv.FormatFloat(cfg.Fps, 'f', -1, 64)}
+	filters = append(filters, privacy.Filters(ss.s.privacy, ss.s.cameraID)...)
+	filters = append(filters, fmt.Sprintf("scale=%d:-2", cfg.Width))
+	return []string{
+		"-map", "0:v:0",
+		"-an", "-sn", "-dn",
+		"-vf", strings.Join(filters, ","),
+		"-q:v", strconv.Itoa(cfg.Quality),
+		"-f", "image2",
+		filepath.Join(ss.dir, framePattern),
+	}
+}
+
+// Follow picks up finished frames, batches them and deletes them from disk.
+// A batch is handed over when full or BatchSeconds after its first frame.
+func (ss *Session) Follow(ctx context.Context) {
+	cfg := ss.s.cfg
+	maxAge := time.Duration(cfg.BatchSeconds) * time.Second
+	var current batch
+	var opened time.Time
+
+	flush := func() {
+		if len(current.parts) > 0 {
+			ss.s.enqueue(current)
+		}
+		current = batch{}
+	}
+	defer flush()
+
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, name := range ss.ready() {
+			path := filepath.Join(ss.dir, name)
+			info, statErr := os.Stat(path)
+			data, readErr := os.ReadFile(path)
+			_ = os.Remove(path)
+			if statErr != nil || readErr != nil {
+				continue
+			}
+			if ss.s.Gate != nil && !ss.s.Gate() {
+				continue
+			}
+
+			if len(current.parts) == 0 {
+				opened = time.Now()
+				current.meta = BatchMetadata{CameraID: ss.s.cameraID, Mode: cfg.Mode}
+			}
+			current.meta.Frames = append(current.meta.Frames, FrameInfo{File: name, CapturedAt: info.ModTime().UTC()})
+			current.parts = append(current.parts, uploader.FramePart{Name: name, Data: data})
+			if len(current.parts) >= cfg.BatchFrames {
+				flush()
+			}
+		}
+
+		if len(current.parts) > 0 && time.Since(opened) >= maxAge {
+			flush()
+		}
+	}
+}
+
+// ready lists finished frames, oldest first. The newest file is only taken
+// once it ends with a JPEG end-of-image marker, as ffmpeg may still be
+// writing it.
+func (ss *Session) ready() []string {
+	entries, err := os.ReadDir(ss.dir)
+	if err != nil {
+		return nil
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".jpg") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+
+	if n := len(names); n > 0 && !complete(filepath.Join(ss.dir, names[n-1])) {
+		names = names[:n-1]
+	}
+	return names
+}
+
+func complete(path string) bool {
+	data, err := os.ReadFile(path)
+	return err == nil && bytes.HasSuffix(data, []byte{0xFF, 0xD9})
+}
@@ -0,0 +1,260 @@
+package schedule
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/events"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+// Arm modes. Auto follows the schedule (or streams all the time without
+// one); armed and disarmed force streaming on or off.
+const (
+	ModeAuto     = "auto"
+	ModeArmed    = "armed"
+	ModeDisarmed = "disarmed"
+)
+
+// StateFilename holds the arm mode beside the executable so an override
+// survives restarts.
+const StateFilename = "arm-state.json"
+
+// Status is the controller's current decision.
+type Status struct {
+	Mode      string    `json:"mode"`
+	Streaming bool      `json:"streaming"`
+	Reason    string    `json:"reason"`
+	Since     time.Time `json:"since"`
+}
+
+// Event reports arm mode changes ("arm") and streaming transitions
+// ("schedule") to the backend.
+type Event struct {
+	Type   string    `json:"type"`
+	Mode   string    `json:"mode"`
+	State  string    `json:"state,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Source string    `json:"source,omitempty"`
+	At     time.Time `json:"at"`
+}
+
+// armState is persisted in StateFilename. Backend is the last mode the
+// backend asked for, so a restart does not re-apply it over a local change.
+type armState struct {
+	Mode      string    `json:"mode"`
+	Source    string    `json:"source,omitempty"`
+	ChangedAt time.Time `json:"changedAt,omitempty"`
+	Backend   string    `json:"backend,omitempty"`
+}
+
+// Controller decides whether the pipeline should run and signals changes.
+type Controller struct {
+	plan         *Plan
+	statePath    string
+	upl          *uploader.Uploader
+	queue        *events.Queue
+	pollInterval time.Duration
+	logger       *log.Logger
+
+	mu        sync.Mutex
+	state     armState
+	streaming bool
+	reason    string
+	since     time.Time
+	changed   chan struct{}
+	pollErr   string
+}
+
+// New loads the persisted arm mode and compiles the schedule, if enabled.
+func New(cfg config.AgentConfig, statePath string, upl *uploader.Uploader, queue *events.Queue, logger *log.Logger) (*Controller, error) {
+	c := &Controller{
+		statePath:    statePath,
+		upl:          upl,
+		queue:        queue,
+		pollInterval: time.Duration(cfg.PollIntervalMs) * time.Millisecond,
+		logger:       logger,
+		state:        armState{Mode: ModeAuto},
+		changed:      make(chan struct{}, 1),
+	}
+	if cfg.Schedule.Enabled {
+		plan, err := Compile(cfg.Schedule)
+		if err != nil {
+			return nil, err
+		}
+		c.plan = plan
+	}
+
+	if data, err := os.ReadFile(statePath); err == nil {
+		var st armState
+		if err := json.Unmarshal(data, &st); err != nil || !validMode(st.Mode) {
+			logger.Printf("Ignoring unreadable %s; arm mode is %s", StateFilename, ModeAuto)
+		} else {
+			c.state = st
+		}
+	}
+
+	c.streaming, c.reason = c.decideLocked(time.Now())
+	c.since = time.Now()
+	return c, nil
+}
+
+// Streaming reports whether the pipeline should currently run.
+func (c *Controller) Streaming() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.streaming
+}
+
+// Changed is signalled whenever Streaming flips.
+func (c *Controller) Changed() <-chan struct{} {
+	return c.changed
+}
+
+// Status returns the current mode and streaming decision.
+func (c *Controller) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Status{Mode: c.state.Mode, Streaming: c.streaming, Reason: c.reason, Since: c.since}
+}
+
+// SetMode applies an arm mode; source ("local-api", "backend") is logged
+// and reported.
+func (c *Controller) SetMode(mode, source string) error {
+	if !validMode(mode) {
+		return fmt.Errorf("mode must be %q, %q or %q", ModeAuto, ModeArmed, ModeDisarmed)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if mode == c.state.Mode {
+		return nil
+	}
+	now := time.Now()
+	c.state.Mode, c.state.Source, c.state.ChangedAt = mode, source, now
+	c.saveLocked()
+
+	c.logger.Printf("Arm mode set to %s by %s", mode, source)
+	c.queue.Send(Event{Type: "arm", Mode: mode, Source: source, At: now})
+	c.evaluateLocked(now)
+	return nil
+}
+
+// Run re-evaluates the schedule at every minute boundary and polls the
+// backend for arm mode changes until ctx ends.
+func (c *Controller) Run(ctx context.Context) {
+	c.mu.Lock()
+	c.reportLocked(time.Now())
+	c.mu.Unlock()
+
+	poll := time.NewTicker(c.pollInterval)
+	defer poll.Stop()
+
+	for {
+		now := time.Now()
+		minute := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case <-ctx.Done():
+			minute.Stop()
+			return
+		case now := <-minute.C:
+			c.mu.Lock()
+			c.evaluateLocked(now)
+			c.mu.Unlock()
+		case <-poll.C:
+			minute.Stop()
+			c.pollBackend(ctx)
+		}
+	}
+}
+
+func (c *Controller) pollBackend(ctx context.Context) {
+	reqCtx, cancel := context.WithTimeout(ctx, c.pollInterval)
+	defer cancel()
+
+	mode, err := c.upl.FetchArmMode(reqCtx)
+	if err != nil {
+		// Log each distinct failure once; backends without arm support 404.
+		if msg := err.Error(); msg != c.pollErr && ctx.Err() == nil {
+			c.logger.Printf("Arm mode poll failed: %v", err)
+			c.pollErr = msg
+		}
+		return
+	}
+	c.pollErr = ""
+
+	c.mu.Lock()
+	if mode == "" || mode == c.state.Backend {
+		c.mu.Unlock()
+		return
+	}
+	c.state.Backend = mode
+	c.saveLocked()
+	c.mu.Unlock()
+
+	if err := c.SetMode(mode, "backend"); err != nil {
+		c.logger.Printf("Ignoring arm mode %q from backend: %v", mode, err)
+	}
+}
+
+func (c *Controller) evaluateLocked(now time.Time) {
+	streaming, reason := c.decideLocked(now)
+	if streaming == c.streaming && reason == c.reason {
+		return
+	}
+
+	flipped := streaming != c.streaming
+	c.streaming, c.reason = streaming, reason
+	if !flipped {
+		return
+	}
+	c.since = now
+	c.reportLocked(now)
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Controller) reportLocked(now time.Time) {
+	state, verb := "stopped", "paused"
+	if c.streaming {
+		state, verb = "streaming", "active"
+	}
+	c.logger.Printf("Streaming %s (mode %s, reason %s)", verb, c.state.Mode, c.reason)
+	c.queue.Send(Event{Type: "schedule", Mode: c.state.Mode, State: state, Reason: c.reason, At: now})
+}
+
+func (c *Controller) decideLocked(now time.Time) (bool, string) {
+	switch c.state.Mode {
+	case ModeArmed:
+		return true, ModeArmed
+	case ModeDisarmed:
+		return false, ModeDisarmed
+	}
+	if c.plan == nil {
+		return true, "always"
+	}
+	return c.plan.At(now)
+}
+
+func (c *Controller) saveLocked() {
+	data, err := json.MarshalIndent(c.state, "", "  ")
+	if err == nil {
+		err = os.WriteFile(c.statePath, data, 0o644)
+	}
+	if err != nil {
+		c.logger.Printf("Could not save %s: %v", StateFilename, err)
+	}
+}
+
+func validMode(mode string) bool {
+	return mode == ModeAuto || mode == ModeArmed || mode == ModeDisarmed
+}
@@ -0,0 +1,39 @@
+package schedule
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/difaeai/windows-agent/internal/localapi"
+)
+
+// Path is where the local API serves the arm mode.
+const Path = "/api/arm"
+
+type modeRequest struct {
+	Mode string `json:"mode"`
+}
+
+// Handler serves GET (current status) and POST {"mode": ...} for the local API.
+func (c *Controller) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			localapi.WriteJSON(w, http.StatusOK, c.Status())
+		case http.MethodPost:
+			var req modeRequest
+			if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+				localapi.WriteError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+			if err := c.SetMode(req.Mode, "local-api"); err != nil {
+				localapi.WriteError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			localapi.WriteJSON(w, http.StatusOK, c.Status())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			localapi.WriteError(w, http.StatusMethodNotAllowed, "use GET or POST")
+		}
+	})
+}
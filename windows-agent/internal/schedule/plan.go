@@ -0,0 +1,111 @@
+// Package schedule decides when the agent streams: weekly windows in the
+// camera's timezone with holiday exceptions, overridden by a manual
+// arm/disarm mode set from the local API or the backend.
+package schedule
+
+import (
+	"fmt"
+	"time"
+	// Windows machines rarely ship a zoneinfo database.
+	_ "time/tzdata"
+
+	"github.com/difaeai/windows-agent/internal/config"
+)
+
+const minutesPerDay = 24 * 60
+
+// span is a streaming window in minutes past midnight; end runs past
+// minutesPerDay for windows that cross midnight.
+type span struct {
+	start, end int
+}
+
+// Plan is a compiled ScheduleConfig.
+type Plan struct {
+	loc      *time.Location
+	weekly   [7][]span
+	holidays map[string][]span
+}
+
+// Compile resolves the timezone and parses the windows of a validated config.
+func Compile(cfg config.ScheduleConfig) (*Plan, error) {
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %q: %w", cfg.Timezone, err)
+	}
+
+	p := &Plan{loc: loc, holidays: make(map[string][]span, len(cfg.Holidays))}
+	for _, w := range cfg.Windows {
+		s, err := compileWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		if len(w.Days) == 0 {
+			for d := range p.weekly {
+				p.weekly[d] = append(p.weekly[d], s)
+			}
+			continue
+		}
+		for _, name := range w.Days {
+			d, _ := config.ParseWeekday(name)
+			p.weekly[d] = append(p.weekly[d], s)
+		}
+	}
+	for _, h := range cfg.Holidays {
+		spans := []span{}
+		for _, w := range h.Windows {
+			s, err := compileWindow(w)
+			if err != nil {
+				return nil, err
+			}
+			spans = append(spans, s)
+		}
+		p.holidays[h.Date] = spans
+	}
+	return p, nil
+}
+
+func compileWindow(w config.WindowConfig) (span, error) {
+	start, err := config.ParseClock(w.Start)
+	if err != nil {
+		return span{}, err
+	}
+	end, err := config.ParseClock(w.End)
+	if err != nil {
+		return span{}, err
+	}
+	if end <= start {
+		end += minutesPerDay
+	}
+	return span{start, end}, nil
+}
+
+// At reports whether t falls inside a streaming window, and whether that
+// day's windows came from the weekly plan ("schedule") or a holiday.
+func (p *Plan) At(t time.Time) (bool, string) {
+	local := t.In(p.loc)
+	minute := local.Hour()*60 + local.Minute()
+
+	today, reason := p.day(local)
+	for _, s := range today {
+		if s.start <= minute && minute < s.end {
+			return true, reason
+		}
+	}
+
+	// Windows that started yesterday and run past midnight.
+	yesterday, prevReason := p.day(local.AddDate(0, 0, -1))
+	for _, s := range yesterday {
+		if minute+minutesPerDay < s.end {
+			return true, prevReason
+		}
+	}
+	return false, reason
+}
+
+func (p *Plan) day(t time.Time) ([]span, string) {
+	if spans, ok := p.holidays[t.Format(time.DateOnly)]; ok {
+		return spans, "holiday"
+	}
+	return p.weekly[t.Weekday()], "schedule"
+}
@@ -0,0 +1,193 @@
+// Package snapshot extracts JPEG stills from segments the HLS pipeline has
+// already written, so thumbnails never need a second camera connection.
+package snapshot
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/ffmpeg"
+	"github.com/difaeai/windows-agent/internal/llhls"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+// Reasons reported alongside each uploaded snapshot.
+const (
+	ReasonInterval = "interval"
+	ReasonOnDemand = "on-demand"
+	ReasonIdle     = "idle"
+)
+
+// Source locates the newest complete media file and the wall-clock time of
+// its first frame.
+type Source func() (path string, startedAt time.Time, err error)
+
+// PlaylistSource reads the newest segment listed in an ffmpeg HLS playlist.
+func PlaylistSource(dir string) Source {
+	return func() (string, time.Time, error) {
+		segments, err := ffmpeg.ReadPlaylist(filepath.Join(dir, "out.m3u8"))
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		if len(segments) == 0 {
+			return "", time.Time{}, fmt.Errorf("no segment listed in %s", dir)
+		}
+
+		newest := segments[len(segments)-1]
+		return startOf(filepath.Join(dir, newest.Name), newest.Duration)
+	}
+}
+
+// PartSource reads the newest LL-HLS part that starts with a keyframe.
+func PartSource(dir string) Source {
+	parts := llhls.NewPartFollower(dir)
+	return func() (string, time.Time, error) {
+		path, duration, err := parts.LatestIndependentPart()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return startOf(path, duration)
+	}
+}
+
+// startOf estimates when a file's first frame was captured: ffmpeg closes a
+// segment right after its last frame, so that is its mtime minus its duration.
+func startOf(path string, duration float64) (string, time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return path, info.ModTime().Add(-time.Duration(duration * float64(time.Second))), nil
+}
+
+// Capture decodes the first keyframe of a local media file into a JPEG.
+func Capture(ctx context.Context, path string, cfg config.SnapshotConfig) ([]byte, error) {
+	return grab(ctx, []string{"-i", path}, nil, cfg, filepath.Base(path))
+}
+
+// CaptureCamera takes a still straight from the camera, for when no pipeline
+// is running. filters (privacy masks) are applied before scaling.
+func CaptureCamera(ctx context.Context, rtspURL string, filters []string, cfg config.SnapshotConfig) ([]byte, error) {
+	return grab(ctx, []string{"-rtsp_transport", "tcp", "-i", rtspURL}, filters, cfg, "the camera")
+}
+
+func grab(ctx context.Context, input, filters []string, cfg config.SnapshotConfig, source string) ([]byte, error) {
+	captureCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+
+	args := []string{
+		"-hide_banner",
+		"-loglevel", "error",
+		"-skip_frame", "nokey",
+	}
+	args = append(args, input...)
+	args = append(args,
+		"-frames:v", "1",
+		"-q:v", strconv.Itoa(cfg.Quality),
+	)
+	if cfg.Width > 0 {
+		filters = append(filters, fmt.Sprintf("scale=%d:-2", cfg.Width))
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	args = append(args, "-f", "image2", "-c:v", "mjpeg", "pipe:1")
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(captureCtx, "ffmpeg", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("ffmpeg snapshot failed: %w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no frame decoded from %s", source)
+	}
+
+	return out, nil
+}
+
+// Snapshotter uploads a still at a fixed interval and whenever triggered.
+// When Gate is set and returns false (no pipeline running), segments on disk
+// are stale and no snapshot is taken.
+type Snapshotter struct {
+	Gate func() bool
+
+	cfg     config.SnapshotConfig
+	source  Source
+	upl     *uploader.Uploader
+	logger  *log.Logger
+	trigger chan struct{}
+}
+
+// New returns a snapshotter reading from source.
+func New(cfg config.SnapshotConfig, source Source, upl *uploader.Uploader, logger *log.Logger) *Snapshotter {
+	return &Snapshotter{
+		cfg:     cfg,
+		source:  source,
+		upl:     upl,
+		logger:  logger,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// Trigger requests a one-off snapshot as soon as possible.
+func (s *Snapshotter) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run takes snapshots until ctx is cancelled.
+func (s *Snapshotter) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(s.cfg.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		reason := ReasonInterval
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.trigger:
+			reason = ReasonOnDemand
+		}
+		if s.Gate != nil && !s.Gate() {
+			continue
+		}
+
+		if err := s.Take(ctx, reason); err != nil && ctx.Err() == nil {
+			s.logger.Printf("Snapshot failed: %v", err)
+		}
+	}
+}
+
+// Take captures and uploads a single snapshot.
+func (s *Snapshotter) Take(ctx context.Context, reason string) error {
+	path, capturedAt, err := s.source()
+	if err != nil {
+		return err
+	}
+
+	data, err := Capture(ctx, path, s.cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := s.upl.UploadSnapshot(ctx, data, capturedAt, reason); err != nil {
+		return err
+	}
+
+	s.logger.Printf("Snapshot uploaded (%s, %d bytes, captured %s)", reason, len(data), capturedAt.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,164 @@
+// Package streamswitch decides when the agent should fall back from the
+// camera's main stream to its sub stream, based on upload throughput and backlog.
+package streamswitch
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/uploader"
+)
+
+const (
+	sampleInterval = 5 * time.Second
+	// busyThreshold is the share of wall time spent uploading above which the
+	// link is considered saturated.
+	busyThreshold = 0.9
+)
+
+// StatsSource provides periodic upload statistics.
+type StatsSource interface {
+	TakeStats() uploader.Stats
+}
+
+// Controller tracks upload health and flips between main and sub stream with
+// hysteresis: it downgrades after sustained congestion and only upgrades
+// after the link has shown enough spare capacity for a full recovery period.
+type Controller struct {
+	cfg    config.StreamSwitchConfig
+	stats  StatsSource
+	logger *log.Logger
+
+	mu      sync.Mutex
+	onSub   bool
+	changed chan struct{}
+
+	congestedSince time.Time
+	healthySince   time.Time
+	mainRate       float64
+}
+
+// New returns a controller that starts on the main stream.
+func New(cfg config.StreamSwitchConfig, stats StatsSource, logger *log.Logger) *Controller {
+	return &Controller{
+		cfg:     cfg,
+		stats:   stats,
+		logger:  logger,
+		changed: make(chan struct{}, 1),
+	}
+}
+
+// OnSub reports whether the sub stream should currently be ingested.
+func (c *Controller) OnSub() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.onSub
+}
+
+// Changed is signalled whenever the controller switches streams.
+func (c *Controller) Changed() <-chan struct{} {
+	return c.changed
+}
+
+// Run samples upload statistics until ctx is cancelled.
+func (c *Controller) Run(ctx context.Context) {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.evaluate(c.stats.TakeStats(), now, sampleInterval)
+		}
+	}
+}
+
+func (c *Controller) evaluate(s uploader.Stats, now time.Time, interval time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	busy := s.Busy.Seconds() / interval.Seconds()
+
+	if !c.onSub {
+		congested := s.Backlog > c.cfg.MaxBacklogSegments || busy > busyThreshold
+		if !congested {
+			c.congestedSince = time.Time{}
+			if s.Backlog == 0 && s.Bytes > 0 {
+				c.observeMainRate(float64(s.Bytes) / interval.Seconds())
+			}
+			return
+		}
+
+		if c.congestedSince.IsZero() {
+			c.congestedSince = now
+		}
+		if now.Sub(c.congestedSince) < seconds(c.cfg.DowngradeAfterSeconds) {
+			return
+		}
+
+		c.logger.Printf("Switching to sub stream: upload backlog %d segments, link busy %.0f%% for %s",
+			s.Backlog, busy*100, now.Sub(c.congestedSince).Round(time.Second))
+		c.switchTo(true)
+		return
+	}
+
+	need := c.requiredRate() * c.cfg.Headroom
+	capacity := 0.0
+	if s.Busy > 0 {
+		capacity = float64(s.Bytes) / s.Busy.Seconds()
+	}
+
+	if s.Backlog > 0 || capacity < need {
+		c.healthySince = time.Time{}
+		return
+	}
+
+	if c.healthySince.IsZero() {
+		c.healthySince = now
+	}
+	if now.Sub(c.healthySince) < seconds(c.cfg.RecoverAfterSeconds) {
+		return
+	}
+
+	c.logger.Printf("Switching back to main stream after %s of stable uploads (%.0f kbit/s available, %.0f kbit/s needed)",
+		now.Sub(c.healthySince).Round(time.Second), capacity*8/1000, need*8/1000)
+	c.switchTo(false)
+}
+
+// observeMainRate keeps a moving average of the main stream's bitrate while
+// uploads keep up, so recovery can be judged against what main really needs.
+func (c *Controller) observeMainRate(rate float64) {
+	if c.mainRate == 0 {
+		c.mainRate = rate
+		return
+	}
+	c.mainRate = 0.8*c.mainRate + 0.2*rate
+}
+
+// requiredRate is the main stream's bitrate in bytes per second.
+func (c *Controller) requiredRate() float64 {
+	if c.mainRate > 0 {
+		return c.mainRate
+	}
+	return float64(c.cfg.MainBitrateKbps) * 1000 / 8
+}
+
+func (c *Controller) switchTo(sub bool) {
+	c.onSub = sub
+	c.congestedSince = time.Time{}
+	c.healthySince = time.Time{}
+
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+func seconds(n int) time.Duration {
+	return time.Duration(n) * time.Second
+}
@@ -0,0 +1,43 @@
+// Package tail follows append-only text files such as ffmpeg segment lists.
+package tail
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"strings"
+)
+
+// ReadLines returns the complete, non-empty lines appended to path after
+// offset, and the offset to resume from. A trailing partial line is left for
+// the next call.
+func ReadLines(path string, offset int64) ([]string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, offset, err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, offset, err
+	}
+
+	raw, err := io.ReadAll(f)
+	if err != nil {
+		return nil, offset, err
+	}
+
+	end := bytes.LastIndexByte(raw, '\n')
+	if end < 0 {
+		return nil, offset, nil
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(raw[:end]), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, offset + int64(end) + 1, nil
+}
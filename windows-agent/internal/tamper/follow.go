@@ -0,0 +1,116 @@
+package tamper
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/tail"
+)
+
+// condition tracks an open blackout or freeze.
+type condition struct {
+	start    time.Time
+	active   bool
+	reported bool
+}
+
+// Follow parses the metadata file as ffmpeg writes it and emits events.
+// Blackouts are reported once they have lasted BlackSeconds; freezes are
+// already held back by freezedetect for FreezeSeconds.
+func (s *Session) Follow(ctx context.Context) {
+	var black, freeze condition
+	var sceneScore float64
+	minBlack := time.Duration(s.d.cfg.BlackSeconds * float64(time.Second))
+
+	defer func() {
+		now := time.Now()
+		if black.reported {
+			s.end(KindBlackout, black.start, now, true)
+		}
+		if freeze.reported {
+			s.end(KindFreeze, freeze.start, now, true)
+		}
+	}()
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var offset int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		lines, next, err := tail.ReadLines(s.path, offset)
+		if err != nil {
+			continue
+		}
+		offset = next
+
+		for _, line := range lines {
+			if strings.HasPrefix(line, "frame:") {
+				sceneScore = 0
+				continue
+			}
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				continue
+			}
+
+			switch key {
+			case "lavfi.black_start":
+				black = condition{start: unixTime(value), active: true}
+			case "lavfi.black_end":
+				if black.active && unixTime(value).Sub(black.start) >= minBlack {
+					if !black.reported {
+						s.d.emit(Event{Kind: KindBlackout, State: StateStarted, Start: black.start})
+					}
+					s.end(KindBlackout, black.start, unixTime(value), false)
+				}
+				black = condition{}
+			case "lavfi.freezedetect.freeze_start":
+				freeze = condition{start: unixTime(value), active: true, reported: true}
+				s.d.emit(Event{Kind: KindFreeze, State: StateStarted, Start: freeze.start})
+			case "lavfi.freezedetect.freeze_end":
+				if freeze.active {
+					s.end(KindFreeze, freeze.start, unixTime(value), false)
+				}
+				freeze = condition{}
+			case "lavfi.scd.score":
+				sceneScore, _ = strconv.ParseFloat(value, 64)
+			case "lavfi.scd.time":
+				at := unixTime(value)
+				s.d.emit(Event{Kind: KindSceneChange, State: StateDetected, Start: at, End: &at, Score: sceneScore})
+			}
+		}
+
+		if black.active && !black.reported && time.Since(black.start) >= minBlack {
+			black.reported = true
+			s.d.emit(Event{Kind: KindBlackout, State: StateStarted, Start: black.start})
+		}
+	}
+}
+
+func (s *Session) end(kind Kind, start, end time.Time, interrupted bool) {
+	s.d.emit(Event{
+		Kind:            kind,
+		State:           StateEnded,
+		Start:           start,
+		End:             &end,
+		DurationSeconds: end.Sub(start).Seconds(),
+		Interrupted:     interrupted,
+	})
+}
+
+// unixTime converts a wall-clock pts_time written by the analysis branch.
+func unixTime(value string) time.Time {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
@@ -0,0 +1,126 @@
+// Package tamper detects blackouts, frozen frames and sudden scene changes
+// (a covered, sprayed or re-aimed camera) with ffmpeg analysis filters on a
+// low-fps branch of the pipeline, and reports them to the backend.
+package tamper
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/config"
+	"github.com/difaeai/windows-agent/internal/events"
+)
+
+// Kind is the type of tamper detected.
+type Kind string
+
+const (
+	KindBlackout    Kind = "blackout"
+	KindFreeze      Kind = "freeze"
+	KindSceneChange Kind = "scene_change"
+)
+
+// State tells whether an event opens or closes a condition. Scene changes
+// are instantaneous and only ever "detected".
+type State string
+
+const (
+	StateStarted  State = "started"
+	StateEnded    State = "ended"
+	StateDetected State = "detected"
+)
+
+const metadataFilename = "tamper.txt"
+
+// Event is the JSON body sent to the backend's events endpoint.
+type Event struct {
+	Type            string     `json:"type"`
+	Kind            Kind       `json:"kind"`
+	State           State      `json:"state"`
+	Start           time.Time  `json:"start"`
+	End             *time.Time `json:"end,omitempty"`
+	DurationSeconds float64    `json:"durationSeconds,omitempty"`
+	Score           float64    `json:"score,omitempty"`
+	// Interrupted marks a condition closed because the pipeline stopped
+	// rather than because the picture recovered.
+	Interrupted bool `json:"interrupted,omitempty"`
+}
+
+// Detector adds the analysis branch to pipeline runs and reports events.
+type Detector struct {
+	cfg    config.TamperConfig
+	events *events.Queue
+	logger *log.Logger
+}
+
+// New returns a detector reporting to the given event queue.
+func New(cfg config.TamperConfig, queue *events.Queue, logger *log.Logger) *Detector {
+	return &Detector{cfg: cfg, events: queue, logger: logger}
+}
+
+func (d *Detector) emit(ev Event) {
+	ev.Type = "tamper"
+	d.logger.Printf("Tamper %s %s at %s", ev.Kind, ev.State, ev.Start.Format(time.RFC3339))
+	d.events.Send(ev)
+}
+
+// Session is the analysis output of one ffmpeg run.
+type Session struct {
+	d    *Detector
+	path string
+}
+
+// Session prepares an analysis output writing its metadata into dir.
+func (d *Detector) Session(dir string) *Session {
+	return &Session{d: d, path: filepath.Join(dir, metadataFilename)}
+}
+
+// Args returns the ffmpeg output arguments for the analysis branch. Frames
+// are re-stamped with the wall clock so detector times are Unix seconds, and
+// only frames carrying detector results are written to the metadata file.
+func (s *Session) Args() []string {
+	cfg := s.d.cfg
+	filters := []string{
+		"setpts=RTCTIME/(TB*1000000)",
+		fmt.Sprintf("fps=%d", cfg.AnalysisFps),
+		"scale=320:-2",
+	}
+	if cfg.BlackSeconds >= 0 {
+		// The minimum duration is applied when parsing, so short dips
+		// still get a precise start time.
+		filters = append(filters, fmt.Sprintf("blackdetect=d=0:pic_th=%s:pix_th=%s", num(cfg.BlackRatio), num(cfg.BlackPixelThreshold)))
+	}
+	if cfg.FreezeSeconds >= 0 {
+		filters = append(filters, fmt.Sprintf("freezedetect=n=%sdB:d=%s", num(cfg.FreezeNoiseDb), num(cfg.FreezeSeconds)))
+	}
+	if cfg.SceneThreshold >= 0 {
+		filters = append(filters,
+			fmt.Sprintf("scdet=threshold=%s", num(cfg.SceneThreshold)),
+			"metadata=mode=delete:key=lavfi.scd.mafd",
+			fmt.Sprintf("metadata=mode=delete:key=lavfi.scd.score:value=%s:function=less", num(cfg.SceneThreshold)),
+		)
+	}
+	filters = append(filters, "metadata=mode=print:direct=1:file="+filterPath(s.path))
+
+	return []string{
+		"-map", "0:v:0",
+		"-an", "-sn", "-dn",
+		"-vf", strings.Join(filters, ","),
+		"-f", "null",
+		"-",
+	}
+}
+
+// filterPath quotes a file path for use as a filter option, escaping the
+// drive colon on Windows.
+func filterPath(p string) string {
+	return "'" + strings.ReplaceAll(filepath.ToSlash(p), ":", `\:`) + "'"
+}
+
+func num(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
@@ -3,6 +3,7 @@ package uploader
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -10,7 +11,9 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -19,8 +22,48 @@ type Uploader struct {
 	uploadBaseURL string
 	bridgeID      string
 	apiKey        string
+	variant       string
 	client        *http.Client
 	logger        *log.Logger
+	stats         *statsRecorder
+
+	// Backends, if set, picks the base URL for each request in place of
+	// the one given to New and is told how each request went.
+	Backends Backends
+}
+
+// Backends chooses between backends; see the failover package.
+type Backends interface {
+	Active() string
+	Report(requestURL string, ok bool)
+}
+
+// Stats summarises segment upload activity since the previous TakeStats call.
+type Stats struct {
+	// Bytes is the payload size of segments and parts delivered.
+	Bytes int64
+	// Busy is the wall time spent delivering them, including retries.
+	Busy time.Duration
+	// Backlog is the most recent count of segments waiting for upload.
+	Backlog int
+}
+
+type statsRecorder struct {
+	mu    sync.Mutex
+	stats Stats
+}
+
+func (r *statsRecorder) record(bytes int, busy time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Bytes += int64(bytes)
+	r.stats.Busy += busy
+}
+
+func (r *statsRecorder) setBacklog(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Backlog = n
 }
 
 func New(uploadBaseURL, bridgeID, apiKey string, logger *log.Logger) *Uploader {
@@ -29,12 +72,36 @@ func New(uploadBaseURL, bridgeID, apiKey string, logger *log.Logger) *Uploader {
 		bridgeID:      bridgeID,
 		apiKey:        apiKey,
 		logger:        logger,
+		stats:         &statsRecorder{},
 		client: &http.Client{
 			Timeout: 20 * time.Second,
 		},
 	}
 }
 
+// TakeStats returns upload statistics gathered since the last call and
+// resets the counters. Variants share their parent's statistics.
+func (u *Uploader) TakeStats() Stats {
+	u.stats.mu.Lock()
+	defer u.stats.mu.Unlock()
+	taken := u.stats.stats
+	u.stats.stats = Stats{Backlog: taken.Backlog}
+	return taken
+}
+
+// SetBacklog reports how many produced segments are still waiting for upload.
+func (u *Uploader) SetBacklog(n int) {
+	u.stats.setBacklog(n)
+}
+
+// Variant returns an uploader that publishes under the named rendition path,
+// e.g. /streams/<bridgeId>/<variant>/, instead of the stream root.
+func (u *Uploader) Variant(name string) *Uploader {
+	v := *u
+	v.variant = name
+	return &v
+}
+
 // MonitorOutput scans an output directory for new playlists/segments and uploads them.
 func (u *Uploader) MonitorOutput(ctx context.Context, outputDir string) {
 	uploaded := make(map[string]time.Time)
@@ -52,6 +119,15 @@ func (u *Uploader) MonitorOutput(ctx context.Context, outputDir string) {
 				continue
 			}
 
+			pending := 0
+			for _, entry := range entries {
+				name := entry.Name()
+				if _, ok := uploaded[name]; !ok && strings.HasSuffix(strings.ToLower(name), ".ts") {
+					pending++
+				}
+			}
+			u.SetBacklog(pending)
+
 			for _, entry := range entries {
 				if entry.IsDir() {
 					continue
@@ -117,9 +193,8 @@ func (u *Uploader) MonitorOutput(ctx context.Context, outputDir string) {
 }
 
 func (u *Uploader) UploadManifest(ctx context.Context, data []byte) error {
-	endpoint := fmt.Sprintf("%s/api/bridges/%s/upload-manifest", u.uploadBaseURL, u.bridgeID)
 	return u.doWithRetry(ctx, func() (*http.Request, error) {
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint("/upload-manifest"), bytes.NewReader(data))
 		if err != nil {
 			return nil, err
 		}
@@ -130,9 +205,253 @@ func (u *Uploader) UploadManifest(ctx context.Context, data []byte) error {
 	})
 }
 
-func (u *Uploader) UploadSegment(ctx context.Context, name string, data []byte) error {
-	endpoint := fmt.Sprintf("%s/api/bridges/%s/upload-segment", u.uploadBaseURL, u.bridgeID)
+// UploadManifestAt pushes an LL-HLS playlist together with the position of the
+// newest part it lists, so the backend can answer blocking playlist reloads.
+func (u *Uploader) UploadManifestAt(ctx context.Context, data []byte, msn, part int) error {
+	return u.doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint("/upload-manifest"), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/vnd.apple.mpegurl")
+		req.Header.Set("X-Bridge-Media-Sequence", strconv.Itoa(msn))
+		req.Header.Set("X-Bridge-Part", strconv.Itoa(part))
+		u.addBridgeHeaders(req)
+		return req, nil
+	})
+}
+
+// UploadPart pushes a single LL-HLS partial segment as soon as it is complete.
+func (u *Uploader) UploadPart(ctx context.Context, name string, msn, part int, independent bool, data []byte) error {
+	started := time.Now()
+	err := u.doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint("/upload-part"), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "video/mp2t")
+		req.Header.Set("X-Bridge-Segment", name)
+		req.Header.Set("X-Bridge-Media-Sequence", strconv.Itoa(msn))
+		req.Header.Set("X-Bridge-Part", strconv.Itoa(part))
+		req.Header.Set("X-Bridge-Part-Independent", strconv.FormatBool(independent))
+		u.addBridgeHeaders(req)
+		return req, nil
+	})
+	u.measure(len(data), started, err)
+	return err
+}
+
+// UploadSnapshot pushes a JPEG still together with the time it was captured.
+func (u *Uploader) UploadSnapshot(ctx context.Context, data []byte, capturedAt time.Time, reason string) error {
 	return u.doWithRetry(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint("/upload-snapshot"), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "image/jpeg")
+		req.Header.Set("X-Bridge-Captured-At", capturedAt.UTC().Format(time.RFC3339Nano))
+		req.Header.Set("X-Bridge-Snapshot-Reason", reason)
+		u.addBridgeHeaders(req)
+		return req, nil
+	})
+}
+
+// UploadClip pushes an MP4 event clip with its JSON metadata as a multipart form.
+func (u *Uploader) UploadClip(ctx context.Context, name string, data, metadata []byte) error {
+	return u.doUntilRejected(ctx, func() (*http.Request, error) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+
+		if err := writer.WriteField("metadata", string(metadata)); err != nil {
+			return nil, err
+		}
+		part, err := writer.CreateFormFile("file", name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint("/upload-clip"), body)
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		u.addBridgeHeaders(req)
+		return req, nil
+	})
+}
+
+// UploadEvent pushes a JSON event (tamper alerts and similar) to the backend.
+func (u *Uploader) UploadEvent(ctx context.Context, data []byte) error {
+	return u.doUntilRejected(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint("/events"), bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		u.addBridgeHeaders(req)
+		return req, nil
+	})
+}
+
+// FetchArmMode asks the backend for the arm/disarm mode it wants the bridge
+// in. It makes a single attempt; callers poll.
+func (u *Uploader) FetchArmMode(ctx context.Context) (string, error) {
+	endpoint := u.endpoint("/arm")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	u.addBridgeHeaders(req)
+
+	resp, err := u.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("arm state request failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil {
+		return "", fmt.Errorf("invalid arm state response: %w", err)
+	}
+	return body.Mode, nil
+}
+
+// ClipRequest is a clip the backend asks the bridge for.
+type ClipRequest struct {
+	ID       string            `json:"id"`
+	Reason   string            `json:"reason"`
+	At       time.Time         `json:"at"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// FetchClipRequests asks the backend for the clips it wants from the bridge.
+// It makes a single attempt; callers poll.
+func (u *Uploader) FetchClipRequests(ctx context.Context) ([]ClipRequest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.endpoint("/clips"), nil)
+	if err != nil {
+		return nil, err
+	}
+	u.addBridgeHeaders(req)
+
+	resp, err := u.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("clip request poll failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Clips []ClipRequest `json:"clips"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil {
+		return nil, fmt.Errorf("invalid clip request response: %w", err)
+	}
+	return body.Clips, nil
+}
+
+// FetchViewers long-polls the backend for the number of viewers watching the
+// bridge. The backend answers as soon as the count differs from known, or
+// with the unchanged count after wait; the request doubles as a keepalive.
+func (u *Uploader) FetchViewers(ctx context.Context, known int, wait time.Duration) (int, error) {
+	endpoint := u.endpoint(fmt.Sprintf("/viewers?known=%d&wait=%d", known, int(wait.Seconds())))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	u.addBridgeHeaders(req)
+
+	resp, err := u.do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("viewer request failed: %s", resp.Status)
+	}
+
+	var body struct {
+		Viewers int `json:"viewers"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body); err != nil {
+		return 0, fmt.Errorf("invalid viewer response: %w", err)
+	}
+	return body.Viewers, nil
+}
+
+// FramePart is one JPEG in a frame batch.
+type FramePart struct {
+	Name string
+	Data []byte
+}
+
+// UploadFrames posts a batch of analysis frames with their JSON metadata as a
+// multipart form. Frames are only useful while fresh, so a failed batch is
+// not retried. An empty endpoint selects the default analysis-frames URL.
+func (u *Uploader) UploadFrames(ctx context.Context, endpoint string, metadata []byte, frames []FramePart) error {
+	if endpoint == "" {
+		endpoint = u.endpoint("/analysis-frames")
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	if err := writer.WriteField("metadata", string(metadata)); err != nil {
+		return err
+	}
+	for _, f := range frames {
+		part, err := writer.CreateFormFile("frames", f.Name)
+		if err != nil {
+			return err
+		}
+		if _, err := part.Write(f.Data); err != nil {
+			return err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	u.addBridgeHeaders(req)
+
+	resp, err := u.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("analysis endpoint returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (u *Uploader) UploadSegment(ctx context.Context, name string, data []byte) error {
+	started := time.Now()
+	err := u.doWithRetry(ctx, func() (*http.Request, error) {
 		body := &bytes.Buffer{}
 		writer := multipart.NewWriter(body)
 
@@ -148,7 +467,7 @@ func (u *Uploader) UploadSegment(ctx context.Context, name string, data []byte)
 			return nil, err
 		}
 
-		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.endpoint("/upload-segment"), body)
 		if err != nil {
 			return nil, err
 		}
@@ -158,9 +477,21 @@ func (u *Uploader) UploadSegment(ctx context.Context, name string, data []byte)
 		u.addBridgeHeaders(req)
 		return req, nil
 	})
+	u.measure(len(data), started, err)
+	return err
 }
 
 func (u *Uploader) doWithRetry(ctx context.Context, build func() (*http.Request, error)) error {
+	return u.retry(ctx, false, build)
+}
+
+// doUntilRejected is doWithRetry for uploads the backend may refuse outright:
+// a 4xx other than 408 or 429 will not change on a retry, so it gives up.
+func (u *Uploader) doUntilRejected(ctx context.Context, build func() (*http.Request, error)) error {
+	return u.retry(ctx, true, build)
+}
+
+func (u *Uploader) retry(ctx context.Context, giveUpOn4xx bool, build func() (*http.Request, error)) error {
 	backoff := 2 * time.Second
 	attempt := 0
 
@@ -171,7 +502,7 @@ func (u *Uploader) doWithRetry(ctx context.Context, build func() (*http.Request,
 			return err
 		}
 
-		resp, err := u.client.Do(req)
+		resp, err := u.do(req)
 		if err == nil && resp.StatusCode < 300 {
 			_ = resp.Body.Close()
 			return nil
@@ -181,6 +512,9 @@ func (u *Uploader) doWithRetry(ctx context.Context, build func() (*http.Request,
 		if resp != nil {
 			status = resp.Status
 			_ = resp.Body.Close()
+			if giveUpOn4xx && rejected(resp.StatusCode) {
+				return fmt.Errorf("backend rejected upload: %s", status)
+			}
 		}
 
 		u.logger.Printf("Upload attempt %d failed (%s). Retrying in %s", attempt, status, backoff)
@@ -195,9 +529,44 @@ func (u *Uploader) doWithRetry(ctx context.Context, build func() (*http.Request,
 	return ctx.Err()
 }
 
+// measure counts time spent on every upload but only bytes that arrived, so a
+// failing link shows up as busy time without throughput.
+func (u *Uploader) measure(bytes int, started time.Time, err error) {
+	if err != nil {
+		bytes = 0
+	}
+	u.stats.record(bytes, time.Since(started))
+}
+
+// endpoint returns the URL of path under this bridge on the active backend.
+func (u *Uploader) endpoint(path string) string {
+	base := u.uploadBaseURL
+	if u.Backends != nil {
+		base = u.Backends.Active()
+	}
+	return fmt.Sprintf("%s/api/bridges/%s%s", base, u.bridgeID, path)
+}
+
+// do sends req and reports the outcome to Backends. Only network errors and
+// 5xx answers count against a backend; a cancelled request counts for nothing.
+func (u *Uploader) do(req *http.Request) (*http.Response, error) {
+	resp, err := u.client.Do(req)
+	if u.Backends != nil && req.Context().Err() == nil {
+		u.Backends.Report(req.URL.String(), err == nil && resp.StatusCode < 500)
+	}
+	return resp, err
+}
+
 func (u *Uploader) addBridgeHeaders(req *http.Request) {
 	req.Header.Set("X-Bridge-Id", u.bridgeID)
 	req.Header.Set("X-Bridge-ApiKey", u.apiKey)
+	if u.variant != "" {
+		req.Header.Set("X-Bridge-Variant", u.variant)
+	}
+}
+
+func rejected(status int) bool {
+	return status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests
 }
 
 func nextBackoff(current time.Duration) time.Duration {
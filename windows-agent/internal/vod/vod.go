@@ -0,0 +1,314 @@
+// Package vod serves recorded footage over the local API: VOD HLS playlists
+// for a time range, the recorded chunks themselves, and MP4 exports.
+package vod
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/localapi"
+	"github.com/difaeai/windows-agent/internal/recorder"
+)
+
+// Prefix is the local API path the handler is mounted on.
+const Prefix = "/api/vod/"
+
+// maxRange bounds a single playlist or export request.
+const maxRange = 24 * time.Hour
+
+// Handler serves /api/vod/<camera>/{recordings,playlist.m3u8,segments/<file>,export.mp4}.
+type Handler struct {
+	cameras map[string]*recorder.Index
+	logger  *log.Logger
+}
+
+// New returns a handler over the given per-camera recording indexes.
+func New(cameras map[string]*recorder.Index, logger *log.Logger) *Handler {
+	return &Handler{cameras: cameras, logger: logger}
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		localapi.WriteError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, Prefix)
+	camera, route, _ := strings.Cut(rest, "/")
+	index, ok := h.cameras[camera]
+	if !ok {
+		localapi.WriteError(w, http.StatusNotFound, "unknown camera")
+		return
+	}
+
+	switch {
+	case route == "recordings":
+		h.serveRecordings(w, r, index)
+	case route == "playlist.m3u8":
+		h.servePlaylist(w, r, index)
+	case route == "export.mp4":
+		h.serveExport(w, r, camera, index)
+	case strings.HasPrefix(route, "segments/"):
+		h.serveSegment(w, r, index, strings.TrimPrefix(route, "segments/"))
+	default:
+		localapi.WriteError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *Handler) serveRecordings(w http.ResponseWriter, r *http.Request, index *recorder.Index) {
+	from, to, err := localapi.ParseRange(r, maxRange)
+	if err != nil {
+		localapi.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chunks := index.Range(from, to)
+	if chunks == nil {
+		chunks = []recorder.Chunk{}
+	}
+	localapi.WriteJSON(w, http.StatusOK, chunks)
+}
+
+// servePlaylist lists every chunk overlapping the range as one segment, with
+// its wall-clock start as EXT-X-PROGRAM-DATE-TIME. Fragmented MP4 chunks
+// carry their own init section, addressed with byte ranges.
+func (h *Handler) servePlaylist(w http.ResponseWriter, r *http.Request, index *recorder.Index) {
+	from, to, err := localapi.ParseRange(r, maxRange)
+	if err != nil {
+		localapi.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chunks := index.Range(from, to)
+	if len(chunks) == 0 {
+		localapi.WriteError(w, http.StatusNotFound, "no recordings in range")
+		return
+	}
+
+	target := 1
+	for _, c := range chunks {
+		if d := int(math.Ceil(c.End.Sub(c.Start).Seconds())); d > target {
+			target = d
+		}
+	}
+
+	query := ""
+	if token := r.URL.Query().Get("token"); token != "" {
+		query = "?token=" + url.QueryEscape(token)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:7\n")
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", target)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+
+	for i, c := range chunks {
+		uri := "segments/" + c.File + query
+		fragmented := strings.HasSuffix(c.File, ".mp4")
+		var initSize int64
+		if fragmented {
+			if initSize, err = mp4InitSize(c.Path(index.Dir())); err != nil {
+				h.logger.Printf("VOD: skipping %s: %v", c.File, err)
+				continue
+			}
+		}
+
+		// Each chunk is a separate ffmpeg segment: MP4 chunks restart their
+		// timeline, and a gap between chunks means recording was interrupted.
+		if i > 0 && (fragmented || c.Start.Sub(chunks[i-1].End) > time.Second) {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+
+		if fragmented {
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\",BYTERANGE=\"%d@0\"\n", uri, initSize)
+			fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", c.Start.UTC().Format("2006-01-02T15:04:05.000Z"))
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\n", c.End.Sub(c.Start).Seconds())
+			fmt.Fprintf(&b, "#EXT-X-BYTERANGE:%d@%d\n%s\n", c.Bytes-initSize, initSize, uri)
+			continue
+		}
+
+		fmt.Fprintf(&b, "#EXT-X-PROGRAM-DATE-TIME:%s\n", c.Start.UTC().Format("2006-01-02T15:04:05.000Z"))
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", c.End.Sub(c.Start).Seconds(), uri)
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// serveSegment serves one recorded chunk, with Range support for players
+// and for the byte-range addressed MP4 playlists.
+func (h *Handler) serveSegment(w http.ResponseWriter, r *http.Request, index *recorder.Index, name string) {
+	if name == "" || name != path.Base(name) || strings.ContainsAny(name, `\/`) {
+		localapi.WriteError(w, http.StatusBadRequest, "invalid segment name")
+		return
+	}
+
+	var chunk *recorder.Chunk
+	for _, c := range index.Chunks() {
+		if c.File == name {
+			chunk = &c
+			break
+		}
+	}
+	if chunk == nil {
+		localapi.WriteError(w, http.StatusNotFound, "unknown segment")
+		return
+	}
+
+	f, err := os.Open(chunk.Path(index.Dir()))
+	if err != nil {
+		localapi.WriteError(w, http.StatusNotFound, "segment no longer available")
+		return
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(name, ".mp4") {
+		w.Header().Set("Content-Type", "video/mp4")
+	} else {
+		w.Header().Set("Content-Type", "video/mp2t")
+	}
+	http.ServeContent(w, r, name, chunk.End, f)
+}
+
+// serveExport streams the range as a fragmented MP4 download, trimmed to the
+// requested times (to the nearest keyframe, since video is not re-encoded).
+func (h *Handler) serveExport(w http.ResponseWriter, r *http.Request, camera string, index *recorder.Index) {
+	from, to, err := localapi.ParseRange(r, maxRange)
+	if err != nil {
+		localapi.WriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	chunks := index.Range(from, to)
+	if len(chunks) == 0 {
+		localapi.WriteError(w, http.StatusNotFound, "no recordings in range")
+		return
+	}
+
+	list, err := writeConcatList(index.Dir(), chunks)
+	if err != nil {
+		localapi.WriteError(w, http.StatusInternalServerError, "could not prepare export")
+		return
+	}
+	defer os.Remove(list)
+
+	offset := from.Sub(chunks[0].Start)
+	if offset < 0 {
+		offset = 0
+	}
+	duration := to.Sub(from)
+	if to.After(chunks[len(chunks)-1].End) {
+		duration = chunks[len(chunks)-1].End.Sub(from)
+	}
+
+	filename := fmt.Sprintf("%s-%s.mp4", camera, from.UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	if err := Export(r.Context(), list, offset, duration, w); err != nil && r.Context().Err() == nil {
+		h.logger.Printf("VOD export %s failed: %v", filename, err)
+	}
+}
+
+// Export runs ffmpeg over a concat list and writes a fragmented MP4 to out.
+func Export(ctx context.Context, concatList string, offset, duration time.Duration, out io.Writer) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg",
+		"-hide_banner",
+		"-loglevel", "error",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", concatList,
+		"-ss", seconds(offset),
+		"-t", seconds(duration),
+		"-map", "0:v:0",
+		"-map", "0:a:0?",
+		"-c:v", "copy",
+		"-c:a", "aac",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-f", "mp4",
+		"pipe:1",
+	)
+	cmd.Stdout = out
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w (%s)", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// writeConcatList writes an ffmpeg concat demuxer list for the chunks.
+func writeConcatList(dir string, chunks []recorder.Chunk) (string, error) {
+	f, err := os.CreateTemp("", "difae-vod-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	for _, c := range chunks {
+		p := filepath.ToSlash(c.Path(dir))
+		if _, err := fmt.Fprintf(f, "file '%s'\n", strings.ReplaceAll(p, "'", `'\''`)); err != nil {
+			os.Remove(f.Name())
+			return "", err
+		}
+	}
+	return f.Name(), nil
+}
+
+// mp4InitSize returns the length of the boxes preceding the first moof, i.e.
+// the ftyp+moov init section of a fragmented MP4 chunk.
+func mp4InitSize(p string) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var offset int64
+	header := make([]byte, 16)
+	for {
+		if _, err := f.ReadAt(header[:8], offset); err != nil {
+			return 0, fmt.Errorf("no moof box found")
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		boxType := string(header[4:8])
+		if boxType == "moof" {
+			return offset, nil
+		}
+		if size == 1 {
+			if _, err := f.ReadAt(header[8:16], offset+8); err != nil {
+				return 0, err
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 {
+			return 0, fmt.Errorf("malformed %q box", boxType)
+		}
+		offset += size
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
@@ -0,0 +1,295 @@
+package vod
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/difaeai/windows-agent/internal/recorder"
+)
+
+var base = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// box returns an MP4 box of the given type with size bytes in total.
+func box(boxType string, size int) []byte {
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], boxType)
+	return b
+}
+
+// recordings is a temporary recording directory with its index.
+type recordings struct {
+	t     *testing.T
+	dir   string
+	index *recorder.Index
+	logs  bytes.Buffer
+}
+
+func newRecordings(t *testing.T) *recordings {
+	t.Helper()
+	dir := t.TempDir()
+	index, err := recorder.OpenIndex(dir, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &recordings{t: t, dir: dir, index: index}
+}
+
+// add writes a chunk covering [start, start+d) and indexes it.
+func (rs *recordings) add(name string, start, d time.Duration, data []byte) {
+	rs.t.Helper()
+	if err := os.WriteFile(filepath.Join(rs.dir, name), data, 0o644); err != nil {
+		rs.t.Fatal(err)
+	}
+	c := recorder.Chunk{File: name, Start: base.Add(start), End: base.Add(start + d), Bytes: int64(len(data))}
+	if err := rs.index.Add(c); err != nil {
+		rs.t.Fatal(err)
+	}
+}
+
+// get requests path from a handler serving camera "cam1".
+func (rs *recordings) get(method, path string, header ...string) *httptest.ResponseRecorder {
+	h := New(map[string]*recorder.Index{"cam1": rs.index}, log.New(&rs.logs, "", 0))
+	r := httptest.NewRequest(method, Prefix+"cam1/"+path, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func between(from, to time.Duration) string {
+	return "from=" + strconv.FormatInt(base.Add(from).Unix(), 10) + "&to=" + strconv.FormatInt(base.Add(to).Unix(), 10)
+}
+
+func errorMessage(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", w.Body.String(), err)
+	}
+	return body.Error
+}
+
+func TestRecordingsRange(t *testing.T) {
+	rs := newRecordings(t)
+	ts := bytes.Repeat([]byte{0x47}, 188)
+	rs.add("a.ts", 0, time.Minute, ts)
+	rs.add("b.ts", time.Minute, time.Minute, ts)
+	rs.add("c.ts", 5*time.Minute, time.Minute, ts)
+
+	tests := []struct {
+		name     string
+		from, to time.Duration
+		want     string
+	}{
+		{"all", -time.Hour, time.Hour, "a.ts,b.ts,c.ts"},
+		{"inside one chunk", 10 * time.Second, 20 * time.Second, "a.ts"},
+		{"across a boundary", 30 * time.Second, 90 * time.Second, "a.ts,b.ts"},
+		// A chunk ending exactly at from, or starting exactly at to, is out.
+		{"edges", time.Minute, 5 * time.Minute, "b.ts"},
+		{"in the gap", 3 * time.Minute, 4 * time.Minute, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := rs.get(http.MethodGet, "recordings?"+between(tt.from, tt.to))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			var chunks []recorder.Chunk
+			if err := json.Unmarshal(w.Body.Bytes(), &chunks); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, c := range chunks {
+				names = append(names, c.File)
+			}
+			if got := strings.Join(names, ","); got != tt.want {
+				t.Errorf("chunks = %s, want %s", got, tt.want)
+			}
+			if chunks == nil {
+				t.Error("an empty range is not an empty JSON array")
+			}
+		})
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	rs := newRecordings(t)
+	tests := []struct {
+		method, path string
+		status       int
+	}{
+		{http.MethodGet, "recordings", http.StatusBadRequest},
+		{http.MethodGet, "recordings?" + between(time.Minute, 0), http.StatusBadRequest},
+		{http.MethodGet, "recordings?" + between(0, 25*time.Hour), http.StatusBadRequest},
+		{http.MethodGet, "segments/..%2Findex.jsonl", http.StatusBadRequest},
+		{http.MethodGet, "unknown", http.StatusNotFound},
+		{http.MethodPost, "recordings", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		if w := rs.get(tt.method, tt.path); w.Code != tt.status {
+			t.Errorf("%s %s: status = %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+	}
+
+	h := New(map[string]*recorder.Index{"cam1": rs.index}, log.New(io.Discard, "", 0))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, Prefix+"cam2/recordings", nil))
+	if w.Code != http.StatusNotFound || errorMessage(t, w) != "unknown camera" {
+		t.Errorf("unknown camera: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPlaylistTS(t *testing.T) {
+	rs := newRecordings(t)
+	ts := bytes.Repeat([]byte{0x47}, 188)
+	rs.add("a.ts", 0, time.Minute, ts)
+	rs.add("b.ts", time.Minute, 90*time.Second, ts)
+	rs.add("c.ts", 5*time.Minute, time.Minute, ts)
+
+	w := rs.get(http.MethodGet, "playlist.m3u8?token=a+b&"+between(0, time.Hour))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	want := "#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:90\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2026-03-01T12:00:00.000Z\n#EXTINF:60.000,\nsegments/a.ts?token=a+b\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2026-03-01T12:01:00.000Z\n#EXTINF:90.000,\nsegments/b.ts?token=a+b\n" +
+		// Recording stopped between b.ts and c.ts.
+		"#EXT-X-DISCONTINUITY\n" +
+		"#EXT-X-PROGRAM-DATE-TIME:2026-03-01T12:05:00.000Z\n#EXTINF:60.000,\nsegments/c.ts?token=a+b\n" +
+		"#EXT-X-ENDLIST\n"
+	if got := w.Body.String(); got != want {
+		t.Errorf("playlist:\n%s\nwant:\n%s", got, want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.apple.mpegurl" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	if w := rs.get(http.MethodGet, "playlist.m3u8?"+between(2*time.Hour, 3*time.Hour)); w.Code != http.StatusNotFound {
+		t.Errorf("empty range: status = %d, want 404", w.Code)
+	}
+}
+
+// TestPlaylistMP4 covers fragmented MP4 chunks, addressed by byte range
+// after their init section, and skips one cut short before its first
+// fragment.
+func TestPlaylistMP4(t *testing.T) {
+	rs := newRecordings(t)
+	chunk := append(append(append(box("ftyp", 24), box("moov", 800)...), box("moof", 100)...), box("mdat", 5000)...)
+	rs.add("a.mp4", 0, time.Minute, chunk)
+	rs.add("b.mp4", time.Minute, time.Minute, append(box("ftyp", 24), box("moov", 800)...))
+	rs.add("c.mp4", 2*time.Minute, time.Minute, chunk)
+
+	w := rs.get(http.MethodGet, "playlist.m3u8?"+between(0, time.Hour))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"#EXT-X-MAP:URI=\"segments/a.mp4\",BYTERANGE=\"824@0\"\n#EXT-X-PROGRAM-DATE-TIME:2026-03-01T12:00:00.000Z\n#EXTINF:60.000,\n#EXT-X-BYTERANGE:5100@824\nsegments/a.mp4\n",
+		"#EXT-X-DISCONTINUITY\n#EXT-X-MAP:URI=\"segments/c.mp4\",BYTERANGE=\"824@0\"\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("playlist lacks %q:\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "b.mp4") {
+		t.Errorf("playlist lists the partial chunk:\n%s", body)
+	}
+	if !strings.Contains(rs.logs.String(), "VOD: skipping b.mp4: no moof box found") {
+		t.Errorf("log = %q", rs.logs.String())
+	}
+}
+
+func TestSegment(t *testing.T) {
+	rs := newRecordings(t)
+	data := make([]byte, 3*188)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	rs.add("a.ts", 0, time.Minute, data)
+	rs.add("gone.ts", time.Minute, time.Minute, data)
+	if err := os.Remove(filepath.Join(rs.dir, "gone.ts")); err != nil {
+		t.Fatal(err)
+	}
+
+	w := rs.get(http.MethodGet, "segments/a.ts")
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Fatalf("status = %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "video/mp2t" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	// Players and byte-range playlists ask for part of a chunk.
+	w = rs.get(http.MethodGet, "segments/a.ts", "Range", "bytes=188-375")
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), data[188:376]) {
+		t.Errorf("range: status = %d, %d bytes", w.Code, w.Body.Len())
+	}
+	if cr := w.Header().Get("Content-Range"); cr != "bytes 188-375/564" {
+		t.Errorf("Content-Range = %q", cr)
+	}
+	if w := rs.get(http.MethodGet, "segments/a.ts", "Range", "bytes=1000-"); w.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end: status = %d", w.Code)
+	}
+
+	// Indexed, but deleted since (e.g. by retention).
+	w = rs.get(http.MethodGet, "segments/gone.ts")
+	if w.Code != http.StatusNotFound || errorMessage(t, w) != "segment no longer available" {
+		t.Errorf("deleted chunk: %d %s", w.Code, w.Body)
+	}
+	// On disk, but not a recording.
+	w = rs.get(http.MethodGet, "segments/index.jsonl")
+	if w.Code != http.StatusNotFound || errorMessage(t, w) != "unknown segment" {
+		t.Errorf("unindexed file: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestExportHead(t *testing.T) {
+	rs := newRecordings(t)
+	rs.add("a.ts", 0, time.Minute, bytes.Repeat([]byte{0x47}, 188))
+
+	w := rs.get(http.MethodHead, "export.mp4?"+between(30*time.Second, 90*time.Second))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	if cd := w.Header().Get("Content-Disposition"); cd != `attachment; filename="cam1-20260301T120030Z.mp4"` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	if w := rs.get(http.MethodHead, "export.mp4?"+between(2*time.Minute, 3*time.Minute)); w.Code != http.StatusNotFound {
+		t.Errorf("empty range: status = %d, want 404", w.Code)
+	}
+}
+
+func TestConcatListQuotes(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "it's")
+	list, err := writeConcatList(dir, []recorder.Chunk{{File: "a.ts"}, {File: "b.ts"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(list)
+	data, err := os.ReadFile(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quoted := strings.ReplaceAll(filepath.ToSlash(dir), "'", `'\''`)
+	want := "file '" + quoted + "/a.ts'\nfile '" + quoted + "/b.ts'\n"
+	if string(data) != want {
+		t.Errorf("list = %q, want %q", data, want)
+	}
+}